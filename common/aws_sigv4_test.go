@@ -0,0 +1,147 @@
+package common
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 以下用例来自AWS SigV4官方测试套件 (aws-sig-v4-test-suite)，凭证和时间为套件约定的固定值
+var sigV4TestCredentials = AWSCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	Region:          "us-east-1",
+}
+
+var sigV4TestTime = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+func TestSignAWSRequestSuite(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		url           string
+		headers       map[string]string
+		body          string
+		sessionToken  string
+		signedHeaders string
+		signature     string
+	}{
+		{
+			name:          "get-vanilla",
+			method:        http.MethodGet,
+			url:           "https://example.amazonaws.com/",
+			signedHeaders: "host;x-amz-date",
+			signature:     "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:          "get-vanilla-query-order-key-case",
+			method:        http.MethodGet,
+			url:           "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			signedHeaders: "host;x-amz-date",
+			signature:     "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:          "get-vanilla-empty-query-key",
+			method:        http.MethodGet,
+			url:           "https://example.amazonaws.com/?Param1=value1",
+			signedHeaders: "host;x-amz-date",
+			signature:     "a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb",
+		},
+		{
+			name:          "post-vanilla",
+			method:        http.MethodPost,
+			url:           "https://example.amazonaws.com/",
+			signedHeaders: "host;x-amz-date",
+			signature:     "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:          "post-vanilla-query",
+			method:        http.MethodPost,
+			url:           "https://example.amazonaws.com/?Param1=value1",
+			signedHeaders: "host;x-amz-date",
+			signature:     "28038455d6de14eafc1f9222cf5aa6f1a96197d7deb8263271d420d138af7f11",
+		},
+		{
+			name:          "post-x-www-form-urlencoded",
+			method:        http.MethodPost,
+			url:           "https://example.amazonaws.com/",
+			headers:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			body:          "Param1=value1",
+			signedHeaders: "content-type;host;x-amz-date",
+			signature:     "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			name:          "session token is signed",
+			method:        http.MethodPost,
+			url:           "https://example.amazonaws.com/",
+			sessionToken:  "session-token",
+			signedHeaders: "host;x-amz-date;x-amz-security-token",
+			signature:     "7ee481142da6780c684f0dafedbf4f61f5023f326eee2077f76aee3b3b3c5786",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("NewRequest: %v", err)
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			credentials := sigV4TestCredentials
+			credentials.SessionToken = tt.sessionToken
+			signAWSRequest(req, sha256Hex([]byte(tt.body)), credentials, "service", sigV4TestTime)
+
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=" + tt.signedHeaders + ", Signature=" + tt.signature
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Errorf("Authorization mismatch\n got: %s\nwant: %s", got, want)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %q", got)
+			}
+			if tt.sessionToken != "" && req.Header.Get("X-Amz-Security-Token") != tt.sessionToken {
+				t.Errorf("X-Amz-Security-Token not set")
+			}
+		})
+	}
+}
+
+func TestSignAWSRequestV4SignsPayloadHash(t *testing.T) {
+	body := []byte(`{"messages":[]}`)
+	req, err := http.NewRequest(http.MethodPost, "https://bedrock-runtime.us-east-1.amazonaws.com/model/m/invoke", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	SignAWSRequestV4(req, body, sigV4TestCredentials, "bedrock", sigV4TestTime)
+
+	if got, want := req.Header.Get("X-Amz-Content-Sha256"), sha256Hex(body); got != want {
+		t.Errorf("X-Amz-Content-Sha256 = %q, want %q", got, want)
+	}
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "SignedHeaders=host;x-amz-content-sha256;x-amz-date,") {
+		t.Errorf("payload hash header is not signed: %s", auth)
+	}
+}
+
+func TestAWSURIEncode(t *testing.T) {
+	tests := []struct {
+		input       string
+		encodeSlash bool
+		want        string
+	}{
+		{"/model/anthropic.claude-3-5-sonnet-20241022-v2:0/invoke", false, "/model/anthropic.claude-3-5-sonnet-20241022-v2%3A0/invoke"},
+		// 非S3服务对已编码的路径再编码一次
+		{"/model/anthropic.claude-v2%3A1/invoke", false, "/model/anthropic.claude-v2%253A1/invoke"},
+		{"a/b c~d_e.f-g", true, "a%2Fb%20c~d_e.f-g"},
+		{"value=1&x", true, "value%3D1%26x"},
+	}
+
+	for _, tt := range tests {
+		if got := AWSURIEncode(tt.input, tt.encodeSlash); got != tt.want {
+			t.Errorf("AWSURIEncode(%q, %v) = %q, want %q", tt.input, tt.encodeSlash, got, tt.want)
+		}
+	}
+}
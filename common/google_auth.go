@@ -0,0 +1,116 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	googleDefaultTokenURI = "https://oauth2.googleapis.com/token"
+	googleCloudScope      = "https://www.googleapis.com/auth/cloud-platform"
+	googleJWTGrantType    = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// GoogleServiceAccount Google服务账号JSON凭证
+type GoogleServiceAccount struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// ParseGoogleServiceAccount 解析服务账号JSON
+func ParseGoogleServiceAccount(data string) (*GoogleServiceAccount, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, errors.New("service account json is empty")
+	}
+
+	var sa GoogleServiceAccount
+	if err := json.Unmarshal([]byte(data), &sa); err != nil {
+		return nil, fmt.Errorf("invalid service account json: %w", err)
+	}
+	if sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, errors.New("service account json missing client_email or private_key")
+	}
+	if sa.ProjectID == "" {
+		return nil, errors.New("service account json missing project_id")
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = googleDefaultTokenURI
+	}
+	return &sa, nil
+}
+
+// MintGoogleAccessToken 使用服务账号签发JWT断言换取OAuth2访问令牌，返回令牌和过期时间戳
+func MintGoogleAccessToken(sa *GoogleServiceAccount, proxyURI string) (string, int64, error) {
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(sa.PrivateKey))
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid service account private key: %w", err)
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   sa.ClientEmail,
+		"scope": googleCloudScope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if sa.PrivateKeyID != "" {
+		token.Header["kid"] = sa.PrivateKeyID
+	}
+
+	assertion, err := token.SignedString(privateKey)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to sign jwt assertion: %w", err)
+	}
+
+	client, err := NewProxyHTTPClient(proxyURI, 30*time.Second)
+	if err != nil {
+		return "", 0, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", googleJWTGrantType)
+	form.Set("assertion", assertion)
+
+	resp, err := client.PostForm(sa.TokenURI, form)
+	if err != nil {
+		return "", 0, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token request failed: HTTP %d - %s", resp.StatusCode, string(body))
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", 0, fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", 0, errors.New("access_token not found in response")
+	}
+	if tokenResp.ExpiresIn <= 0 {
+		tokenResp.ExpiresIn = 3600
+	}
+
+	return tokenResp.AccessToken, now.Unix() + tokenResp.ExpiresIn, nil
+}
@@ -245,21 +245,12 @@ func (o *OAuthHelper) IsTokenExpired(expiresAt int64) bool {
 
 // ExchangeCodeForTokens 使用授权码交换访问令牌
 func (o *OAuthHelper) ExchangeCodeForTokens(authorizationCode, codeVerifier, state, proxyURI string) (*TokenResponse, error) {
-	// 创建HTTP客户端
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	// 创建HTTP客户端，如果提供了代理URI，配置代理
+	client, err := NewProxyHTTPClient(proxyURI, 30*time.Second)
+	if err != nil {
+		return nil, err
 	}
-
-	// 如果提供了代理URI，配置代理
 	if proxyURI != "" {
-		proxyURL, err := url.Parse(proxyURI)
-		if err != nil {
-			return nil, fmt.Errorf("invalid proxy URI: %w", err)
-		}
-		transport := &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-		}
-		client.Transport = transport
 		SysLog(fmt.Sprintf("Using proxy: %s", proxyURI))
 	}
 
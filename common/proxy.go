@@ -0,0 +1,70 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// SetTransportProxy 为Transport配置代理，支持 http/https/socks5/socks5h
+// SOCKS5代理通过拨号器建立连接，socks5h 由代理端解析域名；dialer为空时使用默认拨号配置
+func SetTransportProxy(transport *http.Transport, proxyURI string, dialer *net.Dialer) error {
+	if proxyURI == "" {
+		return nil
+	}
+
+	proxyURL, err := url.Parse(proxyURI)
+	if err != nil {
+		return err
+	}
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	}
+
+	switch strings.ToLower(proxyURL.Scheme) {
+	case "http", "https":
+		transport.Proxy = http.ProxyURL(proxyURL)
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		socksDialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, dialer)
+		if err != nil {
+			return err
+		}
+		contextDialer, ok := socksDialer.(proxy.ContextDialer)
+		if !ok {
+			return fmt.Errorf("socks5 dialer does not support context")
+		}
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return contextDialer.DialContext(ctx, network, addr)
+		}
+	default:
+		return fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+	return nil
+}
+
+// NewProxyHTTPClient 创建使用指定代理的HTTP客户端，proxyURI为空时直连
+func NewProxyHTTPClient(proxyURI string, timeout time.Duration) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	if proxyURI == "" {
+		return client, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if err := SetTransportProxy(transport, proxyURI, nil); err != nil {
+		return nil, fmt.Errorf("invalid proxy URI: %w", err)
+	}
+	client.Transport = transport
+	return client, nil
+}
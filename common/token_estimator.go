@@ -0,0 +1,85 @@
+package common
+
+import (
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// 每条消息的结构开销（角色、分隔符等）
+	estimatedMessageOverhead = 4
+	// 图片和文档按固定token数估算（约等于1000x1000像素的图片）
+	estimatedImageTokens = 1600
+)
+
+// EstimateTokens 估算文本的token数：CJK等宽字符按每字1个token，其他字符约4个字符1个token
+func EstimateTokens(text string) int {
+	wide, other := 0, 0
+	for _, r := range text {
+		if r >= 0x2E80 {
+			wide++
+		} else {
+			other++
+		}
+	}
+	return wide + (other+3)/4
+}
+
+// EstimateRequestTokens 本地估算Claude Messages请求的输入token数，用于无法调用上游计数接口的场景
+func EstimateRequestTokens(body []byte) int {
+	request := gjson.ParseBytes(body)
+	total := 0
+
+	system := request.Get("system")
+	if system.Type == gjson.String {
+		total += EstimateTokens(system.String())
+	} else {
+		for _, block := range system.Array() {
+			total += estimateContentBlockTokens(block)
+		}
+	}
+
+	for _, message := range request.Get("messages").Array() {
+		total += estimatedMessageOverhead
+		content := message.Get("content")
+		if content.Type == gjson.String {
+			total += EstimateTokens(content.String())
+			continue
+		}
+		for _, block := range content.Array() {
+			total += estimateContentBlockTokens(block)
+		}
+	}
+
+	for _, tool := range request.Get("tools").Array() {
+		total += EstimateTokens(tool.Raw)
+	}
+
+	return total
+}
+
+// estimateContentBlockTokens 估算单个内容块的token数
+func estimateContentBlockTokens(block gjson.Result) int {
+	switch block.Get("type").String() {
+	case "text":
+		return EstimateTokens(block.Get("text").String())
+	case "thinking":
+		return EstimateTokens(block.Get("thinking").String())
+	case "image", "document", "image_url", "file", "input_audio":
+		// OpenAI格式的图片、文件和音频片段同样按固定token数估算，避免将base64数据按文本计算
+		return estimatedImageTokens
+	case "tool_use":
+		return EstimateTokens(block.Get("name").String()) + EstimateTokens(block.Get("input").Raw)
+	case "tool_result":
+		content := block.Get("content")
+		if content.Type == gjson.String {
+			return EstimateTokens(content.String())
+		}
+		total := 0
+		for _, item := range content.Array() {
+			total += estimateContentBlockTokens(item)
+		}
+		return total
+	default:
+		return EstimateTokens(block.Raw)
+	}
+}
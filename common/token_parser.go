@@ -14,6 +14,9 @@ type TokenUsage struct {
 	CacheReadInputTokens     int    `json:"cache_read_input_tokens"`
 	CacheCreationInputTokens int    `json:"cache_creation_input_tokens"`
 	Model                    string `json:"model"`
+
+	// 推理tokens数量，OpenAI兼容接口的推理tokens已包含在输出tokens中，仅用于统计
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
 }
 
 // StreamCopyWriter 实现真正的流式转发，边转发边解析
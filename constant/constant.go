@@ -15,6 +15,9 @@ const (
 	TaskStatusCompleted = "completed"
 	TaskStatusFailed    = "failed"
 
+	// 任务类型
+	TaskTypeMessageBatch = "message_batch"
+
 	// 任务优先级
 	TaskPriorityLow    = 1
 	TaskPriorityMedium = 2
@@ -40,6 +43,16 @@ const (
 	PlatformClaudeConsole = "claude_console"
 	PlatformOpenAI        = "openai"
 	PlatformGemini        = "gemini"
+	PlatformBedrock       = "bedrock"
+	PlatformVertex        = "vertex"
+	PlatformAzureOpenAI   = "azure_openai"
+
+	// 账号调度策略
+	SchedulerPriorityLeastUsed = "priority_least_used" // 优先级+今日最少使用（默认）
+	SchedulerWeightedRandom    = "weighted_random"     // 同优先级内按权重随机
+	SchedulerRoundRobin        = "round_robin"         // 同优先级内轮询
+	SchedulerLeastInFlight     = "least_inflight"      // 同优先级内当前并发最少
+	SchedulerLowestLatency     = "lowest_latency"      // 同优先级内首字延迟最低
 
 	ClaudeCodeSystemPrompt = "You are Claude Code, Anthropic's official CLI for Claude."
 )
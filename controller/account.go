@@ -3,6 +3,7 @@ package controller
 import (
 	"claude-code-relay/constant"
 	"claude-code-relay/model"
+	"claude-code-relay/relay"
 	"claude-code-relay/service"
 	"net/http"
 	"strconv"
@@ -78,6 +79,9 @@ func CreateAccount(c *gin.Context) {
 		constant.PlatformClaudeConsole: true,
 		constant.PlatformOpenAI:        true,
 		constant.PlatformGemini:        true,
+		constant.PlatformBedrock:       true,
+		constant.PlatformVertex:        true,
+		constant.PlatformAzureOpenAI:   true,
 	}
 	if !validPlatformTypes[req.PlatformType] {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -251,6 +255,8 @@ func DeleteAccount(c *gin.Context) {
 		})
 		return
 	}
+	// 释放账号复用的上游连接
+	relay.InvalidateAccountTransport(uint(id))
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "删除成功",
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminGetApiKeyAdmissionPolicy 管理员获取API Key的客户端准入策略
+func AdminGetApiKeyAdmissionPolicy(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	policy, err := service.GetApiKeyAdmissionPolicy(id)
+	respondAdmissionPolicy(c, policy, err, "API Key不存在")
+}
+
+// AdminUpdateApiKeyAdmissionPolicy 管理员更新API Key的客户端准入策略，策略为空时继承分组策略
+func AdminUpdateApiKeyAdmissionPolicy(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+	policy, ok := bindAdmissionPolicy(c)
+	if !ok {
+		return
+	}
+
+	err := service.UpdateApiKeyAdmissionPolicy(id, policy)
+	respondAdmissionPolicyUpdate(c, err, "API Key不存在")
+}
+
+// AdminGetGroupAdmissionPolicy 管理员获取分组的客户端准入策略
+func AdminGetGroupAdmissionPolicy(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	policy, err := service.GetGroupAdmissionPolicy(id)
+	respondAdmissionPolicy(c, policy, err, "组不存在")
+}
+
+// AdminUpdateGroupAdmissionPolicy 管理员更新分组的客户端准入策略，策略为空时使用默认策略
+func AdminUpdateGroupAdmissionPolicy(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+	policy, ok := bindAdmissionPolicy(c)
+	if !ok {
+		return
+	}
+
+	err := service.UpdateGroupAdmissionPolicy(id, policy)
+	respondAdmissionPolicyUpdate(c, err, "组不存在")
+}
+
+// parseIDParam 解析路径中的ID参数
+func parseIDParam(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的ID",
+			"code":  constant.InvalidParams,
+		})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// bindAdmissionPolicy 解析并校验准入策略请求体，未设置任何规则时返回nil表示清除策略
+func bindAdmissionPolicy(c *gin.Context) (*model.AdmissionPolicy, bool) {
+	var policy model.AdmissionPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误: " + err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return nil, false
+	}
+
+	if err := service.ValidateAdmissionPolicy(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return nil, false
+	}
+
+	if policy.Mode == "" && len(policy.UserAgentPatterns) == 0 &&
+		len(policy.SystemPromptPrefixes) == 0 && policy.MinClaudeCodeVersion == "" {
+		return nil, true
+	}
+	return &policy, true
+}
+
+// respondAdmissionPolicy 返回准入策略，未配置时同时返回生效的默认策略
+func respondAdmissionPolicy(c *gin.Context, policy *model.AdmissionPolicy, err error, notFoundMessage string) {
+	if err != nil {
+		statusCode, code := http.StatusInternalServerError, constant.InternalServerError
+		if err.Error() == notFoundMessage {
+			statusCode, code = http.StatusNotFound, constant.NotFound
+		}
+		c.JSON(statusCode, gin.H{
+			"error": err.Error(),
+			"code":  code,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取准入策略成功",
+		"code":    constant.Success,
+		"data": gin.H{
+			"policy":  policy,
+			"default": service.DefaultAdmissionPolicy(),
+		},
+	})
+}
+
+// respondAdmissionPolicyUpdate 返回准入策略更新结果
+func respondAdmissionPolicyUpdate(c *gin.Context, err error, notFoundMessage string) {
+	if err != nil {
+		statusCode, code := http.StatusInternalServerError, constant.InternalServerError
+		if err.Error() == notFoundMessage {
+			statusCode, code = http.StatusNotFound, constant.NotFound
+		}
+		c.JSON(statusCode, gin.H{
+			"error": err.Error(),
+			"code":  code,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "准入策略更新成功",
+		"code":    constant.Success,
+	})
+}
@@ -0,0 +1,310 @@
+package controller
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"claude-code-relay/relay"
+	"claude-code-relay/service"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EnableCaptureRequest 开启请求捕获的请求参数
+type EnableCaptureRequest struct {
+	Minutes int `json:"minutes" binding:"required,min=1"` // 捕获时长(分钟)
+}
+
+// ReplayCaptureRequest 重放捕获请求的请求参数
+type ReplayCaptureRequest struct {
+	AccountID uint `json:"account_id" binding:"required"`
+}
+
+// AdminGetApiKeyCapture 管理员获取API Key的请求捕获状态
+func AdminGetApiKeyCapture(c *gin.Context) {
+	getCaptureWindow(c, service.CaptureScopeApiKey)
+}
+
+// AdminEnableApiKeyCapture 管理员为API Key开启限定时长的请求捕获
+func AdminEnableApiKeyCapture(c *gin.Context) {
+	enableCaptureWindow(c, service.CaptureScopeApiKey)
+}
+
+// AdminDisableApiKeyCapture 管理员关闭API Key的请求捕获
+func AdminDisableApiKeyCapture(c *gin.Context) {
+	disableCaptureWindow(c, service.CaptureScopeApiKey)
+}
+
+// AdminGetGroupCapture 管理员获取分组的请求捕获状态
+func AdminGetGroupCapture(c *gin.Context) {
+	getCaptureWindow(c, service.CaptureScopeGroup)
+}
+
+// AdminEnableGroupCapture 管理员为分组开启限定时长的请求捕获
+func AdminEnableGroupCapture(c *gin.Context) {
+	enableCaptureWindow(c, service.CaptureScopeGroup)
+}
+
+// AdminDisableGroupCapture 管理员关闭分组的请求捕获
+func AdminDisableGroupCapture(c *gin.Context) {
+	disableCaptureWindow(c, service.CaptureScopeGroup)
+}
+
+// getCaptureWindow 返回捕获状态
+func getCaptureWindow(c *gin.Context, scope string) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	window, err := service.GetCaptureWindow(scope, id)
+	if err != nil {
+		respondCaptureError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data":    window,
+	})
+}
+
+// enableCaptureWindow 开启捕获
+func enableCaptureWindow(c *gin.Context, scope string) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req EnableCaptureRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误: " + err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	window, err := service.EnableCapture(scope, id, time.Duration(req.Minutes)*time.Minute)
+	if err != nil {
+		respondCaptureError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "请求捕获已开启",
+		"code":    constant.Success,
+		"data":    window,
+	})
+}
+
+// disableCaptureWindow 关闭捕获
+func disableCaptureWindow(c *gin.Context, scope string) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	if err := service.DisableCapture(scope, id); err != nil {
+		respondCaptureError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "请求捕获已关闭",
+		"code":    constant.Success,
+	})
+}
+
+// AdminGetCaptures 管理员分页获取捕获记录，可按API Key和分组筛选
+func AdminGetCaptures(c *gin.Context) {
+	req := model.RequestCaptureListRequest{Page: 1, Limit: 10}
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误: " + err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	result, err := service.GetRequestCaptureList(&req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+			"code":  constant.InternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data":    result,
+	})
+}
+
+// AdminGetCapture 管理员获取捕获记录详情，包含解压后的请求和响应内容
+func AdminGetCapture(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	capture, detail, err := service.GetRequestCapture(id)
+	if err != nil {
+		respondCaptureError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data": gin.H{
+			"capture": capture,
+			"detail":  detail,
+		},
+	})
+}
+
+// AdminDeleteCapture 管理员删除捕获记录
+func AdminDeleteCapture(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	if err := service.DeleteRequestCapture(id); err != nil {
+		respondCaptureError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "删除成功",
+		"code":    constant.Success,
+	})
+}
+
+// AdminReplayCapture 管理员使用指定账号重放捕获的请求，并与原始结果比较
+// 重放按分组当前的改写规则处理入站请求，不计入API Key用量和计费
+func AdminReplayCapture(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req ReplayCaptureRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误: " + err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	capture, detail, err := service.GetRequestCapture(id)
+	if err != nil {
+		respondCaptureError(c, err)
+		return
+	}
+	if detail.Inbound.Truncated {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "入站请求内容已被截断，无法重放",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	account, err := model.GetAccountByID(req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "账号不存在",
+			"code":  constant.NotFound,
+		})
+		return
+	}
+
+	clientStatus, replay := replayCapturedRequest(c, capture, detail, account)
+	common.SysLog(fmt.Sprintf("[CAPTURE] Replayed capture %d against account %s (ID: %d), status %d",
+		capture.ID, account.Name, account.ID, clientStatus))
+
+	original := lastCapturedExchange(detail)
+	replayed := lastCapturedExchange(replay)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "重放完成",
+		"code":    constant.Success,
+		"data": gin.H{
+			"original": original,
+			"replay":   replayed,
+			"diff": gin.H{
+				"status_changed":           original.Response.StatusCode != replayed.Response.StatusCode,
+				"upstream_request_headers": service.DiffCapturedHeaders(original.Request.Headers, replayed.Request.Headers),
+				"upstream_request_body":    service.DiffCapturedBodies(original.Request.Body, replayed.Request.Body),
+				"response_body":            service.DiffCapturedBodies(original.Response.Body, replayed.Response.Body),
+			},
+			"client_status": clientStatus,
+		},
+	})
+}
+
+// replayCapturedRequest 在独立的上下文中将捕获的入站请求转发给指定账号，返回客户端状态码和捕获内容
+func replayCapturedRequest(c *gin.Context, capture *model.RequestCapture, detail *service.CaptureDetail, account *model.Account) (int, *service.CaptureDetail) {
+	recorder := httptest.NewRecorder()
+	replayCtx, _ := gin.CreateTestContext(recorder)
+
+	body := []byte(detail.Inbound.Body)
+	request := httptest.NewRequest(http.MethodPost, capture.Path, bytes.NewReader(body))
+	// 脱敏后的请求头（鉴权头、Cookie等）没有意义，不再回放，上游鉴权由账号提供
+	for name, values := range detail.Inbound.Headers {
+		if service.IsRedactedHeader(name) {
+			continue
+		}
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+	replayCtx.Request = request.WithContext(c.Request.Context())
+
+	if rules := service.GetRewriteRulesForGroup(capture.GroupID); len(rules) > 0 {
+		result := service.ApplyRewriteRules(body, replayCtx.Request.Header, rules)
+		body = result.Body
+		relay.SetHeaderRewrites(replayCtx, result.Headers)
+	}
+
+	relay.StartReplayCapture(replayCtx, body)
+	replayCtx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	dispatchPlatformRequest(replayCtx, account)
+
+	return recorder.Code, relay.CollectReplayCapture(replayCtx)
+}
+
+// lastCapturedExchange 获取最后一次上游请求，没有上游请求时返回空记录
+func lastCapturedExchange(detail *service.CaptureDetail) service.CapturedExchange {
+	if len(detail.Exchanges) == 0 {
+		return service.CapturedExchange{}
+	}
+	return detail.Exchanges[len(detail.Exchanges)-1]
+}
+
+// respondCaptureError 返回请求捕获相关的错误响应
+func respondCaptureError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "捕获记录不存在", "API Key不存在", "组不存在":
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+			"code":  constant.NotFound,
+		})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+			"code":  constant.InvalidParams,
+		})
+	}
+}
@@ -1,14 +1,22 @@
 package controller
 
 import (
+	"bytes"
 	"claude-code-relay/common"
 	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/relay"
+	"claude-code-relay/service"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"io"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type ExchangeRequest struct {
@@ -17,6 +25,10 @@ type ExchangeRequest struct {
 	ProxyURI          string `json:"proxy_uri" binding:"omitempty,url"`
 	CodeVerifier      string `json:"code_verifier" binding:"required"`
 	State             string `json:"state" binding:"required"`
+
+	// 从代理管理中选择代理：指定代理ID，或从代理池中选择健康的代理，优先于proxy_uri
+	ProxyID   uint   `json:"proxy_id"`
+	ProxyPool string `json:"proxy_pool"`
 }
 
 // TestAccountRequest 测试账号请求参数
@@ -69,8 +81,24 @@ func ExchangeCode(c *gin.Context) {
 		return
 	}
 
+	// 选择代理，选中的代理ID返回给前端，创建账号时关联同一个代理保持出口IP一致
+	proxyURI := req.ProxyURI
+	var proxyID uint
+	proxy, err := service.PickProxy(req.ProxyID, req.ProxyPool)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+	if proxy != nil {
+		proxyURI = proxy.URI()
+		proxyID = proxy.ID
+	}
+
 	// 生成访问令牌
-	tokenResult, err := oauthHelper.ExchangeCodeForTokens(finalAuthCode, req.CodeVerifier, req.State, req.ProxyURI)
+	tokenResult, err := oauthHelper.ExchangeCodeForTokens(finalAuthCode, req.CodeVerifier, req.State, proxyURI)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "生成访问令牌事变",
@@ -79,9 +107,10 @@ func ExchangeCode(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "操作成功",
-		"code":    constant.Success,
-		"data":    tokenResult,
+		"message":  "操作成功",
+		"code":     constant.Success,
+		"data":     tokenResult,
+		"proxy_id": proxyID,
 	})
 }
 
@@ -91,38 +120,306 @@ func GetMessages(c *gin.Context) {
 	apiKey, _ := c.Get("api_key")
 	keyInfo := apiKey.(*model.ApiKey)
 
-	// 根据API Key的分组ID查询可用账号列表
-	accounts, err := model.GetAvailableAccountsByGroupID(keyInfo.GroupID)
+	// 读取请求体，切换账号重试时需要重新提供给处理器
+	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "读取请求体失败",
+			"code":    constant.InvalidParams,
+		})
+		return
+	}
+
+	relayMessages(c, keyInfo, body)
+}
+
+// relayMessages 为Claude格式的请求体调度账号并转发，失败时按调度顺序切换账号重试
+// 所有账号都因容量不足（限流、过载、并发已满）无法服务时，按模型配置的降级链改写model后重试
+func relayMessages(c *gin.Context, keyInfo *model.ApiKey, body []byte) {
+	// 开启了请求捕获时记录入站请求、每次上游请求和完整响应
+	relay.StartCapture(c, keyInfo, body)
+	defer relay.FinishCapture(c)
+
+	// 按分组的改写规则调整转发给上游的请求体和请求头
+	if rules := service.GetRewriteRulesForGroup(keyInfo.GroupID); len(rules) > 0 {
+		result := service.ApplyRewriteRules(body, c.Request.Header, rules)
+		for _, ruleErr := range result.Errors {
+			common.SysError(fmt.Sprintf("[REWRITE] group %d rule skipped: %s", keyInfo.GroupID, ruleErr))
+		}
+		body = result.Body
+		relay.SetHeaderRewrites(c, result.Headers)
+	}
+
+	// 会话粘性：同一会话优先回到上次使用的账号，以命中提示词缓存
+	stickyKey := service.GetStickySessionKey(body, keyInfo.GroupID, keyInfo.ID)
+
+	requestedModel := gjson.GetBytes(body, "model").String()
+	currentModel := requestedModel
+	fallbacks := service.GetModelFallbackChain(keyInfo, requestedModel)
+	for relayToAccounts(c, keyInfo, body, stickyKey, len(fallbacks) > 0) {
+		servedModel := fallbacks[0]
+		fallbacks = fallbacks[1:]
+		common.SysLog(fmt.Sprintf("[MODEL_FALLBACK] No capacity for model %s, falling back to %s", currentModel, servedModel))
+
+		body, _ = sjson.SetBytes(body, "model", servedModel)
+		currentModel = servedModel
+		relay.SetModelFallback(c, requestedModel, servedModel)
+	}
+}
+
+// relayToAccounts 按调度顺序将请求转发给分组中的账号
+// 返回true表示容量不足且未向客户端输出任何内容，调用方可以降级模型后重试
+func relayToAccounts(c *gin.Context, keyInfo *model.ApiKey, body []byte, stickyKey string, canFallback bool) bool {
+	// 根据API Key的分组ID查询支持该模型的可用账号列表，并按分组的调度策略排序
+	modelName := gjson.GetBytes(body, "model").String()
+	loadAccounts := func() ([]model.Account, error) {
+		accounts, err := service.GetScheduledAccounts(keyInfo.GroupID, keyInfo.UserID, modelName)
+		if err != nil {
+			return nil, err
+		}
+		accounts, stickyAccountID := service.ApplyStickySession(stickyKey, accounts)
+		if stickyAccountID > 0 {
+			relay.SetStickyAccount(c, stickyAccountID)
+		}
+		return accounts, nil
+	}
+
+	accounts, err := loadAccounts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "查询账号列表失败",
+			"code":    constant.InternalServerError,
+		})
+		return false
+	}
+
+	if len(accounts) == 0 && canFallback {
+		return true
+	}
+
+	// 没有可以立即使用的账号时进入分组等待队列，还可以降级模型时直接降级
+	waiter := &service.AccountWaiter{
+		GroupID:  keyInfo.GroupID,
+		ApiKeyID: keyInfo.ID,
+		Model:    modelName,
+		NoWait:   canFallback,
+		Reload:   loadAccounts,
+	}
+
+	// 按调度顺序尝试候选账号，跳过并发已满的账号，在向客户端输出任何数据前失败时切换到下一个账号
+	tried := make(map[uint]bool)
+	var lastWriter *relay.AttemptWriter
+	for attempt := 1; ; attempt++ {
+		var idx int
+		var lease *service.AccountLease
+		accounts, idx, lease, err = service.AcquireAccountSlot(c.Request.Context(), waiter, accounts, tried)
+		if err != nil {
+			if canFallback && c.Request.Context().Err() == nil {
+				return true
+			}
+			// 切换账号失败时返回上一次尝试缓存的上游错误，首次获取账号失败时返回排队结果
+			if lastWriter != nil {
+				lastWriter.FlushBuffered()
+			} else {
+				respondAcquireError(c, err)
+			}
+			break
+		}
+
+		selectedAccount := &accounts[idx]
+		tried[selectedAccount.ID] = true
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		writer := relay.BeginAttempt(c, selectedAccount)
+		dispatchPlatformRequest(c, selectedAccount)
+		lease.Release()
+
+		canRetry := attempt < relay.GetMaxRelayAttempts(len(accounts)) && service.HasAccountCapacity(accounts, tried)
+		outcome := relay.EndAttempt(c, writer, canRetry, canFallback)
+		lastWriter = writer
+		if outcome == relay.AttemptFallback {
+			return true
+		}
+		if outcome != relay.AttemptRetry {
+			break
+		}
+	}
+
+	attempts := relay.GetRelayAttempts(c)
+	if len(attempts) == 0 {
+		return false
+	}
+
+	final := attempts[len(attempts)-1]
+	if len(attempts) > 1 {
+		common.SysLog(fmt.Sprintf("[FAILOVER] Request finished after %d attempts, final account: %s (ID: %d), status: %d",
+			len(attempts), final.AccountName, final.AccountID, final.StatusCode))
+	}
+
+	// 请求成功后绑定（或续期）会话与实际服务的账号
+	if final.StatusCode < http.StatusBadRequest && final.Error == "" {
+		service.BindStickySession(stickyKey, final.AccountID)
+	}
+	return false
+}
+
+// respondAcquireError 返回获取账号失败的响应
+// 以Anthropic错误格式返回，排队后仍没有可用账号时所有账号限流返回429，否则返回529，并通过Retry-After告知预计恢复时间
+// 分组中没有支持该模型的账号时返回404
+func respondAcquireError(c *gin.Context, err error) {
+	var unavailable *service.AccountUnavailableError
+	switch {
+	case errors.As(err, &unavailable):
+		status, errorType := http.StatusTooManyRequests, "rate_limit_error"
+		if unavailable.Class == service.ErrorClassOverloaded {
+			status, errorType = 529, "overloaded_error"
+		}
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(unavailable.RetryAfter.Seconds()))))
+		c.JSON(status, gin.H{
+			"type": "error",
+			"error": gin.H{
+				"type":    errorType,
+				"message": unavailable.Error(),
+			},
+		})
+	case errors.Is(err, service.ErrNoAccountCandidate):
+		// 分组中没有支持该模型的激活账号，按Anthropic格式返回模型不可用
+		c.JSON(http.StatusNotFound, gin.H{
+			"type": "error",
+			"error": gin.H{
+				"type":    "not_found_error",
+				"message": "分组中没有支持该模型的可用账号",
+			},
+		})
+	case c.Request.Context().Err() != nil:
+		// 客户端已断开，不再输出
+	default:
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"message": "查询账号列表失败",
 			"code":    constant.InternalServerError,
 		})
+	}
+}
+
+// CountTokens 统计请求的输入token数
+// 优先转发给分组中支持计数接口的Claude账号，分组只有OpenAI等其他平台账号或上游不可用时使用本地估算
+func CountTokens(c *gin.Context) {
+	apiKey, _ := c.Get("api_key")
+	keyInfo := apiKey.(*model.ApiKey)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "读取请求体失败",
+			"code":    constant.InvalidParams,
+		})
 		return
 	}
 
-	if len(accounts) == 0 {
+	modelName := gjson.GetBytes(body, "model").String()
+	if modelName != "" && !service.IsModelAllowed(keyInfo, modelName) {
 		c.JSON(http.StatusForbidden, gin.H{
-			"message": "没有可用的账号",
-			"code":    constant.NotFound,
+			"message": "当前API Key不允许使用该模型",
+			"code":    constant.Forbidden,
+		})
+		return
+	}
+
+	accounts, err := service.GetScheduledAccounts(keyInfo.GroupID, keyInfo.UserID, modelName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "查询账号列表失败",
+			"code":    constant.InternalServerError,
 		})
 		return
 	}
 
-	// 选择第一个账号（已按优先级和使用次数排序）
-	selectedAccount := accounts[0]
+	attempts := 0
+	maxAttempts := relay.GetMaxRelayAttempts(len(accounts))
+	for i := range accounts {
+		account := &accounts[i]
+		if !relay.SupportsCountTokens(account) {
+			continue
+		}
+		if attempts >= maxAttempts {
+			break
+		}
+		attempts++
 
-	// 根据平台类型路由到不同的处理器
-	switch selectedAccount.PlatformType {
+		statusCode, responseBody, err := relay.ForwardCountTokens(c.Request.Context(), account, body)
+		if err != nil {
+			common.SysError(fmt.Sprintf("[COUNT_TOKENS] Account %s (ID: %d) request failed: %v", account.Name, account.ID, err))
+			continue
+		}
+		// 限流和服务端错误换下一个账号，其余状态（包括请求参数错误）直接返回给客户端
+		if statusCode == http.StatusTooManyRequests || service.IsCircuitFailureStatus(statusCode) {
+			common.SysError(fmt.Sprintf("[COUNT_TOKENS] Account %s (ID: %d) returned status %d", account.Name, account.ID, statusCode))
+			continue
+		}
+		c.Data(statusCode, "application/json", responseBody)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"input_tokens": common.EstimateRequestTokens(body),
+	})
+}
+
+// ListModels 获取API Key可用的模型列表（Anthropic Models API格式）
+func ListModels(c *gin.Context) {
+	apiKey, _ := c.Get("api_key")
+	keyInfo := apiKey.(*model.ApiKey)
+
+	models, err := service.NewModelConfigService().GetApiKeyModels(keyInfo)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "查询模型列表失败",
+			"code":    constant.InternalServerError,
+		})
+		return
+	}
+
+	data := make([]gin.H, 0, len(models))
+	for _, modelConfig := range models {
+		data = append(data, gin.H{
+			"type":         "model",
+			"id":           modelConfig.Name,
+			"display_name": modelConfig.DisplayName,
+			"created_at":   time.Time(modelConfig.CreatedAt).Format(time.RFC3339),
+		})
+	}
+
+	response := gin.H{
+		"data":     data,
+		"has_more": false,
+		"first_id": nil,
+		"last_id":  nil,
+	}
+	if len(models) > 0 {
+		response["first_id"] = models[0].Name
+		response["last_id"] = models[len(models)-1].Name
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// dispatchPlatformRequest 根据平台类型路由到不同的处理器
+func dispatchPlatformRequest(c *gin.Context, account *model.Account) {
+	switch account.PlatformType {
 	case constant.PlatformClaude:
-		relay.HandleClaudeRequest(c, &selectedAccount)
+		relay.HandleClaudeRequest(c, account)
 	case constant.PlatformClaudeConsole:
-		relay.HandleClaudeConsoleRequest(c, &selectedAccount)
-	case constant.PlatformOpenAI:
-		relay.HandleOpenAIRequest(c, &selectedAccount)
+		relay.HandleClaudeConsoleRequest(c, account)
+	case constant.PlatformOpenAI, constant.PlatformAzureOpenAI:
+		relay.HandleOpenAIRequest(c, account)
+	case constant.PlatformGemini:
+		relay.HandleGeminiRequest(c, account)
+	case constant.PlatformBedrock:
+		relay.HandleBedrockRequest(c, account)
+	case constant.PlatformVertex:
+		relay.HandleVertexRequest(c, account)
 	default:
 		c.JSON(http.StatusBadRequest, gin.H{
-			"message": "不支持的平台类型: " + selectedAccount.PlatformType,
+			"message": "不支持的平台类型: " + account.PlatformType,
 			"code":    constant.InvalidParams,
 		})
 	}
@@ -204,8 +501,14 @@ func executeAccountTest(account *model.Account) TestAccountResponse {
 		statusCode, errorMsg = relay.TestsHandleClaudeRequest(account)
 	case constant.PlatformClaudeConsole:
 		statusCode, errorMsg = relay.TestHandleClaudeConsoleRequest(account)
-	case constant.PlatformOpenAI:
+	case constant.PlatformOpenAI, constant.PlatformAzureOpenAI:
 		statusCode, errorMsg = relay.TestHandleOpenAIRequest(account)
+	case constant.PlatformGemini:
+		statusCode, errorMsg = relay.TestHandleGeminiRequest(account)
+	case constant.PlatformBedrock:
+		statusCode, errorMsg = relay.TestHandleBedrockRequest(account)
+	case constant.PlatformVertex:
+		statusCode, errorMsg = relay.TestHandleVertexRequest(account)
 	default:
 		return TestAccountResponse{
 			Success:      false,
@@ -0,0 +1,305 @@
+package controller
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"claude-code-relay/relay"
+	"claude-code-relay/service"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// 批处理任务记录保存失败时的重试次数和间隔
+const (
+	batchTaskSaveAttempts = 3
+	batchTaskSaveInterval = 200 * time.Millisecond
+)
+
+// CreateMessageBatch 创建Message Batches批处理，批处理固定绑定到创建它的账号
+func CreateMessageBatch(c *gin.Context) {
+	apiKey, _ := c.Get("api_key")
+	keyInfo := apiKey.(*model.ApiKey)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondBatchError(c, http.StatusBadRequest, "invalid_request_error", "读取请求体失败")
+		return
+	}
+
+	models, err := service.ParseMessageBatchModels(body)
+	if err != nil {
+		respondBatchError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	for _, modelName := range models {
+		if !service.IsModelAllowed(keyInfo, modelName) {
+			respondBatchError(c, http.StatusForbidden, "permission_error", "当前API Key不允许使用该模型: "+modelName)
+			return
+		}
+	}
+
+	accounts, err := service.GetScheduledAccounts(keyInfo.GroupID, keyInfo.UserID, models[0])
+	if err != nil {
+		respondBatchError(c, http.StatusInternalServerError, "api_error", "查询账号列表失败")
+		return
+	}
+
+	// 按调度顺序尝试支持批处理且支持所有模型的账号，限流和服务端错误时换下一个账号
+	var lastStatus int
+	var lastBody []byte
+	attempts := 0
+	maxAttempts := relay.GetMaxRelayAttempts(len(accounts))
+	for i := range accounts {
+		account := &accounts[i]
+		if !relay.SupportsMessageBatches(account) || !service.AccountSupportsModels(account, models) {
+			continue
+		}
+		if attempts >= maxAttempts {
+			break
+		}
+		attempts++
+
+		statusCode, responseBody, err := relay.ForwardMessageBatchRequest(c.Request.Context(), account, http.MethodPost, "", body)
+		if err != nil {
+			common.SysError(fmt.Sprintf("[BATCH] Account %s (ID: %d) create batch failed: %v", account.Name, account.ID, err))
+			continue
+		}
+		lastStatus, lastBody = statusCode, responseBody
+		if statusCode == http.StatusTooManyRequests || service.IsCircuitFailureStatus(statusCode) {
+			common.SysError(fmt.Sprintf("[BATCH] Account %s (ID: %d) create batch returned status %d", account.Name, account.ID, statusCode))
+			continue
+		}
+
+		if statusCode == http.StatusOK {
+			batchID := gjson.GetBytes(responseBody, "id").String()
+			if err := saveMessageBatchTask(keyInfo, account, responseBody); err != nil {
+				// 未记录的批处理无法计费和查询，取消上游批处理后返回错误
+				common.SysError(fmt.Sprintf("[BATCH] Failed to save batch task %s: %v", batchID, err))
+				cancelUntrackedMessageBatch(account, batchID)
+				respondBatchError(c, http.StatusInternalServerError, "api_error", "保存批处理任务失败")
+				return
+			}
+			common.SysLog(fmt.Sprintf("[BATCH] Batch %s created on account %s (ID: %d)", batchID, account.Name, account.ID))
+		}
+		writeMessageBatch(c, statusCode, responseBody)
+		return
+	}
+
+	if lastStatus > 0 {
+		c.Data(lastStatus, "application/json", lastBody)
+		return
+	}
+	respondBatchError(c, http.StatusServiceUnavailable, "api_error", "没有支持批处理的可用账号")
+}
+
+// saveMessageBatchTask 保存批处理任务记录，失败时短暂等待后重试
+func saveMessageBatchTask(keyInfo *model.ApiKey, account *model.Account, responseBody []byte) error {
+	var err error
+	for i := 0; i < batchTaskSaveAttempts; i++ {
+		if i > 0 {
+			time.Sleep(batchTaskSaveInterval)
+		}
+		if _, err = service.CreateMessageBatchTask(keyInfo, account, responseBody); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// cancelUntrackedMessageBatch 取消未能保存任务记录的上游批处理，客户端断开后仍需执行
+func cancelUntrackedMessageBatch(account *model.Account, batchID string) {
+	if batchID == "" {
+		return
+	}
+	statusCode, _, err := relay.ForwardMessageBatchRequest(context.Background(), account, http.MethodPost, "/"+batchID+"/cancel", nil)
+	if err != nil || statusCode != http.StatusOK {
+		common.SysError(fmt.Sprintf("[BATCH] Failed to cancel untracked batch %s on account %s (ID: %d): status %d, err %v",
+			batchID, account.Name, account.ID, statusCode, err))
+		return
+	}
+	common.SysLog(fmt.Sprintf("[BATCH] Cancelled untracked batch %s on account %s (ID: %d)", batchID, account.Name, account.ID))
+}
+
+// ListMessageBatches 按从新到旧的顺序列出当前API Key创建的批处理
+func ListMessageBatches(c *gin.Context) {
+	apiKey, _ := c.Get("api_key")
+	keyInfo := apiKey.(*model.ApiKey)
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > 100 {
+		respondBatchError(c, http.StatusBadRequest, "invalid_request_error", "limit必须在1到100之间")
+		return
+	}
+
+	// after_id 返回该批处理之后（更早创建）的一页，before_id 返回该批处理之前（更晚创建）的一页
+	var olderThan, newerThan uint
+	for param, target := range map[string]*uint{"after_id": &olderThan, "before_id": &newerThan} {
+		batchID := c.Query(param)
+		if batchID == "" {
+			continue
+		}
+		task, err := service.GetMessageBatchTask(keyInfo, batchID)
+		if err != nil {
+			respondBatchError(c, http.StatusBadRequest, "invalid_request_error", param+"对应的批处理不存在")
+			return
+		}
+		*target = task.ID
+	}
+
+	tasks, err := service.GetMessageBatchTasks(keyInfo, olderThan, newerThan, limit+1)
+	if err != nil {
+		respondBatchError(c, http.StatusInternalServerError, "api_error", "查询批处理列表失败")
+		return
+	}
+
+	hasMore := len(tasks) > limit
+	if hasMore {
+		tasks = tasks[:limit]
+	}
+	data := make([]json.RawMessage, 0, len(tasks))
+	for _, task := range tasks {
+		data = append(data, rewriteBatchResultsURL(c, []byte(task.Result)))
+	}
+
+	response := gin.H{
+		"data":     data,
+		"has_more": hasMore,
+		"first_id": nil,
+		"last_id":  nil,
+	}
+	if len(tasks) > 0 {
+		response["first_id"] = tasks[0].ExternalID
+		response["last_id"] = tasks[len(tasks)-1].ExternalID
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetMessageBatch 使用创建批处理的账号查询批处理状态
+func GetMessageBatch(c *gin.Context) {
+	forwardMessageBatch(c, http.MethodGet, "")
+}
+
+// CancelMessageBatch 使用创建批处理的账号取消批处理，已完成的请求仍会在结果中返回并计费
+func CancelMessageBatch(c *gin.Context) {
+	forwardMessageBatch(c, http.MethodPost, "/cancel")
+}
+
+// GetMessageBatchResults 使用创建批处理的账号获取JSONL格式的批处理结果
+func GetMessageBatchResults(c *gin.Context) {
+	task, account, ok := getMessageBatchAccount(c)
+	if !ok {
+		return
+	}
+
+	resp, err := relay.OpenMessageBatchRequest(c.Request.Context(), account, http.MethodGet, "/"+task.ExternalID+"/results", nil)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[BATCH] Fetch results of batch %s failed: %v", task.ExternalID, err))
+		respondBatchError(c, http.StatusBadGateway, "api_error", "获取批处理结果失败")
+		return
+	}
+	defer common.CloseIO(resp.Body)
+
+	c.Status(resp.StatusCode)
+	c.Header("Content-Type", resp.Header.Get("Content-Type"))
+	if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+		common.SysError(fmt.Sprintf("[BATCH] Copy results of batch %s failed: %v", task.ExternalID, err))
+	}
+}
+
+// forwardMessageBatch 将批处理查询或取消请求转发给创建批处理的账号，并保存最新的批处理状态
+func forwardMessageBatch(c *gin.Context, method, action string) {
+	task, account, ok := getMessageBatchAccount(c)
+	if !ok {
+		return
+	}
+
+	statusCode, responseBody, err := relay.ForwardMessageBatchRequest(c.Request.Context(), account, method, "/"+task.ExternalID+action, nil)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[BATCH] Request batch %s%s failed: %v", task.ExternalID, action, err))
+		respondBatchError(c, http.StatusBadGateway, "api_error", "请求上游批处理接口失败")
+		return
+	}
+
+	if statusCode == http.StatusOK {
+		if err := model.UpdateTaskResult(task.ID, string(responseBody)); err != nil {
+			common.SysError(fmt.Sprintf("[BATCH] Failed to update batch %s: %v", task.ExternalID, err))
+		}
+	}
+	writeMessageBatch(c, statusCode, responseBody)
+}
+
+// getMessageBatchAccount 获取当前API Key的批处理及创建它的账号
+func getMessageBatchAccount(c *gin.Context) (*model.Task, *model.Account, bool) {
+	apiKey, _ := c.Get("api_key")
+	keyInfo := apiKey.(*model.ApiKey)
+
+	task, err := service.GetMessageBatchTask(keyInfo, c.Param("id"))
+	if err != nil {
+		respondBatchError(c, http.StatusNotFound, "not_found_error", err.Error())
+		return nil, nil, false
+	}
+
+	account, err := model.GetAccountByID(task.AccountID)
+	if err != nil {
+		respondBatchError(c, http.StatusServiceUnavailable, "api_error", "创建批处理的账号已不存在")
+		return nil, nil, false
+	}
+	return task, account, true
+}
+
+// writeMessageBatch 输出上游返回的批处理信息，成功时将结果地址替换为中转服务的地址
+func writeMessageBatch(c *gin.Context, statusCode int, body []byte) {
+	if statusCode == http.StatusOK {
+		body = rewriteBatchResultsURL(c, body)
+	}
+	c.Data(statusCode, "application/json", body)
+}
+
+// rewriteBatchResultsURL 将批处理的results_url替换为中转服务的结果接口，客户端无法直接访问上游地址
+func rewriteBatchResultsURL(c *gin.Context, batch []byte) []byte {
+	if gjson.GetBytes(batch, "results_url").Type != gjson.String {
+		return batch
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	// 保留请求路径中批处理接口之前的路由前缀
+	prefix := c.Request.URL.Path
+	if idx := strings.Index(prefix, "/v1/messages/batches"); idx >= 0 {
+		prefix = prefix[:idx]
+	}
+	resultsURL := fmt.Sprintf("%s://%s%s/v1/messages/batches/%s/results",
+		scheme, c.Request.Host, prefix, gjson.GetBytes(batch, "id").String())
+
+	rewritten, err := sjson.SetBytes(batch, "results_url", resultsURL)
+	if err != nil {
+		return batch
+	}
+	return rewritten
+}
+
+// respondBatchError 以Anthropic错误格式返回批处理接口的错误
+func respondBatchError(c *gin.Context, statusCode int, errorType, message string) {
+	c.JSON(statusCode, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errorType,
+			"message": message,
+		},
+	})
+}
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"claude-code-relay/model"
+	"claude-code-relay/relay"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ChatCompletions OpenAI兼容的对话接口，请求转换为Claude格式后复用账号调度、故障转移和计费流程
+func ChatCompletions(c *gin.Context) {
+	apiKey, _ := c.Get("api_key")
+	keyInfo := apiKey.(*model.ApiKey)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": map[string]interface{}{
+				"type":    "invalid_request_error",
+				"message": "读取请求体失败",
+			},
+		})
+		return
+	}
+
+	claudeBody, chatReq, err := relay.ConvertOpenAIChatRequest(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": map[string]interface{}{
+				"type":    "invalid_request_error",
+				"message": err.Error(),
+			},
+		})
+		return
+	}
+
+	// 处理器输出的Claude格式响应经由转换写入器变为OpenAI格式
+	writer := relay.NewOpenAIChatWriter(c.Writer, chatReq)
+	c.Writer = writer
+	relayMessages(c, keyInfo, claudeBody)
+	c.Writer = writer.ResponseWriter
+	writer.Finish()
+}
@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminGetProxies 管理员分页获取代理列表，可按代理池和地区筛选
+func AdminGetProxies(c *gin.Context) {
+	req := model.ProxyListRequest{Page: 1, Limit: 10}
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误: " + err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	result, err := service.GetProxyList(&req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+			"code":  constant.InternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data":    result,
+	})
+}
+
+// AdminGetProxy 管理员获取代理详情
+func AdminGetProxy(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	proxy, err := service.GetProxy(id)
+	if err != nil {
+		respondProxyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data":    proxy,
+	})
+}
+
+// AdminCreateProxy 管理员创建代理
+func AdminCreateProxy(c *gin.Context) {
+	var req model.ProxyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误: " + err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	proxy, err := service.CreateProxy(&req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+			"code":  constant.InternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "创建成功",
+		"code":    constant.Success,
+		"data":    proxy,
+	})
+}
+
+// AdminUpdateProxy 管理员更新代理
+func AdminUpdateProxy(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req model.ProxyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误: " + err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	proxy, err := service.UpdateProxy(id, &req)
+	if err != nil {
+		respondProxyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "更新成功",
+		"code":    constant.Success,
+		"data":    proxy,
+	})
+}
+
+// AdminDeleteProxy 管理员删除代理
+func AdminDeleteProxy(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	if err := service.DeleteProxy(id); err != nil {
+		respondProxyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "删除成功",
+		"code":    constant.Success,
+	})
+}
+
+// AdminCheckProxy 管理员立即对代理执行健康检查
+func AdminCheckProxy(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	proxy, err := service.GetProxy(id)
+	if err != nil {
+		respondProxyError(c, err)
+		return
+	}
+
+	checkErr := service.CheckAndUpdateProxy(proxy)
+	result := gin.H{
+		"reachable": checkErr == nil,
+		"latency":   proxy.Latency,
+		"status":    proxy.Status,
+	}
+	if checkErr != nil {
+		result["error"] = checkErr.Error()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "检查完成",
+		"code":    constant.Success,
+		"data":    result,
+	})
+}
+
+// respondProxyError 返回代理操作的错误响应
+func respondProxyError(c *gin.Context, err error) {
+	if err.Error() == "代理不存在" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+			"code":  constant.NotFound,
+		})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": err.Error(),
+		"code":  constant.InvalidParams,
+	})
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UpdateRewriteRulesRequest 更新分组请求改写规则的请求体
+type UpdateRewriteRulesRequest struct {
+	Rules []model.RewriteRule `json:"rules"`
+}
+
+// RewriteDryRunRequest 改写规则试运行请求体，未提供rules时使用分组已保存的规则
+type RewriteDryRunRequest struct {
+	Rules   []model.RewriteRule `json:"rules"`
+	Request json.RawMessage     `json:"request" binding:"required"`
+	Headers map[string]string   `json:"headers"`
+}
+
+// AdminGetGroupRewriteRules 管理员获取分组的请求改写规则
+func AdminGetGroupRewriteRules(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	rules, err := service.GetGroupRewriteRules(id)
+	if err != nil {
+		respondRewriteError(c, err)
+		return
+	}
+	if rules == nil {
+		rules = []model.RewriteRule{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取改写规则成功",
+		"code":    constant.Success,
+		"data":    rules,
+	})
+}
+
+// AdminUpdateGroupRewriteRules 管理员更新分组的请求改写规则，规则为空时清除
+func AdminUpdateGroupRewriteRules(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateRewriteRulesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误: " + err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	if err := service.ValidateRewriteRules(req.Rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	if err := service.UpdateGroupRewriteRules(id, req.Rules); err != nil {
+		respondRewriteError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "改写规则更新成功",
+		"code":    constant.Success,
+	})
+}
+
+// AdminDryRunGroupRewriteRules 管理员试运行改写规则，返回示例请求改写后的请求体和请求头
+func AdminDryRunGroupRewriteRules(c *gin.Context) {
+	id, ok := parseIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req RewriteDryRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误: " + err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	rules := req.Rules
+	if rules == nil {
+		savedRules, err := service.GetGroupRewriteRules(id)
+		if err != nil {
+			respondRewriteError(c, err)
+			return
+		}
+		rules = savedRules
+	} else if err := service.ValidateRewriteRules(rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	header := make(http.Header)
+	for name, value := range req.Headers {
+		header.Set(name, value)
+	}
+
+	result := service.ApplyRewriteRules(req.Request, header, rules)
+	service.ApplyHeaderRewrites(header, result.Headers)
+
+	resultHeaders := make(map[string]string, len(header))
+	for name := range header {
+		resultHeaders[name] = header.Get(name)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "试运行成功",
+		"code":    constant.Success,
+		"data": gin.H{
+			"body":            json.RawMessage(result.Body),
+			"headers":         resultHeaders,
+			"header_rewrites": result.Headers,
+			"applied":         result.Applied,
+			"errors":          result.Errors,
+		},
+	})
+}
+
+// respondRewriteError 返回改写规则相关错误
+func respondRewriteError(c *gin.Context, err error) {
+	statusCode, code := http.StatusInternalServerError, constant.InternalServerError
+	if err.Error() == "组不存在" {
+		statusCode, code = http.StatusNotFound, constant.NotFound
+	}
+	c.JSON(statusCode, gin.H{
+		"error": err.Error(),
+		"code":  code,
+	})
+}
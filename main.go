@@ -83,6 +83,8 @@ func main() {
 	router.SetAPIRouter(server)
 	// 设置Claude Code专用路由
 	router.SetClaudeCodeRouter(server)
+	// 设置OpenAI兼容路由
+	router.SetOpenAIRouter(server)
 
 	// 启动服务器
 	port := os.Getenv("PORT")
@@ -1,15 +1,14 @@
 package middleware
 
 import (
+	"bytes"
 	"claude-code-relay/common"
-	"claude-code-relay/constant"
 	"claude-code-relay/model"
+	"claude-code-relay/relay"
 	"claude-code-relay/service"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -26,102 +25,165 @@ type RequestBody struct {
 	System interface{} `json:"system"`
 }
 
-// ClaudeCodeAuth API Key鉴权中间件
+// ClaudeCodeAuth API Key鉴权中间件，并按API Key或分组的准入策略校验客户端
 func ClaudeCodeAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 判断是否来自真实的 Claude Code 请求
-		if !isRealClaudeCodeRequest(c) {
-			c.JSON(http.StatusForbidden, gin.H{
-				"error": "仅支持来自 Claude Code 的请求",
-				"code":  40003,
-			})
-			c.Abort()
-			return
+		if authenticateApiKey(c, service.AdmissionEndpointMessages) {
+			c.Next()
+			releaseBudgetReservation(c)
 		}
+	}
+}
 
-		// 从多个可能的请求头中获取API Key
-		apiKey := getApiKeyFromHeaders(c)
-		if apiKey == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "缺少API Key",
-				"code":  40001,
-			})
-			c.Abort()
-			return
+// ApiKeyAuth API Key鉴权中间件，按接口类型校验客户端准入策略（用于辅助接口、批处理和OpenAI兼容接口）
+func ApiKeyAuth(endpoint string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authenticateApiKey(c, endpoint) {
+			c.Next()
+			releaseBudgetReservation(c)
 		}
+	}
+}
 
-		// 从数据库查询API Key
-		keyInfo, err := model.GetApiKeyByKey(apiKey)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "无效的API Key",
-				"code":  40001,
-			})
-			c.Abort()
-			return
-		}
+// authenticateApiKey 校验API Key、客户端准入策略和用户配额，失败时写入错误响应并中止请求
+func authenticateApiKey(c *gin.Context, endpoint string) bool {
+	// 从多个可能的请求头中获取API Key
+	apiKey := getApiKeyFromHeaders(c)
+	if apiKey == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "缺少API Key",
+			"code":  40001,
+		})
+		c.Abort()
+		return false
+	}
 
-		// 添加调试日志 - API Key认证
-		common.SysLog(fmt.Sprintf("[API_KEY_AUTH] API Key: %s (masked), User ID: %d",
-			maskApiKey(apiKey), keyInfo.UserID))
-
-		// 判断是否达到每日限额
-		if keyInfo.DailyLimit > 0 && keyInfo.TodayTotalCost >= keyInfo.DailyLimit {
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error": "API Key已达到每日使用限额",
-				"code":  40004,
-			})
-			c.Abort()
-			return
-		}
+	// 从数据库查询API Key
+	keyInfo, err := model.GetApiKeyByKey(apiKey)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "无效的API Key",
+			"code":  40001,
+		})
+		c.Abort()
+		return false
+	}
 
-		// API Key已经在model层验证了状态和过期时间
-		// 将API Key信息存储到上下文中供后续使用
-		c.Set("api_key_id", keyInfo.ID)
-		c.Set("api_key", keyInfo)
-		c.Set("user_id", keyInfo.UserID)
-		c.Set("group_id", keyInfo.GroupID)
+	// 添加调试日志 - API Key认证
+	common.SysLog(fmt.Sprintf("[API_KEY_AUTH] API Key: %s (masked), User ID: %d",
+		maskApiKey(apiKey), keyInfo.UserID))
 
-		// 计费检查：在请求前检查用户配额
-		billingService := service.NewBillingService()
+	// 读取请求体，供准入校验和费用预估共用
+	bodyBytes, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "读取请求体失败",
+			"code":  40000,
+		})
+		c.Abort()
+		return false
+	}
 
-		// 预估请求费用（这里使用一个基础费用，实际费用会在请求后计算）
-		estimatedCost := 0.5 // 预估最低费用，避免完全没有余额的用户发起请求
+	// 重新设置请求体，以便后续处理可以再次读取
+	c.Request.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 
-		// 检查用户配额
-		common.SysLog(fmt.Sprintf("[QUOTA_CHECK] Checking quota for User ID: %d, Cost: $%.6f",
-			keyInfo.UserID, estimatedCost))
-		quotaResponse, err := billingService.CheckQuota(keyInfo.UserID, estimatedCost)
-		if err != nil {
-			common.SysError(fmt.Sprintf("[QUOTA_CHECK] Failed to check user quota for User ID %d: %v",
-				keyInfo.UserID, err))
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "计费系统检查失败",
-				"code":  50001,
-			})
-			c.Abort()
-			return
-		}
+	// 按准入策略校验客户端
+	if !checkClientAdmission(c, keyInfo, endpoint, bodyBytes) {
+		return false
+	}
 
-		if !quotaResponse.HasQuota {
-			common.SysError(fmt.Sprintf("[QUOTA_CHECK] Insufficient quota for User ID %d: %s",
-				keyInfo.UserID, quotaResponse.Message))
-			c.JSON(http.StatusPaymentRequired, gin.H{
-				"error": "余额不足或无可用套餐，请充值后再试",
-				"code":  40006,
-			})
-			c.Abort()
-			return
-		}
+	// 判断是否达到每日限额
+	if keyInfo.DailyLimit > 0 && keyInfo.TodayTotalCost >= keyInfo.DailyLimit {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": "API Key已达到每日使用限额",
+			"code":  40004,
+		})
+		c.Abort()
+		return false
+	}
 
-		common.SysLog(fmt.Sprintf("[QUOTA_CHECK] Quota check passed for User ID: %d, Type: %s",
-			keyInfo.UserID, quotaResponse.QuotaType))
+	// API Key已经在model层验证了状态和过期时间
+	// 将API Key信息存储到上下文中供后续使用
+	c.Set("api_key_id", keyInfo.ID)
+	c.Set("api_key", keyInfo)
+	c.Set("user_id", keyInfo.UserID)
+	c.Set("group_id", keyInfo.GroupID)
+
+	// 计费检查：在请求前检查用户配额
+	billingService := service.NewBillingService()
+
+	// 按请求内容预估最高费用，实际费用会在请求后按真实用量计算
+	// count_tokens接口不产生费用，只校验是否有可用配额
+	var estimate *service.RequestCostEstimate
+	if !strings.HasSuffix(c.Request.URL.Path, "/count_tokens") {
+		estimate = service.EstimateRequestCost(rewriteForEstimate(c, keyInfo, endpoint, bodyBytes))
+	}
+	var estimatedCost float64
+	if estimate != nil {
+		estimatedCost = estimate.Cost
+	}
 
-		// 将计费信息存储到上下文中
-		c.Set("billing_service", billingService)
-		c.Set("quota_response", quotaResponse)
+	// 检查用户配额并预留预估费用
+	common.SysLog(fmt.Sprintf("[QUOTA_CHECK] Checking quota for User ID: %d, Cost: $%.6f",
+		keyInfo.UserID, estimatedCost))
+	budgetResult, err := billingService.PreAuthorize(keyInfo.UserID, estimatedCost)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[QUOTA_CHECK] Failed to check user quota for User ID %d: %v",
+			keyInfo.UserID, err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "计费系统检查失败",
+			"code":  50001,
+		})
+		c.Abort()
+		return false
+	}
 
-		c.Next()
+	quotaResponse := budgetResult.Quota
+	if !quotaResponse.HasQuota {
+		common.SysError(fmt.Sprintf("[QUOTA_CHECK] Insufficient quota for User ID %d: %s",
+			keyInfo.UserID, quotaResponse.Message))
+		respondInsufficientBudget(c, estimate, budgetResult.AvailableBalance)
+		return false
+	}
+
+	common.SysLog(fmt.Sprintf("[QUOTA_CHECK] Quota check passed for User ID: %d, Type: %s",
+		keyInfo.UserID, quotaResponse.QuotaType))
+
+	// 将计费信息存储到上下文中
+	c.Set("billing_service", billingService)
+	c.Set("quota_response", quotaResponse)
+	if budgetResult.Reservation != nil {
+		c.Set("budget_reservation", budgetResult.Reservation)
+	}
+
+	return true
+}
+
+// respondInsufficientBudget 以Anthropic错误格式返回402，包含本次请求的费用预估
+func respondInsufficientBudget(c *gin.Context, estimate *service.RequestCostEstimate, availableBalance float64) {
+	message := "余额不足或无可用套餐，请充值后再试"
+	if estimate != nil {
+		message = fmt.Sprintf("余额不足：本次请求预估最高费用 $%.6f（输入约 %d tokens，最多输出 %d tokens），可用余额 $%.6f，请充值或减小max_tokens后再试",
+			estimate.Cost, estimate.InputTokens, estimate.MaxOutputTokens, availableBalance)
+	}
+
+	c.JSON(http.StatusPaymentRequired, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    "billing_error",
+			"message": message,
+		},
+		"estimate":          estimate,
+		"available_balance": availableBalance,
+		"code":              40006,
+	})
+	c.Abort()
+}
+
+// releaseBudgetReservation 请求结束后释放预留的额度
+func releaseBudgetReservation(c *gin.Context) {
+	if reservation, exists := c.Get("budget_reservation"); exists {
+		reservation.(*service.BudgetReservation).Release()
 	}
 }
 
@@ -169,74 +231,43 @@ func maskApiKey(apiKey string) string {
 	return apiKey[:4] + strings.Repeat("*", len(apiKey)-8) + apiKey[len(apiKey)-4:]
 }
 
-// isRealClaudeCodeRequest 判断是否是真实的 Claude Code 请求
-func isRealClaudeCodeRequest(c *gin.Context) bool {
-	// 检查 User-Agent 是否匹配 Claude Code 格式
-	userAgent := c.GetHeader("User-Agent")
-	isClaudeCodeUserAgent := isClaudeCodeUserAgent(userAgent)
-
-	// 检查系统提示词
-	hasClaudeCodeSystemPrompt := hasClaudeCodeSystemPrompt(c)
-
-	// 只有当 User-Agent 匹配且系统提示词正确时，才认为是真实的 Claude Code 请求
-	return isClaudeCodeUserAgent && hasClaudeCodeSystemPrompt
-}
-
-// isClaudeCodeUserAgent 检查 User-Agent 是否匹配 Claude Code 格式
-func isClaudeCodeUserAgent(userAgent string) bool {
-	if userAgent == "" {
-		return false
+// rewriteForEstimate 返回实际转发给上游的请求体，用于按分组改写规则限制后的max_tokens等参数预估费用
+// 对话接口和OpenAI兼容接口转发前会执行分组改写规则，OpenAI请求先转换为Claude格式再改写
+func rewriteForEstimate(c *gin.Context, keyInfo *model.ApiKey, endpoint string, body []byte) []byte {
+	if endpoint != service.AdmissionEndpointMessages && endpoint != service.AdmissionEndpointOpenAI {
+		return body
 	}
-	// 匹配 claude-cli/x.x.x 格式
-	matched, _ := regexp.MatchString(`claude-cli/\d+\.\d+\.\d+`, userAgent)
-	return matched
-}
-
-// hasClaudeCodeSystemPrompt 检查请求中是否包含 Claude Code 系统提示词
-func hasClaudeCodeSystemPrompt(c *gin.Context) bool {
-	// 读取请求体
-	bodyBytes, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		return false
-	}
-
-	// 重新设置请求体，以便后续处理可以再次读取
-	c.Request.Body = io.NopCloser(strings.NewReader(string(bodyBytes)))
-
-	// 解析请求体为通用map结构
-	var requestBody map[string]interface{}
-	if err := json.Unmarshal(bodyBytes, &requestBody); err != nil {
-		return false
+	if endpoint == service.AdmissionEndpointOpenAI {
+		claudeBody, _, err := relay.ConvertOpenAIChatRequest(body)
+		if err != nil {
+			return body
+		}
+		body = claudeBody
 	}
 
-	// 将解析后的请求体存储到上下文中，供后续使用
-	c.Set("request_body", requestBody)
-
-	// 检查system字段
-	system, exists := requestBody["system"]
-	if !exists || system == nil {
-		return false
+	rules := service.GetRewriteRulesForGroup(keyInfo.GroupID)
+	if len(rules) == 0 {
+		return body
 	}
+	return service.ApplyRewriteRules(body, c.Request.Header, rules).Body
+}
 
-	// 如果是字符串格式，一定不是真实的 Claude Code 请求
-	if systemStr, ok := system.(string); ok {
-		_ = systemStr // 避免未使用变量警告
+// checkClientAdmission 按API Key生效的准入策略校验客户端，拒绝时返回未通过的规则
+func checkClientAdmission(c *gin.Context, keyInfo *model.ApiKey, endpoint string, bodyBytes []byte) bool {
+	policy := service.ResolveAdmissionPolicy(keyInfo)
+	if admissionErr := service.CheckAdmission(policy, endpoint, c.GetHeader("User-Agent"), bodyBytes); admissionErr != nil {
+		common.SysLog(fmt.Sprintf("[ADMISSION] API Key %s rejected by rule %s: %s",
+			maskApiKey(keyInfo.Key), admissionErr.Rule, admissionErr.Message))
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "客户端准入校验失败: " + admissionErr.Message,
+			"rule":  admissionErr.Rule,
+			"code":  40003,
+		})
+		c.Abort()
 		return false
 	}
 
-	// 处理数组格式
-	if systemArray, ok := system.([]interface{}); ok && len(systemArray) > 0 {
-		if firstItem, ok := systemArray[0].(map[string]interface{}); ok {
-			// 检查第一个元素是否包含 Claude Code 提示词
-			if itemType, exists := firstItem["type"]; exists && itemType == "text" {
-				if text, exists := firstItem["text"]; exists && text == constant.ClaudeCodeSystemPrompt {
-					return true
-				}
-			}
-		}
-	}
-
-	return false
+	return true
 }
 
 // BillingMiddleware 计费中间件 - 已废弃，计费逻辑已移至日志记录处
@@ -11,6 +11,11 @@ type Account struct {
 	PlatformType                  string         `json:"platform_type" gorm:"type:varchar(50);not null;comment:平台类型(claude/claude_console)"`
 	RequestURL                    string         `json:"request_url" gorm:"type:varchar(500);comment:请求地址"`
 	SecretKey                     string         `json:"secret_key" gorm:"type:text;comment:请求秘钥"`
+	AwsAccessKeyID                string         `json:"aws_access_key_id" gorm:"type:varchar(128);comment:AWS访问密钥ID(bedrock)"`
+	AwsSecretAccessKey            string         `json:"aws_secret_access_key" gorm:"type:text;comment:AWS访问密钥(bedrock)"`
+	AwsRegion                     string         `json:"aws_region" gorm:"type:varchar(50);comment:AWS区域(bedrock)"`
+	VertexServiceAccount          string         `json:"vertex_service_account" gorm:"type:text;comment:Google服务账号JSON(vertex)"`
+	VertexRegion                  string         `json:"vertex_region" gorm:"type:varchar(50);comment:Vertex AI区域(vertex)"`
 	AccessToken                   string         `json:"access_token" gorm:"type:text;comment:claude的官方token"`
 	RefreshToken                  string         `json:"refresh_token" gorm:"type:text;comment:claude的官方刷新token"`
 	ExpiresAt                     int            `json:"expires_at" gorm:"default:0;comment:token过期时间戳"`
@@ -18,6 +23,7 @@ type Account struct {
 	GroupID                       int            `json:"group_id" gorm:"default:0;comment:分组ID"`
 	Priority                      int            `json:"priority" gorm:"default:100;comment:优先级(数字越小越高)"`
 	Weight                        int            `json:"weight" gorm:"default:100;comment:权重(数字越大越高)"`
+	MaxConcurrency                int            `json:"max_concurrency" gorm:"default:0;comment:最大并发请求数(0为不限制)"`
 	TodayUsageCount               int            `json:"today_usage_count" gorm:"default:0;comment:今日使用次数"`
 	TodayInputTokens              int            `json:"today_input_tokens" gorm:"default:0;comment:今日输入tokens"`
 	TodayOutputTokens             int            `json:"today_output_tokens" gorm:"default:0;comment:今日输出tokens"`
@@ -26,7 +32,12 @@ type Account struct {
 	TodayTotalCost                float64        `json:"today_total_cost" gorm:"default:0;comment:今日使用总费用(USD)"`
 	EnableProxy                   bool           `json:"enable_proxy" gorm:"default:false;comment:是否启用代理"`
 	ProxyURI                      string         `json:"proxy_uri" gorm:"type:varchar(500);comment:代理URI字符串"`
-	ModelMapping                  string         `json:"model_mapping" gorm:"type:text;comment:模型映射配置(格式:claude-model:openai-model,多个用逗号分隔)"`
+	ProxyID                       uint           `json:"proxy_id" gorm:"default:0;index;comment:关联的代理ID"`
+	ProxyPool                     string         `json:"proxy_pool" gorm:"type:varchar(100);comment:使用的代理池,关联代理不可用时从池中选择"`
+	CACert                        string         `json:"ca_cert" gorm:"type:text;comment:自定义CA证书(PEM格式),用于校验上游证书"`
+	TLSSkipVerify                 bool           `json:"tls_skip_verify" gorm:"default:false;comment:是否跳过上游证书校验"`
+	ModelMapping                  string         `json:"model_mapping" gorm:"type:text;comment:模型映射配置(格式:claude-model:openai-model[:base-model],多个用逗号分隔)"`
+	SupportedModels               string         `json:"supported_models" gorm:"type:text;comment:支持的模型(逗号分隔,支持*通配符),为空时按模型映射推导或不限制"`
 	LastUsedTime                  *Time          `json:"last_used_time" gorm:"comment:最后使用时间;type:datetime"`
 	RateLimitEndTime              *Time          `json:"rate_limit_end_time" gorm:"comment:限流结束时间;type:datetime"`
 	CurrentStatus                 int            `json:"current_status" gorm:"default:1;comment:当前状态(1:正常,2:接口异常,3:账号异常/限流)"`
@@ -39,6 +50,9 @@ type Account struct {
 	// 关联查询
 	User  User   `json:"user,omitempty" gorm:"foreignKey:UserID"`
 	Group *Group `json:"group" gorm:"-"`
+
+	// 实时限流状态，来自Redis，不存储在数据库中
+	RateLimit *AccountRateLimit `json:"rate_limit,omitempty" gorm:"-"`
 }
 
 // 账号列表请求参数
@@ -59,12 +73,13 @@ type AccountListResponse struct {
 // 账号创建请求参数
 type CreateAccountRequest struct {
 	Name            string `json:"name" binding:"required,min=1,max=100"`
-	PlatformType    string `json:"platform_type" binding:"required,oneof=claude claude_console gemini openai"`
+	PlatformType    string `json:"platform_type" binding:"required,oneof=claude claude_console gemini openai bedrock vertex azure_openai"`
 	RequestURL      string `json:"request_url"`
 	SecretKey       string `json:"secret_key"`
 	GroupID         int    `json:"group_id"`
 	Priority        int    `json:"priority"`
 	Weight          int    `json:"weight" binding:"min=1"`
+	MaxConcurrency  int    `json:"max_concurrency" binding:"min=0"` // 最大并发请求数(0为不限制)
 	EnableProxy     bool   `json:"enable_proxy"`
 	ProxyURI        string `json:"proxy_uri"`
 	ModelMapping    string `json:"model_mapping"`
@@ -74,17 +89,38 @@ type CreateAccountRequest struct {
 	RefreshToken    string `json:"refresh_token"`
 	ExpiresAt       int    `json:"expires_at" binding:"min=0"`
 	TodayUsageCount int    `json:"today_usage_count"` // 今日使用次数
+
+	// AWS Bedrock 凭证
+	AwsAccessKeyID     string `json:"aws_access_key_id"`
+	AwsSecretAccessKey string `json:"aws_secret_access_key"`
+	AwsRegion          string `json:"aws_region"`
+
+	// Google Vertex AI 凭证
+	VertexServiceAccount string `json:"vertex_service_account"`
+	VertexRegion         string `json:"vertex_region"`
+
+	// 支持的模型列表(逗号分隔,支持*通配符)，为空时OpenAI/Gemini账号按模型映射推导，其他平台不限制
+	SupportedModels string `json:"supported_models"`
+
+	// TLS配置：自定义CA证书(PEM格式)，以及是否跳过证书校验（默认校验）
+	CACert        string `json:"ca_cert"`
+	TLSSkipVerify bool   `json:"tls_skip_verify"`
+
+	// 代理：关联的代理ID，以及关联代理不可用或未关联时使用的代理池
+	ProxyID   uint   `json:"proxy_id"`
+	ProxyPool string `json:"proxy_pool"`
 }
 
 // 账号更新请求参数
 type UpdateAccountRequest struct {
 	Name            string `json:"name" binding:"required,min=1,max=100"`
-	PlatformType    string `json:"platform_type" binding:"required,oneof=claude claude_console openai gemini"`
+	PlatformType    string `json:"platform_type" binding:"required,oneof=claude claude_console openai gemini bedrock vertex azure_openai"`
 	RequestURL      string `json:"request_url"`
 	SecretKey       string `json:"secret_key"`
 	GroupID         *int   `json:"group_id" binding:"omitempty,min=0"`
 	Priority        int    `json:"priority" binding:"min=1"`
 	Weight          int    `json:"weight" binding:"min=1"`
+	MaxConcurrency  int    `json:"max_concurrency" binding:"min=0"` // 最大并发请求数(0为不限制)
 	EnableProxy     bool   `json:"enable_proxy"`
 	ProxyURI        string `json:"proxy_uri"`
 	ModelMapping    string `json:"model_mapping"`
@@ -93,6 +129,26 @@ type UpdateAccountRequest struct {
 	AccessToken     string `json:"access_token"`
 	RefreshToken    string `json:"refresh_token"`
 	TodayUsageCount int    `json:"today_usage_count"` // 今日使用次数
+
+	// AWS Bedrock 凭证
+	AwsAccessKeyID     string `json:"aws_access_key_id"`
+	AwsSecretAccessKey string `json:"aws_secret_access_key"`
+	AwsRegion          string `json:"aws_region"`
+
+	// Google Vertex AI 凭证
+	VertexServiceAccount string `json:"vertex_service_account"`
+	VertexRegion         string `json:"vertex_region"`
+
+	// 支持的模型列表(逗号分隔,支持*通配符)，为空时OpenAI/Gemini账号按模型映射推导，其他平台不限制
+	SupportedModels string `json:"supported_models"`
+
+	// TLS配置：自定义CA证书(PEM格式)，以及是否跳过证书校验（默认校验）
+	CACert        string `json:"ca_cert"`
+	TLSSkipVerify bool   `json:"tls_skip_verify"`
+
+	// 代理：关联的代理ID，以及关联代理不可用或未关联时使用的代理池
+	ProxyID   uint   `json:"proxy_id"`
+	ProxyPool string `json:"proxy_pool"`
 }
 
 // 账号激活状态更新请求参数
@@ -139,6 +195,14 @@ func UpdateAccount(account *Account) error {
 	return DB.Save(account).Error
 }
 
+// 清除账号缓存的访问令牌，下次请求重新获取
+func ClearAccountAccessToken(id uint) error {
+	return DB.Model(&Account{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"access_token": "",
+		"expires_at":   0,
+	}).Error
+}
+
 // 删除账号（软删除）
 func DeleteAccount(id uint) error {
 	return DB.Delete(&Account{}, id).Error
@@ -232,6 +296,28 @@ func GetAvailableAccountsByGroupID(groupID int) ([]Account, error) {
 	return accounts, nil
 }
 
+// 根据分组ID获取接口异常（熔断中）的激活账号列表
+func GetAbnormalAccountsByGroupID(groupID int) ([]Account, error) {
+	var accounts []Account
+	err := DB.Where("group_id = ? AND active_status = 1 AND current_status = 2", groupID).
+		Order("priority ASC, today_usage_count ASC").
+		Find(&accounts).Error
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// 根据分组ID获取所有激活的账号（不区分当前状态），用于判断分组是否有可能恢复服务的账号
+func GetActiveAccountsByGroupID(groupID int) ([]Account, error) {
+	var accounts []Account
+	err := DB.Where("group_id = ? AND active_status = 1", groupID).Find(&accounts).Error
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
 // 获取指定用户、分组和优先级下可用账号的最大今日请求次数
 func GetMaxTodayUsageCountFromAvailableAccounts(userID uint, groupID int, priority int) (int, error) {
 	var maxUsageCount int
@@ -0,0 +1,29 @@
+package model
+
+// AccountRateLimit 账号的实时限流状态，由上游响应的 anthropic-ratelimit-* 响应头解析，保存在Redis中
+type AccountRateLimit struct {
+	// 统一限流（Claude订阅账号）
+	Status              string `json:"status,omitempty"`               // allowed / allowed_warning / rejected
+	Reset               int64  `json:"reset,omitempty"`                // 重置时间戳(秒)
+	RepresentativeClaim string `json:"representative_claim,omitempty"` // 当前起决定作用的窗口，如 five_hour / seven_day
+
+	// 5小时窗口
+	FiveHourStatus      string   `json:"five_hour_status,omitempty"`
+	FiveHourReset       int64    `json:"five_hour_reset,omitempty"`
+	FiveHourUtilization *float64 `json:"five_hour_utilization,omitempty"` // 已用比例(0-1)
+
+	// 7天窗口
+	SevenDayStatus      string   `json:"seven_day_status,omitempty"`
+	SevenDayReset       int64    `json:"seven_day_reset,omitempty"`
+	SevenDayUtilization *float64 `json:"seven_day_utilization,omitempty"` // 已用比例(0-1)
+
+	// 请求数/Token数限流（Console API Key）
+	RequestsLimit     *int64 `json:"requests_limit,omitempty"`
+	RequestsRemaining *int64 `json:"requests_remaining,omitempty"`
+	RequestsReset     string `json:"requests_reset,omitempty"` // RFC3339
+	TokensLimit       *int64 `json:"tokens_limit,omitempty"`
+	TokensRemaining   *int64 `json:"tokens_remaining,omitempty"`
+	TokensReset       string `json:"tokens_reset,omitempty"` // RFC3339
+
+	UpdatedAt int64 `json:"updated_at"` // 最后一次更新的时间戳(秒)
+}
@@ -0,0 +1,45 @@
+package model
+
+// 客户端准入模式
+const (
+	AdmissionModeRestricted = "restricted" // 按规则校验
+	AdmissionModeAny        = "any"        // 允许任意客户端
+)
+
+// AdmissionPolicy 客户端准入策略，序列化为JSON保存在API Key或分组上
+// 规则列表为空时不校验该项，全部配置的规则都通过才允许请求
+type AdmissionPolicy struct {
+	Mode                 string   `json:"mode" binding:"omitempty,oneof=restricted any"`
+	UserAgentPatterns    []string `json:"user_agent_patterns"`     // User-Agent正则白名单，匹配任意一个即可
+	SystemPromptPrefixes []string `json:"system_prompt_prefixes"`  // 第一段系统提示词允许的前缀
+	MinClaudeCodeVersion string   `json:"min_claude_code_version"` // 最低Claude Code版本(如1.0.60)
+	AllowOpenAI          bool     `json:"allow_openai"`            // 是否允许任意客户端调用OpenAI兼容接口，关闭时按上述规则校验
+}
+
+// UpdateApiKeyAdmissionPolicy 更新API Key的准入策略
+func UpdateApiKeyAdmissionPolicy(id uint, policy string) error {
+	return DB.Model(&ApiKey{}).Where("id = ?", id).Update("admission_policy", policy).Error
+}
+
+// UpdateGroupAdmissionPolicy 更新分组的准入策略
+func UpdateGroupAdmissionPolicy(id uint, policy string) error {
+	return DB.Model(&Group{}).Where("id = ?", id).Update("admission_policy", policy).Error
+}
+
+// GetApiKeyAdmissionPolicy 获取API Key保存的准入策略
+func GetApiKeyAdmissionPolicy(id uint) (string, error) {
+	var apiKey ApiKey
+	if err := DB.Select("id", "admission_policy").First(&apiKey, id).Error; err != nil {
+		return "", err
+	}
+	return apiKey.AdmissionPolicy, nil
+}
+
+// GetGroupAdmissionPolicy 获取分组保存的准入策略
+func GetGroupAdmissionPolicy(id uint) (string, error) {
+	var group Group
+	if err := DB.Select("id", "admission_policy").First(&group, id).Error; err != nil {
+		return "", err
+	}
+	return group.AdmissionPolicy, nil
+}
@@ -115,6 +115,10 @@ func InitDB() error {
 		// 模型配置相关表
 		&ModelConfig{},
 		&ModelPricing{},
+		// 代理
+		&Proxy{},
+		// 请求捕获
+		&RequestCapture{},
 	)
 	if err != nil {
 		return err
@@ -5,14 +5,17 @@ import (
 )
 
 type Group struct {
-	ID        uint           `json:"id" gorm:"primaryKey"`
-	Name      string         `json:"name" gorm:"type:varchar(100);not null;uniqueIndex:idx_groups_user_name"`
-	Remark    string         `json:"remark" gorm:"type:text"`
-	Status    int            `json:"status" gorm:"default:1"` // 1:启用 0:禁用
-	UserID    uint           `json:"user_id" gorm:"not null;uniqueIndex:idx_groups_user_name"`
-	CreatedAt Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
-	UpdatedAt Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
-	DeletedAt gorm.DeletedAt `json:"-" gorm:"uniqueIndex:idx_groups_user_name"`
+	ID                uint           `json:"id" gorm:"primaryKey"`
+	Name              string         `json:"name" gorm:"type:varchar(100);not null;uniqueIndex:idx_groups_user_name"`
+	Remark            string         `json:"remark" gorm:"type:text"`
+	Status            int            `json:"status" gorm:"default:1"`                                                  // 1:启用 0:禁用
+	SchedulerStrategy string         `json:"scheduler_strategy" gorm:"type:varchar(50);default:'priority_least_used'"` // 账号调度策略
+	AdmissionPolicy   string         `json:"admission_policy" gorm:"type:text"`                                        // 客户端准入策略(JSON)，为空时使用默认策略
+	RewriteRules      string         `json:"rewrite_rules" gorm:"type:text"`                                           // 请求改写规则(JSON数组)
+	UserID            uint           `json:"user_id" gorm:"not null;uniqueIndex:idx_groups_user_name"`
+	CreatedAt         Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
+	UpdatedAt         Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
+	DeletedAt         gorm.DeletedAt `json:"-" gorm:"uniqueIndex:idx_groups_user_name"`
 
 	// 统计字段，不存储在数据库中
 	ApiKeyCount  int `json:"api_key_count" gorm:"-"`
@@ -23,15 +26,17 @@ type Group struct {
 }
 
 type CreateGroupRequest struct {
-	Name   string `json:"name" binding:"required"`
-	Remark string `json:"remark"`
-	Status int    `json:"status"`
+	Name              string `json:"name" binding:"required"`
+	Remark            string `json:"remark"`
+	Status            int    `json:"status"`
+	SchedulerStrategy string `json:"scheduler_strategy" binding:"omitempty,oneof=priority_least_used weighted_random round_robin least_inflight lowest_latency"`
 }
 
 type UpdateGroupRequest struct {
-	Name   string `json:"name"`
-	Remark string `json:"remark"`
-	Status *int   `json:"status"`
+	Name              string `json:"name"`
+	Remark            string `json:"remark"`
+	Status            *int   `json:"status"`
+	SchedulerStrategy string `json:"scheduler_strategy" binding:"omitempty,oneof=priority_least_used weighted_random round_robin least_inflight lowest_latency"`
 }
 
 type GroupListResult struct {
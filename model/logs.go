@@ -20,6 +20,7 @@ type Log struct {
 	OutputTokens             int     `json:"output_tokens" gorm:"default:0"`                            // 输出tokens数量
 	CacheReadInputTokens     int     `json:"cache_read_input_tokens" gorm:"default:0"`                  // 缓存读取输入tokens数量
 	CacheCreationInputTokens int     `json:"cache_creation_input_tokens" gorm:"default:0"`              // 缓存创建输入tokens数量
+	ReasoningTokens          int     `json:"reasoning_tokens" gorm:"default:0"`                         // 推理tokens数量(已包含在输出tokens中)
 	InputCost                float64 `json:"input_cost" gorm:"default:0"`                               // 输入费用(USD)
 	OutputCost               float64 `json:"output_cost" gorm:"default:0"`                              // 输出费用(USD)
 	CacheWriteCost           float64 `json:"cache_write_cost" gorm:"default:0"`                         // 缓存写入费用(USD)
@@ -27,6 +28,10 @@ type Log struct {
 	TotalCost                float64 `json:"total_cost" gorm:"default:0"`                               // 总费用(USD)
 	IsStream                 bool    `json:"is_stream" gorm:"default:false"`                            // 是否为流式输出
 	Duration                 int64   `json:"duration"`                                                  // 请求总耗时(毫秒)
+	RetryCount               int     `json:"retry_count" gorm:"default:0"`                              // 切换账号重试次数
+	AttemptTrace             string  `json:"attempt_trace" gorm:"type:text"`                            // 失败尝试记录(JSON)
+	StickyHit                bool    `json:"sticky_hit" gorm:"default:false"`                           // 是否命中会话粘性绑定
+	RequestedModel           string  `json:"requested_model" gorm:"type:varchar(100)"`                  // 客户端请求的模型，发生模型降级时与实际服务的模型不同
 	CreatedAt                Time    `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"` // 创建时间
 
 	// 关联关系
@@ -44,6 +49,7 @@ type LogCreateRequest struct {
 	OutputTokens             int     `json:"output_tokens"`
 	CacheReadInputTokens     int     `json:"cache_read_input_tokens"`
 	CacheCreationInputTokens int     `json:"cache_creation_input_tokens"`
+	ReasoningTokens          int     `json:"reasoning_tokens"`
 	InputCost                float64 `json:"input_cost"`
 	OutputCost               float64 `json:"output_cost"`
 	CacheWriteCost           float64 `json:"cache_write_cost"`
@@ -51,6 +57,23 @@ type LogCreateRequest struct {
 	TotalCost                float64 `json:"total_cost"`
 	IsStream                 bool    `json:"is_stream"`
 	Duration                 int64   `json:"duration"`
+	RetryCount               int     `json:"retry_count"`
+	AttemptTrace             string  `json:"attempt_trace"`
+	StickyHit                bool    `json:"sticky_hit"`
+	RequestedModel           string  `json:"requested_model"`
+}
+
+// LogMeta 转发层附加到日志记录上的信息
+type LogMeta struct {
+	RetryCount   int    // 切换账号重试次数
+	AttemptTrace string // 失败尝试记录(JSON)
+	StickyHit    bool   // 是否命中会话粘性绑定
+
+	// 发生模型降级时客户端请求的原始模型
+	RequestedModel string
+
+	// 价格倍率（如批处理半价），0表示按原价计费
+	PriceRatio float64
 }
 
 // LogListResult 日志列表响应结构
@@ -166,6 +189,7 @@ func CreateLog(logReq *LogCreateRequest) (*Log, error) {
 		OutputTokens:             logReq.OutputTokens,
 		CacheReadInputTokens:     logReq.CacheReadInputTokens,
 		CacheCreationInputTokens: logReq.CacheCreationInputTokens,
+		ReasoningTokens:          logReq.ReasoningTokens,
 		InputCost:                logReq.InputCost,
 		OutputCost:               logReq.OutputCost,
 		CacheWriteCost:           logReq.CacheWriteCost,
@@ -173,6 +197,10 @@ func CreateLog(logReq *LogCreateRequest) (*Log, error) {
 		TotalCost:                logReq.TotalCost,
 		IsStream:                 logReq.IsStream,
 		Duration:                 logReq.Duration,
+		RetryCount:               logReq.RetryCount,
+		AttemptTrace:             logReq.AttemptTrace,
+		StickyHit:                logReq.StickyHit,
+		RequestedModel:           logReq.RequestedModel,
 	}
 
 	err := DB.Create(log).Error
@@ -185,9 +213,17 @@ func CreateLog(logReq *LogCreateRequest) (*Log, error) {
 }
 
 // CreateLogFromTokenUsage 根据TokenUsage创建日志记录
-func CreateLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, accountID uint, duration int64, isStream bool) (*Log, error) {
+func CreateLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, accountID uint, duration int64, isStream bool, meta *LogMeta) (*Log, error) {
 	// 使用费用计算器计算详细费用
 	costResult := common.CalculateCost(usage)
+	costs := costResult.Costs
+	if meta != nil && meta.PriceRatio > 0 {
+		costs.Input *= meta.PriceRatio
+		costs.Output *= meta.PriceRatio
+		costs.CacheWrite *= meta.PriceRatio
+		costs.CacheRead *= meta.PriceRatio
+		costs.Total *= meta.PriceRatio
+	}
 
 	logReq := &LogCreateRequest{
 		ModelName:                usage.Model,
@@ -198,15 +234,26 @@ func CreateLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, account
 		OutputTokens:             usage.OutputTokens,
 		CacheReadInputTokens:     usage.CacheReadInputTokens,
 		CacheCreationInputTokens: usage.CacheCreationInputTokens,
-		InputCost:                costResult.Costs.Input,
-		OutputCost:               costResult.Costs.Output,
-		CacheWriteCost:           costResult.Costs.CacheWrite,
-		CacheReadCost:            costResult.Costs.CacheRead,
-		TotalCost:                costResult.Costs.Total,
+		ReasoningTokens:          usage.ReasoningTokens,
+		InputCost:                costs.Input,
+		OutputCost:               costs.Output,
+		CacheWriteCost:           costs.CacheWrite,
+		CacheReadCost:            costs.CacheRead,
+		TotalCost:                costs.Total,
 		IsStream:                 isStream,
 		Duration:                 duration,
 	}
 
+	if meta != nil {
+		logReq.RetryCount = meta.RetryCount
+		logReq.AttemptTrace = meta.AttemptTrace
+		logReq.StickyHit = meta.StickyHit
+		logReq.RequestedModel = meta.RequestedModel
+	}
+	if logReq.RequestedModel == "" {
+		logReq.RequestedModel = usage.Model
+	}
+
 	return CreateLog(logReq)
 }
 
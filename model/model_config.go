@@ -23,6 +23,9 @@ type ModelConfig struct {
 	CreatedAt     Time   `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
 	UpdatedAt     Time   `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
 
+	// 降级模型链：没有账号能服务该模型时按顺序尝试，逗号分隔
+	FallbackModels string `json:"fallback_models" gorm:"type:text;comment:降级模型链,逗号分隔"`
+
 	// 关联关系
 	Pricing []*ModelPricing `json:"pricing,omitempty" gorm:"foreignKey:ModelID"`
 }
@@ -66,6 +69,9 @@ type CreateModelRequest struct {
 	Description   string `json:"description"`
 	MaxTokens     *int   `json:"max_tokens"`
 	ContextWindow *int   `json:"context_window"`
+
+	// 降级模型链，逗号分隔
+	FallbackModels string `json:"fallback_models"`
 }
 
 // UpdateModelRequest 更新模型请求
@@ -79,6 +85,9 @@ type UpdateModelRequest struct {
 	Description   string `json:"description"`
 	MaxTokens     *int   `json:"max_tokens"`
 	ContextWindow *int   `json:"context_window"`
+
+	// 降级模型链，逗号分隔
+	FallbackModels string `json:"fallback_models"`
 }
 
 // CreatePricingRequest 创建定价请求
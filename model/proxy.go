@@ -0,0 +1,165 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// 代理类型
+const (
+	ProxyTypeHTTP   = "http"
+	ProxyTypeHTTPS  = "https"
+	ProxyTypeSOCKS5 = "socks5"
+)
+
+// 代理健康状态
+const (
+	ProxyStatusHealthy   = 1 // 正常
+	ProxyStatusUnhealthy = 2 // 健康检查失败，已从代理池轮换出去
+)
+
+// Proxy 上游代理，账号可直接关联代理或通过代理池选择
+type Proxy struct {
+	ID            uint           `json:"id" gorm:"primaryKey"`
+	Name          string         `json:"name" gorm:"type:varchar(100);not null;comment:代理名称"`
+	Type          string         `json:"type" gorm:"type:varchar(20);not null;default:'http';comment:代理类型(http/https/socks5)"`
+	Host          string         `json:"host" gorm:"type:varchar(255);not null;comment:代理地址"`
+	Port          int            `json:"port" gorm:"not null;comment:代理端口"`
+	Username      string         `json:"username" gorm:"type:varchar(255);comment:认证用户名"`
+	Password      string         `json:"-" gorm:"type:varchar(255);comment:认证密码"`
+	Region        string         `json:"region" gorm:"type:varchar(50);index;comment:地区标签"`
+	Pool          string         `json:"pool" gorm:"type:varchar(100);index;comment:所属代理池"`
+	Status        int            `json:"status" gorm:"default:1;comment:健康状态(1:正常,2:异常)"`
+	ActiveStatus  int            `json:"active_status" gorm:"default:1;comment:激活状态(1:启用,2:禁用)"`
+	Latency       int            `json:"latency" gorm:"default:0;comment:最近一次健康检查延迟(毫秒)"`
+	FailCount     int            `json:"fail_count" gorm:"default:0;comment:连续健康检查失败次数"`
+	LastError     string         `json:"last_error" gorm:"type:varchar(500);comment:最近一次健康检查错误"`
+	LastCheckTime *Time          `json:"last_check_time" gorm:"type:datetime;comment:最近一次健康检查时间"`
+	CreatedAt     Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
+	UpdatedAt     Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
+	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// 代理创建/更新请求参数
+type ProxyRequest struct {
+	Name         string `json:"name" binding:"required,min=1,max=100"`
+	Type         string `json:"type" binding:"required,oneof=http https socks5"`
+	Host         string `json:"host" binding:"required,max=255"`
+	Port         int    `json:"port" binding:"required,min=1,max=65535"`
+	Username     string `json:"username"`
+	Password     string `json:"password"` // 更新时为空表示保留原密码，清除用户名时一并清除
+	Region       string `json:"region" binding:"max=50"`
+	Pool         string `json:"pool" binding:"max=100"`
+	ActiveStatus int    `json:"active_status" binding:"omitempty,oneof=1 2"`
+}
+
+// 代理列表请求参数
+type ProxyListRequest struct {
+	Page   int    `json:"page" form:"page" binding:"min=1"`
+	Limit  int    `json:"limit" form:"limit" binding:"min=1,max=100"`
+	Pool   string `json:"pool" form:"pool"`
+	Region string `json:"region" form:"region"`
+}
+
+// 代理列表响应结构
+type ProxyListResponse struct {
+	Proxies []Proxy `json:"proxies"`
+	Total   int64   `json:"total"`
+	Page    int     `json:"page"`
+	Limit   int     `json:"limit"`
+}
+
+func (p *Proxy) TableName() string {
+	return "proxies"
+}
+
+// URI 生成代理连接地址，包含认证信息
+func (p *Proxy) URI() string {
+	proxyURL := &url.URL{
+		Scheme: p.Type,
+		Host:   net.JoinHostPort(p.Host, strconv.Itoa(p.Port)),
+	}
+	if p.Username != "" {
+		proxyURL.User = url.UserPassword(p.Username, p.Password)
+	}
+	return proxyURL.String()
+}
+
+// DisplayName 不含认证信息的代理描述，用于日志
+func (p *Proxy) DisplayName() string {
+	return fmt.Sprintf("%s(%s://%s)", p.Name, p.Type, net.JoinHostPort(p.Host, strconv.Itoa(p.Port)))
+}
+
+func CreateProxy(proxy *Proxy) error {
+	proxy.ID = 0
+	return DB.Create(proxy).Error
+}
+
+func GetProxyByID(id uint) (*Proxy, error) {
+	var proxy Proxy
+	if err := DB.First(&proxy, id).Error; err != nil {
+		return nil, err
+	}
+	return &proxy, nil
+}
+
+func UpdateProxy(proxy *Proxy) error {
+	return DB.Save(proxy).Error
+}
+
+func DeleteProxy(id uint) error {
+	return DB.Delete(&Proxy{}, id).Error
+}
+
+// GetProxies 分页获取代理列表，可按代理池和地区筛选
+func GetProxies(page, limit int, pool, region string) ([]Proxy, int64, error) {
+	var proxies []Proxy
+	var total int64
+
+	query := DB.Model(&Proxy{})
+	if pool != "" {
+		query = query.Where("pool = ?", pool)
+	}
+	if region != "" {
+		query = query.Where("region = ?", region)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("id ASC").Offset(offset).Limit(limit).Find(&proxies).Error; err != nil {
+		return nil, 0, err
+	}
+	return proxies, total, nil
+}
+
+// GetActiveProxies 获取所有启用的代理，供调度和健康检查使用
+func GetActiveProxies() ([]Proxy, error) {
+	var proxies []Proxy
+	err := DB.Where("active_status = ?", 1).Order("id ASC").Find(&proxies).Error
+	return proxies, err
+}
+
+// UpdateProxyHealth 更新代理的健康检查结果
+func UpdateProxyHealth(proxy *Proxy) error {
+	return DB.Model(&Proxy{}).Where("id = ?", proxy.ID).Updates(map[string]interface{}{
+		"status":          proxy.Status,
+		"latency":         proxy.Latency,
+		"fail_count":      proxy.FailCount,
+		"last_error":      proxy.LastError,
+		"last_check_time": proxy.LastCheckTime,
+	}).Error
+}
+
+// CountAccountsByProxyID 统计关联指定代理的账号数量
+func CountAccountsByProxyID(proxyID uint) (int64, error) {
+	var count int64
+	err := DB.Model(&Account{}).Where("proxy_id = ?", proxyID).Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,89 @@
+package model
+
+import "time"
+
+// RequestCapture 开启请求捕获后记录的一次完整转发过程，用于排查转发问题和重放
+type RequestCapture struct {
+	ID         uint   `json:"id" gorm:"primaryKey"`
+	RequestID  string `json:"request_id" gorm:"type:varchar(64);index;comment:请求ID"`
+	ApiKeyID   uint   `json:"api_key_id" gorm:"index;comment:API Key ID"`
+	GroupID    int    `json:"group_id" gorm:"index;comment:分组ID"`
+	UserID     uint   `json:"user_id" gorm:"comment:所属用户ID"`
+	Path       string `json:"path" gorm:"type:varchar(255);comment:请求路径"`
+	Model      string `json:"model" gorm:"type:varchar(100);comment:请求模型"`
+	AccountID  uint   `json:"account_id" gorm:"comment:最后一次尝试的账号ID"`
+	StatusCode int    `json:"status_code" gorm:"comment:最后一次尝试的上游状态码"`
+	Attempts   int    `json:"attempts" gorm:"comment:上游请求次数"`
+	Duration   int64  `json:"duration" gorm:"comment:总耗时(毫秒)"`
+	Size       int    `json:"size" gorm:"comment:压缩后大小(字节)"`
+	Data       []byte `json:"-" gorm:"type:mediumblob;comment:gzip压缩的捕获内容"`
+	CreatedAt  Time   `json:"created_at" gorm:"type:datetime;index;default:CURRENT_TIMESTAMP"`
+}
+
+// 捕获记录列表请求参数
+type RequestCaptureListRequest struct {
+	Page     int   `json:"page" form:"page" binding:"min=1"`
+	Limit    int   `json:"limit" form:"limit" binding:"min=1,max=100"`
+	ApiKeyID *uint `json:"api_key_id" form:"api_key_id"`
+	GroupID  *int  `json:"group_id" form:"group_id"`
+}
+
+// 捕获记录列表响应结构
+type RequestCaptureListResponse struct {
+	Captures []RequestCapture `json:"captures"`
+	Total    int64            `json:"total"`
+	Page     int              `json:"page"`
+	Limit    int              `json:"limit"`
+}
+
+func (r *RequestCapture) TableName() string {
+	return "request_captures"
+}
+
+func CreateRequestCapture(capture *RequestCapture) error {
+	capture.ID = 0
+	return DB.Create(capture).Error
+}
+
+func GetRequestCaptureByID(id uint) (*RequestCapture, error) {
+	var capture RequestCapture
+	if err := DB.First(&capture, id).Error; err != nil {
+		return nil, err
+	}
+	return &capture, nil
+}
+
+func DeleteRequestCapture(id uint) error {
+	return DB.Delete(&RequestCapture{}, id).Error
+}
+
+// GetRequestCaptures 分页获取捕获记录，列表不返回捕获内容
+func GetRequestCaptures(req *RequestCaptureListRequest) ([]RequestCapture, int64, error) {
+	var captures []RequestCapture
+	var total int64
+
+	query := DB.Model(&RequestCapture{})
+	if req.ApiKeyID != nil {
+		query = query.Where("api_key_id = ?", *req.ApiKeyID)
+	}
+	if req.GroupID != nil {
+		query = query.Where("group_id = ?", *req.GroupID)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (req.Page - 1) * req.Limit
+	err := query.Omit("data").Order("id DESC").Offset(offset).Limit(req.Limit).Find(&captures).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return captures, total, nil
+}
+
+// DeleteRequestCapturesBefore 删除指定时间之前的捕获记录
+func DeleteRequestCapturesBefore(before time.Time) (int64, error) {
+	result := DB.Where("created_at < ?", before).Delete(&RequestCapture{})
+	return result.RowsAffected, result.Error
+}
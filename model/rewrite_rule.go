@@ -0,0 +1,51 @@
+package model
+
+import "encoding/json"
+
+// 请求改写动作
+const (
+	RewriteActionSet    = "set"    // 设置字段（不存在时创建）
+	RewriteActionDelete = "delete" // 删除字段，配合item_match时删除数组中匹配的元素
+	RewriteActionAppend = "append" // 向数组追加元素，字符串类型的system会先转换为文本块数组
+)
+
+// 请求头改写的路径前缀，如 header.anthropic-beta
+const RewriteHeaderPathPrefix = "header."
+
+// RewriteCondition 改写规则的匹配条件，Path使用gjson路径语法
+type RewriteCondition struct {
+	Path  string          `json:"path" binding:"required"`
+	Op    string          `json:"op" binding:"required,oneof=exists not_exists eq ne gt gte lt lte contains in"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// RewriteRule 分组的请求改写规则，按顺序对转发前的Messages请求体执行
+type RewriteRule struct {
+	Name      string            `json:"name"`
+	Match     *RewriteCondition `json:"match,omitempty"` // 为空时总是执行
+	Action    string            `json:"action" binding:"required,oneof=set delete append"`
+	Path      string            `json:"path" binding:"required"` // 目标字段(sjson路径)，header.前缀表示请求头
+	Value     json.RawMessage   `json:"value,omitempty"`
+	ItemMatch *RewriteCondition `json:"item_match,omitempty"` // delete数组时按元素匹配，Path相对于数组元素
+}
+
+// HeaderRewrite 改写规则产生的请求头操作
+type HeaderRewrite struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Value  string `json:"value"`
+}
+
+// UpdateGroupRewriteRules 更新分组的请求改写规则
+func UpdateGroupRewriteRules(id uint, rules string) error {
+	return DB.Model(&Group{}).Where("id = ?", id).Update("rewrite_rules", rules).Error
+}
+
+// GetGroupRewriteRules 获取分组保存的请求改写规则
+func GetGroupRewriteRules(id uint) (string, error) {
+	var group Group
+	if err := DB.Select("id", "rewrite_rules").First(&group, id).Error; err != nil {
+		return "", err
+	}
+	return group.RewriteRules, nil
+}
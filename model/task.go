@@ -19,6 +19,13 @@ type Task struct {
 	UpdatedAt   Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
 	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
 
+	// 异步上游任务（如Message Batches）的关联信息，任务固定由创建时的账号执行
+	Type       string `json:"type" gorm:"type:varchar(50);index;comment:任务类型"`
+	ExternalID string `json:"external_id" gorm:"type:varchar(100);index;comment:上游任务ID"`
+	ApiKeyID   uint   `json:"api_key_id" gorm:"index;comment:创建任务的API Key ID"`
+	AccountID  uint   `json:"account_id" gorm:"comment:执行任务的账号ID"`
+	Result     string `json:"result" gorm:"type:mediumtext;comment:上游返回的最新任务状态(JSON)"`
+
 	// 关联
 	User User `json:"user" gorm:"foreignKey:UserID"`
 }
@@ -88,3 +95,57 @@ func UpdateTaskStatus(id uint, status string) error {
 	}
 	return DB.Model(&Task{}).Where("id = ?", id).Updates(updates).Error
 }
+
+// GetTaskByExternalID 根据任务类型和上游任务ID获取任务
+func GetTaskByExternalID(taskType, externalID string) (*Task, error) {
+	var task Task
+	err := DB.Where("type = ? AND external_id = ?", taskType, externalID).First(&task).Error
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// GetApiKeyTasks 按从新到旧的顺序获取API Key创建的指定类型任务
+// olderThan大于0时返回ID比它小的任务，newerThan大于0时返回紧邻在它之后创建的任务
+func GetApiKeyTasks(taskType string, apiKeyID uint, olderThan, newerThan uint, limit int) ([]Task, error) {
+	var tasks []Task
+	query := DB.Where("type = ? AND api_key_id = ?", taskType, apiKeyID)
+	if newerThan > 0 {
+		if err := query.Where("id > ?", newerThan).Order("id ASC").Limit(limit).Find(&tasks).Error; err != nil {
+			return nil, err
+		}
+		for i, j := 0, len(tasks)-1; i < j; i, j = i+1, j-1 {
+			tasks[i], tasks[j] = tasks[j], tasks[i]
+		}
+		return tasks, nil
+	}
+	if olderThan > 0 {
+		query = query.Where("id < ?", olderThan)
+	}
+	err := query.Order("id DESC").Limit(limit).Find(&tasks).Error
+	return tasks, err
+}
+
+// GetTasksByTypeAndStatus 获取指定类型和状态的任务
+func GetTasksByTypeAndStatus(taskType string, statuses []string) ([]Task, error) {
+	var tasks []Task
+	err := DB.Where("type = ? AND status IN ?", taskType, statuses).Order("id ASC").Find(&tasks).Error
+	return tasks, err
+}
+
+// UpdateTaskResult 更新上游返回的任务信息
+func UpdateTaskResult(id uint, result string) error {
+	return DB.Model(&Task{}).Where("id = ?", id).Update("result", result).Error
+}
+
+// ClaimTaskCompletion 将未完成的任务标记为已完成，返回是否由本次调用完成，用于避免多实例重复处理任务结果
+func ClaimTaskCompletion(id uint, status, result string) (bool, error) {
+	now := time.Now()
+	tx := DB.Model(&Task{}).Where("id = ? AND status NOT IN ?", id, []string{"completed", "failed"}).Updates(map[string]interface{}{
+		"status":       status,
+		"result":       result,
+		"completed_at": &now,
+	})
+	return tx.RowsAffected == 1, tx.Error
+}
@@ -0,0 +1,40 @@
+package relay
+
+import (
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// Azure OpenAI默认API版本
+	defaultAzureOpenAIAPIVersion = "2024-10-21"
+)
+
+// getAzureOpenAIAPIVersion 获取Azure OpenAI的API版本，账号请求地址中的api-version参数优先
+func getAzureOpenAIAPIVersion(query url.Values) string {
+	if version := query.Get("api-version"); version != "" {
+		return version
+	}
+	if version := os.Getenv("AZURE_OPENAI_API_VERSION"); version != "" {
+		return version
+	}
+	return defaultAzureOpenAIAPIVersion
+}
+
+// azureChatCompletionsURL 构建Azure OpenAI部署的对话接口地址
+// 账号请求地址为资源地址，如 https://{resource}.openai.azure.com，部署名称由模型映射得到
+func azureChatCompletionsURL(requestURL, deployment string) (string, error) {
+	endpoint, err := url.Parse(strings.TrimSpace(requestURL))
+	if err != nil {
+		return "", err
+	}
+
+	query := endpoint.Query()
+	query.Set("api-version", getAzureOpenAIAPIVersion(query))
+	basePath := strings.TrimSuffix(strings.TrimSuffix(endpoint.Path, "/"), "/openai")
+	endpoint.Path = basePath + "/openai/deployments/" + deployment + "/chat/completions"
+	endpoint.RawPath = ""
+	endpoint.RawQuery = query.Encode()
+	return endpoint.String(), nil
+}
@@ -0,0 +1,482 @@
+package relay
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// Bedrock 请求配置
+	bedrockAnthropicVersion = "bedrock-2023-05-31"
+	bedrockServiceName      = "bedrock"
+	bedrockDefaultRegion    = "us-east-1"
+)
+
+// Bedrock 错误类型定义
+var (
+	bedrockErrCredentials = gin.H{"error": map[string]interface{}{"type": "configuration_error", "message": "账号未配置AWS访问密钥"}}
+	bedrockErrTransform   = gin.H{"error": map[string]interface{}{"type": "request_error", "message": "Failed to build Bedrock request body"}}
+)
+
+// bedrockModelIDs Anthropic模型ID与Bedrock模型ID的对应关系（不含跨区域推理前缀）
+var bedrockModelIDs = map[string]string{
+	"claude-opus-4-1-20250805":   "anthropic.claude-opus-4-1-20250805-v1:0",
+	"claude-opus-4-20250514":     "anthropic.claude-opus-4-20250514-v1:0",
+	"claude-sonnet-4-20250514":   "anthropic.claude-sonnet-4-20250514-v1:0",
+	"claude-3-7-sonnet-20250219": "anthropic.claude-3-7-sonnet-20250219-v1:0",
+	"claude-3-5-sonnet-20241022": "anthropic.claude-3-5-sonnet-20241022-v2:0",
+	"claude-3-5-sonnet-20240620": "anthropic.claude-3-5-sonnet-20240620-v1:0",
+	"claude-3-5-haiku-20241022":  "anthropic.claude-3-5-haiku-20241022-v1:0",
+	"claude-3-haiku-20240307":    "anthropic.claude-3-haiku-20240307-v1:0",
+}
+
+// cloudSupportedBetas Bedrock和Vertex支持透传的beta特性，其余beta（如oauth）会导致请求被拒绝
+var cloudSupportedBetas = map[string]bool{
+	"interleaved-thinking-2025-05-14":        true,
+	"fine-grained-tool-streaming-2025-05-14": true,
+	"token-efficient-tools-2025-02-19":       true,
+	"context-1m-2025-08-07":                  true,
+}
+
+// HandleBedrockRequest 处理AWS Bedrock平台的请求
+func HandleBedrockRequest(c *gin.Context, account *model.Account) {
+	startTime := time.Now()
+
+	apiKey := extractAPIKey(c)
+
+	// Bedrock区分流式和非流式接口，需要保留客户端的stream参数
+	requestBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errRequestBody)
+		return
+	}
+
+	modelName := gjson.GetBytes(requestBody, "model").String()
+	if modelName == "" {
+		c.JSON(http.StatusServiceUnavailable, errMissingModel)
+		return
+	}
+
+	if apiKey != nil {
+		if err := validateModelRestriction(c, apiKey, modelName); err != nil {
+			return
+		}
+	}
+
+	if account.AwsAccessKeyID == "" || account.AwsSecretAccessKey == "" {
+		c.JSON(http.StatusInternalServerError, bedrockErrCredentials)
+		return
+	}
+
+	isStream := gjson.GetBytes(requestBody, "stream").Bool()
+	body, err := buildBedrockRequestBody(requestBody, c.Request.Header.Get("anthropic-beta"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, appendErrorMessage(bedrockErrTransform, err.Error()))
+		return
+	}
+
+	modelID := resolveBedrockModelID(modelName, account)
+	req, err := createBedrockRequest(c.Request.Context(), account, modelID, body, isStream)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(errCreateRequest, err.Error()))
+		return
+	}
+
+	client, err := createHTTPClient(account)
+	if err != nil {
+		recordUpstreamError(c, err)
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(errProxyConfig, err.Error()))
+		return
+	}
+
+	resp, err := doUpstream(c, client, req, account)
+	if err != nil {
+		recordUpstreamError(c, err)
+		handleRequestError(c, err)
+		return
+	}
+	defer common.CloseIO(resp.Body)
+
+	recordUpstreamStatus(c, resp.StatusCode)
+
+	if resp.StatusCode >= statusBadRequest {
+		handleBedrockErrorResponse(c, resp, account)
+		return
+	}
+
+	var usageTokens *common.TokenUsage
+	if isStream {
+		setStreamResponseHeaders(c)
+		c.Header("Content-Type", "text/event-stream")
+		c.Status(resp.StatusCode)
+		c.Writer.Flush()
+
+		usageTokens, err = common.ParseStreamResponse(c.Writer, newBedrockEventStreamReader(resp.Body))
+		if err != nil {
+			log.Println("bedrock stream copy and parse failed:", err.Error())
+		}
+	} else {
+		responseBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, appendErrorMessage(errResponseRead, err.Error()))
+			return
+		}
+		usageTokens, _ = common.ParseJSONResponse(responseBody)
+		c.Data(resp.StatusCode, "application/json", responseBody)
+	}
+
+	// 计费使用Anthropic模型名称，而不是Bedrock模型ID
+	if usageTokens != nil {
+		usageTokens.Model = modelName
+	}
+
+	updateAccountAndStats(account, resp.StatusCode, usageTokens)
+
+	if apiKey != nil {
+		go service.UpdateApiKeyStatus(apiKey, resp.StatusCode, usageTokens)
+	}
+
+	saveRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens, isStream, buildLogMeta(c))
+}
+
+// buildBedrockRequestBody 将Anthropic请求体转换为Bedrock InvokeModel请求体
+// 模型和流式标记通过URL传递，metadata等Bedrock不接受的字段需要移除
+func buildBedrockRequestBody(body []byte, betaHeader string) ([]byte, error) {
+	var err error
+	body = stripRelayThinkingBlocks(body)
+	for _, field := range []string{"model", "stream", "metadata"} {
+		if body, err = sjson.DeleteBytes(body, field); err != nil {
+			return nil, err
+		}
+	}
+
+	if body, err = sjson.SetBytes(body, "anthropic_version", bedrockAnthropicVersion); err != nil {
+		return nil, err
+	}
+
+	if betas := filterCloudBetas(betaHeader); len(betas) > 0 {
+		if body, err = sjson.SetBytes(body, "anthropic_beta", betas); err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+// filterCloudBetas 过滤anthropic-beta请求头，只保留云平台支持的beta特性
+func filterCloudBetas(betaHeader string) []string {
+	var betas []string
+	for _, beta := range strings.Split(betaHeader, ",") {
+		beta = strings.TrimSpace(beta)
+		if cloudSupportedBetas[beta] {
+			betas = append(betas, beta)
+		}
+	}
+	return betas
+}
+
+// resolveBedrockModelID 将Anthropic模型ID转换为Bedrock模型ID
+// 优先使用账号的模型映射配置，其次使用内置映射并加上区域对应的跨区域推理前缀
+func resolveBedrockModelID(modelName string, account *model.Account) string {
+	defaultModelID, ok := bedrockModelIDs[modelName]
+	if !ok {
+		defaultModelID = "anthropic." + modelName + "-v1:0"
+	}
+
+	region := getBedrockRegion(account)
+	switch {
+	case strings.HasPrefix(region, "us-"):
+		defaultModelID = "us." + defaultModelID
+	case strings.HasPrefix(region, "eu-"):
+		defaultModelID = "eu." + defaultModelID
+	case strings.HasPrefix(region, "ap-"):
+		defaultModelID = "apac." + defaultModelID
+	}
+
+	return applyModelMapping(modelName, account.ModelMapping, defaultModelID)
+}
+
+// getBedrockRegion 获取账号配置的AWS区域
+func getBedrockRegion(account *model.Account) string {
+	if account.AwsRegion != "" {
+		return account.AwsRegion
+	}
+	return bedrockDefaultRegion
+}
+
+// createBedrockRequest 创建并签名Bedrock请求
+func createBedrockRequest(ctx context.Context, account *model.Account, modelID string, body []byte, isStream bool) (*http.Request, error) {
+	region := getBedrockRegion(account)
+
+	action := "invoke"
+	if isStream {
+		action = "invoke-with-response-stream"
+	}
+
+	host := fmt.Sprintf("bedrock-runtime.%s.amazonaws.com", region)
+	if account.RequestURL != "" {
+		if parsed, err := url.Parse(account.RequestURL); err == nil && parsed.Host != "" {
+			host = parsed.Host
+		}
+	}
+
+	rawPath := "/model/" + common.AWSURIEncode(modelID, true) + "/" + action
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+host+rawPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawPath = rawPath
+	req.URL.Path = "/model/" + modelID + "/" + action
+
+	req.Header.Set("Content-Type", "application/json")
+	if isStream {
+		req.Header.Set("Accept", "application/vnd.amazon.eventstream")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+
+	common.SignAWSRequestV4(req, body, common.AWSCredentials{
+		AccessKeyID:     account.AwsAccessKeyID,
+		SecretAccessKey: account.AwsSecretAccessKey,
+		Region:          region,
+	}, bedrockServiceName, time.Now())
+
+	return req, nil
+}
+
+// handleBedrockErrorResponse 处理Bedrock错误响应
+func handleBedrockErrorResponse(c *gin.Context, resp *http.Response, account *model.Account) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(errResponseRead, err.Error()))
+		return
+	}
+
+	log.Printf("❌ Bedrock错误响应内容: %s", string(responseBody))
+
+	recordUpstreamErrorBody(c, responseBody)
+	accountService := service.NewAccountService()
+	accountService.UpdateAccountErrorStatus(account, resp.StatusCode, responseBody)
+
+	message := gjson.GetBytes(responseBody, "message").String()
+	if message == "" {
+		message = fmt.Sprintf("Request failed with status %d", resp.StatusCode)
+	}
+
+	c.JSON(resp.StatusCode, gin.H{
+		"error": map[string]interface{}{
+			"type":    "response_error",
+			"message": message,
+		},
+	})
+}
+
+// bedrockEventStreamReader 将Bedrock的event-stream二进制帧解码为Anthropic SSE文本
+type bedrockEventStreamReader struct {
+	src     io.Reader
+	pending bytes.Buffer
+	done    bool
+}
+
+// newBedrockEventStreamReader 创建event-stream解码读取器
+func newBedrockEventStreamReader(src io.Reader) *bedrockEventStreamReader {
+	return &bedrockEventStreamReader{src: src}
+}
+
+// Read 实现io.Reader接口，每次解码一个完整帧
+func (r *bedrockEventStreamReader) Read(p []byte) (int, error) {
+	for r.pending.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.decodeNextFrame(); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("decode bedrock event stream failed: %v", err)
+			}
+			r.done = true
+		}
+	}
+	return r.pending.Read(p)
+}
+
+// decodeNextFrame 读取并解码一个event-stream帧
+// 帧格式: 总长度(4) | 头部长度(4) | 前导CRC(4) | 头部 | 负载 | 消息CRC(4)
+func (r *bedrockEventStreamReader) decodeNextFrame() error {
+	prelude := make([]byte, 12)
+	if _, err := io.ReadFull(r.src, prelude); err != nil {
+		return err
+	}
+
+	totalLength := binary.BigEndian.Uint32(prelude[0:4])
+	headersLength := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[0:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return errors.New("event stream prelude checksum mismatch")
+	}
+	if totalLength < 16+headersLength {
+		return errors.New("invalid event stream frame length")
+	}
+
+	rest := make([]byte, totalLength-12)
+	if _, err := io.ReadFull(r.src, rest); err != nil {
+		return err
+	}
+
+	messageCRC := binary.BigEndian.Uint32(rest[len(rest)-4:])
+	checksum := crc32.Update(crc32.ChecksumIEEE(prelude), crc32.IEEETable, rest[:len(rest)-4])
+	if checksum != messageCRC {
+		return errors.New("event stream message checksum mismatch")
+	}
+
+	headers, err := parseEventStreamHeaders(rest[:headersLength])
+	if err != nil {
+		return err
+	}
+	payload := rest[headersLength : len(rest)-4]
+
+	switch headers[":message-type"] {
+	case "event":
+		if headers[":event-type"] != "chunk" {
+			return nil
+		}
+		encoded := gjson.GetBytes(payload, "bytes").String()
+		eventJSON, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		// 移除Bedrock附加的调用统计信息
+		eventJSON, _ = sjson.DeleteBytes(eventJSON, "amazon-bedrock-invocationMetrics")
+		eventType := gjson.GetBytes(eventJSON, "type").String()
+		fmt.Fprintf(&r.pending, "event: %s\ndata: %s\n\n", eventType, eventJSON)
+	case "exception", "error":
+		message := gjson.GetBytes(payload, "message").String()
+		if message == "" {
+			message = string(payload)
+		}
+		errorType := headers[":exception-type"]
+		if errorType == "" {
+			errorType = headers[":error-code"]
+		}
+		errorEvent, _ := json.Marshal(map[string]interface{}{
+			"type": "error",
+			"error": map[string]interface{}{
+				"type":    errorType,
+				"message": message,
+			},
+		})
+		fmt.Fprintf(&r.pending, "event: error\ndata: %s\n\n", errorEvent)
+	}
+	return nil
+}
+
+// parseEventStreamHeaders 解析event-stream帧头部，只保留字符串类型的值
+func parseEventStreamHeaders(data []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	errTruncated := errors.New("truncated event stream header")
+
+	for offset := 0; offset < len(data); {
+		nameLength := int(data[offset])
+		offset++
+		if offset+nameLength+1 > len(data) {
+			return nil, errTruncated
+		}
+		name := string(data[offset : offset+nameLength])
+		offset += nameLength
+
+		valueType := data[offset]
+		offset++
+
+		var valueLength int
+		switch valueType {
+		case 0, 1: // bool true/false
+			valueLength = 0
+		case 2: // byte
+			valueLength = 1
+		case 3: // short
+			valueLength = 2
+		case 4: // int
+			valueLength = 4
+		case 5, 8: // long, timestamp
+			valueLength = 8
+		case 9: // uuid
+			valueLength = 16
+		case 6, 7: // bytes, string
+			if offset+2 > len(data) {
+				return nil, errTruncated
+			}
+			valueLength = int(binary.BigEndian.Uint16(data[offset : offset+2]))
+			offset += 2
+		default:
+			return nil, fmt.Errorf("unknown event stream header type %d", valueType)
+		}
+
+		if offset+valueLength > len(data) {
+			return nil, errTruncated
+		}
+		if valueType == 7 {
+			headers[name] = string(data[offset : offset+valueLength])
+		}
+		offset += valueLength
+	}
+	return headers, nil
+}
+
+// TestHandleBedrockRequest 测试Bedrock账号连接，返回状态码和错误信息
+func TestHandleBedrockRequest(account *model.Account) (int, string) {
+	if account.AwsAccessKeyID == "" || account.AwsSecretAccessKey == "" {
+		return http.StatusBadRequest, "账号未配置AWS访问密钥"
+	}
+
+	requestBody := []byte(GetTestRequestBody(100))
+	modelID := resolveBedrockModelID(gjson.GetBytes(requestBody, "model").String(), account)
+	body, err := buildBedrockRequestBody(requestBody, "")
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to build request body: " + err.Error()
+	}
+
+	req, err := createBedrockRequest(context.Background(), account, modelID, body, false)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to create request: " + err.Error()
+	}
+
+	client, err := createHTTPClient(account)
+	if err != nil {
+		return http.StatusInternalServerError, "Invalid proxy configuration: " + err.Error()
+	}
+	client.Timeout = 30 * time.Second
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return http.StatusInternalServerError, "Request failed: " + err.Error()
+	}
+	defer common.CloseIO(resp.Body)
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, "Failed to read response: " + err.Error()
+	}
+
+	if resp.StatusCode >= statusBadRequest {
+		return resp.StatusCode, gjson.GetBytes(responseBody, "message").String()
+	}
+
+	return resp.StatusCode, ""
+}
@@ -0,0 +1,201 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+)
+
+// encodeEventStreamFrame 按event-stream格式编码帧，头部值均为字符串类型
+func encodeEventStreamFrame(headers [][2]string, payload []byte) []byte {
+	var headerBytes bytes.Buffer
+	for _, header := range headers {
+		headerBytes.WriteByte(byte(len(header[0])))
+		headerBytes.WriteString(header[0])
+		headerBytes.WriteByte(7)
+		_ = binary.Write(&headerBytes, binary.BigEndian, uint16(len(header[1])))
+		headerBytes.WriteString(header[1])
+	}
+	return encodeEventStreamFrameRaw(headerBytes.Bytes(), payload)
+}
+
+// encodeEventStreamFrameRaw 使用已编码的头部构造帧，前导和消息CRC均正确
+func encodeEventStreamFrameRaw(headers, payload []byte) []byte {
+	totalLength := 16 + len(headers) + len(payload)
+	frame := make([]byte, 12, totalLength)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(totalLength))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(headers)))
+	binary.BigEndian.PutUint32(frame[8:12], crc32.ChecksumIEEE(frame[0:8]))
+	frame = append(frame, headers...)
+	frame = append(frame, payload...)
+	return binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(frame))
+}
+
+// bedrockChunkFrame 构造Bedrock InvokeModelWithResponseStream返回的chunk事件帧
+func bedrockChunkFrame(event string) []byte {
+	payload := `{"bytes":"` + base64.StdEncoding.EncodeToString([]byte(event)) + `","p":"abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVW"}`
+	return encodeEventStreamFrame([][2]string{
+		{":event-type", "chunk"},
+		{":content-type", "application/json"},
+		{":message-type", "event"},
+	}, []byte(payload))
+}
+
+func TestDecodeNextFrame(t *testing.T) {
+	chunk := bedrockChunkFrame(`{"type":"message_stop","amazon-bedrock-invocationMetrics":{"inputTokenCount":10}}`)
+
+	badPreludeCRC := append([]byte(nil), chunk...)
+	badPreludeCRC[11] ^= 0xff
+
+	badMessageCRC := append([]byte(nil), chunk...)
+	badMessageCRC[len(badMessageCRC)-1] ^= 0xff
+
+	// 头部声明的字符串长度超出头部区域
+	truncatedHeader := encodeEventStreamFrameRaw([]byte{11, ':', 'e', 'v', 'e', 'n', 't', '-', 't', 'y', 'p', 'e', 7, 0, 20, 'c', 'h'}, []byte(`{}`))
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "chunk event",
+			frame: chunk,
+			want:  "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+		},
+		{
+			name: "exception event",
+			frame: encodeEventStreamFrame([][2]string{
+				{":exception-type", "throttlingException"},
+				{":content-type", "application/json"},
+				{":message-type", "exception"},
+			}, []byte(`{"message":"Too many requests"}`)),
+			want: "event: error\ndata: {\"error\":{\"message\":\"Too many requests\",\"type\":\"throttlingException\"},\"type\":\"error\"}\n\n",
+		},
+		{
+			name:    "bad prelude crc",
+			frame:   badPreludeCRC,
+			wantErr: "prelude checksum mismatch",
+		},
+		{
+			name:    "bad message crc",
+			frame:   badMessageCRC,
+			wantErr: "message checksum mismatch",
+		},
+		{
+			name:    "truncated header",
+			frame:   truncatedHeader,
+			wantErr: "truncated event stream header",
+		},
+		{
+			name:    "truncated frame",
+			frame:   chunk[:len(chunk)-10],
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := newBedrockEventStreamReader(bytes.NewReader(tt.frame))
+			err := reader.decodeNextFrame()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decodeNextFrame error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeNextFrame: %v", err)
+			}
+			if got := reader.pending.String(); got != tt.want {
+				t.Errorf("decoded event\n got: %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBedrockEventStreamReaderStopsOnCorruptFrame(t *testing.T) {
+	corrupt := bedrockChunkFrame(`{"type":"message_stop"}`)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	var stream bytes.Buffer
+	stream.Write(bedrockChunkFrame(`{"type":"ping"}`))
+	stream.Write(corrupt)
+	stream.Write(bedrockChunkFrame(`{"type":"message_stop"}`))
+
+	output, err := io.ReadAll(newBedrockEventStreamReader(&stream))
+	if err != nil && !errors.Is(err, io.EOF) {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := "event: ping\ndata: {\"type\":\"ping\"}\n\n"; string(output) != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
+func TestParseEventStreamHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "string and non-string values",
+			data: []byte{
+				3, 'a', 'b', 'c', 7, 0, 2, 'h', 'i',
+				4, 'f', 'l', 'a', 'g', 0,
+				3, 'n', 'u', 'm', 4, 0, 0, 0, 42,
+			},
+			want: map[string]string{"abc": "hi"},
+		},
+		{
+			name:    "name longer than data",
+			data:    []byte{10, 'a', 'b'},
+			wantErr: true,
+		},
+		{
+			name:    "missing string length",
+			data:    []byte{1, 'a', 7, 0},
+			wantErr: true,
+		},
+		{
+			name:    "value longer than data",
+			data:    []byte{1, 'a', 4, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "unknown value type",
+			data:    []byte{1, 'a', 42},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEventStreamHeaders(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseEventStreamHeaders = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEventStreamHeaders: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseEventStreamHeaders = %v, want %v", got, tt.want)
+			}
+			for name, value := range tt.want {
+				if got[name] != value {
+					t.Errorf("header %s = %q, want %q", name, got[name], value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package relay
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+const ctxKeyCapture = "request_capture"
+
+// requestCapture 单个请求的捕获状态，保存在gin上下文中
+type requestCapture struct {
+	mu        sync.Mutex
+	startTime time.Time
+	record    model.RequestCapture
+	detail    service.CaptureDetail
+	bodies    []*captureBuffer // 与detail.Exchanges一一对应的上游响应内容
+	maxBytes  int
+}
+
+// captureBuffer 有上限的响应内容缓冲区
+type captureBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if remaining := b.limit - b.buf.Len(); remaining < len(p) {
+		if remaining > 0 {
+			b.buf.Write(p[:remaining])
+		}
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// captureReadCloser 读取上游响应时同时写入捕获缓冲区
+type captureReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *captureReadCloser) Close() error {
+	return r.closer.Close()
+}
+
+// StartCapture API Key或其分组开启了请求捕获时，记录脱敏后的入站请求
+func StartCapture(c *gin.Context, keyInfo *model.ApiKey, body []byte) {
+	if !service.IsCaptureEnabled(keyInfo.ID, keyInfo.GroupID) {
+		return
+	}
+	startCapture(c, keyInfo, body)
+}
+
+// startCapture 创建捕获状态并记录入站请求
+func startCapture(c *gin.Context, keyInfo *model.ApiKey, body []byte) *requestCapture {
+	maxBytes := service.GetCaptureMaxBodyBytes()
+	capture := &requestCapture{
+		startTime: time.Now(),
+		maxBytes:  maxBytes,
+		record: model.RequestCapture{
+			RequestID: c.GetString("request_id"),
+			Path:      c.Request.URL.Path,
+			Model:     gjson.GetBytes(body, "model").String(),
+		},
+	}
+	if keyInfo != nil {
+		capture.record.ApiKeyID = keyInfo.ID
+		capture.record.GroupID = keyInfo.GroupID
+		capture.record.UserID = keyInfo.UserID
+	}
+	capture.detail.Inbound = service.CapturedHTTP{
+		Method:  c.Request.Method,
+		URL:     service.RedactURL(c.Request.URL),
+		Headers: service.RedactHeaders(c.Request.Header),
+	}
+	capture.detail.Inbound.Body, capture.detail.Inbound.Truncated = limitCaptured(body, maxBytes)
+
+	c.Set(ctxKeyCapture, capture)
+	return capture
+}
+
+// getCapture 获取当前请求的捕获状态，未开启捕获时返回nil
+func getCapture(c *gin.Context) *requestCapture {
+	if value, exists := c.Get(ctxKeyCapture); exists {
+		if capture, ok := value.(*requestCapture); ok {
+			return capture
+		}
+	}
+	return nil
+}
+
+// doUpstream 发送上游请求，开启捕获时记录脱敏后的出站请求、上游状态码、响应头和完整响应内容
+func doUpstream(c *gin.Context, client *http.Client, req *http.Request, account *model.Account) (*http.Response, error) {
+	capture := getCapture(c)
+	if capture == nil {
+		return client.Do(req)
+	}
+
+	exchange := service.CapturedExchange{
+		AccountID:    account.ID,
+		AccountName:  account.Name,
+		PlatformType: account.PlatformType,
+		Request: service.CapturedHTTP{
+			Method:  req.Method,
+			URL:     service.RedactURL(req.URL),
+			Headers: service.RedactHeaders(req.Header),
+		},
+	}
+	if req.GetBody != nil {
+		if reader, err := req.GetBody(); err == nil {
+			body, _ := io.ReadAll(reader)
+			exchange.Request.Body, exchange.Request.Truncated = limitCaptured(body, capture.maxBytes)
+		}
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	exchange.Duration = time.Since(start).Milliseconds()
+
+	buffer := &captureBuffer{limit: capture.maxBytes}
+	if err != nil {
+		exchange.Error = err.Error()
+	} else {
+		exchange.Response.StatusCode = resp.StatusCode
+		exchange.Response.Headers = service.RedactHeaders(resp.Header)
+		resp.Body = &captureReadCloser{Reader: io.TeeReader(resp.Body, buffer), closer: resp.Body}
+	}
+
+	capture.mu.Lock()
+	capture.detail.Exchanges = append(capture.detail.Exchanges, exchange)
+	capture.bodies = append(capture.bodies, buffer)
+	capture.mu.Unlock()
+	return resp, err
+}
+
+// FinishCapture 请求结束后保存捕获记录
+func FinishCapture(c *gin.Context) {
+	capture := getCapture(c)
+	if capture == nil {
+		return
+	}
+	c.Set(ctxKeyCapture, nil)
+
+	capture.finalize()
+	if err := service.SaveRequestCapture(&capture.record, &capture.detail); err != nil {
+		common.SysError("save request capture error: " + err.Error())
+	}
+}
+
+// finalize 填充上游响应内容和汇总信息
+func (capture *requestCapture) finalize() {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+
+	for i := range capture.detail.Exchanges {
+		exchange := &capture.detail.Exchanges[i]
+		buffer := capture.bodies[i]
+		buffer.mu.Lock()
+		body := service.DecodeCapturedBody(buffer.buf.Bytes(), http.Header(exchange.Response.Headers).Get("Content-Encoding"))
+		exchange.Response.Body = string(body)
+		exchange.Response.Truncated = buffer.truncated
+		buffer.mu.Unlock()
+	}
+
+	capture.record.Duration = time.Since(capture.startTime).Milliseconds()
+	if count := len(capture.detail.Exchanges); count > 0 {
+		last := capture.detail.Exchanges[count-1]
+		capture.record.AccountID = last.AccountID
+		capture.record.StatusCode = last.Response.StatusCode
+	}
+}
+
+// limitCaptured 按上限截断捕获内容
+func limitCaptured(body []byte, limit int) (string, bool) {
+	if len(body) > limit {
+		return string(body[:limit]), true
+	}
+	return string(body), false
+}
+
+// StartReplayCapture 为重放请求开启捕获，重放结果不保存，由CollectReplayCapture取回
+func StartReplayCapture(c *gin.Context, body []byte) {
+	startCapture(c, nil, body)
+}
+
+// CollectReplayCapture 取回重放请求的捕获内容
+func CollectReplayCapture(c *gin.Context) *service.CaptureDetail {
+	capture := getCapture(c)
+	if capture == nil {
+		return &service.CaptureDetail{}
+	}
+	c.Set(ctxKeyCapture, nil)
+
+	capture.finalize()
+	return &capture.detail
+}
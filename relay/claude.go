@@ -8,14 +8,12 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -35,10 +33,10 @@ const (
 	// 默认超时配置
 	defaultHTTPTimeout = 120 * time.Second
 	tokenRefreshBuffer = 300 // 5分钟
-	rateLimitDuration  = 5 * time.Hour
 
 	// 状态码
 	statusRateLimit  = 429
+	statusOverloaded = 529
 	statusOK         = 200
 	statusBadRequest = 400
 
@@ -90,13 +88,15 @@ func HandleClaudeRequest(c *gin.Context, account *model.Account) {
 	accessToken, err := getValidAccessToken(account)
 	if err != nil {
 		log.Printf("获取有效访问token失败: %v", err)
+		recordUpstreamError(c, err)
 		c.JSON(http.StatusInternalServerError, appendErrorMessage(errAuthFailed, err.Error()))
 		return
 	}
 
-	client := createHTTPClient(account)
-	if client == nil {
-		c.JSON(http.StatusInternalServerError, errProxyConfig)
+	client, err := createHTTPClient(account)
+	if err != nil {
+		recordUpstreamError(c, err)
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(errProxyConfig, err.Error()))
 		return
 	}
 
@@ -106,13 +106,17 @@ func HandleClaudeRequest(c *gin.Context, account *model.Account) {
 		return
 	}
 
-	resp, err := client.Do(req)
+	resp, err := doUpstream(c, client, req, account)
 	if err != nil {
+		recordUpstreamError(c, err)
 		handleRequestError(c, err)
 		return
 	}
 	defer common.CloseIO(resp.Body)
 
+	recordUpstreamStatus(c, resp.StatusCode)
+	service.RecordAccountRateLimit(account.ID, resp.Header)
+
 	responseReader, err := createResponseReader(resp)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, appendErrorMessage(errDecompression, err.Error()))
@@ -122,17 +126,17 @@ func HandleClaudeRequest(c *gin.Context, account *model.Account) {
 	var usageTokens *common.TokenUsage
 	if resp.StatusCode < statusBadRequest {
 		usageTokens = handleSuccessResponse(c, resp, responseReader)
+		updateAccountAndStats(account, resp.StatusCode, usageTokens)
 	} else {
-		handleErrorResponse(c, resp, responseReader, account)
+		errorBody := handleErrorResponse(c, resp, responseReader, account)
+		service.NewAccountService().UpdateAccountErrorStatus(account, resp.StatusCode, errorBody)
 	}
 
-	updateAccountAndStats(account, resp.StatusCode, usageTokens)
-
 	if apiKey != nil {
 		go service.UpdateApiKeyStatus(apiKey, resp.StatusCode, usageTokens)
 	}
 
-	saveRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens, true)
+	saveRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens, true, buildLogMeta(c))
 }
 
 // requestData 封装请求数据
@@ -158,6 +162,7 @@ func parseAndValidateRequest(c *gin.Context) (*requestData, error) {
 	}
 
 	body, _ = sjson.SetBytes(body, "stream", true)
+	body = stripRelayThinkingBlocks(body)
 
 	modelName := gjson.GetBytes(body, "model").String()
 	if modelName == "" {
@@ -170,42 +175,26 @@ func parseAndValidateRequest(c *gin.Context) (*requestData, error) {
 
 // validateModelRestriction 验证模型限制
 func validateModelRestriction(c *gin.Context, apiKey *model.ApiKey, modelName string) error {
-	if apiKey.ModelRestriction == "" {
+	if service.IsModelAllowed(apiKey, modelName) {
 		return nil
 	}
 
-	allowedModels := strings.Split(apiKey.ModelRestriction, ",")
-	for _, allowedModel := range allowedModels {
-		if strings.EqualFold(strings.TrimSpace(allowedModel), modelName) {
-			return nil
-		}
-	}
-
 	c.JSON(http.StatusForbidden, errModelNotAllowed)
 	return errors.New("model not allowed")
 }
 
-// createHTTPClient 创建HTTP客户端
-func createHTTPClient(account *model.Account) *http.Client {
-	timeout := parseHTTPTimeout()
-
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	if account.EnableProxy && account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err != nil {
-			log.Printf("invalid proxy URI: %s", err.Error())
-			return nil
-		}
-		transport.Proxy = http.ProxyURL(proxyURL)
+// createHTTPClient 创建HTTP客户端，代理不可用或代理地址无效时返回错误
+func createHTTPClient(account *model.Account) (*http.Client, error) {
+	proxyURI, err := accountProxyURI(account)
+	if err != nil {
+		return nil, err
 	}
-
-	return &http.Client{
-		Timeout:   timeout,
-		Transport: transport,
+	client, err := newAccountHTTPClient(account, proxyURI, parseHTTPTimeout())
+	if err != nil {
+		log.Printf("invalid proxy URI: %s", err.Error())
+		return nil, err
 	}
+	return client, nil
 }
 
 // parseHTTPTimeout 解析HTTP超时时间
@@ -233,6 +222,7 @@ func createClaudeRequest(c *gin.Context, body []byte, accessToken string) (*http
 	copyRequestHeaders(c, req)
 	setClaudeAPIHeaders(req, accessToken)
 	setStreamHeaders(c, req)
+	applyHeaderRewrites(c, req)
 
 	return req, nil
 }
@@ -310,16 +300,17 @@ func handleSuccessResponse(c *gin.Context, resp *http.Response, responseReader i
 	return usageTokens
 }
 
-// handleErrorResponse 处理错误响应
-func handleErrorResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, account *model.Account) {
+// handleErrorResponse 处理错误响应，返回上游错误响应体
+func handleErrorResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, account *model.Account) []byte {
 	responseBody, err := io.ReadAll(responseReader)
 	if err != nil {
 		log.Printf("❌ 读取错误响应失败: %v", err)
 		c.JSON(http.StatusInternalServerError, appendErrorMessage(errResponseRead, err.Error()))
-		return
+		return nil
 	}
 
 	log.Printf("❌ 错误响应内容: %s", string(responseBody))
+	recordUpstreamErrorBody(c, responseBody)
 
 	c.Status(resp.StatusCode)
 	copyResponseHeaders(c, resp)
@@ -332,6 +323,7 @@ func handleErrorResponse(c *gin.Context, resp *http.Response, responseReader io.
 			"message": "Request failed with status " + strconv.Itoa(resp.StatusCode),
 		},
 	})
+	return responseBody
 }
 
 // copyResponseHeaders 复制响应头
@@ -371,10 +363,12 @@ func handleRateLimit(resp *http.Response, responseBody []byte, account *model.Ac
 		account.RateLimitEndTime = &rateLimitEndTime
 		log.Printf("账号 %s 限流至 %s", account.Name, resetTime.Format(time.RFC3339))
 	} else {
-		resetTime := time.Now().Add(rateLimitDuration)
+		// 没有重置时间时按连续限流次数指数退避，不再直接锁定5小时
+		duration, strikes := service.NextAccountCooldown(account.ID, service.ErrorClassRateLimit)
+		resetTime := time.Now().Add(duration)
 		rateLimitEndTime := model.Time(resetTime)
 		account.RateLimitEndTime = &rateLimitEndTime
-		log.Printf("账号 %s 限流至 %s (默认5小时)", account.Name, resetTime.Format(time.RFC3339))
+		log.Printf("账号 %s 限流至 %s (第%d次连续限流，退避%s)", account.Name, resetTime.Format(time.RFC3339), strikes, duration.Round(time.Second))
 	}
 
 	if err := model.UpdateAccount(account); err != nil {
@@ -438,7 +432,7 @@ func clearRateLimitIfExpired(account *model.Account) {
 }
 
 // saveRequestLog 保存请求日志并处理计费
-func saveRequestLog(startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage, isStream bool) {
+func saveRequestLog(startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage, isStream bool, meta *model.LogMeta) {
 	// 只有成功的请求才记录日志和计费
 	if statusCode >= statusOK && statusCode < 300 && usageTokens != nil && apiKey != nil {
 		duration := time.Since(startTime).Milliseconds()
@@ -453,7 +447,7 @@ func saveRequestLog(startTime time.Time, apiKey *model.ApiKey, account *model.Ac
 
 		go func() {
 			// 1. 记录调用日志
-			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKeyUserID, apiKeyID, accountID, duration, isStream)
+			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKeyUserID, apiKeyID, accountID, duration, isStream, meta)
 			if err != nil {
 				log.Printf("保存日志失败: %v", err)
 			}
@@ -530,23 +524,11 @@ func TestsHandleClaudeRequest(account *model.Account) (int, string) {
 		req.Header.Set(name, value)
 	}
 
-	httpClientTimeout := 30 * time.Second
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	if account.EnableProxy && account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err != nil {
-			return http.StatusInternalServerError, "Invalid proxy URI: " + err.Error()
-		}
-		transport.Proxy = http.ProxyURL(proxyURL)
-	}
-
-	client := &http.Client{
-		Timeout:   httpClientTimeout,
-		Transport: transport,
+	client, err := createHTTPClient(account)
+	if err != nil {
+		return http.StatusInternalServerError, "Invalid proxy configuration: " + err.Error()
 	}
+	client.Timeout = 30 * time.Second
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -669,20 +651,13 @@ func refreshToken(account *model.Account) (accessToken, refreshToken string, exp
 	req.Header.Set("Origin", "https://claude.ai")
 
 	// 创建HTTP客户端，配置代理（如果启用）
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	if account.EnableProxy && account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err == nil {
-			transport.Proxy = http.ProxyURL(proxyURL)
-		}
+	proxyURI, err := accountProxyURI(account)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("获取代理失败: %v", err)
 	}
-
-	client := &http.Client{
-		Timeout:   30 * time.Second,
-		Transport: transport,
+	client, err := newAccountHTTPClient(account, proxyURI, 30*time.Second)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("创建HTTP客户端失败: %v", err)
 	}
 
 	resp, err := client.Do(req)
@@ -3,19 +3,18 @@ package relay
 import (
 	"bytes"
 	"claude-code-relay/common"
+	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/service"
 	"compress/flate"
 	"compress/gzip"
 	"context"
-	"crypto/tls"
 	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/tidwall/sjson"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -54,9 +53,10 @@ func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account) {
 		return
 	}
 
-	client := createConsoleHTTPClient(account)
-	if client == nil {
-		c.JSON(http.StatusInternalServerError, consoleErrProxyConfig)
+	client, err := createConsoleHTTPClient(account)
+	if err != nil {
+		recordUpstreamError(c, err)
+		c.JSON(http.StatusInternalServerError, appendConsoleErrorMessage(consoleErrProxyConfig, err.Error()))
 		return
 	}
 
@@ -66,17 +66,26 @@ func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account) {
 		return
 	}
 
-	resp, err := client.Do(req)
+	resp, err := doUpstream(c, client, req, account)
 	if err != nil {
+		recordUpstreamError(c, err)
 		handleConsoleRequestError(c, err)
 		return
 	}
 	defer common.CloseIO(resp.Body)
 
+	recordUpstreamStatus(c, resp.StatusCode)
+	service.RecordAccountRateLimit(account.ID, resp.Header)
+
 	accountService := service.NewAccountService()
 
 	if resp.StatusCode >= consoleStatusBadRequest {
-		accountService.UpdateAccountStatus(account, resp.StatusCode, nil)
+		var errorBody []byte
+		if responseReader, err := createConsoleResponseReader(resp); err == nil {
+			errorBody, _ = io.ReadAll(responseReader)
+		}
+		recordUpstreamErrorBody(c, errorBody)
+		accountService.UpdateAccountErrorStatus(account, resp.StatusCode, errorBody)
 		c.JSON(http.StatusServiceUnavailable, gin.H{
 			"error": map[string]interface{}{
 				"type":    "response_error",
@@ -100,7 +109,7 @@ func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account) {
 		go service.UpdateApiKeyStatus(apiKey, resp.StatusCode, usageTokens)
 	}
 
-	saveConsoleRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens)
+	saveConsoleRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens, buildLogMeta(c))
 }
 
 // extractConsoleAPIKey 从上下文中提取API Key
@@ -120,30 +129,30 @@ func parseConsoleRequest(c *gin.Context) ([]byte, error) {
 	}
 
 	body, _ = sjson.SetBytes(body, "stream", true)
+	body = stripRelayThinkingBlocks(body)
 	return body, nil
 }
 
-// createConsoleHTTPClient 创建Console HTTP客户端
-func createConsoleHTTPClient(account *model.Account) *http.Client {
-	timeout := parseConsoleHTTPTimeout()
-
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// createConsoleHTTPClient 创建Console HTTP客户端，代理不可用或代理地址无效时返回错误
+func createConsoleHTTPClient(account *model.Account) (*http.Client, error) {
+	proxyURI, err := upstreamProxyURI(account, account.ProxyURI)
+	if err != nil {
+		return nil, err
 	}
-
-	if account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err != nil {
-			log.Printf("invalid proxy URI: %s", err.Error())
-			return nil
-		}
-		transport.Proxy = http.ProxyURL(proxyURL)
+	client, err := newAccountHTTPClient(account, proxyURI, parseConsoleHTTPTimeout())
+	if err != nil {
+		log.Printf("invalid proxy URI: %s", err.Error())
+		return nil, err
 	}
+	return client, nil
+}
 
-	return &http.Client{
-		Timeout:   timeout,
-		Transport: transport,
+// createAnthropicHTTPClient 创建Anthropic接口（count_tokens、批处理）的HTTP客户端，代理规则与各平台的消息接口一致
+func createAnthropicHTTPClient(account *model.Account) (*http.Client, error) {
+	if account.PlatformType == constant.PlatformClaudeConsole {
+		return createConsoleHTTPClient(account)
 	}
+	return createHTTPClient(account)
 }
 
 // parseConsoleHTTPTimeout 解析Console HTTP超时时间
@@ -173,6 +182,7 @@ func createConsoleRequest(c *gin.Context, body []byte, account *model.Account) (
 	copyConsoleRequestHeaders(c, req)
 	setConsoleAPIHeaders(req, account.SecretKey)
 	setConsoleStreamHeaders(c, req)
+	applyHeaderRewrites(c, req)
 
 	return req, nil
 }
@@ -290,12 +300,12 @@ func setConsoleStreamResponseHeaders(c *gin.Context) {
 }
 
 // saveConsoleRequestLog 保存Console请求日志
-func saveConsoleRequestLog(startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage) {
+func saveConsoleRequestLog(startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage, meta *model.LogMeta) {
 	if statusCode >= consoleStatusOK && statusCode < 300 && usageTokens != nil && apiKey != nil {
 		duration := time.Since(startTime).Milliseconds()
 		logService := service.NewLogService()
 		go func() {
-			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, true)
+			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, true, meta)
 			if err != nil {
 				log.Printf("保存日志失败: %v", err)
 			}
@@ -327,9 +337,9 @@ func TestHandleClaudeConsoleRequest(account *model.Account) (int, string) {
 		req.Header.Set(name, value)
 	}
 
-	client := createConsoleHTTPClient(account)
-	if client == nil {
-		return http.StatusInternalServerError, "Failed to create HTTP client"
+	client, err := createConsoleHTTPClient(account)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to create HTTP client: " + err.Error()
 	}
 
 	resp, err := client.Do(req)
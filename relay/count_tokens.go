@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// count_tokens 请求超时时间
+	countTokensTimeout = 30 * time.Second
+)
+
+// SupportsCountTokens 判断账号平台是否提供Anthropic的count_tokens接口
+func SupportsCountTokens(account *model.Account) bool {
+	return account.PlatformType == constant.PlatformClaude || account.PlatformType == constant.PlatformClaudeConsole
+}
+
+// ForwardCountTokens 将count_tokens请求转发给账号对应的上游，返回上游状态码和响应体
+func ForwardCountTokens(ctx context.Context, account *model.Account, body []byte) (int, []byte, error) {
+	var requestURL string
+	var headers map[string]string
+
+	switch account.PlatformType {
+	case constant.PlatformClaude:
+		accessToken, err := getValidAccessToken(account)
+		if err != nil {
+			return 0, nil, err
+		}
+		requestURL = ClaudeAPIURL + "/count_tokens"
+		headers = buildClaudeAPIHeaders(accessToken)
+	case constant.PlatformClaudeConsole:
+		requestURL = strings.TrimSuffix(account.RequestURL, "/") + "/v1/messages/count_tokens"
+		headers = buildConsoleAPIHeaders(account.SecretKey)
+	default:
+		return 0, nil, errors.New("platform does not support count_tokens: " + account.PlatformType)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	// 计数接口不是流式接口
+	req.Header.Del("x-stainless-helper-method")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	client, err := createAnthropicHTTPClient(account)
+	if err != nil {
+		return 0, nil, err
+	}
+	client.Timeout = countTokensTimeout
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer common.CloseIO(resp.Body)
+	service.RecordAccountRateLimit(account.ID, resp.Header)
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, responseBody, nil
+}
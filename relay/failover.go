@@ -0,0 +1,381 @@
+package relay
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 默认失败重试次数（不含首次请求）
+	defaultRelayMaxRetries = 2
+
+	// 上下文键
+	ctxKeyAttemptState = "relay_attempt_state"
+	ctxKeyAttempts     = "relay_attempts"
+	ctxKeyStickyID     = "relay_sticky_account_id"
+	ctxKeyRequested    = "relay_requested_model"
+
+	// 模型降级时返回给客户端的响应头
+	headerRequestedModel = "X-Requested-Model"
+	headerServedModel    = "X-Served-Model"
+)
+
+// AttemptOutcome 转发尝试结束后的处理方式
+type AttemptOutcome int
+
+const (
+	AttemptDone     AttemptOutcome = iota // 响应已输出给客户端
+	AttemptRetry                          // 切换到下一个账号重试
+	AttemptFallback                       // 容量不足且未输出任何内容，调用方可以降级模型后重试
+)
+
+// RelayAttempt 记录一次转发尝试的结果
+type RelayAttempt struct {
+	AccountID    uint   `json:"account_id"`
+	AccountName  string `json:"account_name"`
+	PlatformType string `json:"platform_type"`
+	StatusCode   int    `json:"status_code"`
+	Error        string `json:"error,omitempty"`
+	ErrorClass   string `json:"error_class,omitempty"` // 失败的错误分类，见 service.ErrorClass*
+	Duration     int64  `json:"duration"`
+}
+
+// attemptState 单次转发尝试过程中由处理器写入的上游结果
+type attemptState struct {
+	accountID      uint
+	upstreamStatus int
+	upstreamErr    error
+	upstreamBody   []byte
+}
+
+// AttemptWriter 在确认可以向客户端输出之前缓存错误响应的写入器
+// 状态码小于400的响应会立即透传给客户端（此后不再允许重试），
+// 错误响应则先写入缓冲区，由调用方决定丢弃后重试还是最终输出
+type AttemptWriter struct {
+	gin.ResponseWriter
+	header     http.Header
+	status     int
+	committed  bool
+	buffer     bytes.Buffer
+	account    *model.Account
+	startTime  time.Time
+	firstWrite time.Time // 首次向客户端写出响应体（首个SSE事件）的时间
+}
+
+// newAttemptWriter 创建转发尝试写入器
+func newAttemptWriter(w gin.ResponseWriter, account *model.Account) *AttemptWriter {
+	return &AttemptWriter{
+		ResponseWriter: w,
+		header:         w.Header().Clone(),
+		status:         http.StatusOK,
+		account:        account,
+		startTime:      time.Now(),
+	}
+}
+
+// Header 返回响应头（提交前为独立副本）
+func (w *AttemptWriter) Header() http.Header {
+	if w.committed {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+// WriteHeader 记录状态码，真正写出延迟到提交时
+func (w *AttemptWriter) WriteHeader(code int) {
+	if w.committed || code <= 0 {
+		return
+	}
+	w.status = code
+}
+
+// WriteHeaderNow 成功状态立即提交，错误状态保持缓存
+func (w *AttemptWriter) WriteHeaderNow() {
+	if !w.committed && w.status < statusBadRequest {
+		w.commit()
+	}
+}
+
+// Write 成功响应直接透传，错误响应写入缓冲区
+func (w *AttemptWriter) Write(data []byte) (int, error) {
+	if !w.committed && w.status < statusBadRequest {
+		w.commit()
+	}
+	if w.committed {
+		if w.firstWrite.IsZero() && len(data) > 0 {
+			w.firstWrite = time.Now()
+		}
+		return w.ResponseWriter.Write(data)
+	}
+	return w.buffer.Write(data)
+}
+
+// WriteString 实现gin.ResponseWriter接口
+func (w *AttemptWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush 仅在已提交（或可提交）时刷新到客户端
+func (w *AttemptWriter) Flush() {
+	if !w.committed && w.status < statusBadRequest {
+		w.commit()
+	}
+	if w.committed {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// Status 返回当前记录的状态码
+func (w *AttemptWriter) Status() int {
+	if w.committed {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+// Size 返回已写入的字节数
+func (w *AttemptWriter) Size() int {
+	if w.committed {
+		return w.ResponseWriter.Size()
+	}
+	return w.buffer.Len()
+}
+
+// Written 是否已经写入过响应
+func (w *AttemptWriter) Written() bool {
+	return w.committed || w.buffer.Len() > 0
+}
+
+// Committed 是否已有数据发送到客户端
+func (w *AttemptWriter) Committed() bool {
+	return w.committed
+}
+
+// commit 将缓存的响应头和状态码写出到客户端
+func (w *AttemptWriter) commit() {
+	dst := w.ResponseWriter.Header()
+	for name := range dst {
+		delete(dst, name)
+	}
+	for name, values := range w.header {
+		dst[name] = values
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.WriteHeaderNow()
+	w.committed = true
+}
+
+// FlushBuffered 输出缓存的错误响应，用于切换账号失败时返回上一次尝试的上游错误
+func (w *AttemptWriter) FlushBuffered() {
+	if w.committed {
+		return
+	}
+	w.commit()
+	if w.buffer.Len() > 0 {
+		_, _ = w.ResponseWriter.Write(w.buffer.Bytes())
+	}
+	w.buffer.Reset()
+}
+
+// GetMaxRelayAttempts 获取单个请求最多尝试的账号数
+func GetMaxRelayAttempts(candidates int) int {
+	retries := defaultRelayMaxRetries
+	if retriesStr := os.Getenv("RELAY_MAX_RETRIES"); retriesStr != "" {
+		if parsed, err := strconv.Atoi(retriesStr); err == nil && parsed >= 0 {
+			retries = parsed
+		}
+	}
+
+	attempts := retries + 1
+	if attempts > candidates {
+		attempts = candidates
+	}
+	return attempts
+}
+
+// BeginAttempt 开始一次转发尝试，替换上下文中的响应写入器
+// 账号并发由调用方获取的并发槽位租约统计
+func BeginAttempt(c *gin.Context, account *model.Account) *AttemptWriter {
+	writer := newAttemptWriter(c.Writer, account)
+	c.Writer = writer
+	c.Set(ctxKeyAttemptState, &attemptState{accountID: account.ID})
+	return writer
+}
+
+// EndAttempt 结束一次转发尝试，返回后续处理方式
+// canRetry表示还有可切换的账号，canFallback表示还有可降级的模型
+func EndAttempt(c *gin.Context, writer *AttemptWriter, canRetry, canFallback bool) AttemptOutcome {
+	c.Writer = writer.ResponseWriter
+	account := writer.account
+
+	// 成功响应记录首字延迟（首次写出响应体的时间），供最低延迟调度策略使用
+	if writer.Committed() && writer.status < statusBadRequest && !writer.firstWrite.IsZero() {
+		service.RecordAccountLatency(account.ID, writer.firstWrite.Sub(writer.startTime))
+	}
+
+	// 网络错误没有上游状态码，单独计入熔断器
+	state := getAttemptState(c)
+	if state != nil && state.upstreamErr != nil && !errors.Is(state.upstreamErr, context.Canceled) {
+		service.NewAccountService().RecordAccountRequestError(account)
+	}
+
+	attempt := RelayAttempt{
+		AccountID:    account.ID,
+		AccountName:  account.Name,
+		PlatformType: account.PlatformType,
+		StatusCode:   writer.Status(),
+		Duration:     time.Since(writer.startTime).Milliseconds(),
+	}
+	if state != nil {
+		if state.upstreamStatus > 0 {
+			attempt.StatusCode = state.upstreamStatus
+		}
+		if state.upstreamErr != nil {
+			attempt.Error = state.upstreamErr.Error()
+			if !errors.Is(state.upstreamErr, context.Canceled) {
+				attempt.ErrorClass = service.ErrorClassNetwork
+			}
+		} else {
+			attempt.ErrorClass = service.ClassifyUpstreamError(attempt.StatusCode, state.upstreamBody)
+		}
+	}
+	appendAttempt(c, attempt)
+
+	if writer.Committed() {
+		return AttemptDone
+	}
+
+	if canRetry && isRetryableAttempt(state) {
+		common.SysLog(fmt.Sprintf("[FAILOVER] Account %s (ID: %d) failed with status %d, switching to next account",
+			account.Name, account.ID, attempt.StatusCode))
+		return AttemptRetry
+	}
+
+	// 没有账号可以切换时，容量不足的错误先不输出，交给调用方尝试降级模型
+	if canFallback && isCapacityFailure(state) {
+		return AttemptFallback
+	}
+
+	writer.FlushBuffered()
+	return AttemptDone
+}
+
+// SetStickyAccount 记录会话粘性绑定的账号，用于日志标记是否命中
+func SetStickyAccount(c *gin.Context, accountID uint) {
+	c.Set(ctxKeyStickyID, accountID)
+}
+
+// SetModelFallback 记录模型降级，后续响应通过响应头告知客户端，日志同时记录请求模型和实际服务的模型
+func SetModelFallback(c *gin.Context, requestedModel, servedModel string) {
+	c.Set(ctxKeyRequested, requestedModel)
+	c.Writer.Header().Set(headerRequestedModel, requestedModel)
+	c.Writer.Header().Set(headerServedModel, servedModel)
+}
+
+// GetRelayAttempts 获取当前请求的所有转发尝试记录
+func GetRelayAttempts(c *gin.Context) []RelayAttempt {
+	if value, exists := c.Get(ctxKeyAttempts); exists {
+		if attempts, ok := value.([]RelayAttempt); ok {
+			return attempts
+		}
+	}
+	return nil
+}
+
+// appendAttempt 追加转发尝试记录
+func appendAttempt(c *gin.Context, attempt RelayAttempt) {
+	c.Set(ctxKeyAttempts, append(GetRelayAttempts(c), attempt))
+}
+
+// getAttemptState 获取当前转发尝试状态
+func getAttemptState(c *gin.Context) *attemptState {
+	if value, exists := c.Get(ctxKeyAttemptState); exists {
+		if state, ok := value.(*attemptState); ok {
+			return state
+		}
+	}
+	return nil
+}
+
+// recordUpstreamStatus 记录上游返回的状态码
+func recordUpstreamStatus(c *gin.Context, statusCode int) {
+	if state := getAttemptState(c); state != nil {
+		state.upstreamStatus = statusCode
+	}
+}
+
+// recordUpstreamErrorBody 记录上游错误响应体，用于按错误类型分类（部分上游使用非标准状态码）
+func recordUpstreamErrorBody(c *gin.Context, body []byte) {
+	if state := getAttemptState(c); state != nil {
+		state.upstreamBody = body
+	}
+}
+
+// recordUpstreamError 记录与账号相关的请求失败（网络错误、token失效等）
+func recordUpstreamError(c *gin.Context, err error) {
+	if state := getAttemptState(c); state != nil {
+		state.upstreamErr = err
+	}
+}
+
+// isRetryableAttempt 判断本次失败是否可以换账号重试
+func isRetryableAttempt(state *attemptState) bool {
+	if state == nil {
+		return false
+	}
+
+	if state.upstreamErr != nil {
+		// 客户端主动取消的请求不再重试
+		return !errors.Is(state.upstreamErr, context.Canceled)
+	}
+
+	switch {
+	case isCapacityFailure(state):
+		return true
+	case state.upstreamStatus >= http.StatusInternalServerError:
+		// 包含529 overloaded
+		return true
+	default:
+		return false
+	}
+}
+
+// isCapacityFailure 判断本次失败是否由上游容量不足（限流或过载）导致
+func isCapacityFailure(state *attemptState) bool {
+	if state == nil || state.upstreamErr != nil {
+		return false
+	}
+	class := service.ClassifyUpstreamError(state.upstreamStatus, state.upstreamBody)
+	return class == service.ErrorClassRateLimit || class == service.ErrorClassOverloaded
+}
+
+// buildLogMeta 根据转发尝试记录构建日志附加信息
+func buildLogMeta(c *gin.Context) *model.LogMeta {
+	attempts := GetRelayAttempts(c)
+	meta := &model.LogMeta{}
+	if state := getAttemptState(c); state != nil && state.accountID > 0 {
+		meta.StickyHit = c.GetUint(ctxKeyStickyID) == state.accountID
+	}
+	meta.RequestedModel = c.GetString(ctxKeyRequested)
+	if len(attempts) == 0 {
+		return meta
+	}
+
+	meta.RetryCount = len(attempts)
+	if traceBytes, err := json.Marshal(attempts); err == nil {
+		meta.AttemptTrace = string(traceBytes)
+	}
+	return meta
+}
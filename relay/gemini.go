@@ -0,0 +1,802 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// Gemini 默认请求地址和模型
+	geminiDefaultBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+	geminiDefaultModel   = "gemini-2.5-pro"
+)
+
+// Gemini API 类型定义
+type GeminiInlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type GeminiFunctionCall struct {
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type GeminiFunctionResponse struct {
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+}
+
+type GeminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	InlineData       *GeminiInlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *GeminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+type GeminiFunctionDeclaration struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+}
+
+type GeminiTool struct {
+	FunctionDeclarations []GeminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type GeminiFunctionCallingConfig struct {
+	Mode                 string   `json:"mode"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+type GeminiToolConfig struct {
+	FunctionCallingConfig GeminiFunctionCallingConfig `json:"functionCallingConfig"`
+}
+
+type GeminiGenerationConfig struct {
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	TopK            *int     `json:"topK,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+type GeminiRequest struct {
+	Contents          []GeminiContent         `json:"contents"`
+	SystemInstruction *GeminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []GeminiTool            `json:"tools,omitempty"`
+	ToolConfig        *GeminiToolConfig       `json:"toolConfig,omitempty"`
+	GenerationConfig  *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+// Gemini 响应类型定义
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason"`
+}
+
+type GeminiUsageMetadata struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+}
+
+type GeminiResponse struct {
+	Candidates    []GeminiCandidate    `json:"candidates"`
+	UsageMetadata *GeminiUsageMetadata `json:"usageMetadata,omitempty"`
+}
+
+// HandleGeminiRequest 处理 Gemini 请求的中转
+func HandleGeminiRequest(c *gin.Context, account *model.Account) {
+	startTime := time.Now()
+
+	// 从上下文中获取API Key信息
+	var apiKey *model.ApiKey
+	if keyInfo, exists := c.Get("api_key"); exists {
+		apiKey = keyInfo.(*model.ApiKey)
+	}
+
+	// 读取请求体
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": map[string]interface{}{
+				"type":    "request_body_error",
+				"message": "Failed to read request body: " + err.Error(),
+			},
+		})
+		return
+	}
+
+	// 解析Claude请求
+	var claudeReq ClaudeRequest
+	if err := json.Unmarshal(body, &claudeReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": map[string]interface{}{
+				"type":    "json_parse_error",
+				"message": "Failed to parse request JSON: " + err.Error(),
+			},
+		})
+		return
+	}
+
+	if err := validateGeminiImageSources(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": map[string]interface{}{
+				"type":    "invalid_request_error",
+				"message": err.Error(),
+			},
+		})
+		return
+	}
+
+	// 应用模型映射并转换为Gemini格式
+	mappedModelName := applyModelMapping(claudeReq.Model, account.ModelMapping, geminiDefaultModel)
+	geminiReq := convertClaudeToGemini(claudeReq)
+
+	geminiBody, err := json.Marshal(geminiReq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": map[string]interface{}{
+				"type":    "json_marshal_error",
+				"message": "Failed to marshal Gemini request: " + err.Error(),
+			},
+		})
+		return
+	}
+
+	// 统一使用流式接口请求上游，根据客户端是否需要流式响应再做转换
+	geminiURL := buildGeminiURL(account, mappedModelName, true)
+	req, err := http.NewRequestWithContext(c.Request.Context(), "POST", geminiURL, bytes.NewBuffer(geminiBody))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": map[string]interface{}{
+				"type":    "internal_server_error",
+				"message": "Failed to create request: " + err.Error(),
+			},
+		})
+		return
+	}
+	setGeminiAPIHeaders(req, account.SecretKey)
+
+	client, err := createGeminiHTTPClient(account, parseHTTPTimeout())
+	if err != nil {
+		recordUpstreamError(c, err)
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(errProxyConfig, err.Error()))
+		return
+	}
+
+	resp, err := doUpstream(c, client, req, account)
+	if err != nil {
+		recordUpstreamError(c, err)
+		log.Printf("Gemini API request failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": map[string]interface{}{
+				"type":    "network_error",
+				"message": "Failed to execute request: " + err.Error(),
+			},
+		})
+		return
+	}
+	defer common.CloseIO(resp.Body)
+
+	recordUpstreamStatus(c, resp.StatusCode)
+
+	if resp.StatusCode >= 400 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		recordUpstreamErrorBody(c, bodyBytes)
+		accountService := service.NewAccountService()
+		accountService.UpdateAccountErrorStatus(account, resp.StatusCode, bodyBytes)
+
+		log.Printf("❌ Gemini错误响应内容: %s", string(bodyBytes))
+		c.JSON(resp.StatusCode, gin.H{
+			"error": map[string]interface{}{
+				"type":    "response_error",
+				"message": extractGeminiErrorMessage(bodyBytes, resp.StatusCode),
+			},
+		})
+		return
+	}
+
+	// 收到第一个事件前不提交响应，上游返回空内容时仍可切换账号
+	if claudeReq.Stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+	}
+
+	transformer := newGeminiStreamTransformer(claudeReq.Model)
+	usageTokens, err := processGeminiStreamResponse(c.Writer, resp.Body, transformer, claudeReq.Stream)
+	if err != nil {
+		recordUpstreamStatus(c, http.StatusBadGateway)
+		c.Writer.Header().Del("Content-Type")
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": map[string]interface{}{
+				"type":    "api_error",
+				"message": err.Error(),
+			},
+		})
+		return
+	}
+	// 按实际请求的Gemini模型计费
+	if usageTokens != nil {
+		usageTokens.Model = mappedModelName
+	}
+
+	updateAccountAndStats(account, resp.StatusCode, usageTokens)
+
+	if apiKey != nil {
+		go service.UpdateApiKeyStatus(apiKey, resp.StatusCode, usageTokens)
+	}
+
+	saveRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens, claudeReq.Stream, buildLogMeta(c))
+}
+
+// buildGeminiURL 构建Gemini接口地址
+func buildGeminiURL(account *model.Account, modelName string, stream bool) string {
+	baseURL := strings.TrimSuffix(account.RequestURL, "/")
+	if baseURL == "" {
+		baseURL = geminiDefaultBaseURL
+	}
+
+	if stream {
+		return fmt.Sprintf("%s/models/%s:streamGenerateContent?alt=sse", baseURL, modelName)
+	}
+	return fmt.Sprintf("%s/models/%s:generateContent", baseURL, modelName)
+}
+
+// setGeminiAPIHeaders 设置Gemini API请求头
+func setGeminiAPIHeaders(req *http.Request, secretKey string) {
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", secretKey)
+}
+
+// createGeminiHTTPClient 创建Gemini HTTP客户端
+func createGeminiHTTPClient(account *model.Account, timeout time.Duration) (*http.Client, error) {
+	proxyURI, err := accountProxyURI(account)
+	if err != nil {
+		return nil, err
+	}
+	return newAccountHTTPClient(account, proxyURI, timeout)
+}
+
+// extractGeminiErrorMessage 提取Gemini错误响应中的错误信息
+func extractGeminiErrorMessage(body []byte, statusCode int) string {
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error.Message != "" {
+		return errResp.Error.Status + ": " + errResp.Error.Message
+	}
+	return fmt.Sprintf("Request failed with status %d", statusCode)
+}
+
+// convertClaudeToGemini 将Claude请求转换为Gemini格式
+func convertClaudeToGemini(claudeReq ClaudeRequest) GeminiRequest {
+	geminiReq := GeminiRequest{
+		GenerationConfig: &GeminiGenerationConfig{
+			MaxOutputTokens: claudeReq.MaxTokens,
+			Temperature:     claudeReq.Temperature,
+			TopP:            claudeReq.TopP,
+			TopK:            claudeReq.TopK,
+			StopSequences:   claudeReq.StopSequences,
+		},
+	}
+
+	// 系统提示词
+	if systemMessage := extractSystemMessage(claudeReq.System); systemMessage != "" {
+		geminiReq.SystemInstruction = &GeminiContent{
+			Parts: []GeminiPart{{Text: systemMessage}},
+		}
+	}
+
+	// Gemini的函数结果需要函数名称，记录tool_use_id与工具名称的对应关系
+	toolNames := make(map[string]string)
+
+	for _, message := range claudeReq.Messages {
+		role := "user"
+		if message.Role == "assistant" {
+			role = "model"
+		}
+
+		var parts []GeminiPart
+		switch content := message.Content.(type) {
+		case string:
+			if content != "" {
+				parts = append(parts, GeminiPart{Text: content})
+			}
+		case []interface{}:
+			for _, block := range content {
+				blockMap, ok := block.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				parts = append(parts, convertClaudeBlockToGeminiParts(blockMap, toolNames)...)
+			}
+		}
+
+		if len(parts) == 0 {
+			continue
+		}
+
+		// 合并相同角色的连续消息
+		if n := len(geminiReq.Contents); n > 0 && geminiReq.Contents[n-1].Role == role {
+			geminiReq.Contents[n-1].Parts = append(geminiReq.Contents[n-1].Parts, parts...)
+			continue
+		}
+		geminiReq.Contents = append(geminiReq.Contents, GeminiContent{Role: role, Parts: parts})
+	}
+
+	// 工具定义
+	if len(claudeReq.Tools) > 0 {
+		var declarations []GeminiFunctionDeclaration
+		for _, tool := range claudeReq.Tools {
+			declarations = append(declarations, GeminiFunctionDeclaration{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  recursivelyCleanSchema(tool.InputSchema),
+			})
+		}
+		geminiReq.Tools = []GeminiTool{{FunctionDeclarations: declarations}}
+	}
+
+	// 工具选择
+	if claudeReq.ToolChoice != nil {
+		config := GeminiFunctionCallingConfig{Mode: "AUTO"}
+		switch claudeReq.ToolChoice.Type {
+		case "any":
+			config.Mode = "ANY"
+		case "tool":
+			config.Mode = "ANY"
+			config.AllowedFunctionNames = []string{claudeReq.ToolChoice.Name}
+		case "none":
+			config.Mode = "NONE"
+		}
+		geminiReq.ToolConfig = &GeminiToolConfig{FunctionCallingConfig: config}
+	}
+
+	return geminiReq
+}
+
+// convertClaudeBlockToGeminiParts 将Claude内容块转换为Gemini的parts
+func convertClaudeBlockToGeminiParts(block map[string]interface{}, toolNames map[string]string) []GeminiPart {
+	switch block["type"] {
+	case "text":
+		if text, ok := block["text"].(string); ok && text != "" {
+			return []GeminiPart{{Text: text}}
+		}
+	case "image":
+		if part := convertClaudeImageToGemini(block); part != nil {
+			return []GeminiPart{*part}
+		}
+	case "tool_use":
+		name, _ := block["name"].(string)
+		if id, ok := block["id"].(string); ok {
+			toolNames[id] = name
+		}
+		args, _ := block["input"].(map[string]interface{})
+		return []GeminiPart{{FunctionCall: &GeminiFunctionCall{Name: name, Args: args}}}
+	case "tool_result":
+		toolUseID, _ := block["tool_use_id"].(string)
+		name := toolNames[toolUseID]
+		if name == "" {
+			name = toolUseID
+		}
+
+		// 工具结果中的文本作为函数返回值，图片作为额外的parts
+		var texts []string
+		var imageParts []GeminiPart
+		switch content := block["content"].(type) {
+		case string:
+			texts = append(texts, content)
+		case []interface{}:
+			for _, item := range content {
+				itemMap, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				switch itemMap["type"] {
+				case "text":
+					if text, ok := itemMap["text"].(string); ok {
+						texts = append(texts, text)
+					}
+				case "image":
+					if part := convertClaudeImageToGemini(itemMap); part != nil {
+						imageParts = append(imageParts, *part)
+					}
+				}
+			}
+		}
+
+		resultKey := "content"
+		if isError, _ := block["is_error"].(bool); isError {
+			resultKey = "error"
+		}
+		parts := []GeminiPart{{
+			FunctionResponse: &GeminiFunctionResponse{
+				Name:     name,
+				Response: map[string]interface{}{resultKey: strings.Join(texts, "\n")},
+			},
+		}}
+		return append(parts, imageParts...)
+	}
+	return nil
+}
+
+// convertClaudeImageToGemini 将Claude图片块转换为Gemini格式
+func convertClaudeImageToGemini(block map[string]interface{}) *GeminiPart {
+	source, ok := block["source"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	mediaType, _ := source["media_type"].(string)
+	switch source["type"] {
+	case "base64":
+		data, _ := source["data"].(string)
+		return &GeminiPart{InlineData: &GeminiInlineData{MimeType: mediaType, Data: data}}
+	}
+	// url来源的图片在转换前已被拒绝
+	return nil
+}
+
+// validateGeminiImageSources 校验图片来源，Gemini的fileData只能引用上传到Gemini的文件，url来源的图片直接拒绝
+func validateGeminiImageSources(body []byte) error {
+	for _, message := range gjson.GetBytes(body, "messages").Array() {
+		for _, block := range message.Get("content").Array() {
+			blocks := []gjson.Result{block}
+			if block.Get("type").String() == "tool_result" {
+				blocks = append(blocks, block.Get("content").Array()...)
+			}
+			for _, item := range blocks {
+				if item.Get("type").String() == "image" && item.Get("source.type").String() == "url" {
+					return errors.New("Gemini账号不支持url来源的图片，请使用base64来源")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// mapGeminiFinishReason 映射Gemini停止原因为Claude格式
+func mapGeminiFinishReason(finishReason string, hasToolUse bool) string {
+	if hasToolUse {
+		return "tool_use"
+	}
+	switch finishReason {
+	case "MAX_TOKENS":
+		return "max_tokens"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// GeminiStreamTransformer Gemini流式响应转换器
+type GeminiStreamTransformer struct {
+	messageID         string
+	model             string
+	started           bool
+	textBlockOpen     bool
+	contentBlockIndex int
+	hasToolUse        bool
+	finishReason      string
+	usage             GeminiUsageMetadata
+	content           []ClaudeContentBlock
+}
+
+// newGeminiStreamTransformer 创建Gemini流式转换器
+func newGeminiStreamTransformer(model string) *GeminiStreamTransformer {
+	return &GeminiStreamTransformer{
+		messageID: fmt.Sprintf("msg_%s", generateRandomID()),
+		model:     model,
+	}
+}
+
+// sendEvent 发送SSE事件
+func (gt *GeminiStreamTransformer) sendEvent(writer gin.ResponseWriter, eventType string, data interface{}) {
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", eventType, jsonData)
+	writer.Flush()
+}
+
+// inputTokens 未命中缓存的输入tokens
+func (gt *GeminiStreamTransformer) inputTokens() int {
+	return gt.usage.PromptTokenCount - gt.usage.CachedContentTokenCount
+}
+
+// outputTokens 输出tokens（思考tokens按输出计费）
+func (gt *GeminiStreamTransformer) outputTokens() int {
+	return gt.usage.CandidatesTokenCount + gt.usage.ThoughtsTokenCount
+}
+
+// processChunk 处理单个Gemini流式chunk，isClientStream为false时只累积结果
+func (gt *GeminiStreamTransformer) processChunk(writer gin.ResponseWriter, chunk GeminiResponse, isClientStream bool) {
+	if chunk.UsageMetadata != nil {
+		gt.usage = *chunk.UsageMetadata
+	}
+
+	if isClientStream && !gt.started {
+		gt.sendEvent(writer, "message_start", map[string]interface{}{
+			"type": "message_start",
+			"message": map[string]interface{}{
+				"id":          gt.messageID,
+				"type":        "message",
+				"role":        "assistant",
+				"model":       gt.model,
+				"content":     []interface{}{},
+				"stop_reason": nil,
+				"usage": map[string]int{
+					"input_tokens":            gt.inputTokens(),
+					"cache_read_input_tokens": gt.usage.CachedContentTokenCount,
+					"output_tokens":           0,
+				},
+			},
+		})
+		gt.started = true
+	}
+
+	if len(chunk.Candidates) == 0 {
+		return
+	}
+	candidate := chunk.Candidates[0]
+	if candidate.FinishReason != "" {
+		gt.finishReason = candidate.FinishReason
+	}
+
+	for _, part := range candidate.Content.Parts {
+		switch {
+		case part.Thought:
+			// 思考内容没有Claude签名，无法回传，直接跳过
+			continue
+		case part.FunctionCall != nil:
+			gt.appendToolUse(writer, part.FunctionCall, isClientStream)
+		case part.Text != "":
+			gt.appendText(writer, part.Text, isClientStream)
+		}
+	}
+}
+
+// appendText 追加文本内容
+func (gt *GeminiStreamTransformer) appendText(writer gin.ResponseWriter, text string, isClientStream bool) {
+	if !gt.textBlockOpen {
+		gt.content = append(gt.content, ClaudeContentBlock{Type: "text"})
+		gt.textBlockOpen = true
+		if isClientStream {
+			gt.sendEvent(writer, "content_block_start", map[string]interface{}{
+				"type":  "content_block_start",
+				"index": gt.contentBlockIndex,
+				"content_block": map[string]interface{}{
+					"type": "text",
+					"text": "",
+				},
+			})
+		}
+	}
+
+	gt.content[len(gt.content)-1].Text += text
+	if isClientStream {
+		gt.sendEvent(writer, "content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": gt.contentBlockIndex,
+			"delta": map[string]interface{}{
+				"type": "text_delta",
+				"text": text,
+			},
+		})
+	}
+}
+
+// appendToolUse 追加工具调用，Gemini一次返回完整的函数调用参数
+func (gt *GeminiStreamTransformer) appendToolUse(writer gin.ResponseWriter, call *GeminiFunctionCall, isClientStream bool) {
+	gt.closeTextBlock(writer, isClientStream)
+
+	args := call.Args
+	if args == nil {
+		args = make(map[string]interface{})
+	}
+	toolUseID := "toolu_" + generateRandomID()
+	gt.content = append(gt.content, ClaudeContentBlock{
+		Type:  "tool_use",
+		ID:    toolUseID,
+		Name:  call.Name,
+		Input: args,
+	})
+	gt.hasToolUse = true
+
+	if isClientStream {
+		argsJSON, _ := json.Marshal(args)
+		gt.sendEvent(writer, "content_block_start", map[string]interface{}{
+			"type":  "content_block_start",
+			"index": gt.contentBlockIndex,
+			"content_block": map[string]interface{}{
+				"type":  "tool_use",
+				"id":    toolUseID,
+				"name":  call.Name,
+				"input": map[string]interface{}{},
+			},
+		})
+		gt.sendEvent(writer, "content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": gt.contentBlockIndex,
+			"delta": map[string]interface{}{
+				"type":         "input_json_delta",
+				"partial_json": string(argsJSON),
+			},
+		})
+		gt.sendEvent(writer, "content_block_stop", map[string]interface{}{
+			"type":  "content_block_stop",
+			"index": gt.contentBlockIndex,
+		})
+	}
+	gt.contentBlockIndex++
+}
+
+// closeTextBlock 结束当前文本块
+func (gt *GeminiStreamTransformer) closeTextBlock(writer gin.ResponseWriter, isClientStream bool) {
+	if !gt.textBlockOpen {
+		return
+	}
+	if isClientStream {
+		gt.sendEvent(writer, "content_block_stop", map[string]interface{}{
+			"type":  "content_block_stop",
+			"index": gt.contentBlockIndex,
+		})
+	}
+	gt.textBlockOpen = false
+	gt.contentBlockIndex++
+}
+
+// sendFinalEvents 发送最终事件
+func (gt *GeminiStreamTransformer) sendFinalEvents(writer gin.ResponseWriter) {
+	gt.closeTextBlock(writer, true)
+
+	gt.sendEvent(writer, "message_delta", map[string]interface{}{
+		"type": "message_delta",
+		"delta": map[string]interface{}{
+			"stop_reason":   mapGeminiFinishReason(gt.finishReason, gt.hasToolUse),
+			"stop_sequence": nil,
+		},
+		"usage": map[string]int{
+			"output_tokens": gt.outputTokens(),
+		},
+	})
+
+	gt.sendEvent(writer, "message_stop", map[string]interface{}{
+		"type": "message_stop",
+	})
+}
+
+// processGeminiStreamResponse 处理Gemini流式响应并转换为Claude格式
+// 上游没有返回任何内容时不写出响应，返回错误
+func processGeminiStreamResponse(writer gin.ResponseWriter, reader io.Reader, transformer *GeminiStreamTransformer, isClientStream bool) (*common.TokenUsage, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		var chunk GeminiResponse
+		if err := json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &chunk); err != nil {
+			continue // 忽略解析错误的chunk
+		}
+		transformer.processChunk(writer, chunk, isClientStream)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("Gemini stream read failed: %v", err)
+	}
+
+	if !transformer.started && transformer.content == nil && transformer.usage.TotalTokenCount == 0 && transformer.finishReason == "" {
+		return nil, errors.New("Gemini上游返回了空响应")
+	}
+
+	if isClientStream {
+		if transformer.started {
+			transformer.sendFinalEvents(writer)
+		}
+	} else {
+		content := transformer.content
+		if content == nil {
+			content = []ClaudeContentBlock{}
+		}
+		claudeResponse := ClaudeResponse{
+			ID:         transformer.messageID,
+			Type:       "message",
+			Role:       "assistant",
+			Model:      transformer.model,
+			Content:    content,
+			StopReason: mapGeminiFinishReason(transformer.finishReason, transformer.hasToolUse),
+			Usage: ClaudeUsage{
+				InputTokens:          transformer.inputTokens(),
+				OutputTokens:         transformer.outputTokens(),
+				CacheReadInputTokens: transformer.usage.CachedContentTokenCount,
+			},
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		jsonBytes, _ := json.Marshal(claudeResponse)
+		writer.Write(jsonBytes)
+	}
+
+	if transformer.usage.TotalTokenCount == 0 {
+		return nil, nil
+	}
+	return &common.TokenUsage{
+		InputTokens:          transformer.inputTokens(),
+		OutputTokens:         transformer.outputTokens(),
+		CacheReadInputTokens: transformer.usage.CachedContentTokenCount,
+		Model:                transformer.model,
+	}, nil
+}
+
+// TestHandleGeminiRequest 测试Gemini账号连接，返回状态码和错误信息
+func TestHandleGeminiRequest(account *model.Account) (int, string) {
+	var claudeReq ClaudeRequest
+	if err := json.Unmarshal([]byte(GetTestRequestBody(100)), &claudeReq); err != nil {
+		return http.StatusBadRequest, "Failed to parse request JSON: " + err.Error()
+	}
+
+	mappedModelName := applyModelMapping(claudeReq.Model, account.ModelMapping, geminiDefaultModel)
+	geminiBody, err := json.Marshal(convertClaudeToGemini(claudeReq))
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to marshal Gemini request: " + err.Error()
+	}
+
+	req, err := http.NewRequest("POST", buildGeminiURL(account, mappedModelName, false), bytes.NewBuffer(geminiBody))
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to create request: " + err.Error()
+	}
+	setGeminiAPIHeaders(req, account.SecretKey)
+
+	client, err := createGeminiHTTPClient(account, 30*time.Second)
+	if err != nil {
+		return http.StatusInternalServerError, "Invalid proxy URI: " + err.Error()
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return http.StatusInternalServerError, "Request failed: " + err.Error()
+	}
+	defer common.CloseIO(resp.Body)
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, "Failed to read response: " + err.Error()
+	}
+
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode, extractGeminiErrorMessage(bodyBytes, resp.StatusCode)
+	}
+
+	return resp.StatusCode, ""
+}
@@ -0,0 +1,188 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// Anthropic官方批处理接口地址
+	ClaudeMessageBatchesURL = "https://api.anthropic.com/v1/messages/batches"
+)
+
+// SupportsMessageBatches 判断账号平台是否提供Anthropic的Message Batches接口
+func SupportsMessageBatches(account *model.Account) bool {
+	return account.PlatformType == constant.PlatformClaude || account.PlatformType == constant.PlatformClaudeConsole
+}
+
+// OpenMessageBatchRequest 向账号对应的上游发送批处理请求，path为批处理接口下的子路径，调用方负责关闭响应体
+func OpenMessageBatchRequest(ctx context.Context, account *model.Account, method, path string, body []byte) (*http.Response, error) {
+	var requestURL string
+	var headers map[string]string
+
+	switch account.PlatformType {
+	case constant.PlatformClaude:
+		accessToken, err := getValidAccessToken(account)
+		if err != nil {
+			return nil, err
+		}
+		requestURL = ClaudeMessageBatchesURL + path
+		headers = buildClaudeAPIHeaders(accessToken)
+	case constant.PlatformClaudeConsole:
+		requestURL = strings.TrimSuffix(account.RequestURL, "/") + "/v1/messages/batches" + path
+		headers = buildConsoleAPIHeaders(account.SecretKey)
+	default:
+		return nil, errors.New("platform does not support message batches: " + account.PlatformType)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	// 批处理接口不是流式接口
+	req.Header.Del("x-stainless-helper-method")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client, err := createAnthropicHTTPClient(account)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	service.RecordAccountRateLimit(account.ID, resp.Header)
+	return resp, nil
+}
+
+// ForwardMessageBatchRequest 发送批处理请求并读取完整响应，返回上游状态码和响应体
+func ForwardMessageBatchRequest(ctx context.Context, account *model.Account, method, path string, body []byte) (int, []byte, error) {
+	resp, err := OpenMessageBatchRequest(ctx, account, method, path, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer common.CloseIO(resp.Body)
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, responseBody, nil
+}
+
+// PollMessageBatches 查询所有未完成批处理的状态，批处理结束后收取结果并按批处理价格计费
+func PollMessageBatches() {
+	tasks, err := model.GetTasksByTypeAndStatus(constant.TaskTypeMessageBatch, []string{constant.TaskStatusPending, constant.TaskStatusRunning})
+	if err != nil {
+		common.SysError("[BATCH] Failed to query message batch tasks: " + err.Error())
+		return
+	}
+
+	for i := range tasks {
+		pollMessageBatch(&tasks[i])
+	}
+}
+
+// pollMessageBatch 使用创建批处理的账号查询状态，结束后收取结果
+func pollMessageBatch(task *model.Task) {
+	account, err := model.GetAccountByID(task.AccountID)
+	if err != nil {
+		// 批处理只能由创建它的账号访问，账号已删除时无法再收取结果
+		common.SysError(fmt.Sprintf("[BATCH] Account %d of batch %s not found, marking as failed", task.AccountID, task.ExternalID))
+		_, _ = model.ClaimTaskCompletion(task.ID, constant.TaskStatusFailed, task.Result)
+		return
+	}
+
+	ctx := context.Background()
+	statusCode, batch, err := ForwardMessageBatchRequest(ctx, account, http.MethodGet, "/"+task.ExternalID, nil)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[BATCH] Failed to retrieve batch %s: %v", task.ExternalID, err))
+		return
+	}
+	if statusCode == http.StatusNotFound {
+		common.SysError(fmt.Sprintf("[BATCH] Batch %s no longer exists upstream, marking as failed", task.ExternalID))
+		_, _ = model.ClaimTaskCompletion(task.ID, constant.TaskStatusFailed, task.Result)
+		return
+	}
+	if statusCode != http.StatusOK {
+		common.SysError(fmt.Sprintf("[BATCH] Retrieve batch %s returned status %d", task.ExternalID, statusCode))
+		return
+	}
+
+	if gjson.GetBytes(batch, "processing_status").String() != service.MessageBatchStatusEnded {
+		if err := model.UpdateTaskResult(task.ID, string(batch)); err != nil {
+			common.SysError(fmt.Sprintf("[BATCH] Failed to update batch %s: %v", task.ExternalID, err))
+		}
+		return
+	}
+
+	resp, err := OpenMessageBatchRequest(ctx, account, http.MethodGet, "/"+task.ExternalID+"/results", nil)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[BATCH] Failed to fetch results of batch %s: %v", task.ExternalID, err))
+		return
+	}
+	defer common.CloseIO(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		common.SysError(fmt.Sprintf("[BATCH] Fetch results of batch %s returned status %d", task.ExternalID, resp.StatusCode))
+		return
+	}
+
+	// 全部结果计费后才标记完成，读取中断时下次轮询继续收取，已计费的请求按custom_id跳过
+	billed, err := billMessageBatchResults(task, account, resp.Body)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[BATCH] Reading results of batch %s failed after %d billed requests: %v", task.ExternalID, billed, err))
+		return
+	}
+
+	claimed, err := model.ClaimTaskCompletion(task.ID, constant.TaskStatusCompleted, string(batch))
+	if err != nil || !claimed {
+		return
+	}
+	common.SysLog(fmt.Sprintf("[BATCH] Batch %s completed on account %s (ID: %d), billed %d succeeded requests",
+		task.ExternalID, account.Name, account.ID, billed))
+}
+
+// billMessageBatchResults 逐行读取JSONL格式的批处理结果，对成功的请求计费，返回计费的请求数
+func billMessageBatchResults(task *model.Task, account *model.Account, results io.Reader) (int, error) {
+	reader := bufio.NewReader(results)
+	billed := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if gjson.GetBytes(line, "result.type").String() == "succeeded" {
+				usage, _ := common.ParseJSONResponse([]byte(gjson.GetBytes(line, "result.message").Raw))
+				if service.BillMessageBatchResult(task, account, gjson.GetBytes(line, "custom_id").String(), usage) {
+					billed++
+				}
+			}
+		}
+		if err == io.EOF {
+			return billed, nil
+		}
+		if err != nil {
+			return billed, err
+		}
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"claude-code-relay/common"
+	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/service"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
@@ -14,12 +16,17 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
 	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
+// 中转生成的思考签名前缀，OpenAI兼容接口返回的思考内容没有Anthropic签名
+const relayThinkingSignaturePrefix = "relay:"
+
 // Claude API 类型定义
 type ClaudeTool struct {
 	Name        string      `json:"name"`
@@ -36,6 +43,10 @@ type ClaudeContentBlock struct {
 	Input     map[string]interface{} `json:"input,omitempty"`
 	ToolUseID string                 `json:"tool_use_id,omitempty"`
 	Content   interface{}            `json:"content,omitempty"`
+
+	// 扩展思考内容及签名
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
 }
 
 type ClaudeContentSource struct {
@@ -50,8 +61,9 @@ type ClaudeMessage struct {
 }
 
 type ClaudeToolChoice struct {
-	Type string `json:"type"`
-	Name string `json:"name,omitempty"`
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
 }
 
 type ClaudeRequest struct {
@@ -67,6 +79,13 @@ type ClaudeRequest struct {
 	Tools         []ClaudeTool           `json:"tools,omitempty"`
 	ToolChoice    *ClaudeToolChoice      `json:"tool_choice,omitempty"`
 	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+	Thinking      *ClaudeThinking        `json:"thinking,omitempty"`
+}
+
+// ClaudeThinking 扩展思考配置
+type ClaudeThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
 }
 
 // OpenAI API 类型定义
@@ -75,6 +94,10 @@ type OpenAIMessage struct {
 	Content    interface{}      `json:"content"`
 	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
 	ToolCallID string           `json:"tool_call_id,omitempty"`
+
+	// 推理内容，DeepSeek等使用reasoning_content，OpenRouter等使用reasoning
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Reasoning        string `json:"reasoning,omitempty"`
 }
 
 type OpenAIToolCall struct {
@@ -114,6 +137,11 @@ type OpenAIRequest struct {
 	Stream      bool            `json:"stream,omitempty"`
 	Tools       []OpenAITool    `json:"tools,omitempty"`
 	ToolChoice  interface{}     `json:"tool_choice,omitempty"`
+
+	// 推理参数，o系列等模型使用reasoning_effort，Qwen等模型使用enable_thinking和thinking_budget
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	EnableThinking  *bool  `json:"enable_thinking,omitempty"`
+	ThinkingBudget  *int   `json:"thinking_budget,omitempty"`
 }
 
 // OpenAI 响应类型定义
@@ -133,9 +161,14 @@ type OpenAIChoice struct {
 }
 
 type OpenAIUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
+	CompletionTokensDetails *OpenAICompletionDetails `json:"completion_tokens_details,omitempty"`
+}
+
+type OpenAICompletionDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
 }
 
 // Claude 响应类型定义
@@ -150,8 +183,9 @@ type ClaudeResponse struct {
 }
 
 type ClaudeUsage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens,omitempty"`
 }
 
 type OpenAITargetConfig struct {
@@ -159,7 +193,7 @@ type OpenAITargetConfig struct {
 	ModelName string
 }
 
-// HandleOpenAIRequest 处理 OpenAI 请求的中转
+// HandleOpenAIRequest 处理 OpenAI 和 Azure OpenAI 请求的中转
 func HandleOpenAIRequest(c *gin.Context, account *model.Account) {
 	// 记录请求开始时间用于计算耗时
 	startTime := time.Now()
@@ -211,11 +245,30 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account) {
 		ModelName: "gpt-4o",           // 默认模型，会被模型映射覆盖
 	}
 
-	// 应用模型映射
-	mappedModelName := applyModelMapping(claudeReq.Model, account.ModelMapping, targetConfig.ModelName)
+	// 应用模型映射，Azure OpenAI的部署名称由用户自定义，必须通过映射指定
+	mappedModelName, baseModel, err := resolveOpenAITargetModel(account, claudeReq.Model, targetConfig.ModelName)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": map[string]interface{}{
+				"type":    "configuration_error",
+				"message": err.Error(),
+			},
+		})
+		return
+	}
 
 	// 转换Claude请求为OpenAI格式
-	openaiReq := convertClaudeToOpenAI(claudeReq, mappedModelName)
+	openaiReq, err := convertClaudeToOpenAI(claudeReq, mappedModelName, baseModel)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"type": "error",
+			"error": map[string]interface{}{
+				"type":    "invalid_request_error",
+				"message": err.Error(),
+			},
+		})
+		return
+	}
 
 	// 序列化OpenAI请求
 	openaiBody, err := json.Marshal(openaiReq)
@@ -230,7 +283,16 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account) {
 	}
 
 	// 创建OpenAI API请求
-	openaiURL := targetConfig.BaseURL + "/chat/completions"
+	openaiURL, err := openAIChatCompletionsURL(account, mappedModelName)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": map[string]interface{}{
+				"type":    "configuration_error",
+				"message": "账号请求地址无效: " + err.Error(),
+			},
+		})
+		return
+	}
 	req, err := http.NewRequestWithContext(ctx, "POST", openaiURL, bytes.NewBuffer(openaiBody))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -244,7 +306,7 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account) {
 
 	// 设置请求头
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+account.SecretKey)
+	setOpenAIAuthHeader(req, account)
 
 	// 创建HTTP客户端
 	httpClientTimeout, _ := time.ParseDuration(os.Getenv("HTTP_CLIENT_TIMEOUT") + "s")
@@ -252,33 +314,27 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account) {
 		httpClientTimeout = 120 * time.Second
 	}
 
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	// 复用账号的连接池，配置代理
+	var client *http.Client
+	proxyURI, err := upstreamProxyURI(account, account.ProxyURI)
+	if err == nil {
+		client, err = newAccountHTTPClient(account, proxyURI, httpClientTimeout)
 	}
-
-	// 配置代理
-	if account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": map[string]interface{}{
-					"type":    "proxy_configuration_error",
-					"message": "Invalid proxy URI: " + err.Error(),
-				},
-			})
-			return
-		}
-		transport.Proxy = http.ProxyURL(proxyURL)
-	}
-
-	client := &http.Client{
-		Timeout:   httpClientTimeout,
-		Transport: transport,
+	if err != nil {
+		recordUpstreamError(c, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": map[string]interface{}{
+				"type":    "proxy_configuration_error",
+				"message": "Invalid proxy configuration: " + err.Error(),
+			},
+		})
+		return
 	}
 
 	// 发送请求
-	resp, err := client.Do(req)
+	resp, err := doUpstream(c, client, req, account)
 	if err != nil {
+		recordUpstreamError(c, err)
 		log.Printf("OpenAI API request failed: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": map[string]interface{}{
@@ -290,11 +346,14 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account) {
 	}
 	defer common.CloseIO(resp.Body)
 
+	recordUpstreamStatus(c, resp.StatusCode)
+
 	// 检查响应状态
 	accountService := service.NewAccountService()
 	if resp.StatusCode >= 400 {
-		accountService.UpdateAccountStatus(account, resp.StatusCode, nil)
 		bodyBytes, _ := io.ReadAll(resp.Body)
+		recordUpstreamErrorBody(c, bodyBytes)
+		accountService.UpdateAccountErrorStatus(account, resp.StatusCode, bodyBytes)
 		c.Data(resp.StatusCode, "application/json", bodyBytes)
 		return
 	}
@@ -303,6 +362,23 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account) {
 	handleStreamingResponse(c, resp, claudeReq.Model, claudeReq.Stream, account, apiKey, startTime)
 }
 
+// openAIChatCompletionsURL 获取账号的对话接口地址，Azure OpenAI按部署名称拼接地址
+func openAIChatCompletionsURL(account *model.Account, modelName string) (string, error) {
+	if account.PlatformType == constant.PlatformAzureOpenAI {
+		return azureChatCompletionsURL(account.RequestURL, modelName)
+	}
+	return account.RequestURL + "/chat/completions", nil
+}
+
+// setOpenAIAuthHeader 设置鉴权请求头，Azure OpenAI使用api-key请求头
+func setOpenAIAuthHeader(req *http.Request, account *model.Account) {
+	if account.PlatformType == constant.PlatformAzureOpenAI {
+		req.Header.Set("api-key", account.SecretKey)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+account.SecretKey)
+}
+
 // extractSystemMessage 从system字段中提取系统消息文本
 // 支持字符串和数组格式的system字段
 func extractSystemMessage(systemField interface{}) string {
@@ -336,35 +412,58 @@ func extractSystemMessage(systemField interface{}) string {
 	}
 }
 
-// applyModelMapping 应用模型映射配置
-// 格式: claude-haiku-20250303:gpt-4o-mini,claude-sonnet:gpt-4o
-// 如果没有找到映射，返回默认的目标模型名称
-func applyModelMapping(claudeModel, modelMapping, defaultTargetModel string) string {
-	if modelMapping == "" {
-		return defaultTargetModel
+// resolveOpenAITargetModel 按模型映射确定上游模型，返回上游模型（Azure OpenAI为部署名称）和用于判断模型能力的基础模型
+// Azure OpenAI账号没有匹配的映射时返回配置错误，其他账号使用默认模型
+func resolveOpenAITargetModel(account *model.Account, claudeModel, defaultTargetModel string) (string, string, error) {
+	target, baseModel, ok := lookupModelMapping(claudeModel, account.ModelMapping)
+	if ok {
+		return target, baseModel, nil
+	}
+	if account.PlatformType == constant.PlatformAzureOpenAI {
+		return "", "", fmt.Errorf("Azure OpenAI账号未配置模型 %s 对应的部署名称，请在模型映射中配置", claudeModel)
 	}
+	return defaultTargetModel, "", nil
+}
 
-	// 解析映射配置
-	mappings := strings.Split(modelMapping, ",")
-	for _, mapping := range mappings {
+// lookupModelMapping 查找源模型对应的映射，格式为 源模型:目标模型 或 源模型:目标模型:基础模型
+// 基础模型用于Azure OpenAI等目标名称不能体现实际模型的场景，决定推理参数等模型能力
+func lookupModelMapping(claudeModel, modelMapping string) (string, string, bool) {
+	for _, mapping := range strings.Split(modelMapping, ",") {
 		mapping = strings.TrimSpace(mapping)
 		if mapping == "" {
 			continue
 		}
 
 		parts := strings.Split(mapping, ":")
-		if len(parts) != 2 {
+		if len(parts) != 2 && len(parts) != 3 {
 			continue
 		}
 
 		sourceModel := strings.TrimSpace(parts[0])
 		targetModel := strings.TrimSpace(parts[1])
+		if sourceModel == "" || targetModel == "" {
+			continue
+		}
 
 		// 支持模糊匹配，只要包含关键字就匹配
-		if strings.Contains(claudeModel, sourceModel) || claudeModel == sourceModel {
-			return targetModel
+		if strings.Contains(claudeModel, sourceModel) {
+			var baseModel string
+			if len(parts) == 3 {
+				baseModel = strings.TrimSpace(parts[2])
+			}
+			return targetModel, baseModel, true
 		}
 	}
+	return "", "", false
+}
+
+// applyModelMapping 应用模型映射配置
+// 格式: claude-haiku-20250303:gpt-4o-mini,claude-sonnet:gpt-4o
+// 如果没有找到映射，返回默认的目标模型名称
+func applyModelMapping(claudeModel, modelMapping, defaultTargetModel string) string {
+	if targetModel, _, ok := lookupModelMapping(claudeModel, modelMapping); ok {
+		return targetModel
+	}
 
 	// 如果没有找到映射，返回默认目标模型
 	return defaultTargetModel
@@ -414,8 +513,15 @@ func recursivelyCleanSchema(schema interface{}) interface{} {
 }
 
 // convertClaudeToOpenAI 将Claude请求转换为OpenAI格式
-func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequest {
+// baseModel为目标模型对应的基础模型，用于判断图片和推理参数等模型能力，为空时使用modelName
+func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName, baseModel string) (OpenAIRequest, error) {
+	capabilityModel := modelName
+	if baseModel != "" {
+		capabilityModel = baseModel
+	}
+
 	var openaiMessages []OpenAIMessage
+	contentConverter := newClaudeContentConverter(capabilityModel)
 
 	// 添加system消息（支持字符串和数组格式）
 	systemMessage := extractSystemMessage(claudeReq.System)
@@ -427,7 +533,8 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 	}
 
 	// 转换消息
-	for _, message := range claudeReq.Messages {
+	turnStart := currentTurnStart(claudeReq.Messages)
+	for i, message := range claudeReq.Messages {
 		if message.Role == "user" {
 			// 处理用户消息
 			if contentBlocks, ok := message.Content.([]interface{}); ok {
@@ -444,17 +551,32 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 					}
 				}
 
-				// 添加工具结果消息
+				// 添加工具结果消息，tool消息只支持文本，工具结果中的图片和文档放到随后的用户消息中
+				var toolMediaContent []map[string]interface{}
 				for _, result := range toolResults {
 					if resultMap, ok := result.(map[string]interface{}); ok {
 						var content string
-						if resultMap["content"] != nil {
-							if str, ok := resultMap["content"].(string); ok {
-								content = str
-							} else {
-								contentBytes, _ := json.Marshal(resultMap["content"])
-								content = string(contentBytes)
+						switch resultContent := resultMap["content"].(type) {
+						case string:
+							content = resultContent
+						case []interface{}:
+							parts, err := contentConverter.convertBlocks(resultContent)
+							if err != nil {
+								return OpenAIRequest{}, err
 							}
+							var texts []string
+							for _, part := range parts {
+								if part["type"] == "text" {
+									texts = append(texts, part["text"].(string))
+								} else {
+									toolMediaContent = append(toolMediaContent, part)
+								}
+							}
+							content = strings.Join(texts, "\n")
+						case nil:
+						default:
+							contentBytes, _ := json.Marshal(resultContent)
+							content = string(contentBytes)
 						}
 
 						openaiMessages = append(openaiMessages, OpenAIMessage{
@@ -466,28 +588,12 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 				}
 
 				// 添加其他用户内容
-				if len(otherContent) > 0 {
-					var convertedContent []map[string]interface{}
-					for _, block := range otherContent {
-						if blockMap, ok := block.(map[string]interface{}); ok {
-							if blockMap["type"] == "text" {
-								convertedContent = append(convertedContent, map[string]interface{}{
-									"type": "text",
-									"text": blockMap["text"],
-								})
-							} else if blockMap["type"] == "image" {
-								if source, ok := blockMap["source"].(map[string]interface{}); ok {
-									imageURL := fmt.Sprintf("data:%s;base64,%s", source["media_type"], source["data"])
-									convertedContent = append(convertedContent, map[string]interface{}{
-										"type": "image_url",
-										"image_url": map[string]string{
-											"url": imageURL,
-										},
-									})
-								}
-							}
-						}
-					}
+				convertedContent, err := contentConverter.convertBlocks(otherContent)
+				if err != nil {
+					return OpenAIRequest{}, err
+				}
+				convertedContent = append(toolMediaContent, convertedContent...)
+				if len(convertedContent) > 0 {
 					openaiMessages = append(openaiMessages, OpenAIMessage{
 						Role:    "user",
 						Content: convertedContent,
@@ -503,6 +609,7 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 		} else if message.Role == "assistant" {
 			// 处理助手消息
 			var textParts []string
+			var thinkingParts []string
 			var toolCalls []OpenAIToolCall
 
 			if contentBlocks, ok := message.Content.([]interface{}); ok {
@@ -510,6 +617,10 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 					if blockMap, ok := block.(map[string]interface{}); ok {
 						if blockMap["type"] == "text" {
 							textParts = append(textParts, blockMap["text"].(string))
+						} else if blockMap["type"] == "thinking" {
+							if thinking, ok := blockMap["thinking"].(string); ok && thinking != "" {
+								thinkingParts = append(thinkingParts, thinking)
+							}
 						} else if blockMap["type"] == "tool_use" {
 							arguments := "{}"
 							if blockMap["input"] != nil {
@@ -536,6 +647,10 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 			}
 			if len(toolCalls) > 0 {
 				assistantMessage.ToolCalls = toolCalls
+				// 当前轮次工具调用过程中的推理内容需要回传（DeepSeek等要求），之前轮次的推理内容不回传
+				if i >= turnStart && len(thinkingParts) > 0 {
+					assistantMessage.ReasoningContent = strings.Join(thinkingParts, "\n")
+				}
 			}
 			if assistantMessage.Content == "" {
 				assistantMessage.Content = nil
@@ -555,6 +670,9 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 		Stop:        claudeReq.StopSequences,
 	}
 
+	// 转换扩展思考配置
+	applyThinkingConfig(&openaiReq, claudeReq.Thinking, capabilityModel)
+
 	// 转换工具
 	if len(claudeReq.Tools) > 0 {
 		for _, tool := range claudeReq.Tools {
@@ -584,7 +702,139 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 		}
 	}
 
-	return openaiReq
+	return openaiReq, nil
+}
+
+// currentTurnStart 返回当前轮次的起始位置，即最后一条非工具结果的用户消息
+func currentTurnStart(messages []ClaudeMessage) int {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role != "user" {
+			continue
+		}
+		contentBlocks, ok := messages[i].Content.([]interface{})
+		if !ok {
+			return i
+		}
+		for _, block := range contentBlocks {
+			if blockMap, ok := block.(map[string]interface{}); ok && blockMap["type"] != "tool_result" {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// applyThinkingConfig 将Claude的思考预算映射为上游模型的推理参数
+// o系列、GPT-5等模型使用reasoning_effort，Qwen系列使用enable_thinking和thinking_budget，
+// DeepSeek等推理模型默认输出推理内容，不需要额外参数；modelName为判断模型能力使用的模型名称
+func applyThinkingConfig(openaiReq *OpenAIRequest, thinking *ClaudeThinking, modelName string) {
+	enabled := thinking != nil && thinking.Type == "enabled"
+	modelName = strings.ToLower(modelName)
+	if idx := strings.LastIndex(modelName, "/"); idx >= 0 {
+		modelName = modelName[idx+1:]
+	}
+
+	switch {
+	case strings.HasPrefix(modelName, "qwen"):
+		// 未指定thinking时保持上游模型的默认行为
+		if thinking == nil {
+			return
+		}
+		openaiReq.EnableThinking = &enabled
+		if enabled && thinking.BudgetTokens > 0 {
+			budget := thinking.BudgetTokens
+			openaiReq.ThinkingBudget = &budget
+		}
+	case isReasoningEffortModel(modelName):
+		if !enabled {
+			return
+		}
+		openaiReq.ReasoningEffort = mapReasoningEffort(thinking.BudgetTokens)
+		// o系列模型不支持自定义temperature和top_p
+		if strings.HasPrefix(modelName, "o") {
+			openaiReq.Temperature = nil
+			openaiReq.TopP = nil
+		}
+	}
+}
+
+// isReasoningEffortModel 判断模型是否支持reasoning_effort参数
+func isReasoningEffortModel(modelName string) bool {
+	for _, prefix := range []string{"o1", "o3", "o4", "gpt-5", "grok-3-mini", "gemini-2.5"} {
+		if strings.HasPrefix(modelName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapReasoningEffort 按思考预算映射推理强度
+func mapReasoningEffort(budgetTokens int) string {
+	switch {
+	case budgetTokens < 4096:
+		return "low"
+	case budgetTokens < 16384:
+		return "medium"
+	default:
+		return "high"
+	}
+}
+
+// thinkingSignature 生成思考内容的签名，OpenAI兼容接口不返回签名，使用带中转前缀的思考内容摘要代替
+// 这类签名不是Anthropic签发的，转发到Anthropic平台前由stripRelayThinkingBlocks移除
+func thinkingSignature(thinking string) string {
+	sum := sha256.Sum256([]byte(thinking))
+	return relayThinkingSignaturePrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// stripRelayThinkingBlocks 移除请求历史消息中由中转生成签名的思考块，避免Anthropic校验签名失败
+// 只包含这类思考块的助手消息整条移除，上游不接受内容为空的消息
+func stripRelayThinkingBlocks(body []byte) []byte {
+	messages := gjson.GetBytes(body, "messages").Array()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Get("role").String() != "assistant" {
+			continue
+		}
+		blocks := messages[i].Get("content").Array()
+		removed := 0
+		for j := len(blocks) - 1; j >= 0; j-- {
+			if blocks[j].Get("type").String() != "thinking" ||
+				!strings.HasPrefix(blocks[j].Get("signature").String(), relayThinkingSignaturePrefix) {
+				continue
+			}
+			if stripped, err := sjson.DeleteBytes(body, fmt.Sprintf("messages.%d.content.%d", i, j)); err == nil {
+				body = stripped
+				removed++
+			}
+		}
+		if removed > 0 && removed == len(blocks) {
+			if stripped, err := sjson.DeleteBytes(body, fmt.Sprintf("messages.%d", i)); err == nil {
+				body = stripped
+			}
+		}
+	}
+	return body
+}
+
+// reasoningDelta 提取推理内容增量，DeepSeek等使用reasoning_content，OpenRouter等使用reasoning
+func reasoningDelta(delta map[string]interface{}) string {
+	if reasoning, ok := delta["reasoning_content"].(string); ok && reasoning != "" {
+		return reasoning
+	}
+	if reasoning, ok := delta["reasoning"].(string); ok {
+		return reasoning
+	}
+	return ""
+}
+
+// reasoningTokens 提取usage中的推理tokens数量
+func reasoningTokens(usage map[string]interface{}) int {
+	if details, ok := usage["completion_tokens_details"].(map[string]interface{}); ok {
+		if tokens, ok := details["reasoning_tokens"].(float64); ok {
+			return int(tokens)
+		}
+	}
+	return 0
 }
 
 // convertOpenAIToClaudeResponse 将OpenAI响应转换为Claude格式
@@ -594,6 +844,19 @@ func convertOpenAIToClaudeResponse(openaiResp OpenAIResponse, model string) Clau
 	if len(openaiResp.Choices) > 0 {
 		choice := openaiResp.Choices[0]
 
+		// 添加思考内容
+		reasoning := choice.Message.ReasoningContent
+		if reasoning == "" {
+			reasoning = choice.Message.Reasoning
+		}
+		if reasoning != "" {
+			contentBlocks = append(contentBlocks, ClaudeContentBlock{
+				Type:      "thinking",
+				Thinking:  reasoning,
+				Signature: thinkingSignature(reasoning),
+			})
+		}
+
 		// 添加文本内容
 		if choice.Message.Content != nil {
 			if content, ok := choice.Message.Content.(string); ok && content != "" {
@@ -685,8 +948,9 @@ func handleStreamingResponse(c *gin.Context, resp *http.Response, model string,
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 && apiKey != nil {
 		duration := time.Since(startTime).Milliseconds()
 		logService := service.NewLogService()
+		meta := buildLogMeta(c)
 		go func() {
-			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isClientStream)
+			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isClientStream, meta)
 			if err != nil {
 				log.Printf("保存日志失败: %v", err)
 			}
@@ -698,8 +962,9 @@ func handleStreamingResponse(c *gin.Context, resp *http.Response, model string,
 func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, transformer *StreamTransformer, isClientStream bool) *common.TokenUsage {
 	scanner := bufio.NewScanner(reader)
 
-	var totalPromptTokens, totalCompletionTokens int
+	var totalPromptTokens, totalCompletionTokens, totalReasoningTokens int
 	var responseContent strings.Builder
+	var reasoningContent strings.Builder
 	var toolCalls []OpenAIToolCall
 	var finishReason string
 
@@ -735,6 +1000,7 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 			if completionTokens, ok := usage["completion_tokens"].(float64); ok {
 				totalCompletionTokens = int(completionTokens)
 			}
+			totalReasoningTokens = reasoningTokens(usage)
 		}
 
 		// 处理流式数据
@@ -746,6 +1012,11 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 				}
 
 				if delta, ok := choice["delta"].(map[string]interface{}); ok {
+					// 收集推理内容，与流式输出一致，文本开始后的推理内容不再收集
+					if responseContent.Len() == 0 {
+						reasoningContent.WriteString(reasoningDelta(delta))
+					}
+
 					// 收集文本内容
 					if content, ok := delta["content"].(string); ok {
 						responseContent.WriteString(content)
@@ -794,6 +1065,15 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 		// 构建Claude格式的内容块
 		var contentBlocks []ClaudeContentBlock
 
+		// 添加思考内容
+		if reasoningContent.Len() > 0 {
+			contentBlocks = append(contentBlocks, ClaudeContentBlock{
+				Type:      "thinking",
+				Thinking:  reasoningContent.String(),
+				Signature: thinkingSignature(reasoningContent.String()),
+			})
+		}
+
 		// 添加文本内容
 		if responseContent.Len() > 0 {
 			contentBlocks = append(contentBlocks, ClaudeContentBlock{
@@ -855,9 +1135,10 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 	// 返回token使用统计
 	if totalPromptTokens > 0 || totalCompletionTokens > 0 {
 		return &common.TokenUsage{
-			InputTokens:  totalPromptTokens,
-			OutputTokens: totalCompletionTokens,
-			Model:        transformer.model,
+			InputTokens:     totalPromptTokens,
+			OutputTokens:    totalCompletionTokens,
+			Model:           transformer.model,
+			ReasoningTokens: totalReasoningTokens,
 		}
 	}
 
@@ -871,6 +1152,13 @@ type StreamTransformer struct {
 	model             string
 	toolCalls         map[int]*ToolCallState
 	contentBlockIndex int
+
+	// 思考块和文本块状态，思考块在文本块之前输出
+	thinking      strings.Builder
+	thinkingOpen  bool
+	thinkingIndex int
+	textStarted   bool
+	textIndex     int
 }
 
 // ToolCallState 工具调用状态
@@ -930,15 +1218,6 @@ func (st *StreamTransformer) processChunk(writer gin.ResponseWriter, openaiChunk
 			},
 		})
 
-		st.sendEvent(writer, "content_block_start", map[string]interface{}{
-			"type":  "content_block_start",
-			"index": 0,
-			"content_block": map[string]interface{}{
-				"type": "text",
-				"text": "",
-			},
-		})
-
 		st.initialized = true
 	}
 
@@ -946,11 +1225,17 @@ func (st *StreamTransformer) processChunk(writer gin.ResponseWriter, openaiChunk
 	if choices, ok := openaiChunk["choices"].([]interface{}); ok && len(choices) > 0 {
 		if choice, ok := choices[0].(map[string]interface{}); ok {
 			if delta, ok := choice["delta"].(map[string]interface{}); ok {
-				// 处理文本内容
-				if content, ok := delta["content"].(string); ok {
+				// 处理推理内容
+				if reasoning := reasoningDelta(delta); reasoning != "" {
+					st.appendThinking(writer, reasoning)
+				}
+
+				// 处理文本内容，推理阶段的空文本不开启文本块
+				if content, ok := delta["content"].(string); ok && (content != "" || st.textStarted) {
+					st.ensureTextBlock(writer)
 					st.sendEvent(writer, "content_block_delta", map[string]interface{}{
 						"type":  "content_block_delta",
-						"index": 0,
+						"index": st.textIndex,
 						"delta": map[string]interface{}{
 							"type": "text_delta",
 							"text": content,
@@ -971,6 +1256,82 @@ func (st *StreamTransformer) processChunk(writer gin.ResponseWriter, openaiChunk
 	}
 }
 
+// nextBlockIndex 分配下一个内容块索引
+func (st *StreamTransformer) nextBlockIndex() int {
+	index := st.contentBlockIndex
+	st.contentBlockIndex++
+	return index
+}
+
+// appendThinking 输出推理内容增量
+// 思考块必须位于文本块之前，文本开始后的推理内容不再输出，非流式响应按相同规则聚合
+func (st *StreamTransformer) appendThinking(writer gin.ResponseWriter, reasoning string) {
+	if st.textStarted {
+		return
+	}
+	if !st.thinkingOpen {
+		st.thinkingIndex = st.nextBlockIndex()
+		st.thinkingOpen = true
+		st.sendEvent(writer, "content_block_start", map[string]interface{}{
+			"type":  "content_block_start",
+			"index": st.thinkingIndex,
+			"content_block": map[string]interface{}{
+				"type":      "thinking",
+				"thinking":  "",
+				"signature": "",
+			},
+		})
+	}
+
+	st.thinking.WriteString(reasoning)
+	st.sendEvent(writer, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": st.thinkingIndex,
+		"delta": map[string]interface{}{
+			"type":     "thinking_delta",
+			"thinking": reasoning,
+		},
+	})
+}
+
+// closeThinkingBlock 发送思考签名并结束思考块
+func (st *StreamTransformer) closeThinkingBlock(writer gin.ResponseWriter) {
+	if !st.thinkingOpen {
+		return
+	}
+	st.sendEvent(writer, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": st.thinkingIndex,
+		"delta": map[string]interface{}{
+			"type":      "signature_delta",
+			"signature": thinkingSignature(st.thinking.String()),
+		},
+	})
+	st.sendEvent(writer, "content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": st.thinkingIndex,
+	})
+	st.thinkingOpen = false
+}
+
+// ensureTextBlock 结束思考块并开启文本块
+func (st *StreamTransformer) ensureTextBlock(writer gin.ResponseWriter) {
+	if st.textStarted {
+		return
+	}
+	st.closeThinkingBlock(writer)
+	st.textIndex = st.nextBlockIndex()
+	st.textStarted = true
+	st.sendEvent(writer, "content_block_start", map[string]interface{}{
+		"type":  "content_block_start",
+		"index": st.textIndex,
+		"content_block": map[string]interface{}{
+			"type": "text",
+			"text": "",
+		},
+	})
+}
+
 // processToolCallDelta 处理工具调用增量
 func (st *StreamTransformer) processToolCallDelta(writer gin.ResponseWriter, tcDelta map[string]interface{}) {
 	index := int(tcDelta["index"].(float64))
@@ -1004,8 +1365,8 @@ func (st *StreamTransformer) processToolCallDelta(writer gin.ResponseWriter, tcD
 
 	// 如果工具调用准备就绪且未开始，发送开始事件
 	if toolCall.ID != "" && toolCall.Name != "" && !toolCall.Started {
-		st.contentBlockIndex++
-		toolCall.ClaudeIndex = st.contentBlockIndex
+		st.ensureTextBlock(writer)
+		toolCall.ClaudeIndex = st.nextBlockIndex()
 		toolCall.Started = true
 
 		st.sendEvent(writer, "content_block_start", map[string]interface{}{
@@ -1040,9 +1401,10 @@ func (st *StreamTransformer) processToolCallDelta(writer gin.ResponseWriter, tcD
 // sendFinalEvents 发送最终事件
 func (st *StreamTransformer) sendFinalEvents(writer gin.ResponseWriter) {
 	// 发送内容块结束事件
+	st.ensureTextBlock(writer)
 	st.sendEvent(writer, "content_block_stop", map[string]interface{}{
 		"type":  "content_block_stop",
-		"index": 0,
+		"index": st.textIndex,
 	})
 
 	// 发送所有工具调用的结束事件
@@ -1094,10 +1456,16 @@ func TestHandleOpenAIRequest(account *model.Account) (int, string) {
 	}
 
 	// 应用模型映射
-	mappedModelName := applyModelMapping(claudeReq.Model, account.ModelMapping, targetConfig.ModelName)
+	mappedModelName, baseModel, err := resolveOpenAITargetModel(account, claudeReq.Model, targetConfig.ModelName)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
 
 	// 转换Claude请求为OpenAI格式
-	openaiReq := convertClaudeToOpenAI(claudeReq, mappedModelName)
+	openaiReq, err := convertClaudeToOpenAI(claudeReq, mappedModelName, baseModel)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
 
 	// 序列化OpenAI请求
 	openaiBody, err := json.Marshal(openaiReq)
@@ -1106,7 +1474,10 @@ func TestHandleOpenAIRequest(account *model.Account) (int, string) {
 	}
 
 	// 创建OpenAI API请求
-	openaiURL := targetConfig.BaseURL + "/chat/completions"
+	openaiURL, err := openAIChatCompletionsURL(account, mappedModelName)
+	if err != nil {
+		return http.StatusBadRequest, "账号请求地址无效: " + err.Error()
+	}
 	req, err := http.NewRequest("POST", openaiURL, bytes.NewBuffer(openaiBody))
 	if err != nil {
 		return http.StatusInternalServerError, "Failed to create request: " + err.Error()
@@ -1114,26 +1485,16 @@ func TestHandleOpenAIRequest(account *model.Account) (int, string) {
 
 	// 设置请求头
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+account.SecretKey)
+	setOpenAIAuthHeader(req, account)
 
 	// 创建HTTP客户端
-	httpClientTimeout := 30 * time.Second
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	// 配置代理
-	if account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err != nil {
-			return http.StatusInternalServerError, "Invalid proxy URI: " + err.Error()
-		}
-		transport.Proxy = http.ProxyURL(proxyURL)
+	proxyURI, err := upstreamProxyURI(account, account.ProxyURI)
+	if err != nil {
+		return http.StatusInternalServerError, "Invalid proxy configuration: " + err.Error()
 	}
-
-	client := &http.Client{
-		Timeout:   httpClientTimeout,
-		Transport: transport,
+	client, err := newAccountHTTPClient(account, proxyURI, 30*time.Second)
+	if err != nil {
+		return http.StatusInternalServerError, "Invalid proxy URI: " + err.Error()
 	}
 
 	// 发送请求
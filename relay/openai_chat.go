@@ -0,0 +1,802 @@
+package relay
+
+import (
+	"bytes"
+	"claude-code-relay/constant"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// Chat Completions 未指定max_tokens时使用的默认值（Claude要求必填）
+	openAIChatDefaultMaxTokens = 4096
+	// Claude的temperature取值范围为0~1
+	claudeMaxTemperature = 1.0
+)
+
+// OpenAIChatRequest OpenAI Chat Completions入站请求
+type OpenAIChatRequest struct {
+	Model               string               `json:"model"`
+	Messages            []OpenAIMessage      `json:"messages"`
+	MaxTokens           *int                 `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int                 `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64             `json:"temperature,omitempty"`
+	TopP                *float64             `json:"top_p,omitempty"`
+	Stop                interface{}          `json:"stop,omitempty"`
+	Stream              bool                 `json:"stream,omitempty"`
+	StreamOptions       *OpenAIStreamOptions `json:"stream_options,omitempty"`
+	Tools               []OpenAITool         `json:"tools,omitempty"`
+	ToolChoice          interface{}          `json:"tool_choice,omitempty"`
+	ParallelToolCalls   *bool                `json:"parallel_tool_calls,omitempty"`
+	User                string               `json:"user,omitempty"`
+}
+
+// OpenAIStreamOptions 流式响应选项
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// claudeTurn 转换过程中的一条Claude消息，相邻同角色消息会被合并
+type claudeTurn struct {
+	role   string
+	blocks []map[string]interface{}
+}
+
+// ConvertOpenAIChatRequest 将OpenAI Chat Completions请求转换为Claude Messages请求体
+func ConvertOpenAIChatRequest(body []byte) ([]byte, *OpenAIChatRequest, error) {
+	var chatReq OpenAIChatRequest
+	if err := json.Unmarshal(body, &chatReq); err != nil {
+		return nil, nil, fmt.Errorf("invalid request body: %w", err)
+	}
+	if chatReq.Model == "" {
+		return nil, nil, errors.New("model is required")
+	}
+	if len(chatReq.Messages) == 0 {
+		return nil, nil, errors.New("messages is required")
+	}
+
+	// 账号池中的官方账号只接受Claude Code请求，系统提示词需要以Claude Code提示词开头
+	system := []map[string]interface{}{{"type": "text", "text": constant.ClaudeCodeSystemPrompt}}
+	var turns []claudeTurn
+	appendTurn := func(role string, blocks []map[string]interface{}) {
+		if len(blocks) == 0 {
+			return
+		}
+		if n := len(turns); n > 0 && turns[n-1].role == role {
+			turns[n-1].blocks = append(turns[n-1].blocks, blocks...)
+			return
+		}
+		turns = append(turns, claudeTurn{role: role, blocks: blocks})
+	}
+
+	for _, msg := range chatReq.Messages {
+		switch msg.Role {
+		case "system", "developer":
+			for _, text := range extractOpenAITextParts(msg.Content) {
+				system = append(system, map[string]interface{}{"type": "text", "text": text})
+			}
+		case "user":
+			blocks, err := convertOpenAIContentParts(msg.Content)
+			if err != nil {
+				return nil, nil, err
+			}
+			appendTurn("user", blocks)
+		case "assistant":
+			blocks, err := convertOpenAIContentParts(msg.Content)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, toolCall := range msg.ToolCalls {
+				input := map[string]interface{}{}
+				if toolCall.Function.Arguments != "" {
+					if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &input); err != nil || input == nil {
+						input = map[string]interface{}{}
+					}
+				}
+				blocks = append(blocks, map[string]interface{}{
+					"type":  "tool_use",
+					"id":    toolCall.ID,
+					"name":  toolCall.Function.Name,
+					"input": input,
+				})
+			}
+			appendTurn("assistant", blocks)
+		case "tool":
+			// 工具结果中的图片和文件转换为tool_result的内容块，纯文本结果保持字符串格式
+			blocks, err := convertOpenAIContentParts(msg.Content)
+			if err != nil {
+				return nil, nil, err
+			}
+			var content interface{} = strings.Join(extractOpenAITextParts(msg.Content), "\n")
+			for _, block := range blocks {
+				if block["type"] != "text" {
+					content = blocks
+					break
+				}
+			}
+			appendTurn("user", []map[string]interface{}{{
+				"type":        "tool_result",
+				"tool_use_id": msg.ToolCallID,
+				"content":     content,
+			}})
+		default:
+			return nil, nil, fmt.Errorf("unsupported message role: %s", msg.Role)
+		}
+	}
+
+	if len(turns) == 0 {
+		return nil, nil, errors.New("messages must contain at least one user message")
+	}
+
+	claudeReq := ClaudeRequest{
+		Model:       chatReq.Model,
+		System:      system,
+		MaxTokens:   openAIChatDefaultMaxTokens,
+		Stream:      chatReq.Stream,
+		Temperature: chatReq.Temperature,
+		TopP:        chatReq.TopP,
+	}
+	for _, turn := range turns {
+		claudeReq.Messages = append(claudeReq.Messages, ClaudeMessage{Role: turn.role, Content: turn.blocks})
+	}
+
+	if chatReq.MaxCompletionTokens != nil && *chatReq.MaxCompletionTokens > 0 {
+		claudeReq.MaxTokens = *chatReq.MaxCompletionTokens
+	} else if chatReq.MaxTokens != nil && *chatReq.MaxTokens > 0 {
+		claudeReq.MaxTokens = *chatReq.MaxTokens
+	}
+
+	if claudeReq.Temperature != nil && *claudeReq.Temperature > claudeMaxTemperature {
+		temperature := claudeMaxTemperature
+		claudeReq.Temperature = &temperature
+	}
+
+	switch stop := chatReq.Stop.(type) {
+	case string:
+		if stop != "" {
+			claudeReq.StopSequences = []string{stop}
+		}
+	case []interface{}:
+		for _, item := range stop {
+			if str, ok := item.(string); ok && str != "" {
+				claudeReq.StopSequences = append(claudeReq.StopSequences, str)
+			}
+		}
+	}
+
+	for _, tool := range chatReq.Tools {
+		if tool.Type != "" && tool.Type != "function" {
+			continue
+		}
+		schema := tool.Function.Parameters
+		if schema == nil {
+			schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		claudeReq.Tools = append(claudeReq.Tools, ClaudeTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: schema,
+		})
+	}
+
+	if len(claudeReq.Tools) > 0 {
+		claudeReq.ToolChoice = convertOpenAIToolChoice(chatReq.ToolChoice)
+		if chatReq.ParallelToolCalls != nil && !*chatReq.ParallelToolCalls {
+			claudeReq.ToolChoice.DisableParallelToolUse = true
+		}
+	}
+
+	if chatReq.User != "" {
+		claudeReq.Metadata = map[string]interface{}{"user_id": chatReq.User}
+	}
+
+	claudeBody, err := json.Marshal(claudeReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	return claudeBody, &chatReq, nil
+}
+
+// extractOpenAITextParts 提取消息内容中的文本，支持字符串和内容数组格式
+func extractOpenAITextParts(content interface{}) []string {
+	switch v := content.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		var texts []string
+		for _, item := range v {
+			if part, ok := item.(map[string]interface{}); ok && part["type"] == "text" {
+				if text, ok := part["text"].(string); ok && text != "" {
+					texts = append(texts, text)
+				}
+			}
+		}
+		return texts
+	}
+	return nil
+}
+
+// convertOpenAIContentParts 将OpenAI消息内容转换为Claude内容块
+func convertOpenAIContentParts(content interface{}) ([]map[string]interface{}, error) {
+	switch v := content.(type) {
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		return []map[string]interface{}{{"type": "text", "text": v}}, nil
+	case []interface{}:
+		var blocks []map[string]interface{}
+		for _, item := range v {
+			part, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch part["type"] {
+			case "text":
+				if text, ok := part["text"].(string); ok && text != "" {
+					blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+				}
+			case "image_url":
+				imageURL := ""
+				switch image := part["image_url"].(type) {
+				case string:
+					imageURL = image
+				case map[string]interface{}:
+					imageURL, _ = image["url"].(string)
+				}
+				source, err := convertOpenAIImageURL(imageURL)
+				if err != nil {
+					return nil, err
+				}
+				blocks = append(blocks, map[string]interface{}{"type": "image", "source": source})
+			case "file":
+				document, err := convertOpenAIFile(part["file"])
+				if err != nil {
+					return nil, err
+				}
+				blocks = append(blocks, document)
+			}
+		}
+		return blocks, nil
+	}
+	return nil, nil
+}
+
+// convertOpenAIImageURL 将图片地址转换为Claude图片来源，支持data URI和http(s)地址
+func convertOpenAIImageURL(imageURL string) (map[string]interface{}, error) {
+	if strings.HasPrefix(imageURL, "data:") {
+		meta, data, found := strings.Cut(strings.TrimPrefix(imageURL, "data:"), ",")
+		mediaType, encoding, _ := strings.Cut(meta, ";")
+		if !found || encoding != "base64" || mediaType == "" {
+			return nil, errors.New("invalid image data URI, expected data:<media_type>;base64,<data>")
+		}
+		return map[string]interface{}{"type": "base64", "media_type": mediaType, "data": data}, nil
+	}
+	if strings.HasPrefix(imageURL, "http://") || strings.HasPrefix(imageURL, "https://") {
+		return map[string]interface{}{"type": "url", "url": imageURL}, nil
+	}
+	return nil, errors.New("unsupported image_url, expected data URI or http(s) URL")
+}
+
+// convertOpenAIFile 将OpenAI的file片段转换为Claude文档，只支持file_data形式的base64数据
+func convertOpenAIFile(file interface{}) (map[string]interface{}, error) {
+	fileMap, _ := file.(map[string]interface{})
+	fileData, _ := fileMap["file_data"].(string)
+	if fileData == "" {
+		return nil, errors.New("unsupported file part, expected file_data as data URI (file_id is not supported)")
+	}
+
+	meta, data, found := strings.Cut(strings.TrimPrefix(fileData, "data:"), ",")
+	mediaType, encoding, _ := strings.Cut(meta, ";")
+	if !strings.HasPrefix(fileData, "data:") || !found || encoding != "base64" {
+		return nil, errors.New("invalid file_data, expected data:<media_type>;base64,<data>")
+	}
+	if mediaType == "" {
+		mediaType = "application/pdf"
+	}
+
+	document := map[string]interface{}{
+		"type":   "document",
+		"source": map[string]interface{}{"type": "base64", "media_type": mediaType, "data": data},
+	}
+	if filename, ok := fileMap["filename"].(string); ok && filename != "" {
+		document["title"] = filename
+	}
+	return document, nil
+}
+
+// convertOpenAIToolChoice 将OpenAI的tool_choice转换为Claude格式
+func convertOpenAIToolChoice(toolChoice interface{}) *ClaudeToolChoice {
+	switch v := toolChoice.(type) {
+	case string:
+		switch v {
+		case "none":
+			return &ClaudeToolChoice{Type: "none"}
+		case "required":
+			return &ClaudeToolChoice{Type: "any"}
+		}
+	case map[string]interface{}:
+		if function, ok := v["function"].(map[string]interface{}); ok {
+			if name, ok := function["name"].(string); ok && name != "" {
+				return &ClaudeToolChoice{Type: "tool", Name: name}
+			}
+		}
+	}
+	return &ClaudeToolChoice{Type: "auto"}
+}
+
+// mapClaudeStopReason 将Claude的停止原因映射为OpenAI的finish_reason
+func mapClaudeStopReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// OpenAIChatWriter 将处理器输出的Claude响应（SSE或JSON）转换为OpenAI Chat Completions格式的写入器
+// 处理器和故障转移逻辑写入的内容都先经过该写入器，请求结束后由调用方执行Finish输出最终结果
+type OpenAIChatWriter struct {
+	gin.ResponseWriter
+	header       http.Header
+	status       int
+	body         bytes.Buffer
+	pending      bytes.Buffer
+	isSSE        bool
+	sniffed      bool
+	started      bool
+	model        string
+	stream       bool
+	includeUsage bool
+
+	// 响应聚合状态
+	id           string
+	created      int64
+	content      strings.Builder
+	toolCalls    []OpenAIToolCall
+	toolIndex    map[int]int
+	finishReason string
+	usage        OpenAIUsage
+	gotMessage   bool
+	finished     bool
+	streamError  gjson.Result
+}
+
+// NewOpenAIChatWriter 创建Chat Completions响应转换写入器
+func NewOpenAIChatWriter(w gin.ResponseWriter, chatReq *OpenAIChatRequest) *OpenAIChatWriter {
+	writer := &OpenAIChatWriter{
+		ResponseWriter: w,
+		header:         http.Header{},
+		status:         http.StatusOK,
+		model:          chatReq.Model,
+		stream:         chatReq.Stream,
+		toolIndex:      make(map[int]int),
+		id:             "chatcmpl-" + generateRandomID(),
+		created:        time.Now().Unix(),
+	}
+	if chatReq.StreamOptions != nil {
+		writer.includeUsage = chatReq.StreamOptions.IncludeUsage
+	}
+	return writer
+}
+
+// Header 返回处理器使用的响应头，最终响应头由转换器自行设置
+func (w *OpenAIChatWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader 记录状态码
+func (w *OpenAIChatWriter) WriteHeader(code int) {
+	if !w.started && code > 0 {
+		w.status = code
+	}
+}
+
+// WriteHeaderNow 响应头在转换后才写出
+func (w *OpenAIChatWriter) WriteHeaderNow() {}
+
+// Write 接收Claude格式的响应数据
+func (w *OpenAIChatWriter) Write(data []byte) (int, error) {
+	if w.status >= statusBadRequest {
+		return w.body.Write(data)
+	}
+
+	// 根据首个非空字符判断是JSON响应还是SSE流
+	if !w.sniffed {
+		trimmed := bytes.TrimSpace(data)
+		if len(trimmed) == 0 {
+			return len(data), nil
+		}
+		w.sniffed = true
+		w.isSSE = trimmed[0] != '{'
+	}
+
+	if !w.isSSE {
+		return w.body.Write(data)
+	}
+
+	w.pending.Write(data)
+	for {
+		line, err := w.pending.ReadBytes('\n')
+		if err != nil {
+			// 不完整的行放回缓冲区等待后续数据
+			w.pending.Write(line)
+			break
+		}
+		w.processSSELine(line)
+	}
+	return len(data), nil
+}
+
+// WriteString 实现gin.ResponseWriter接口
+func (w *OpenAIChatWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush 流式输出已开始时刷新到客户端
+func (w *OpenAIChatWriter) Flush() {
+	if w.started {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// Status 返回当前记录的状态码
+func (w *OpenAIChatWriter) Status() int {
+	return w.status
+}
+
+// Written 是否已经写入过响应
+func (w *OpenAIChatWriter) Written() bool {
+	return w.started || w.sniffed || w.body.Len() > 0
+}
+
+// Finish 输出最终的OpenAI格式响应，必须在请求处理结束后调用
+func (w *OpenAIChatWriter) Finish() {
+	if w.status >= statusBadRequest {
+		w.writeError(w.status, w.body.Bytes())
+		return
+	}
+
+	if w.isSSE {
+		if w.pending.Len() > 0 {
+			w.processSSELine(w.pending.Bytes())
+			w.pending.Reset()
+		}
+	} else if w.body.Len() > 0 {
+		w.processMessage(w.body.Bytes())
+	}
+
+	if !w.stream {
+		switch {
+		case w.streamError.Exists():
+			status := http.StatusInternalServerError
+			if w.streamError.Get("error.type").String() == "overloaded_error" {
+				status = 529
+			}
+			w.writeError(status, []byte(w.streamError.Raw))
+		case !w.gotMessage:
+			w.writeError(http.StatusBadGateway, nil)
+		default:
+			w.writeCompletion()
+		}
+		return
+	}
+
+	if !w.started {
+		if !w.gotMessage {
+			w.writeError(http.StatusBadGateway, nil)
+			return
+		}
+		w.startStream()
+	}
+	if !w.finished && w.gotMessage && !w.streamError.Exists() {
+		w.finishStream()
+	}
+	_, _ = w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
+	w.ResponseWriter.Flush()
+}
+
+// processSSELine 处理一行Claude SSE数据
+func (w *OpenAIChatWriter) processSSELine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return
+	}
+	event := gjson.ParseBytes(bytes.TrimSpace(line[5:]))
+
+	switch event.Get("type").String() {
+	case "message_start":
+		w.onMessageStart(event.Get("message"))
+	case "content_block_start":
+		block := event.Get("content_block")
+		if block.Get("type").String() == "tool_use" {
+			w.onToolUseStart(int(event.Get("index").Int()), block.Get("id").String(), block.Get("name").String())
+		}
+	case "content_block_delta":
+		delta := event.Get("delta")
+		switch delta.Get("type").String() {
+		case "text_delta":
+			w.onTextDelta(delta.Get("text").String())
+		case "input_json_delta":
+			w.onToolArgumentsDelta(int(event.Get("index").Int()), delta.Get("partial_json").String())
+		}
+	case "message_delta":
+		w.onMessageDelta(event.Get("delta.stop_reason").String(), event.Get("usage"))
+	case "message_stop":
+		if w.stream && !w.finished {
+			w.finishStream()
+		}
+	case "error":
+		w.streamError = event
+		if w.stream && w.started {
+			w.writeChunkData(map[string]interface{}{"error": openAIErrorBody(event.Get("error.type").String(), event.Get("error.message").String())})
+		}
+	}
+}
+
+// processMessage 处理非流式的Claude消息响应，按流式事件的顺序重放
+func (w *OpenAIChatWriter) processMessage(body []byte) {
+	message := gjson.ParseBytes(body)
+	if message.Get("type").String() != "message" {
+		return
+	}
+
+	w.onMessageStart(message)
+	for i, block := range message.Get("content").Array() {
+		switch block.Get("type").String() {
+		case "text":
+			w.onTextDelta(block.Get("text").String())
+		case "tool_use":
+			w.onToolUseStart(i, block.Get("id").String(), block.Get("name").String())
+			arguments := block.Get("input").Raw
+			if arguments == "" {
+				arguments = "{}"
+			}
+			w.onToolArgumentsDelta(i, arguments)
+		}
+	}
+	w.onMessageDelta(message.Get("stop_reason").String(), message.Get("usage"))
+}
+
+// onMessageStart 记录消息ID和输入token
+func (w *OpenAIChatWriter) onMessageStart(message gjson.Result) {
+	w.gotMessage = true
+	if id := message.Get("id").String(); id != "" {
+		w.id = "chatcmpl-" + strings.TrimPrefix(id, "msg_")
+	}
+	w.updateUsage(message.Get("usage"))
+
+	if w.stream {
+		w.startStream()
+		w.writeChunk(map[string]interface{}{"role": "assistant", "content": ""}, nil)
+	}
+}
+
+// onTextDelta 处理文本增量
+func (w *OpenAIChatWriter) onTextDelta(text string) {
+	if text == "" {
+		return
+	}
+	if w.stream {
+		w.writeChunk(map[string]interface{}{"content": text}, nil)
+		return
+	}
+	w.content.WriteString(text)
+}
+
+// onToolUseStart 处理工具调用开始
+func (w *OpenAIChatWriter) onToolUseStart(blockIndex int, id, name string) {
+	index := len(w.toolCalls)
+	w.toolIndex[blockIndex] = index
+	w.toolCalls = append(w.toolCalls, OpenAIToolCall{
+		ID:       id,
+		Type:     "function",
+		Function: OpenAIFunctionCall{Name: name},
+	})
+
+	if w.stream {
+		w.writeChunk(map[string]interface{}{
+			"tool_calls": []map[string]interface{}{{
+				"index":    index,
+				"id":       id,
+				"type":     "function",
+				"function": map[string]interface{}{"name": name, "arguments": ""},
+			}},
+		}, nil)
+	}
+}
+
+// onToolArgumentsDelta 处理工具调用参数增量
+func (w *OpenAIChatWriter) onToolArgumentsDelta(blockIndex int, partial string) {
+	index, ok := w.toolIndex[blockIndex]
+	if !ok || partial == "" {
+		return
+	}
+	if w.stream {
+		w.writeChunk(map[string]interface{}{
+			"tool_calls": []map[string]interface{}{{
+				"index":    index,
+				"function": map[string]interface{}{"arguments": partial},
+			}},
+		}, nil)
+		return
+	}
+	w.toolCalls[index].Function.Arguments += partial
+}
+
+// onMessageDelta 记录停止原因和输出token
+func (w *OpenAIChatWriter) onMessageDelta(stopReason string, usage gjson.Result) {
+	if stopReason != "" {
+		w.finishReason = mapClaudeStopReason(stopReason)
+	}
+	w.updateUsage(usage)
+}
+
+// updateUsage 更新token统计，prompt_tokens包含缓存读取和缓存创建的token
+func (w *OpenAIChatWriter) updateUsage(usage gjson.Result) {
+	if !usage.Exists() {
+		return
+	}
+	if usage.Get("input_tokens").Exists() {
+		w.usage.PromptTokens = int(usage.Get("input_tokens").Int() +
+			usage.Get("cache_read_input_tokens").Int() +
+			usage.Get("cache_creation_input_tokens").Int())
+	}
+	if usage.Get("output_tokens").Exists() {
+		w.usage.CompletionTokens = int(usage.Get("output_tokens").Int())
+	}
+	w.usage.TotalTokens = w.usage.PromptTokens + w.usage.CompletionTokens
+}
+
+// startStream 写出流式响应头
+func (w *OpenAIChatWriter) startStream() {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.copyModelHeaders()
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	w.ResponseWriter.Header().Set("Cache-Control", "no-cache")
+	w.ResponseWriter.Header().Set("Connection", "keep-alive")
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// finishStream 发送带finish_reason的最后一个chunk和可选的usage chunk
+func (w *OpenAIChatWriter) finishStream() {
+	w.finished = true
+	finishReason := w.finishReason
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	w.writeChunk(map[string]interface{}{}, &finishReason)
+
+	if w.includeUsage {
+		w.writeChunkData(map[string]interface{}{
+			"id":      w.id,
+			"object":  "chat.completion.chunk",
+			"created": w.created,
+			"model":   w.model,
+			"choices": []interface{}{},
+			"usage":   w.usage,
+		})
+	}
+}
+
+// writeChunk 发送一个chat.completion.chunk
+func (w *OpenAIChatWriter) writeChunk(delta map[string]interface{}, finishReason *string) {
+	w.writeChunkData(map[string]interface{}{
+		"id":      w.id,
+		"object":  "chat.completion.chunk",
+		"created": w.created,
+		"model":   w.model,
+		"choices": []map[string]interface{}{{
+			"index":         0,
+			"delta":         delta,
+			"finish_reason": finishReason,
+		}},
+	})
+}
+
+// writeChunkData 以SSE格式写出数据并刷新
+func (w *OpenAIChatWriter) writeChunkData(data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	_, _ = w.ResponseWriter.Write([]byte("data: " + string(jsonData) + "\n\n"))
+	w.ResponseWriter.Flush()
+}
+
+// writeCompletion 输出非流式的chat.completion响应
+func (w *OpenAIChatWriter) writeCompletion() {
+	message := OpenAIMessage{Role: "assistant", ToolCalls: w.toolCalls}
+	if w.content.Len() > 0 {
+		message.Content = w.content.String()
+	}
+
+	finishReason := w.finishReason
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+
+	w.writeJSON(http.StatusOK, OpenAIResponse{
+		ID:      w.id,
+		Object:  "chat.completion",
+		Created: w.created,
+		Model:   w.model,
+		Choices: []OpenAIChoice{{
+			Index:        0,
+			Message:      message,
+			FinishReason: finishReason,
+		}},
+		Usage: w.usage,
+	})
+}
+
+// writeError 将Claude或中转服务的错误响应转换为OpenAI错误格式输出
+func (w *OpenAIChatWriter) writeError(status int, body []byte) {
+	result := gjson.ParseBytes(body)
+	errorType := result.Get("error.type").String()
+	message := result.Get("error.message").String()
+	if message == "" {
+		// 中转服务自身的错误格式: {"message": "..."} 或 {"error": "..."}
+		message = result.Get("message").String()
+	}
+	if message == "" && result.Get("error").Type == gjson.String {
+		message = result.Get("error").String()
+	}
+	if message == "" {
+		message = fmt.Sprintf("Request failed with status %d", status)
+	}
+	if errorType == "" {
+		errorType = "api_error"
+	}
+
+	w.writeJSON(status, gin.H{"error": openAIErrorBody(errorType, message)})
+}
+
+// writeJSON 写出JSON响应
+func (w *OpenAIChatWriter) writeJSON(status int, data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		status = http.StatusInternalServerError
+		jsonData = []byte(`{"error":{"message":"failed to encode response","type":"api_error"}}`)
+	}
+	w.copyModelHeaders()
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.WriteHeader(status)
+	_, _ = w.ResponseWriter.Write(jsonData)
+}
+
+// copyModelHeaders 将模型降级和Retry-After响应头透传给客户端
+func (w *OpenAIChatWriter) copyModelHeaders() {
+	for _, name := range []string{headerRequestedModel, headerServedModel, "Retry-After"} {
+		if value := w.header.Get(name); value != "" {
+			w.ResponseWriter.Header().Set(name, value)
+		}
+	}
+}
+
+// openAIErrorBody 构建OpenAI格式的错误内容
+func openAIErrorBody(errorType, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"message": message,
+		"type":    errorType,
+		"code":    nil,
+	}
+}
@@ -0,0 +1,186 @@
+package relay
+
+import (
+	"claude-code-relay/constant"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestConvertOpenAIChatRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    map[string]string // gjson路径 -> 期望的JSON值
+		missing []string          // 不应出现的路径
+		wantErr string
+	}{
+		{
+			name: "system prompt and developer messages",
+			body: `{"model":"claude-sonnet-4","messages":[
+				{"role":"system","content":"Be brief."},
+				{"role":"developer","content":[{"type":"text","text":"Use Go."}]},
+				{"role":"user","content":"hi"}]}`,
+			want: map[string]string{
+				"system.#":      `3`,
+				"system.1.text": `"Be brief."`,
+				"system.2.text": `"Use Go."`,
+				"messages":      `[{"role":"user","content":[{"type":"text","text":"hi"}]}]`,
+				"max_tokens":    `4096`,
+				"system.0.text": mustJSON(constant.ClaudeCodeSystemPrompt),
+			},
+		},
+		{
+			name: "stop string",
+			body: `{"model":"m","messages":[{"role":"user","content":"hi"}],"stop":"END"}`,
+			want: map[string]string{"stop_sequences": `["END"]`},
+		},
+		{
+			name: "stop array drops empty entries",
+			body: `{"model":"m","messages":[{"role":"user","content":"hi"}],"stop":["a","",7,"b"]}`,
+			want: map[string]string{"stop_sequences": `["a","b"]`},
+		},
+		{
+			name:    "empty stop is omitted",
+			body:    `{"model":"m","messages":[{"role":"user","content":"hi"}],"stop":""}`,
+			missing: []string{"stop_sequences"},
+		},
+		{
+			name: "max_completion_tokens wins and temperature is clamped",
+			body: `{"model":"m","messages":[{"role":"user","content":"hi"}],"max_tokens":100,"max_completion_tokens":200,"temperature":1.5}`,
+			want: map[string]string{"max_tokens": `200`, "temperature": `1`},
+		},
+		{
+			name: "tools with required choice and parallel calls disabled",
+			body: `{"model":"m","messages":[{"role":"user","content":"hi"}],
+				"tools":[
+					{"type":"function","function":{"name":"get_weather","description":"Weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}},
+					{"type":"function","function":{"name":"now"}},
+					{"type":"retrieval"}],
+				"tool_choice":"required","parallel_tool_calls":false}`,
+			want: map[string]string{
+				"tools.#":              `2`,
+				"tools.0.name":         `"get_weather"`,
+				"tools.0.input_schema": `{"type":"object","properties":{"city":{"type":"string"}}}`,
+				"tools.1.input_schema": `{"type":"object","properties":{}}`,
+				"tool_choice":          `{"type":"any","disable_parallel_tool_use":true}`,
+			},
+		},
+		{
+			name: "named tool choice",
+			body: `{"model":"m","messages":[{"role":"user","content":"hi"}],
+				"tools":[{"type":"function","function":{"name":"now"}}],
+				"tool_choice":{"type":"function","function":{"name":"now"}}}`,
+			want: map[string]string{"tool_choice": `{"type":"tool","name":"now"}`},
+		},
+		{
+			name: "assistant tool calls and tool results",
+			body: `{"model":"m","messages":[
+				{"role":"user","content":"weather?"},
+				{"role":"assistant","content":null,"tool_calls":[
+					{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}},
+					{"id":"call_2","type":"function","function":{"name":"now","arguments":"not json"}}]},
+				{"role":"tool","tool_call_id":"call_1","content":"sunny"},
+				{"role":"tool","tool_call_id":"call_2","content":"noon"}]}`,
+			want: map[string]string{
+				"messages.#":         `3`,
+				"messages.1.content": `[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"Paris"}},{"type":"tool_use","id":"call_2","name":"now","input":{}}]`,
+				"messages.2.role":    `"user"`,
+				"messages.2.content": `[{"type":"tool_result","tool_use_id":"call_1","content":"sunny"},{"type":"tool_result","tool_use_id":"call_2","content":"noon"}]`,
+			},
+		},
+		{
+			name: "tool result with image keeps content blocks",
+			body: `{"model":"m","messages":[
+				{"role":"user","content":"look"},
+				{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"screenshot","arguments":"{}"}}]},
+				{"role":"tool","tool_call_id":"call_1","content":[
+					{"type":"text","text":"captured"},
+					{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0KGgo="}}]}]}`,
+			want: map[string]string{
+				"messages.2.content.0.content": `[{"type":"text","text":"captured"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw0KGgo="}}]`,
+			},
+		},
+		{
+			name: "user images from data URI and url",
+			body: `{"model":"m","messages":[{"role":"user","content":[
+				{"type":"text","text":"compare"},
+				{"type":"image_url","image_url":{"url":"data:image/jpeg;base64,/9j/4AAQ"}},
+				{"type":"image_url","image_url":"https://example.com/a.png"}]}]}`,
+			want: map[string]string{
+				"messages.0.content.1.source": `{"type":"base64","media_type":"image/jpeg","data":"/9j/4AAQ"}`,
+				"messages.0.content.2.source": `{"type":"url","url":"https://example.com/a.png"}`,
+			},
+		},
+		{
+			name:    "invalid image data URI",
+			body:    `{"model":"m","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png,raw"}}]}]}`,
+			wantErr: "invalid image data URI",
+		},
+		{
+			name:    "unsupported image scheme",
+			body:    `{"model":"m","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"ftp://example.com/a.png"}}]}]}`,
+			wantErr: "unsupported image_url",
+		},
+		{
+			name:    "missing model",
+			body:    `{"messages":[{"role":"user","content":"hi"}]}`,
+			wantErr: "model is required",
+		},
+		{
+			name:    "unsupported role",
+			body:    `{"model":"m","messages":[{"role":"function","content":"hi"}]}`,
+			wantErr: "unsupported message role",
+		},
+		{
+			name:    "system only",
+			body:    `{"model":"m","messages":[{"role":"system","content":"hi"}]}`,
+			wantErr: "at least one user message",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claudeBody, _, err := ConvertOpenAIChatRequest([]byte(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ConvertOpenAIChatRequest error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ConvertOpenAIChatRequest: %v", err)
+			}
+
+			for path, wantRaw := range tt.want {
+				result := gjson.GetBytes(claudeBody, path)
+				if !result.Exists() {
+					t.Errorf("%s missing in %s", path, claudeBody)
+					continue
+				}
+				var got, want interface{}
+				_ = json.Unmarshal([]byte(result.Raw), &got)
+				if err := json.Unmarshal([]byte(wantRaw), &want); err != nil {
+					t.Fatalf("bad fixture for %s: %v", path, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %s, want %s", path, result.Raw, wantRaw)
+				}
+			}
+			for _, path := range tt.missing {
+				if gjson.GetBytes(claudeBody, path).Exists() {
+					t.Errorf("%s should be omitted in %s", path, claudeBody)
+				}
+			}
+		})
+	}
+}
+
+// mustJSON 将字符串编码为JSON字面量
+func mustJSON(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
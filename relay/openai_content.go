@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 默认单张图片大小上限，与Anthropic接口一致
+	defaultOpenAIMaxImageBytes = 5 * 1024 * 1024
+	// 默认单个文档大小上限，与Anthropic接口一致
+	defaultOpenAIMaxDocumentBytes = 32 * 1024 * 1024
+	// 默认不支持图片和文件输入的模型
+	defaultOpenAINonVisionModels = "deepseek-*,o1-mini*,o3-mini*,gpt-3.5-*,qwq-*"
+)
+
+// getOpenAIContentLimit 读取内容大小上限配置（字节）
+func getOpenAIContentLimit(name string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+// modelSupportsVision 判断上游模型是否支持图片和文件输入，不支持的模型通过OPENAI_NON_VISION_MODELS配置（支持*通配符）
+func modelSupportsVision(modelName string) bool {
+	patterns := os.Getenv("OPENAI_NON_VISION_MODELS")
+	if patterns == "" {
+		patterns = defaultOpenAINonVisionModels
+	}
+
+	modelName = strings.ToLower(modelName)
+	if idx := strings.LastIndex(modelName, "/"); idx >= 0 {
+		modelName = modelName[idx+1:]
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if matched, err := path.Match(pattern, modelName); err == nil && matched {
+			return false
+		}
+	}
+	return true
+}
+
+// claudeContentConverter 将Claude的多模态内容块转换为OpenAI的内容片段
+type claudeContentConverter struct {
+	modelName        string
+	maxImageBytes    int
+	maxDocumentBytes int
+}
+
+// newClaudeContentConverter 创建内容转换器
+func newClaudeContentConverter(modelName string) *claudeContentConverter {
+	return &claudeContentConverter{
+		modelName:        modelName,
+		maxImageBytes:    getOpenAIContentLimit("OPENAI_MAX_IMAGE_BYTES", defaultOpenAIMaxImageBytes),
+		maxDocumentBytes: getOpenAIContentLimit("OPENAI_MAX_DOCUMENT_BYTES", defaultOpenAIMaxDocumentBytes),
+	}
+}
+
+// convertBlocks 转换text、image和document内容块，其他类型的内容块忽略
+func (cc *claudeContentConverter) convertBlocks(blocks []interface{}) ([]map[string]interface{}, error) {
+	var parts []map[string]interface{}
+	for _, block := range blocks {
+		blockMap, ok := block.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch blockMap["type"] {
+		case "text":
+			if text, ok := blockMap["text"].(string); ok {
+				parts = append(parts, map[string]interface{}{"type": "text", "text": text})
+			}
+		case "image":
+			part, err := cc.convertImage(blockMap)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		case "document":
+			documentParts, err := cc.convertDocument(blockMap)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, documentParts...)
+		}
+	}
+	return parts, nil
+}
+
+// convertImage 将Claude图片转换为image_url片段，支持base64和url来源
+func (cc *claudeContentConverter) convertImage(block map[string]interface{}) (map[string]interface{}, error) {
+	if !modelSupportsVision(cc.modelName) {
+		return nil, fmt.Errorf("模型 %s 不支持图片输入", cc.modelName)
+	}
+
+	source, _ := block["source"].(map[string]interface{})
+	var imageURL string
+	switch source["type"] {
+	case "base64":
+		data, _ := source["data"].(string)
+		if err := checkBase64Size(data, cc.maxImageBytes, "图片"); err != nil {
+			return nil, err
+		}
+		imageURL = fmt.Sprintf("data:%s;base64,%s", source["media_type"], data)
+	case "url":
+		imageURL, _ = source["url"].(string)
+		if imageURL == "" {
+			return nil, errors.New("图片缺少url")
+		}
+	default:
+		return nil, fmt.Errorf("不支持的图片来源类型: %v", source["type"])
+	}
+
+	return map[string]interface{}{
+		"type": "image_url",
+		"image_url": map[string]string{
+			"url": imageURL,
+		},
+	}, nil
+}
+
+// convertDocument 将Claude文档转换为OpenAI片段
+// PDF转换为file片段，纯文本和自定义内容文档转换为文本片段
+// OpenAI的file类型只支持base64数据，url来源的文档不在中转服务端下载，直接拒绝
+func (cc *claudeContentConverter) convertDocument(block map[string]interface{}) ([]map[string]interface{}, error) {
+	source, _ := block["source"].(map[string]interface{})
+	title, _ := block["title"].(string)
+
+	switch source["type"] {
+	case "text":
+		data, _ := source["data"].(string)
+		if title != "" {
+			data = title + "\n\n" + data
+		}
+		return []map[string]interface{}{{"type": "text", "text": data}}, nil
+	case "content":
+		switch content := source["content"].(type) {
+		case string:
+			return []map[string]interface{}{{"type": "text", "text": content}}, nil
+		case []interface{}:
+			return cc.convertBlocks(content)
+		}
+		return nil, nil
+	case "base64":
+		mediaType, _ := source["media_type"].(string)
+		data, _ := source["data"].(string)
+		if err := checkBase64Size(data, cc.maxDocumentBytes, "文档"); err != nil {
+			return nil, err
+		}
+		return cc.filePart(title, mediaType, data)
+	case "url":
+		return nil, errors.New("不支持url来源的文档，请使用base64来源")
+	}
+	return nil, fmt.Errorf("不支持的文档来源类型: %v", source["type"])
+}
+
+// filePart 构建OpenAI的file片段
+func (cc *claudeContentConverter) filePart(title, mediaType, data string) ([]map[string]interface{}, error) {
+	if !modelSupportsVision(cc.modelName) {
+		return nil, fmt.Errorf("模型 %s 不支持文件输入", cc.modelName)
+	}
+	if mediaType == "" {
+		mediaType = "application/pdf"
+	}
+	if title == "" || title == "." || title == "/" {
+		title = "document.pdf"
+	}
+
+	return []map[string]interface{}{{
+		"type": "file",
+		"file": map[string]string{
+			"filename":  title,
+			"file_data": fmt.Sprintf("data:%s;base64,%s", mediaType, data),
+		},
+	}}, nil
+}
+
+// checkBase64Size 按解码后的大小校验base64内容
+func checkBase64Size(data string, maxBytes int, kind string) error {
+	if data == "" {
+		return fmt.Errorf("%s内容为空", kind)
+	}
+	padding := len(data) - len(strings.TrimRight(data, "="))
+	if base64.StdEncoding.DecodedLen(len(data))-padding > maxBytes {
+		return fmt.Errorf("%s大小超过限制 %d 字节", kind, maxBytes)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package relay
+
+import (
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ctxKeyHeaderRewrites = "relay_header_rewrites"
+
+// SetHeaderRewrites 记录分组改写规则产生的请求头操作
+// 同时作用于客户端请求头（供透传请求头的平台使用），并在设置固定请求头后再次应用，保证规则优先
+func SetHeaderRewrites(c *gin.Context, rewrites []model.HeaderRewrite) {
+	if len(rewrites) == 0 {
+		return
+	}
+	service.ApplyHeaderRewrites(c.Request.Header, rewrites)
+	c.Set(ctxKeyHeaderRewrites, rewrites)
+}
+
+// applyHeaderRewrites 将改写规则的请求头操作应用到上游请求
+func applyHeaderRewrites(c *gin.Context, req *http.Request) {
+	if value, exists := c.Get(ctxKeyHeaderRewrites); exists {
+		service.ApplyHeaderRewrites(req.Header, value.([]model.HeaderRewrite))
+	}
+}
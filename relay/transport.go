@@ -0,0 +1,178 @@
+package relay
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 连接池默认配置
+	defaultTransportMaxIdleConns        = 100
+	defaultTransportMaxIdleConnsPerHost = 10
+	defaultTransportIdleConnTimeout     = 90 * time.Second
+	defaultTransportDialTimeout         = 10 * time.Second
+	defaultTransportTLSHandshakeTimeout = 10 * time.Second
+	defaultTransportKeepAlive           = 30 * time.Second
+)
+
+// transportEntry 账号复用的Transport及生成它的连接配置
+type transportEntry struct {
+	key       string
+	transport *http.Transport
+}
+
+var (
+	transportMu sync.Mutex
+	transports  = make(map[uint]*transportEntry)
+)
+
+// accountProxyURI 获取账号的代理地址，优先使用关联的代理或代理池，其次是启用的代理URI
+func accountProxyURI(account *model.Account) (string, error) {
+	if account.EnableProxy {
+		return upstreamProxyURI(account, account.ProxyURI)
+	}
+	return upstreamProxyURI(account, "")
+}
+
+// upstreamProxyURI 账号关联了代理或代理池时使用其代理地址，否则使用legacyURI
+// 关联的代理不可用时返回错误，请求不会绕过代理直连
+func upstreamProxyURI(account *model.Account, legacyURI string) (string, error) {
+	proxyURI, err := service.ResolveAccountProxyURI(account)
+	if err != nil {
+		return "", err
+	}
+	if proxyURI != "" {
+		return proxyURI, nil
+	}
+	return legacyURI, nil
+}
+
+// newAccountHTTPClient 创建使用账号复用Transport的HTTP客户端，proxyURI为空时直连
+func newAccountHTTPClient(account *model.Account, proxyURI string, timeout time.Duration) (*http.Client, error) {
+	transport, err := getAccountTransport(account, proxyURI)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
+
+// getAccountTransport 获取账号复用的Transport，代理、请求地址或TLS配置变化时重建
+func getAccountTransport(account *model.Account, proxyURI string) (*http.Transport, error) {
+	key := transportKey(account, proxyURI)
+
+	transportMu.Lock()
+	defer transportMu.Unlock()
+
+	if entry, ok := transports[account.ID]; ok {
+		if entry.key == key {
+			return entry.transport, nil
+		}
+		// 配置已变化，关闭旧连接池的空闲连接，进行中的请求不受影响
+		entry.transport.CloseIdleConnections()
+		delete(transports, account.ID)
+	}
+
+	transport, err := newTransport(account, proxyURI)
+	if err != nil {
+		return nil, err
+	}
+	transports[account.ID] = &transportEntry{key: key, transport: transport}
+	return transport, nil
+}
+
+// InvalidateAccountTransport 移除账号缓存的Transport并关闭空闲连接
+func InvalidateAccountTransport(accountID uint) {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+
+	if entry, ok := transports[accountID]; ok {
+		entry.transport.CloseIdleConnections()
+		delete(transports, accountID)
+	}
+}
+
+// transportKey 由影响连接的账号配置生成缓存键
+func transportKey(account *model.Account, proxyURI string) string {
+	caSum := sha256.Sum256([]byte(account.CACert))
+	return strings.Join([]string{
+		proxyURI,
+		account.RequestURL,
+		strconv.FormatBool(account.TLSSkipVerify),
+		hex.EncodeToString(caSum[:]),
+	}, "|")
+}
+
+// newTransport 按账号配置创建支持连接复用和HTTP/2的Transport，默认校验上游证书
+func newTransport(account *model.Account, proxyURI string) (*http.Transport, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: account.TLSSkipVerify}
+	if account.CACert != "" {
+		// 自定义CA在系统根证书基础上追加
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(account.CACert)) {
+			return nil, errors.New("invalid CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   getTransportDuration("HTTP_DIAL_TIMEOUT", defaultTransportDialTimeout),
+		KeepAlive: defaultTransportKeepAlive,
+	}
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          getTransportInt("HTTP_MAX_IDLE_CONNS", defaultTransportMaxIdleConns),
+		MaxIdleConnsPerHost:   getTransportInt("HTTP_MAX_IDLE_CONNS_PER_HOST", defaultTransportMaxIdleConnsPerHost),
+		IdleConnTimeout:       getTransportDuration("HTTP_IDLE_CONN_TIMEOUT", defaultTransportIdleConnTimeout),
+		TLSHandshakeTimeout:   getTransportDuration("HTTP_TLS_HANDSHAKE_TIMEOUT", defaultTransportTLSHandshakeTimeout),
+		ResponseHeaderTimeout: getTransportDuration("HTTP_RESPONSE_HEADER_TIMEOUT", 0),
+		ExpectContinueTimeout: time.Second,
+	}
+
+	if err := common.SetTransportProxy(transport, proxyURI, dialer); err != nil {
+		return nil, err
+	}
+
+	return transport, nil
+}
+
+// getTransportInt 读取连接池整数配置
+func getTransportInt(name string, defaultValue int) int {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// getTransportDuration 读取连接超时配置（秒），0表示不限制
+func getTransportDuration(name string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(name); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,351 @@
+package relay
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// Vertex 请求配置
+	vertexAnthropicVersion = "vertex-2023-10-16"
+	vertexDefaultRegion    = "us-east5"
+)
+
+// Vertex 错误类型定义
+var (
+	vertexErrCredentials = gin.H{"error": map[string]interface{}{"type": "configuration_error", "message": "Vertex服务账号凭证无效"}}
+	vertexErrTransform   = gin.H{"error": map[string]interface{}{"type": "request_error", "message": "Failed to build Vertex request body"}}
+)
+
+// vertexModelIDs 模型ID与Vertex模型ID不符合通用转换规则的特例
+var vertexModelIDs = map[string]string{
+	"claude-3-5-sonnet-20241022": "claude-3-5-sonnet-v2@20241022",
+}
+
+// vertexDateSuffix 模型ID末尾的日期版本号
+var vertexDateSuffix = regexp.MustCompile(`-(\d{8})$`)
+
+// HandleVertexRequest 处理Google Vertex AI平台的请求
+func HandleVertexRequest(c *gin.Context, account *model.Account) {
+	startTime := time.Now()
+
+	apiKey := extractAPIKey(c)
+
+	// Vertex区分流式和非流式接口，需要保留客户端的stream参数
+	requestBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errRequestBody)
+		return
+	}
+
+	modelName := gjson.GetBytes(requestBody, "model").String()
+	if modelName == "" {
+		c.JSON(http.StatusServiceUnavailable, errMissingModel)
+		return
+	}
+
+	if apiKey != nil {
+		if err := validateModelRestriction(c, apiKey, modelName); err != nil {
+			return
+		}
+	}
+
+	serviceAccount, err := common.ParseGoogleServiceAccount(account.VertexServiceAccount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(vertexErrCredentials, err.Error()))
+		return
+	}
+
+	accessToken, err := getValidVertexAccessToken(account, serviceAccount)
+	if err != nil {
+		recordUpstreamError(c, err)
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(vertexErrCredentials, err.Error()))
+		return
+	}
+
+	isStream := gjson.GetBytes(requestBody, "stream").Bool()
+	body, err := buildVertexRequestBody(requestBody)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, appendErrorMessage(vertexErrTransform, err.Error()))
+		return
+	}
+
+	modelID := resolveVertexModelID(modelName, account)
+	req, err := createVertexRequest(c.Request.Context(), account, serviceAccount.ProjectID, modelID, accessToken, body, isStream)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(errCreateRequest, err.Error()))
+		return
+	}
+	if betas := filterCloudBetas(c.Request.Header.Get("anthropic-beta")); len(betas) > 0 {
+		req.Header.Set("anthropic-beta", strings.Join(betas, ","))
+	}
+
+	client, err := createHTTPClient(account)
+	if err != nil {
+		recordUpstreamError(c, err)
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(errProxyConfig, err.Error()))
+		return
+	}
+
+	resp, err := doUpstream(c, client, req, account)
+	if err != nil {
+		recordUpstreamError(c, err)
+		handleRequestError(c, err)
+		return
+	}
+	defer common.CloseIO(resp.Body)
+
+	recordUpstreamStatus(c, resp.StatusCode)
+
+	if resp.StatusCode >= statusBadRequest {
+		handleVertexErrorResponse(c, resp, account)
+		return
+	}
+
+	var usageTokens *common.TokenUsage
+	if isStream {
+		setStreamResponseHeaders(c)
+		c.Header("Content-Type", "text/event-stream")
+		c.Status(resp.StatusCode)
+		c.Writer.Flush()
+
+		usageTokens, err = common.ParseStreamResponse(c.Writer, resp.Body)
+		if err != nil {
+			log.Println("vertex stream copy and parse failed:", err.Error())
+		}
+	} else {
+		responseBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, appendErrorMessage(errResponseRead, err.Error()))
+			return
+		}
+		usageTokens, _ = common.ParseJSONResponse(responseBody)
+		c.Data(resp.StatusCode, "application/json", responseBody)
+	}
+
+	// 计费使用Anthropic模型名称，而不是Vertex模型ID
+	if usageTokens != nil {
+		usageTokens.Model = modelName
+	}
+
+	updateAccountAndStats(account, resp.StatusCode, usageTokens)
+
+	if apiKey != nil {
+		go service.UpdateApiKeyStatus(apiKey, resp.StatusCode, usageTokens)
+	}
+
+	saveRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens, isStream, buildLogMeta(c))
+}
+
+// getValidVertexAccessToken 获取有效的Vertex访问令牌，令牌缓存在账号上，即将过期时重新签发
+func getValidVertexAccessToken(account *model.Account, serviceAccount *common.GoogleServiceAccount) (string, error) {
+	if account.AccessToken != "" && time.Now().Unix() < int64(account.ExpiresAt)-tokenRefreshBuffer {
+		return account.AccessToken, nil
+	}
+
+	accessToken, expiresAt, err := mintVertexAccessToken(account, serviceAccount)
+	if err != nil {
+		return "", err
+	}
+
+	account.AccessToken = accessToken
+	account.ExpiresAt = int(expiresAt)
+	if err := model.UpdateAccount(account); err != nil {
+		log.Printf("更新Vertex账号token信息到数据库失败: %v", err)
+	}
+	return accessToken, nil
+}
+
+// mintVertexAccessToken 使用服务账号签发新的访问令牌
+func mintVertexAccessToken(account *model.Account, serviceAccount *common.GoogleServiceAccount) (string, int64, error) {
+	proxyURI, err := accountProxyURI(account)
+	if err != nil {
+		return "", 0, err
+	}
+	return common.MintGoogleAccessToken(serviceAccount, proxyURI)
+}
+
+// RefreshVertexToken 为Vertex账号重新签发访问令牌，返回新令牌和过期时间戳
+func RefreshVertexToken(account *model.Account) (string, int64, error) {
+	if account == nil {
+		return "", 0, errors.New("account cannot be nil")
+	}
+
+	serviceAccount, err := common.ParseGoogleServiceAccount(account.VertexServiceAccount)
+	if err != nil {
+		return "", 0, err
+	}
+
+	log.Printf("Minting Vertex token for account: %s (ID: %d)", account.Name, account.ID)
+	return mintVertexAccessToken(account, serviceAccount)
+}
+
+// buildVertexRequestBody 将Anthropic请求体转换为Vertex rawPredict请求体
+// 模型通过URL传递，anthropic_version需要使用Vertex的版本号
+func buildVertexRequestBody(body []byte) ([]byte, error) {
+	body, err := sjson.DeleteBytes(stripRelayThinkingBlocks(body), "model")
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetBytes(body, "anthropic_version", vertexAnthropicVersion)
+}
+
+// resolveVertexModelID 将Anthropic模型ID转换为Vertex模型ID（日期版本号使用@分隔）
+// 优先使用账号的模型映射配置
+func resolveVertexModelID(modelName string, account *model.Account) string {
+	defaultModelID, ok := vertexModelIDs[modelName]
+	if !ok {
+		defaultModelID = vertexDateSuffix.ReplaceAllString(modelName, "@$1")
+	}
+	return applyModelMapping(modelName, account.ModelMapping, defaultModelID)
+}
+
+// getVertexRegion 获取账号配置的Vertex区域
+func getVertexRegion(account *model.Account) string {
+	if account.VertexRegion != "" {
+		return account.VertexRegion
+	}
+	return vertexDefaultRegion
+}
+
+// createVertexRequest 创建Vertex rawPredict/streamRawPredict请求
+func createVertexRequest(ctx context.Context, account *model.Account, projectID, modelID, accessToken string, body []byte, isStream bool) (*http.Request, error) {
+	region := getVertexRegion(account)
+
+	action := "rawPredict"
+	if isStream {
+		action = "streamRawPredict"
+	}
+
+	host := region + "-aiplatform.googleapis.com"
+	if region == "global" {
+		host = "aiplatform.googleapis.com"
+	}
+	if account.RequestURL != "" {
+		if parsed, err := url.Parse(account.RequestURL); err == nil && parsed.Host != "" {
+			host = parsed.Host
+		}
+	}
+
+	requestURL := fmt.Sprintf("https://%s/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:%s",
+		host, projectID, region, modelID, action)
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	if isStream {
+		req.Header.Set("Accept", "text/event-stream")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+	return req, nil
+}
+
+// extractVertexErrorMessage 提取Vertex错误信息，兼容Anthropic和Google两种错误格式
+func extractVertexErrorMessage(body []byte, statusCode int) string {
+	if message := gjson.GetBytes(body, "error.message").String(); message != "" {
+		if errorType := gjson.GetBytes(body, "error.type").String(); errorType != "" {
+			return errorType + ": " + message
+		}
+	}
+	return extractGeminiErrorMessage(body, statusCode)
+}
+
+// handleVertexErrorResponse 处理Vertex错误响应
+func handleVertexErrorResponse(c *gin.Context, resp *http.Response, account *model.Account) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(errResponseRead, err.Error()))
+		return
+	}
+
+	log.Printf("❌ Vertex错误响应内容: %s", string(responseBody))
+
+	// 令牌失效时清除缓存，下次请求重新签发
+	if resp.StatusCode == http.StatusUnauthorized {
+		account.AccessToken = ""
+		account.ExpiresAt = 0
+		if err := model.ClearAccountAccessToken(account.ID); err != nil {
+			log.Printf("清除Vertex账号 %d 访问令牌失败: %v", account.ID, err)
+		}
+	}
+
+	recordUpstreamErrorBody(c, responseBody)
+	accountService := service.NewAccountService()
+	accountService.UpdateAccountErrorStatus(account, resp.StatusCode, responseBody)
+
+	c.JSON(resp.StatusCode, gin.H{
+		"error": map[string]interface{}{
+			"type":    "response_error",
+			"message": extractVertexErrorMessage(responseBody, resp.StatusCode),
+		},
+	})
+}
+
+// TestHandleVertexRequest 测试Vertex账号连接，返回状态码和错误信息
+func TestHandleVertexRequest(account *model.Account) (int, string) {
+	serviceAccount, err := common.ParseGoogleServiceAccount(account.VertexServiceAccount)
+	if err != nil {
+		return http.StatusBadRequest, "Vertex服务账号凭证无效: " + err.Error()
+	}
+
+	accessToken, err := getValidVertexAccessToken(account, serviceAccount)
+	if err != nil {
+		return http.StatusUnauthorized, "Failed to mint access token: " + err.Error()
+	}
+
+	requestBody := []byte(GetTestRequestBody(100))
+	modelID := resolveVertexModelID(gjson.GetBytes(requestBody, "model").String(), account)
+	body, err := buildVertexRequestBody(requestBody)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to build request body: " + err.Error()
+	}
+	body, _ = sjson.SetBytes(body, "stream", false)
+
+	req, err := createVertexRequest(context.Background(), account, serviceAccount.ProjectID, modelID, accessToken, body, false)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to create request: " + err.Error()
+	}
+
+	client, err := createHTTPClient(account)
+	if err != nil {
+		return http.StatusInternalServerError, "Invalid proxy configuration: " + err.Error()
+	}
+	client.Timeout = 30 * time.Second
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return http.StatusInternalServerError, "Request failed: " + err.Error()
+	}
+	defer common.CloseIO(resp.Body)
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, "Failed to read response: " + err.Error()
+	}
+
+	if resp.StatusCode >= statusBadRequest {
+		return resp.StatusCode, extractVertexErrorMessage(responseBody, resp.StatusCode)
+	}
+
+	return resp.StatusCode, ""
+}
@@ -209,14 +209,47 @@ func SetAPIRouter(server *gin.Engine) {
 				// 密钥管理接口（管理员专用）
 				adminKeys := admin.Group("/keys")
 				{
-					adminKeys.GET("", controller.AdminGetApiKeys) // 获取所有用户API Key列表
+					adminKeys.GET("", controller.AdminGetApiKeys)                                       // 获取所有用户API Key列表
+					adminKeys.GET("/:id/admission-policy", controller.AdminGetApiKeyAdmissionPolicy)    // 获取API Key准入策略
+					adminKeys.PUT("/:id/admission-policy", controller.AdminUpdateApiKeyAdmissionPolicy) // 更新API Key准入策略
+					adminKeys.GET("/:id/capture", controller.AdminGetApiKeyCapture)                     // 获取API Key请求捕获状态
+					adminKeys.PUT("/:id/capture", controller.AdminEnableApiKeyCapture)                  // 开启API Key请求捕获
+					adminKeys.DELETE("/:id/capture", controller.AdminDisableApiKeyCapture)              // 关闭API Key请求捕获
 				}
 
 				// 分组管理接口（管理员专用）
 				adminGroups := admin.Group("/groups")
 				{
-					adminGroups.GET("", controller.AdminGetGroups)        // 获取所有用户分组列表
-					adminGroups.GET("/all", controller.AdminGetAllGroups) // 获取所有分组（用于下拉选择）
+					adminGroups.GET("", controller.AdminGetGroups)                                          // 获取所有用户分组列表
+					adminGroups.GET("/all", controller.AdminGetAllGroups)                                   // 获取所有分组（用于下拉选择）
+					adminGroups.GET("/:id/admission-policy", controller.AdminGetGroupAdmissionPolicy)       // 获取分组准入策略
+					adminGroups.PUT("/:id/admission-policy", controller.AdminUpdateGroupAdmissionPolicy)    // 更新分组准入策略
+					adminGroups.GET("/:id/rewrite-rules", controller.AdminGetGroupRewriteRules)             // 获取分组请求改写规则
+					adminGroups.PUT("/:id/rewrite-rules", controller.AdminUpdateGroupRewriteRules)          // 更新分组请求改写规则
+					adminGroups.POST("/:id/rewrite-rules/dry-run", controller.AdminDryRunGroupRewriteRules) // 试运行请求改写规则
+					adminGroups.GET("/:id/capture", controller.AdminGetGroupCapture)                        // 获取分组请求捕获状态
+					adminGroups.PUT("/:id/capture", controller.AdminEnableGroupCapture)                     // 开启分组请求捕获
+					adminGroups.DELETE("/:id/capture", controller.AdminDisableGroupCapture)                 // 关闭分组请求捕获
+				}
+
+				// 代理管理接口（管理员专用）
+				adminProxies := admin.Group("/proxies")
+				{
+					adminProxies.GET("", controller.AdminGetProxies)            // 获取代理列表
+					adminProxies.POST("", controller.AdminCreateProxy)          // 创建代理
+					adminProxies.GET("/:id", controller.AdminGetProxy)          // 获取代理详情
+					adminProxies.PUT("/:id", controller.AdminUpdateProxy)       // 更新代理
+					adminProxies.DELETE("/:id", controller.AdminDeleteProxy)    // 删除代理
+					adminProxies.POST("/:id/check", controller.AdminCheckProxy) // 立即健康检查
+				}
+
+				// 请求捕获记录（管理员专用）
+				adminCaptures := admin.Group("/captures")
+				{
+					adminCaptures.GET("", controller.AdminGetCaptures)               // 获取捕获记录列表
+					adminCaptures.GET("/:id", controller.AdminGetCapture)            // 获取捕获记录详情
+					adminCaptures.DELETE("/:id", controller.AdminDeleteCapture)      // 删除捕获记录
+					adminCaptures.POST("/:id/replay", controller.AdminReplayCapture) // 使用指定账号重放并比较结果
 				}
 			}
 
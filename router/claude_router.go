@@ -3,18 +3,28 @@ package router
 import (
 	"claude-code-relay/controller"
 	"claude-code-relay/middleware"
+	"claude-code-relay/service"
 
 	"github.com/gin-gonic/gin"
 )
 
 func SetClaudeCodeRouter(server *gin.Engine) {
 	claude := server.Group("/claude-code")
-	// api key 鉴权
-	claude.Use(middleware.ClaudeCodeAuth())
 	// 计费中间件
 	claude.Use(middleware.BillingMiddleware())
 	{
-		// 对话接口
-		claude.POST("/v1/messages", controller.GetMessages)
+		// 对话接口（api key 鉴权，仅允许 Claude Code 客户端）
+		claude.POST("/v1/messages", middleware.ClaudeCodeAuth(), controller.GetMessages)
+
+		// 辅助接口（api key 鉴权，校验准入策略中系统提示词以外的规则），Claude Code 和 Anthropic SDK 会调用，请求中不一定携带 Claude Code 系统提示词
+		claude.POST("/v1/messages/count_tokens", middleware.ApiKeyAuth(service.AdmissionEndpointAuxiliary), controller.CountTokens)
+		claude.GET("/v1/models", middleware.ApiKeyAuth(service.AdmissionEndpointAuxiliary), controller.ListModels)
+
+		// Message Batches批处理接口（api key 鉴权，创建时逐个校验批内请求），批处理按批处理价格计费
+		claude.POST("/v1/messages/batches", middleware.ApiKeyAuth(service.AdmissionEndpointBatches), controller.CreateMessageBatch)
+		claude.GET("/v1/messages/batches", middleware.ApiKeyAuth(service.AdmissionEndpointAuxiliary), controller.ListMessageBatches)
+		claude.GET("/v1/messages/batches/:id", middleware.ApiKeyAuth(service.AdmissionEndpointAuxiliary), controller.GetMessageBatch)
+		claude.POST("/v1/messages/batches/:id/cancel", middleware.ApiKeyAuth(service.AdmissionEndpointAuxiliary), controller.CancelMessageBatch)
+		claude.GET("/v1/messages/batches/:id/results", middleware.ApiKeyAuth(service.AdmissionEndpointAuxiliary), controller.GetMessageBatchResults)
 	}
 }
@@ -0,0 +1,19 @@
+package router
+
+import (
+	"claude-code-relay/controller"
+	"claude-code-relay/middleware"
+	"claude-code-relay/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetOpenAIRouter(server *gin.Engine) {
+	openai := server.Group("/v1")
+	// api key 鉴权（准入策略开启 allow_openai 时不限制 Claude Code 客户端）
+	openai.Use(middleware.ApiKeyAuth(service.AdmissionEndpointOpenAI))
+	{
+		// OpenAI 兼容的对话接口
+		openai.POST("/chat/completions", controller.ChatCompletions)
+	}
+}
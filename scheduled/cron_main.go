@@ -81,6 +81,27 @@ func (s *CronService) Start() {
 		return
 	}
 
+	// 每5分钟检查代理健康状态，失败的代理从代理池中轮换出去
+	_, err = s.cron.AddFunc("0 */5 * * * *", s.checkProxyHealth)
+	if err != nil {
+		log.Printf("Failed to add proxy health check cron job: %v", err)
+		return
+	}
+
+	// 每小时清理超过保留时间的请求捕获记录
+	_, err = s.cron.AddFunc("0 0 * * * *", s.cleanExpiredCaptures)
+	if err != nil {
+		log.Printf("Failed to add capture cleanup cron job: %v", err)
+		return
+	}
+
+	// 每5分钟查询未完成的批处理，结束后收取结果并按批处理价格计费
+	_, err = s.cron.AddFunc("0 */5 * * * *", s.pollMessageBatches)
+	if err != nil {
+		log.Printf("Failed to add message batch poll cron job: %v", err)
+		return
+	}
+
 	// 启动定时任务
 	s.cron.Start()
 	common.SysLog("Cron service started successfully")
@@ -273,8 +294,14 @@ func (s *CronService) testAndRecoverAccount(account *model.Account) bool {
 		statusCode, err = relay.TestsHandleClaudeRequest(account)
 	case constant.PlatformClaudeConsole:
 		statusCode, err = relay.TestHandleClaudeConsoleRequest(account)
-	case constant.PlatformOpenAI:
+	case constant.PlatformOpenAI, constant.PlatformAzureOpenAI:
 		statusCode, err = relay.TestHandleOpenAIRequest(account)
+	case constant.PlatformGemini:
+		statusCode, err = relay.TestHandleGeminiRequest(account)
+	case constant.PlatformBedrock:
+		statusCode, err = relay.TestHandleBedrockRequest(account)
+	case constant.PlatformVertex:
+		statusCode, err = relay.TestHandleVertexRequest(account)
 	default:
 		common.SysError(fmt.Sprintf("Unsupported platform type for account %s (ID: %d): %s", account.Name, account.ID, account.PlatformType))
 		return false
@@ -290,6 +317,7 @@ func (s *CronService) testAndRecoverAccount(account *model.Account) bool {
 			common.SysError(fmt.Sprintf("Failed to recover account %s (ID: %d): %v", account.Name, account.ID, updateErr))
 			return false
 		}
+		service.ResetCircuitBreaker(account.ID)
 		return true
 	} else {
 		// 测试失败，记录日志但不改变状态
@@ -362,10 +390,44 @@ func (s *CronService) checkRateLimitExpiredAccounts() {
 		}
 	}
 
+	// 唤醒等待账号的排队请求
+	if recoveredCount > 0 {
+		service.NotifyAccountQueue()
+	}
+
 	duration := time.Since(startTime)
 	common.SysLog(fmt.Sprintf("Rate limit expired accounts check task completed in %s. Recovered: %d", duration.String(), recoveredCount))
 }
 
+// cleanExpiredCaptures 清理超过保留时间的请求捕获记录
+func (s *CronService) cleanExpiredCaptures() {
+	deletedCount, err := service.CleanExpiredCaptures()
+	if err != nil {
+		common.SysError("Failed to clean expired request captures: " + err.Error())
+		return
+	}
+	if deletedCount > 0 {
+		common.SysLog("Cleaned expired request captures, deleted " + strconv.FormatInt(deletedCount, 10) + " records")
+	}
+}
+
+// checkProxyHealth 检查所有启用代理的可达性和延迟
+func (s *CronService) checkProxyHealth() {
+	startTime := time.Now()
+	healthy, unhealthy := service.CheckAllProxies()
+	if healthy+unhealthy == 0 {
+		return
+	}
+
+	duration := time.Since(startTime)
+	common.SysLog(fmt.Sprintf("Proxy health check task completed in %s. Healthy: %d, Unhealthy: %d", duration.String(), healthy, unhealthy))
+}
+
+// pollMessageBatches 查询未完成批处理的状态并收取已结束批处理的结果
+func (s *CronService) pollMessageBatches() {
+	relay.PollMessageBatches()
+}
+
 // resetTimeCardDailyUsage 重置时间卡的每日使用次数
 func (s *CronService) resetTimeCardDailyUsage() {
 	startTime := time.Now()
@@ -428,15 +490,16 @@ func (s *CronService) ManualCleanupBillingPlans() error {
 	return nil
 }
 
-// checkAndRefreshTokens 检查并刷新即将过期的Claude账号Token
+// checkAndRefreshTokens 检查并刷新即将过期的Claude账号和Vertex账号Token
 func (s *CronService) checkAndRefreshTokens() {
 	startTime := time.Now()
 	common.SysLog("Starting Claude accounts token refresh check task")
 
-	// 获取所有启用的Claude账号（包括claude和claude_console平台）
+	// 获取所有启用的Claude账号（包括claude和claude_console平台）以及Vertex账号
 	var claudeAccounts []model.Account
-	err := model.DB.Where("platform_type IN (?, ?) AND active_status = ? AND refresh_token IS NOT NULL AND refresh_token != ''",
-		constant.PlatformClaude, constant.PlatformClaudeConsole, 1).Find(&claudeAccounts).Error
+	err := model.DB.Where("(platform_type IN (?, ?) AND refresh_token IS NOT NULL AND refresh_token != '') OR platform_type = ?",
+		constant.PlatformClaude, constant.PlatformClaudeConsole, constant.PlatformVertex).
+		Where("active_status = ?", 1).Find(&claudeAccounts).Error
 	if err != nil {
 		common.SysError("Failed to query Claude accounts for token refresh: " + err.Error())
 		return
@@ -459,8 +522,11 @@ func (s *CronService) checkAndRefreshTokens() {
 
 	// 逐个检查每个账号的token过期时间
 	for _, account := range claudeAccounts {
+		// Vertex账号的token由服务账号签发，没有token时直接签发
+		isVertex := account.PlatformType == constant.PlatformVertex
+
 		// 检查token是否存在
-		if account.AccessToken == "" {
+		if account.AccessToken == "" && !isVertex {
 			common.SysLog(fmt.Sprintf("Account %s (ID: %d) has no access token, skipping", account.Name, account.ID))
 			skippedCount++
 			continue
@@ -470,7 +536,7 @@ func (s *CronService) checkAndRefreshTokens() {
 		expiresAt := int64(account.ExpiresAt)
 
 		// 如果没有过期时间或者过期时间还很久，跳过
-		if expiresAt <= 0 {
+		if expiresAt <= 0 && !isVertex {
 			common.SysLog(fmt.Sprintf("Account %s (ID: %d) has no expiry time, skipping", account.Name, account.ID))
 			skippedCount++
 			continue
@@ -505,6 +571,10 @@ func (s *CronService) checkAndRefreshTokens() {
 
 // refreshAccountToken 刷新单个账号的token
 func (s *CronService) refreshAccountToken(account *model.Account) bool {
+	if account.PlatformType == constant.PlatformVertex {
+		return s.refreshVertexToken(account)
+	}
+
 	// 检查是否有refresh token
 	if account.RefreshToken == "" {
 		common.SysError(fmt.Sprintf("Account %s (ID: %d) has no refresh token, cannot refresh", account.Name, account.ID))
@@ -545,6 +615,28 @@ func (s *CronService) refreshAccountToken(account *model.Account) bool {
 	return true
 }
 
+// refreshVertexToken 使用服务账号为Vertex账号重新签发token
+func (s *CronService) refreshVertexToken(account *model.Account) bool {
+	newAccessToken, newExpiresAt, err := relay.RefreshVertexToken(account)
+	if err != nil {
+		common.SysError(fmt.Sprintf("Failed to mint vertex token for account %s (ID: %d): %v", account.Name, account.ID, err))
+		return false
+	}
+
+	account.AccessToken = newAccessToken
+	account.ExpiresAt = int(newExpiresAt)
+
+	if err := model.UpdateAccount(account); err != nil {
+		common.SysError(fmt.Sprintf("Failed to update account token info for %s (ID: %d): %v", account.Name, account.ID, err))
+		return false
+	}
+
+	expiryTime := time.Unix(newExpiresAt, 0)
+	common.SysLog(fmt.Sprintf("Vertex account %s (ID: %d) token minted successfully, new token expires at %s",
+		account.Name, account.ID, expiryTime.Format("2006-01-02 15:04:05")))
+	return true
+}
+
 // ManualRefreshTokens 手动刷新Claude账号token（用于测试或管理员操作）
 func (s *CronService) ManualRefreshTokens() error {
 	common.SysLog("Manual Claude accounts token refresh triggered")
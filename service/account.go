@@ -2,9 +2,12 @@ package service
 
 import (
 	"claude-code-relay/common"
+	"claude-code-relay/constant"
 	"claude-code-relay/model"
+	"crypto/x509"
 	"errors"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -27,6 +30,7 @@ func (s *AccountService) GetAccountList(page, limit int, userID *uint) (*model.A
 	if err != nil {
 		return nil, errors.New("获取账号列表失败")
 	}
+	AttachAccountRateLimits(accounts)
 
 	result := &model.AccountListResponse{
 		Accounts: accounts,
@@ -40,6 +44,16 @@ func (s *AccountService) GetAccountList(page, limit int, userID *uint) (*model.A
 
 // CreateAccount 创建账号
 func (s *AccountService) CreateAccount(req *model.CreateAccountRequest, userID uint) (*model.Account, error) {
+	if err := validateCACert(req.CACert); err != nil {
+		return nil, err
+	}
+	if err := validateAccountProxy(req.ProxyID); err != nil {
+		return nil, err
+	}
+	if err := validateModelMapping(req.PlatformType, req.ModelMapping); err != nil {
+		return nil, err
+	}
+
 	// 设置今日请求次数：获取同用户、同分组、同优先级可用账号的最大今日请求次数，然后减1
 	todayUsageCount := req.TodayUsageCount
 	if todayUsageCount == 0 && req.Priority > 0 {
@@ -61,6 +75,7 @@ func (s *AccountService) CreateAccount(req *model.CreateAccountRequest, userID u
 		GroupID:         req.GroupID,
 		Priority:        req.Priority,
 		Weight:          req.Weight,
+		MaxConcurrency:  req.MaxConcurrency,
 		EnableProxy:     req.EnableProxy,
 		ProxyURI:        req.ProxyURI,
 		ModelMapping:    req.ModelMapping,
@@ -71,6 +86,19 @@ func (s *AccountService) CreateAccount(req *model.CreateAccountRequest, userID u
 		ExpiresAt:       req.ExpiresAt,
 		TodayUsageCount: todayUsageCount,
 		UserID:          userID,
+
+		AwsAccessKeyID:     req.AwsAccessKeyID,
+		AwsSecretAccessKey: req.AwsSecretAccessKey,
+		AwsRegion:          req.AwsRegion,
+
+		VertexServiceAccount: req.VertexServiceAccount,
+		VertexRegion:         req.VertexRegion,
+
+		SupportedModels: normalizeModelList(req.SupportedModels),
+		CACert:          strings.TrimSpace(req.CACert),
+		TLSSkipVerify:   req.TLSSkipVerify,
+		ProxyID:         req.ProxyID,
+		ProxyPool:       strings.TrimSpace(req.ProxyPool),
 	}
 
 	if err := model.CreateAccount(account); err != nil {
@@ -91,12 +119,23 @@ func (s *AccountService) GetAccountByID(id uint, userID *uint) (*model.Account,
 	if userID != nil && account.UserID != *userID {
 		return nil, errors.New("无权访问此账号")
 	}
+	account.RateLimit = GetAccountRateLimit(account.ID)
 
 	return account, nil
 }
 
 // UpdateAccount 更新账号
 func (s *AccountService) UpdateAccount(id uint, req *model.UpdateAccountRequest, userID *uint) (*model.Account, error) {
+	if err := validateCACert(req.CACert); err != nil {
+		return nil, err
+	}
+	if err := validateAccountProxy(req.ProxyID); err != nil {
+		return nil, err
+	}
+	if err := validateModelMapping(req.PlatformType, req.ModelMapping); err != nil {
+		return nil, err
+	}
+
 	account, err := s.GetAccountByID(id, userID)
 	if err != nil {
 		return nil, err
@@ -111,9 +150,15 @@ func (s *AccountService) UpdateAccount(id uint, req *model.UpdateAccountRequest,
 	}
 	account.Priority = req.Priority
 	account.Weight = req.Weight
+	account.MaxConcurrency = req.MaxConcurrency
 	account.EnableProxy = req.EnableProxy
 	account.ProxyURI = req.ProxyURI
 	account.ModelMapping = req.ModelMapping
+	account.SupportedModels = normalizeModelList(req.SupportedModels)
+	account.CACert = strings.TrimSpace(req.CACert)
+	account.TLSSkipVerify = req.TLSSkipVerify
+	account.ProxyID = req.ProxyID
+	account.ProxyPool = strings.TrimSpace(req.ProxyPool)
 	account.ActiveStatus = req.ActiveStatus
 	account.IsMax = req.IsMax
 
@@ -121,6 +166,20 @@ func (s *AccountService) UpdateAccount(id uint, req *model.UpdateAccountRequest,
 		account.SecretKey = req.SecretKey
 	}
 
+	account.AwsAccessKeyID = req.AwsAccessKeyID
+	account.AwsRegion = req.AwsRegion
+	if req.AwsSecretAccessKey != "" {
+		account.AwsSecretAccessKey = req.AwsSecretAccessKey
+	}
+
+	account.VertexRegion = req.VertexRegion
+	if req.VertexServiceAccount != "" {
+		account.VertexServiceAccount = req.VertexServiceAccount
+		// 凭证变更后需要重新签发访问令牌
+		account.AccessToken = ""
+		account.ExpiresAt = 0
+	}
+
 	if req.AccessToken != "" {
 		account.AccessToken = req.AccessToken
 	}
@@ -141,6 +200,31 @@ func (s *AccountService) UpdateAccount(id uint, req *model.UpdateAccountRequest,
 	return account, nil
 }
 
+// validateModelMapping 校验模型映射，Azure OpenAI的部署名称由用户自定义，必须配置至少一条映射
+func validateModelMapping(platformType, modelMapping string) error {
+	if platformType != constant.PlatformAzureOpenAI {
+		return nil
+	}
+	for _, mapping := range strings.Split(modelMapping, ",") {
+		parts := strings.Split(strings.TrimSpace(mapping), ":")
+		if (len(parts) == 2 || len(parts) == 3) && strings.TrimSpace(parts[0]) != "" && strings.TrimSpace(parts[1]) != "" {
+			return nil
+		}
+	}
+	return errors.New("Azure OpenAI账号需要配置模型映射，格式为 源模型:部署名称[:基础模型]")
+}
+
+// validateCACert 校验自定义CA证书是否为合法的PEM格式
+func validateCACert(caCert string) error {
+	if strings.TrimSpace(caCert) == "" {
+		return nil
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM([]byte(caCert)) {
+		return errors.New("CA证书格式错误，需要PEM格式的证书")
+	}
+	return nil
+}
+
 // DeleteAccount 删除账号
 func (s *AccountService) DeleteAccount(id uint, userID *uint) error {
 	account, err := s.GetAccountByID(id, userID)
@@ -211,22 +295,54 @@ func (s *AccountService) UpdateAccountCurrentStatus(id uint, currentStatus int,
 		return errors.New("更新账号当前状态失败")
 	}
 
+	// 手动恢复正常时重置熔断器和冷却状态
+	if currentStatus == 1 {
+		ResetCircuitBreaker(account.ID)
+		ClearAccountCooldown(account.ID)
+	}
+
 	return nil
 }
 
 // UpdateAccountStatus 根据响应状态码更新账号状态
 func (s *AccountService) UpdateAccountStatus(account *model.Account, statusCode int, usage *common.TokenUsage) {
-	// 根据状态码设置CurrentStatus
-	switch {
-	case statusCode == 429:
-		// 限流状态
+	s.updateAccountStatus(account, statusCode, nil, usage)
+}
+
+// UpdateAccountErrorStatus 根据上游错误响应更新账号状态，错误响应体中的错误类型优先于状态码
+func (s *AccountService) UpdateAccountErrorStatus(account *model.Account, statusCode int, errorBody []byte) {
+	s.updateAccountStatus(account, statusCode, errorBody, nil)
+}
+
+// updateAccountStatus 按错误分类更新账号状态，成功时更新使用统计
+func (s *AccountService) updateAccountStatus(account *model.Account, statusCode int, errorBody []byte, usage *common.TokenUsage) {
+	// 根据错误分类设置CurrentStatus
+	switch class := ClassifyUpstreamError(statusCode, errorBody); {
+	case class == ErrorClassRateLimit:
+		// 限流状态，没有上游给出的重置时间时按连续限流次数指数退避
 		account.CurrentStatus = 3
-	case statusCode > 400:
-		// 接口异常
+		if account.RateLimitEndTime == nil || time.Now().After(time.Time(*account.RateLimitEndTime)) {
+			duration, _ := NextAccountCooldown(account.ID, ErrorClassRateLimit)
+			rateLimitEndTime := model.Time(time.Now().Add(duration))
+			account.RateLimitEndTime = &rateLimitEndTime
+		}
+	case class == ErrorClassOverloaded:
+		// 上游过载与账号无关，只短暂冷却，不计入熔断器
+		StartAccountCooldown(account, class)
+		return
+	case class == ErrorClassUpstream5xx || class == ErrorClassAuthRevoked:
+		// 先按分类冷却，同时计入熔断器，熔断器打开时才标记为接口异常
+		StartAccountCooldown(account, class)
+		if !RecordCircuitFailure(account.ID) {
+			return
+		}
 		account.CurrentStatus = 2
 	case statusCode == 200 || statusCode == 201:
-		// 正常状态
-		account.CurrentStatus = 1
+		// 熔断器关闭时恢复正常状态，半开探测期间保持原状态
+		if RecordCircuitSuccess(account.ID) {
+			account.CurrentStatus = 1
+		}
+		ClearAccountCooldown(account.ID)
 
 		// 请求成功时更新最后使用时间和今日使用次数
 		now := time.Now()
@@ -296,3 +412,16 @@ func (s *AccountService) UpdateAccountStatus(account *model.Account, statusCode
 		log.Printf("failed to update account status: %v", err)
 	}
 }
+
+// RecordAccountRequestError 记录网络错误等未拿到上游响应的失败，账号短暂冷却，熔断器打开时标记为接口异常
+func (s *AccountService) RecordAccountRequestError(account *model.Account) {
+	StartAccountCooldown(account, ErrorClassNetwork)
+	if !RecordCircuitFailure(account.ID) {
+		return
+	}
+
+	account.CurrentStatus = 2
+	if err := model.UpdateAccount(account); err != nil {
+		log.Printf("failed to update account status: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// 上游错误分类
+const (
+	ErrorClassRateLimit      = "rate_limit"      // 账号限流(429)
+	ErrorClassOverloaded     = "overloaded"      // 上游过载(529)，与账号无关，短暂冷却即可
+	ErrorClassAuthRevoked    = "auth_revoked"    // 鉴权失败(401/403)，账号凭证失效或被封禁
+	ErrorClassInvalidRequest = "invalid_request" // 请求内容错误(400/404/413等)，不影响账号
+	ErrorClassUpstream5xx    = "upstream_5xx"    // 上游服务端错误
+	ErrorClassNetwork        = "network"         // 网络错误，未拿到上游响应
+)
+
+const (
+	accountCooldownKeyPrefix       = "account_cooldown:"
+	accountCooldownStrikeKeyPrefix = "account_cooldown_strikes:"
+	// 默认的冷却时间随机抖动比例，避免大量账号同时恢复
+	defaultCooldownJitter = 0.2
+
+	statusOverloaded = 529
+)
+
+// cooldownPolicy 单个错误分类的冷却策略，冷却时间为 base*2^(连续失败次数-1)，不超过max
+type cooldownPolicy struct {
+	base time.Duration
+	max  time.Duration
+}
+
+// defaultCooldownPolicies 各错误分类的默认冷却策略，未列出的分类不冷却
+var defaultCooldownPolicies = map[string]cooldownPolicy{
+	ErrorClassRateLimit:   {base: time.Minute, max: 5 * time.Hour},
+	ErrorClassOverloaded:  {base: 30 * time.Second, max: 10 * time.Minute},
+	ErrorClassUpstream5xx: {base: 30 * time.Second, max: 10 * time.Minute},
+	ErrorClassNetwork:     {base: 15 * time.Second, max: 5 * time.Minute},
+	ErrorClassAuthRevoked: {base: 5 * time.Minute, max: 6 * time.Hour},
+}
+
+// AccountCooldown 账号的临时冷却状态，保存在Redis中，冷却期间调度时跳过该账号
+type AccountCooldown struct {
+	Class   string `json:"class"`
+	Strikes int64  `json:"strikes"` // 该分类的连续失败次数
+	Until   int64  `json:"until"`   // 冷却结束时间戳(秒)
+}
+
+// ClassifyUpstreamError 根据上游状态码和错误响应体对失败进行分类，状态码为0表示网络错误，成功响应返回空字符串
+func ClassifyUpstreamError(statusCode int, body []byte) string {
+	if statusCode == 0 {
+		return ErrorClassNetwork
+	}
+	if statusCode < http.StatusBadRequest {
+		return ""
+	}
+
+	// 部分上游会用非标准状态码返回Anthropic格式的错误，优先以错误类型为准
+	if len(body) > 0 {
+		switch gjson.GetBytes(body, "error.type").String() {
+		case "overloaded_error":
+			return ErrorClassOverloaded
+		case "rate_limit_error":
+			return ErrorClassRateLimit
+		}
+		if strings.Contains(strings.ToLower(gjson.GetBytes(body, "error.message").String()), "exceed your account's rate limit") {
+			return ErrorClassRateLimit
+		}
+	}
+
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorClassRateLimit
+	case statusCode == statusOverloaded:
+		return ErrorClassOverloaded
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrorClassAuthRevoked
+	case statusCode >= http.StatusInternalServerError:
+		return ErrorClassUpstream5xx
+	default:
+		return ErrorClassInvalidRequest
+	}
+}
+
+// getCooldownPolicy 获取错误分类的冷却策略，支持通过 ACCOUNT_COOLDOWN_<分类>_BASE_SECONDS/_MAX_SECONDS 覆盖
+func getCooldownPolicy(class string) (cooldownPolicy, bool) {
+	policy, ok := defaultCooldownPolicies[class]
+	if !ok {
+		return policy, false
+	}
+	prefix := "ACCOUNT_COOLDOWN_" + strings.ToUpper(class)
+	policy.base = getEnvDuration(prefix+"_BASE_SECONDS", policy.base)
+	policy.max = getEnvDuration(prefix+"_MAX_SECONDS", policy.max)
+	if policy.max < policy.base {
+		policy.max = policy.base
+	}
+	return policy, true
+}
+
+// getCooldownJitter 获取冷却时间的随机抖动比例
+func getCooldownJitter() float64 {
+	if value := os.Getenv("ACCOUNT_COOLDOWN_JITTER"); value != "" {
+		if jitter, err := strconv.ParseFloat(value, 64); err == nil && jitter >= 0 && jitter < 1 {
+			return jitter
+		}
+	}
+	return defaultCooldownJitter
+}
+
+// cooldownDuration 按连续失败次数计算指数退避的冷却时间，并加入随机抖动
+func cooldownDuration(policy cooldownPolicy, strikes int64, jitter float64) time.Duration {
+	if strikes < 1 {
+		strikes = 1
+	}
+	// 限制指数避免溢出，超过上限后统一取max
+	exponent := math.Min(float64(strikes-1), 30)
+	duration := time.Duration(math.Min(float64(policy.base)*math.Pow(2, exponent), float64(policy.max)))
+	if jitter > 0 {
+		duration = time.Duration(float64(duration) * (1 - jitter + rand.Float64()*2*jitter))
+	}
+	return duration
+}
+
+// accountCooldownStrikeKey 账号某个错误分类的连续失败计数键
+func accountCooldownStrikeKey(accountID uint, class string) string {
+	return accountCooldownStrikeKeyPrefix + strconv.Itoa(int(accountID)) + ":" + class
+}
+
+// NextAccountCooldown 累加账号该分类的连续失败次数，返回本次应冷却的时间，分类不需要冷却时返回0
+func NextAccountCooldown(accountID uint, class string) (time.Duration, int64) {
+	policy, ok := getCooldownPolicy(class)
+	if !ok {
+		return 0, 0
+	}
+
+	ctx := context.Background()
+	key := accountCooldownStrikeKey(accountID, class)
+	strikes, err := common.RDB.Incr(ctx, key).Result()
+	if err != nil {
+		common.SysError("incr account cooldown strikes error: " + err.Error())
+		strikes = 1
+	} else {
+		// 超过两倍最长冷却时间没有再失败，则重新从基础冷却时间开始
+		common.RDB.Expire(ctx, key, 2*policy.max)
+	}
+	return cooldownDuration(policy, strikes, getCooldownJitter()), strikes
+}
+
+// StartAccountCooldown 让账号按错误分类进入冷却，已有更长的冷却时保持不变，返回本次计算的冷却时间
+func StartAccountCooldown(account *model.Account, class string) time.Duration {
+	duration, strikes := NextAccountCooldown(account.ID, class)
+	if duration <= 0 {
+		return 0
+	}
+
+	until := time.Now().Add(duration)
+	if current := GetAccountCooldown(account.ID); current != nil && current.Until > until.Unix() {
+		return duration
+	}
+
+	data, err := json.Marshal(AccountCooldown{Class: class, Strikes: strikes, Until: until.Unix()})
+	if err != nil {
+		return duration
+	}
+	key := accountCooldownKeyPrefix + strconv.Itoa(int(account.ID))
+	if err := common.RDB.Set(context.Background(), key, data, duration).Err(); err != nil {
+		common.SysError("set account cooldown error: " + err.Error())
+		return duration
+	}
+
+	common.SysLog(fmt.Sprintf("[COOLDOWN] Account %s (ID: %d) cooling down for %s after %s error (strike %d)",
+		account.Name, account.ID, duration.Round(time.Second), class, strikes))
+	return duration
+}
+
+// GetAccountCooldown 获取账号当前的冷却状态，未冷却时返回nil
+func GetAccountCooldown(accountID uint) *AccountCooldown {
+	data, err := common.RDB.Get(context.Background(), accountCooldownKeyPrefix+strconv.Itoa(int(accountID))).Bytes()
+	if err != nil {
+		return nil
+	}
+	var cooldown AccountCooldown
+	if err := json.Unmarshal(data, &cooldown); err != nil {
+		return nil
+	}
+	return &cooldown
+}
+
+// ClearAccountCooldown 请求成功后清除账号的冷却状态和所有分类的连续失败次数
+func ClearAccountCooldown(accountID uint) {
+	keys := []string{accountCooldownKeyPrefix + strconv.Itoa(int(accountID))}
+	for class := range defaultCooldownPolicies {
+		keys = append(keys, accountCooldownStrikeKey(accountID, class))
+	}
+	if err := common.RDB.Del(context.Background(), keys...).Err(); err != nil {
+		common.SysError("clear account cooldown error: " + err.Error())
+	}
+}
+
+// filterCoolingAccounts 过滤掉冷却中的账号，全部账号都在冷却时返回空列表，由调用方排队等待冷却到期或降级模型
+func filterCoolingAccounts(accounts []model.Account) []model.Account {
+	if len(accounts) == 0 {
+		return accounts
+	}
+
+	keys := make([]string, len(accounts))
+	for i, account := range accounts {
+		keys[i] = accountCooldownKeyPrefix + strconv.Itoa(int(account.ID))
+	}
+	values, err := common.RDB.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		common.SysError("get account cooldowns error: " + err.Error())
+		return accounts
+	}
+
+	available := make([]model.Account, 0, len(accounts))
+	for i, value := range values {
+		if value == nil {
+			available = append(available, accounts[i])
+		}
+	}
+	return available
+}
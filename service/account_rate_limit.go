@@ -0,0 +1,248 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	accountRateLimitKeyPrefix = "account_ratelimit:"
+	// 限流状态最长保留时间，覆盖7天窗口
+	accountRateLimitTTL = 7 * 24 * time.Hour
+	// 默认的限流预警阈值，已用比例达到该值的账号调度时排在后面
+	defaultRateLimitWarnThreshold = 0.9
+
+	rateLimitStatusWarning  = "allowed_warning"
+	rateLimitStatusRejected = "rejected"
+)
+
+// ParseAccountRateLimit 从上游响应头解析限流状态，没有任何限流响应头时返回nil
+func ParseAccountRateLimit(header http.Header) *model.AccountRateLimit {
+	state := &model.AccountRateLimit{
+		Status:              header.Get("anthropic-ratelimit-unified-status"),
+		Reset:               parseHeaderInt(header, "anthropic-ratelimit-unified-reset"),
+		RepresentativeClaim: header.Get("anthropic-ratelimit-unified-representative-claim"),
+		FiveHourStatus:      header.Get("anthropic-ratelimit-unified-5h-status"),
+		FiveHourReset:       parseHeaderInt(header, "anthropic-ratelimit-unified-5h-reset"),
+		FiveHourUtilization: parseHeaderUtilization(header, "anthropic-ratelimit-unified-5h-utilization"),
+		SevenDayStatus:      header.Get("anthropic-ratelimit-unified-7d-status"),
+		SevenDayReset:       parseHeaderInt(header, "anthropic-ratelimit-unified-7d-reset"),
+		SevenDayUtilization: parseHeaderUtilization(header, "anthropic-ratelimit-unified-7d-utilization"),
+		RequestsLimit:       parseHeaderIntPtr(header, "anthropic-ratelimit-requests-limit"),
+		RequestsRemaining:   parseHeaderIntPtr(header, "anthropic-ratelimit-requests-remaining"),
+		RequestsReset:       header.Get("anthropic-ratelimit-requests-reset"),
+		TokensLimit:         parseHeaderIntPtr(header, "anthropic-ratelimit-tokens-limit"),
+		TokensRemaining:     parseHeaderIntPtr(header, "anthropic-ratelimit-tokens-remaining"),
+		TokensReset:         header.Get("anthropic-ratelimit-tokens-reset"),
+	}
+
+	if state.Status == "" && state.FiveHourStatus == "" && state.SevenDayStatus == "" &&
+		state.FiveHourUtilization == nil && state.SevenDayUtilization == nil &&
+		state.RequestsLimit == nil && state.TokensLimit == nil {
+		return nil
+	}
+	state.UpdatedAt = time.Now().Unix()
+	return state
+}
+
+// RecordAccountRateLimit 解析上游响应头中的限流信息并保存到Redis
+func RecordAccountRateLimit(accountID uint, header http.Header) {
+	state := ParseAccountRateLimit(header)
+	if state == nil {
+		return
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	key := accountRateLimitKeyPrefix + strconv.Itoa(int(accountID))
+	if err := common.RDB.Set(context.Background(), key, data, accountRateLimitTTL).Err(); err != nil {
+		common.SysError("record account rate limit error: " + err.Error())
+	}
+}
+
+// GetAccountRateLimit 获取账号最近一次记录的限流状态
+func GetAccountRateLimit(accountID uint) *model.AccountRateLimit {
+	data, err := common.RDB.Get(context.Background(), accountRateLimitKeyPrefix+strconv.Itoa(int(accountID))).Bytes()
+	if err != nil {
+		return nil
+	}
+	var state model.AccountRateLimit
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil
+	}
+	return &state
+}
+
+// GetAccountRateLimits 批量获取账号的限流状态
+func GetAccountRateLimits(accounts []model.Account) map[uint]*model.AccountRateLimit {
+	states := make(map[uint]*model.AccountRateLimit, len(accounts))
+	if len(accounts) == 0 {
+		return states
+	}
+
+	keys := make([]string, len(accounts))
+	for i, account := range accounts {
+		keys[i] = accountRateLimitKeyPrefix + strconv.Itoa(int(account.ID))
+	}
+
+	values, err := common.RDB.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		common.SysError("get account rate limits error: " + err.Error())
+		return states
+	}
+
+	for i, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var state model.AccountRateLimit
+		if err := json.Unmarshal([]byte(str), &state); err == nil {
+			states[accounts[i].ID] = &state
+		}
+	}
+	return states
+}
+
+// AttachAccountRateLimits 为账号列表附加实时限流状态，供账号列表和详情接口返回
+func AttachAccountRateLimits(accounts []model.Account) {
+	states := GetAccountRateLimits(accounts)
+	for i := range accounts {
+		accounts[i].RateLimit = states[accounts[i].ID]
+	}
+}
+
+// AccountRateLimitPressure 计算账号的限流压力(0-1)，1表示已被拒绝，已过重置时间的窗口不计入
+func AccountRateLimitPressure(state *model.AccountRateLimit, now int64, warnThreshold float64) float64 {
+	if state == nil {
+		return 0
+	}
+
+	pressure := 0.0
+	windows := []struct {
+		status      string
+		reset       int64
+		utilization *float64
+	}{
+		{state.Status, state.Reset, nil},
+		{state.FiveHourStatus, state.FiveHourReset, state.FiveHourUtilization},
+		{state.SevenDayStatus, state.SevenDayReset, state.SevenDayUtilization},
+	}
+	for _, window := range windows {
+		if window.reset > 0 && now >= window.reset {
+			continue
+		}
+		switch window.status {
+		case rateLimitStatusRejected:
+			return 1
+		case rateLimitStatusWarning:
+			pressure = math.Max(pressure, warnThreshold)
+		}
+		if window.utilization != nil {
+			pressure = math.Max(pressure, *window.utilization)
+		}
+	}
+
+	pressure = math.Max(pressure, remainingPressure(state.RequestsLimit, state.RequestsRemaining, state.RequestsReset, now))
+	pressure = math.Max(pressure, remainingPressure(state.TokensLimit, state.TokensRemaining, state.TokensReset, now))
+	return math.Min(pressure, 1)
+}
+
+// remainingPressure 根据额度和剩余量计算已用比例
+func remainingPressure(limit, remaining *int64, reset string, now int64) float64 {
+	if limit == nil || remaining == nil || *limit <= 0 {
+		return 0
+	}
+	if resetTime, err := time.Parse(time.RFC3339, reset); err == nil && now >= resetTime.Unix() {
+		return 0
+	}
+	return 1 - float64(*remaining)/float64(*limit)
+}
+
+// getRateLimitWarnThreshold 获取限流预警阈值
+func getRateLimitWarnThreshold() float64 {
+	if value := os.Getenv("ACCOUNT_RATELIMIT_WARN_THRESHOLD"); value != "" {
+		if threshold, err := strconv.ParseFloat(value, 64); err == nil && threshold > 0 && threshold <= 1 {
+			return threshold
+		}
+	}
+	return defaultRateLimitWarnThreshold
+}
+
+// deprioritizeLimitedAccounts 将接近限流的账号移到调度顺序末尾，已被拒绝的账号排在最后，同层级内保持原有顺序
+func deprioritizeLimitedAccounts(accounts []model.Account) []model.Account {
+	if len(accounts) < 2 {
+		return accounts
+	}
+
+	states := GetAccountRateLimits(accounts)
+	if len(states) == 0 {
+		return accounts
+	}
+
+	now := time.Now().Unix()
+	threshold := getRateLimitWarnThreshold()
+	tiers := make(map[uint]int, len(accounts))
+	for _, account := range accounts {
+		pressure := AccountRateLimitPressure(states[account.ID], now, threshold)
+		switch {
+		case pressure >= 1:
+			tiers[account.ID] = 2
+		case pressure >= threshold:
+			tiers[account.ID] = 1
+		}
+	}
+
+	sort.SliceStable(accounts, func(i, j int) bool {
+		return tiers[accounts[i].ID] < tiers[accounts[j].ID]
+	})
+	return accounts
+}
+
+// parseHeaderInt 解析整数响应头，不存在或格式错误时返回0
+func parseHeaderInt(header http.Header, name string) int64 {
+	if value := parseHeaderIntPtr(header, name); value != nil {
+		return *value
+	}
+	return 0
+}
+
+// parseHeaderIntPtr 解析整数响应头，不存在或格式错误时返回nil
+func parseHeaderIntPtr(header http.Header, name string) *int64 {
+	value := strings.TrimSpace(header.Get(name))
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &parsed
+}
+
+// parseHeaderUtilization 解析已用比例响应头，兼容百分比格式
+func parseHeaderUtilization(header http.Header, name string) *float64 {
+	value := strings.TrimSpace(header.Get(name))
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil {
+		return nil
+	}
+	if parsed > 1 || strings.HasSuffix(value, "%") {
+		parsed /= 100
+	}
+	return &parsed
+}
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"gorm.io/gorm"
+)
+
+// 准入规则名称，拒绝请求时返回给客户端
+const (
+	AdmissionRuleUserAgent       = "user_agent"
+	AdmissionRuleSystemPrompt    = "system_prompt"
+	AdmissionRuleMinClaudeCode   = "min_claude_code_version"
+	defaultClaudeCodeUserAgentRe = `claude-cli/\d+\.\d+\.\d+`
+)
+
+// 准入校验的接口类型，不同接口校验的规则不同
+const (
+	AdmissionEndpointMessages  = "messages"  // 对话接口，校验全部规则
+	AdmissionEndpointAuxiliary = "auxiliary" // count_tokens、模型列表和批处理查询接口，请求中不一定携带系统提示词，不校验系统提示词
+	AdmissionEndpointBatches   = "batches"   // 创建批处理接口，逐个校验批内请求的系统提示词
+	AdmissionEndpointOpenAI    = "openai"    // OpenAI兼容接口，策略开启allow_openai时不校验，否则按OpenAI格式校验全部规则
+)
+
+var (
+	claudeCodeVersionRegexp = regexp.MustCompile(`claude-cli/(\d+)\.(\d+)\.(\d+)`)
+	versionRegexp           = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+	// 已编译的User-Agent正则缓存
+	admissionRegexpCache sync.Map
+)
+
+// AdmissionError 客户端准入校验失败，Rule为未通过的规则
+type AdmissionError struct {
+	Rule    string
+	Message string
+}
+
+// Error 实现error接口
+func (e *AdmissionError) Error() string {
+	return e.Rule + ": " + e.Message
+}
+
+// DefaultAdmissionPolicy 默认准入策略：仅允许 Claude Code 客户端，OpenAI兼容接口需分组显式开启allow_openai
+func DefaultAdmissionPolicy() *model.AdmissionPolicy {
+	return &model.AdmissionPolicy{
+		Mode:                 model.AdmissionModeRestricted,
+		UserAgentPatterns:    []string{defaultClaudeCodeUserAgentRe},
+		SystemPromptPrefixes: []string{constant.ClaudeCodeSystemPrompt},
+		AllowOpenAI:          false,
+	}
+}
+
+// ParseAdmissionPolicy 解析保存的准入策略，空字符串表示未配置
+func ParseAdmissionPolicy(raw string) (*model.AdmissionPolicy, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var policy model.AdmissionPolicy
+	if err := json.Unmarshal([]byte(raw), &policy); err != nil {
+		return nil, err
+	}
+	if policy.Mode == "" {
+		policy.Mode = model.AdmissionModeRestricted
+	}
+	return &policy, nil
+}
+
+// ValidateAdmissionPolicy 校验准入策略配置
+func ValidateAdmissionPolicy(policy *model.AdmissionPolicy) error {
+	if policy.Mode != "" && policy.Mode != model.AdmissionModeRestricted && policy.Mode != model.AdmissionModeAny {
+		return errors.New("准入模式只能是 restricted 或 any")
+	}
+	for _, pattern := range policy.UserAgentPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("User-Agent正则 %q 无效: %v", pattern, err)
+		}
+	}
+	if policy.MinClaudeCodeVersion != "" && !versionRegexp.MatchString(policy.MinClaudeCodeVersion) {
+		return errors.New("最低Claude Code版本格式应为 x.y.z")
+	}
+	return nil
+}
+
+// ResolveAdmissionPolicy 获取API Key生效的准入策略：API Key策略优先，其次分组策略，都未配置时使用默认策略
+func ResolveAdmissionPolicy(apiKey *model.ApiKey) *model.AdmissionPolicy {
+	if policy := parseStoredAdmissionPolicy(apiKey.AdmissionPolicy, fmt.Sprintf("api key %d", apiKey.ID)); policy != nil {
+		return policy
+	}
+
+	if apiKey.GroupID > 0 {
+		if group, err := model.GetGroupById(apiKey.GroupID, apiKey.UserID); err == nil {
+			if policy := parseStoredAdmissionPolicy(group.AdmissionPolicy, fmt.Sprintf("group %d", group.ID)); policy != nil {
+				return policy
+			}
+		}
+	}
+
+	return DefaultAdmissionPolicy()
+}
+
+// parseStoredAdmissionPolicy 解析数据库中的策略，格式错误时记录日志并视为未配置
+func parseStoredAdmissionPolicy(raw, owner string) *model.AdmissionPolicy {
+	policy, err := ParseAdmissionPolicy(raw)
+	if err != nil {
+		common.SysError(fmt.Sprintf("invalid admission policy on %s: %v", owner, err))
+		return nil
+	}
+	return policy
+}
+
+// CheckAdmission 按准入策略和接口类型校验客户端请求，返回第一条未通过的规则
+func CheckAdmission(policy *model.AdmissionPolicy, endpoint, userAgent string, body []byte) *AdmissionError {
+	if policy.Mode == model.AdmissionModeAny {
+		return nil
+	}
+	if endpoint == AdmissionEndpointOpenAI && policy.AllowOpenAI {
+		return nil
+	}
+
+	if len(policy.UserAgentPatterns) > 0 && !matchAnyUserAgent(policy.UserAgentPatterns, userAgent) {
+		return &AdmissionError{
+			Rule:    AdmissionRuleUserAgent,
+			Message: fmt.Sprintf("User-Agent %q 不在允许的客户端列表中", userAgent),
+		}
+	}
+
+	if policy.MinClaudeCodeVersion != "" {
+		matches := claudeCodeVersionRegexp.FindStringSubmatch(userAgent)
+		if matches == nil {
+			return &AdmissionError{
+				Rule:    AdmissionRuleMinClaudeCode,
+				Message: "无法从User-Agent中识别Claude Code版本",
+			}
+		}
+		version := strings.Join(matches[1:], ".")
+		if compareVersions(version, policy.MinClaudeCodeVersion) < 0 {
+			return &AdmissionError{
+				Rule:    AdmissionRuleMinClaudeCode,
+				Message: fmt.Sprintf("Claude Code版本 %s 低于最低要求 %s", version, policy.MinClaudeCodeVersion),
+			}
+		}
+	}
+
+	if len(policy.SystemPromptPrefixes) == 0 {
+		return nil
+	}
+	switch endpoint {
+	case AdmissionEndpointAuxiliary:
+		return nil
+	case AdmissionEndpointBatches:
+		for _, request := range gjson.GetBytes(body, "requests").Array() {
+			if err := checkSystemPromptPrefix(policy, extractFirstSystemText([]byte(request.Get("params").Raw))); err != nil {
+				return err
+			}
+		}
+		return nil
+	case AdmissionEndpointOpenAI:
+		return checkSystemPromptPrefix(policy, extractFirstOpenAISystemText(body))
+	default:
+		return checkSystemPromptPrefix(policy, extractFirstSystemText(body))
+	}
+}
+
+// checkSystemPromptPrefix 校验系统提示词是否以允许的前缀开头
+func checkSystemPromptPrefix(policy *model.AdmissionPolicy, systemText string) *AdmissionError {
+	for _, prefix := range policy.SystemPromptPrefixes {
+		if prefix != "" && strings.HasPrefix(systemText, prefix) {
+			return nil
+		}
+	}
+	return &AdmissionError{
+		Rule:    AdmissionRuleSystemPrompt,
+		Message: "系统提示词不以允许的前缀开头",
+	}
+}
+
+// matchAnyUserAgent 判断User-Agent是否匹配任意一个正则
+func matchAnyUserAgent(patterns []string, userAgent string) bool {
+	for _, pattern := range patterns {
+		var re *regexp.Regexp
+		if cached, ok := admissionRegexpCache.Load(pattern); ok {
+			re = cached.(*regexp.Regexp)
+		} else {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				continue
+			}
+			admissionRegexpCache.Store(pattern, compiled)
+			re = compiled
+		}
+		if re.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractFirstSystemText 提取请求体中第一段系统提示词，支持字符串和数组格式
+func extractFirstSystemText(body []byte) string {
+	system := gjson.GetBytes(body, "system")
+	if system.Type == gjson.String {
+		return system.String()
+	}
+	for _, block := range system.Array() {
+		if block.Get("type").String() == "text" {
+			return block.Get("text").String()
+		}
+	}
+	return ""
+}
+
+// extractFirstOpenAISystemText 提取OpenAI格式请求中第一条system或developer消息的文本
+func extractFirstOpenAISystemText(body []byte) string {
+	for _, message := range gjson.GetBytes(body, "messages").Array() {
+		role := message.Get("role").String()
+		if role != "system" && role != "developer" {
+			continue
+		}
+		content := message.Get("content")
+		if content.Type == gjson.String {
+			return content.String()
+		}
+		for _, part := range content.Array() {
+			if part.Get("type").String() == "text" {
+				return part.Get("text").String()
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// compareVersions 比较x.y.z格式的版本号
+func compareVersions(a, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		numA, _ := strconv.Atoi(partsA[i])
+		numB, _ := strconv.Atoi(partsB[i])
+		if numA != numB {
+			if numA < numB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(partsA) - len(partsB)
+}
+
+// GetApiKeyAdmissionPolicy 获取API Key配置的准入策略，未配置时返回nil
+func GetApiKeyAdmissionPolicy(id uint) (*model.AdmissionPolicy, error) {
+	raw, err := model.GetApiKeyAdmissionPolicy(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("API Key不存在")
+		}
+		return nil, err
+	}
+	return ParseAdmissionPolicy(raw)
+}
+
+// UpdateApiKeyAdmissionPolicy 更新API Key的准入策略，policy为nil时清除（继承分组策略）
+func UpdateApiKeyAdmissionPolicy(id uint, policy *model.AdmissionPolicy) error {
+	if _, err := GetApiKeyAdmissionPolicy(id); err != nil {
+		return err
+	}
+	raw, err := marshalAdmissionPolicy(policy)
+	if err != nil {
+		return err
+	}
+	return model.UpdateApiKeyAdmissionPolicy(id, raw)
+}
+
+// GetGroupAdmissionPolicy 获取分组配置的准入策略，未配置时返回nil
+func GetGroupAdmissionPolicy(id uint) (*model.AdmissionPolicy, error) {
+	raw, err := model.GetGroupAdmissionPolicy(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("组不存在")
+		}
+		return nil, err
+	}
+	return ParseAdmissionPolicy(raw)
+}
+
+// UpdateGroupAdmissionPolicy 更新分组的准入策略，policy为nil时清除（使用默认策略）
+func UpdateGroupAdmissionPolicy(id uint, policy *model.AdmissionPolicy) error {
+	if _, err := GetGroupAdmissionPolicy(id); err != nil {
+		return err
+	}
+	raw, err := marshalAdmissionPolicy(policy)
+	if err != nil {
+		return err
+	}
+	return model.UpdateGroupAdmissionPolicy(id, raw)
+}
+
+// marshalAdmissionPolicy 校验并序列化准入策略
+func marshalAdmissionPolicy(policy *model.AdmissionPolicy) (string, error) {
+	if policy == nil {
+		return "", nil
+	}
+	if err := ValidateAdmissionPolicy(policy); err != nil {
+		return "", err
+	}
+	if policy.Mode == "" {
+		policy.Mode = model.AdmissionModeRestricted
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
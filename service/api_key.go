@@ -5,6 +5,7 @@ import (
 	"claude-code-relay/model"
 	"errors"
 	"log"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -201,13 +202,31 @@ func ValidateApiKey(key string) (*model.ApiKey, error) {
 	return apiKey, nil
 }
 
+// IsModelAllowed 判断API Key的模型限制是否允许使用指定模型
+func IsModelAllowed(apiKey *model.ApiKey, modelName string) bool {
+	if apiKey.ModelRestriction == "" {
+		return true
+	}
+
+	for _, allowedModel := range strings.Split(apiKey.ModelRestriction, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowedModel), modelName) {
+			return true
+		}
+	}
+	return false
+}
+
 // UpdateApiKeyStatus 根据响应状态码更新API Key统计信息
 func UpdateApiKeyStatus(apiKey *model.ApiKey, statusCode int, usage *common.TokenUsage) {
 	// 只在请求成功时更新API Key统计信息
 	if statusCode != 200 && statusCode != 201 {
 		return
 	}
+	updateApiKeyUsage(apiKey, usage, 1)
+}
 
+// updateApiKeyUsage 累加API Key今日使用次数、tokens和按价格倍率计算的费用
+func updateApiKeyUsage(apiKey *model.ApiKey, usage *common.TokenUsage, priceRatio float64) {
 	now := time.Now()
 
 	// 判断最后使用时间是否为当天
@@ -231,7 +250,7 @@ func UpdateApiKeyStatus(apiKey *model.ApiKey, statusCode int, usage *common.Toke
 	if usage != nil {
 		// 计算本次请求的费用
 		costResult := common.CalculateCost(usage)
-		currentCost := costResult.Costs.Total
+		currentCost := costResult.Costs.Total * priceRatio
 
 		if apiKey.LastUsedTime != nil {
 			lastUsedDate := time.Time(*apiKey.LastUsedTime).Format("2006-01-02")
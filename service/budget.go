@@ -0,0 +1,186 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// 用户已预留额度的key前缀，值为所有进行中请求的预估费用之和
+	budgetReservationKeyPrefix = "billing_reserved:"
+	// 预留额度的默认保留时长，实例异常退出时未释放的预留额度到期后自动清除
+	defaultBudgetReservationTTL = 10 * time.Minute
+	// 请求未指定max_tokens时按此输出token数估算
+	defaultEstimatedMaxTokens = 4096
+	// 无法估算费用的请求使用的最低费用，避免没有余额的用户发起请求
+	minEstimatedCost = 0.000001
+)
+
+// reserveBudgetScript 余额扣除已预留额度后足够时预留本次请求的额度，返回1表示成功，否则返回当前已预留额度
+var reserveBudgetScript = redis.NewScript(`
+local reserved = tonumber(redis.call('GET', KEYS[1]) or '0')
+if reserved + tonumber(ARGV[1]) > tonumber(ARGV[2]) then
+	return tostring(reserved)
+end
+redis.call('INCRBYFLOAT', KEYS[1], ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// releaseBudgetScript 释放本次请求预留的额度，预留额度归零时删除key
+var releaseBudgetScript = redis.NewScript(`
+local reserved = tonumber(redis.call('INCRBYFLOAT', KEYS[1], -tonumber(ARGV[1])))
+if reserved <= 0.000000001 then
+	redis.call('DEL', KEYS[1])
+end
+return 1
+`)
+
+// RequestCostEstimate 请求的最坏情况费用预估
+type RequestCostEstimate struct {
+	Model           string  `json:"model"`
+	InputTokens     int     `json:"input_tokens"`
+	MaxOutputTokens int     `json:"max_output_tokens"`
+	Cost            float64 `json:"estimated_cost"`
+}
+
+// BudgetReservation 请求预留的余额额度，请求结束后释放
+type BudgetReservation struct {
+	UserID uint
+	Amount float64
+}
+
+// BudgetCheckResult 预授权结果
+type BudgetCheckResult struct {
+	Quota       *model.CheckQuotaResponse
+	Reservation *BudgetReservation
+	// 余额不足时的可用余额（已扣除其他进行中请求的预留额度）
+	AvailableBalance float64
+}
+
+// EstimateRequestCost 按输入token估算值、max_tokens和模型定价估算请求的最高费用
+// 支持Claude Messages、OpenAI Chat Completions和Message Batches请求，无法识别的请求返回nil
+func EstimateRequestCost(body []byte) *RequestCostEstimate {
+	if len(body) == 0 || !gjson.ValidBytes(body) {
+		return nil
+	}
+
+	// 批处理按所有请求之和以及批处理价格倍率估算
+	if requests := gjson.GetBytes(body, "requests"); requests.IsArray() {
+		var total *RequestCostEstimate
+		for _, request := range requests.Array() {
+			estimate := EstimateRequestCost([]byte(request.Get("params").Raw))
+			if estimate == nil {
+				continue
+			}
+			if total == nil {
+				total = &RequestCostEstimate{Model: estimate.Model}
+			}
+			total.InputTokens += estimate.InputTokens
+			total.MaxOutputTokens += estimate.MaxOutputTokens
+			total.Cost += estimate.Cost
+		}
+		if total != nil {
+			total.Cost *= GetBatchPriceRatio()
+		}
+		return total
+	}
+
+	modelName := gjson.GetBytes(body, "model").String()
+	if modelName == "" || !gjson.GetBytes(body, "messages").IsArray() {
+		return nil
+	}
+
+	maxTokens := int(gjson.GetBytes(body, "max_tokens").Int())
+	if completionTokens := int(gjson.GetBytes(body, "max_completion_tokens").Int()); completionTokens > 0 {
+		maxTokens = completionTokens
+	}
+	if maxTokens <= 0 {
+		maxTokens = defaultEstimatedMaxTokens
+	}
+
+	// 输入按输入和缓存写入中较高的价格计算，输出按max_tokens全部用完计算
+	inputTokens := common.EstimateRequestTokens(body)
+	pricing := common.GetModelPricing(modelName)
+	inputPrice := math.Max(pricing.Input, pricing.CacheWrite)
+	cost := float64(inputTokens)/1000000*inputPrice + float64(maxTokens)/1000000*pricing.Output
+
+	return &RequestCostEstimate{
+		Model:           modelName,
+		InputTokens:     inputTokens,
+		MaxOutputTokens: maxTokens,
+		Cost:            cost,
+	}
+}
+
+// getBudgetReservationTTL 获取预留额度的保留时长
+func getBudgetReservationTTL() time.Duration {
+	return getEnvDuration("BUDGET_RESERVATION_TTL", defaultBudgetReservationTTL)
+}
+
+// PreAuthorize 检查用户配额，使用余额扣费时预留预估费用，余额扣除其他进行中请求的预留额度后不足时拒绝
+// 时间卡和次数卡套餐按次数计费，不需要预留
+func (bs *BillingService) PreAuthorize(userID uint, estimatedCost float64) (*BudgetCheckResult, error) {
+	if estimatedCost < minEstimatedCost {
+		estimatedCost = minEstimatedCost
+	}
+
+	quota, err := bs.CheckQuota(userID, estimatedCost)
+	if err != nil {
+		return nil, err
+	}
+	result := &BudgetCheckResult{Quota: quota}
+	if !quota.HasQuota || quota.QuotaType != "balance" || common.RDB == nil {
+		if !quota.HasQuota {
+			if balance, err := bs.getUserBalance(userID); err == nil {
+				result.AvailableBalance = balance.Balance
+			}
+		}
+		return result, nil
+	}
+
+	balance := *quota.RemainingBalance
+	key := budgetReservationKeyPrefix + strconv.Itoa(int(userID))
+	reply, err := reserveBudgetScript.Run(context.Background(), common.RDB, []string{key},
+		strconv.FormatFloat(estimatedCost, 'f', -1, 64),
+		strconv.FormatFloat(balance, 'f', -1, 64),
+		int(getBudgetReservationTTL().Seconds())).Result()
+	if err != nil {
+		// Redis异常时退化为只校验余额
+		common.SysError(fmt.Sprintf("[BUDGET] Failed to reserve budget for User ID %d: %v", userID, err))
+		return result, nil
+	}
+
+	if reserved, ok := reply.(string); ok {
+		reservedAmount, _ := strconv.ParseFloat(reserved, 64)
+		result.AvailableBalance = math.Max(balance-reservedAmount, 0)
+		result.Quota = &model.CheckQuotaResponse{
+			HasQuota: false,
+			Message:  "余额扣除进行中请求的预留额度后不足",
+		}
+		return result, nil
+	}
+
+	result.Reservation = &BudgetReservation{UserID: userID, Amount: estimatedCost}
+	return result, nil
+}
+
+// Release 释放预留的额度
+func (r *BudgetReservation) Release() {
+	if r == nil || common.RDB == nil {
+		return
+	}
+	key := budgetReservationKeyPrefix + strconv.Itoa(int(r.UserID))
+	if err := releaseBudgetScript.Run(context.Background(), common.RDB, []string{key},
+		strconv.FormatFloat(r.Amount, 'f', -1, 64)).Err(); err != nil {
+		common.SysError(fmt.Sprintf("[BUDGET] Failed to release budget for User ID %d: %v", r.UserID, err))
+	}
+}
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+// 请求捕获范围
+const (
+	CaptureScopeApiKey = "key"
+	CaptureScopeGroup  = "group"
+)
+
+const (
+	captureWindowKeyPrefix = "capture_window:"
+	// 默认的捕获配置
+	defaultCaptureMaxWindow    = 24 * time.Hour
+	defaultCaptureRetention    = 72 * time.Hour
+	defaultCaptureMaxBodyBytes = 4 << 20
+	redactedValue              = "[REDACTED]"
+)
+
+// 捕获时需要脱敏的请求头和URL参数
+var (
+	captureSensitiveHeaders = map[string]bool{
+		"authorization":        true,
+		"proxy-authorization":  true,
+		"x-api-key":            true,
+		"x-goog-api-key":       true,
+		"api-key":              true,
+		"cookie":               true,
+		"set-cookie":           true,
+		"x-amz-security-token": true,
+	}
+	captureSensitiveParams = []string{"key", "api_key", "access_token"}
+)
+
+// CapturedHTTP 捕获的一次HTTP请求或响应
+type CapturedHTTP struct {
+	Method     string              `json:"method,omitempty"`
+	URL        string              `json:"url,omitempty"`
+	StatusCode int                 `json:"status_code,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	Truncated  bool                `json:"truncated,omitempty"` // 内容超过上限被截断
+}
+
+// CapturedExchange 捕获的一次上游请求及其响应，响应内容为上游返回的完整内容（流式请求为SSE原文）
+type CapturedExchange struct {
+	AccountID    uint         `json:"account_id"`
+	AccountName  string       `json:"account_name"`
+	PlatformType string       `json:"platform_type"`
+	Request      CapturedHTTP `json:"request"`
+	Response     CapturedHTTP `json:"response"`
+	Error        string       `json:"error,omitempty"`
+	Duration     int64        `json:"duration"` // 毫秒
+}
+
+// CaptureDetail 捕获记录的完整内容，压缩后保存在数据库中
+type CaptureDetail struct {
+	Inbound   CapturedHTTP       `json:"inbound"`
+	Exchanges []CapturedExchange `json:"exchanges"`
+}
+
+// CaptureWindow 捕获开启状态
+type CaptureWindow struct {
+	Enabled bool  `json:"enabled"`
+	Until   int64 `json:"until,omitempty"` // 捕获结束时间戳(秒)
+}
+
+// captureWindowKey 捕获开启状态的Redis键
+func captureWindowKey(scope string, id uint) string {
+	return captureWindowKeyPrefix + scope + ":" + strconv.Itoa(int(id))
+}
+
+// EnableCapture 为API Key或分组开启限定时长的请求捕获，到期后自动关闭
+func EnableCapture(scope string, id uint, duration time.Duration) (*CaptureWindow, error) {
+	if err := checkCaptureTarget(scope, id); err != nil {
+		return nil, err
+	}
+	maxWindow := getEnvDuration("CAPTURE_MAX_WINDOW_SECONDS", defaultCaptureMaxWindow)
+	if duration <= 0 || duration > maxWindow {
+		return nil, errors.New("捕获时长必须在1秒到" + maxWindow.String() + "之间")
+	}
+
+	until := time.Now().Add(duration).Unix()
+	if err := common.RDB.Set(context.Background(), captureWindowKey(scope, id), until, duration).Err(); err != nil {
+		return nil, errors.New("开启请求捕获失败")
+	}
+	common.SysLog("[CAPTURE] enabled for " + scope + " " + strconv.Itoa(int(id)) + " for " + duration.String())
+	return &CaptureWindow{Enabled: true, Until: until}, nil
+}
+
+// DisableCapture 关闭API Key或分组的请求捕获
+func DisableCapture(scope string, id uint) error {
+	if err := common.RDB.Del(context.Background(), captureWindowKey(scope, id)).Err(); err != nil {
+		return errors.New("关闭请求捕获失败")
+	}
+	return nil
+}
+
+// GetCaptureWindow 获取API Key或分组的请求捕获状态
+func GetCaptureWindow(scope string, id uint) (*CaptureWindow, error) {
+	if err := checkCaptureTarget(scope, id); err != nil {
+		return nil, err
+	}
+	until, err := common.RDB.Get(context.Background(), captureWindowKey(scope, id)).Int64()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return &CaptureWindow{}, nil
+		}
+		return nil, err
+	}
+	return &CaptureWindow{Enabled: true, Until: until}, nil
+}
+
+// checkCaptureTarget 检查捕获对象是否存在
+func checkCaptureTarget(scope string, id uint) error {
+	switch scope {
+	case CaptureScopeApiKey:
+		if err := model.DB.Select("id").First(&model.ApiKey{}, id).Error; err != nil {
+			return errors.New("API Key不存在")
+		}
+	case CaptureScopeGroup:
+		if err := model.DB.Select("id").First(&model.Group{}, id).Error; err != nil {
+			return errors.New("组不存在")
+		}
+	default:
+		return errors.New("无效的捕获范围")
+	}
+	return nil
+}
+
+// IsCaptureEnabled 判断API Key或其所属分组是否开启了请求捕获
+func IsCaptureEnabled(apiKeyID uint, groupID int) bool {
+	keys := []string{captureWindowKey(CaptureScopeApiKey, apiKeyID)}
+	if groupID > 0 {
+		keys = append(keys, captureWindowKey(CaptureScopeGroup, uint(groupID)))
+	}
+	count, err := common.RDB.Exists(context.Background(), keys...).Result()
+	if err != nil {
+		return false
+	}
+	return count > 0
+}
+
+// GetCaptureMaxBodyBytes 单个请求或响应最多捕获的字节数
+func GetCaptureMaxBodyBytes() int {
+	return getEnvInt("CAPTURE_MAX_BODY_BYTES", defaultCaptureMaxBodyBytes)
+}
+
+// IsRedactedHeader 判断请求头是否会在捕获时脱敏
+func IsRedactedHeader(name string) bool {
+	return captureSensitiveHeaders[strings.ToLower(name)]
+}
+
+// RedactHeaders 复制请求头并对鉴权相关的值脱敏
+func RedactHeaders(header http.Header) map[string][]string {
+	redacted := make(map[string][]string, len(header))
+	for name, values := range header {
+		if IsRedactedHeader(name) {
+			redacted[name] = []string{redactedValue}
+			continue
+		}
+		redacted[name] = append([]string(nil), values...)
+	}
+	return redacted
+}
+
+// RedactURL 对URL中携带密钥的查询参数脱敏
+func RedactURL(rawURL *url.URL) string {
+	if rawURL == nil {
+		return ""
+	}
+	redacted := *rawURL
+	redacted.User = nil
+	query := redacted.Query()
+	changed := false
+	for _, param := range captureSensitiveParams {
+		if query.Has(param) {
+			query.Set(param, redactedValue)
+			changed = true
+		}
+	}
+	if changed {
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.String()
+}
+
+// DecodeCapturedBody 将捕获的响应内容按Content-Encoding解压，截断或解压失败时保留原始内容
+func DecodeCapturedBody(body []byte, contentEncoding string) []byte {
+	if !strings.EqualFold(contentEncoding, "gzip") || len(body) == 0 {
+		return body
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil && len(decoded) == 0 {
+		return body
+	}
+	return decoded
+}
+
+// SaveRequestCapture 压缩并保存捕获记录
+func SaveRequestCapture(capture *model.RequestCapture, detail *CaptureDetail) error {
+	data, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	capture.Data = buf.Bytes()
+	capture.Size = buf.Len()
+	capture.Attempts = len(detail.Exchanges)
+	return model.CreateRequestCapture(capture)
+}
+
+// GetRequestCapture 获取捕获记录并解压内容
+func GetRequestCapture(id uint) (*model.RequestCapture, *CaptureDetail, error) {
+	capture, err := model.GetRequestCaptureByID(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errors.New("捕获记录不存在")
+		}
+		return nil, nil, err
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(capture.Data))
+	if err != nil {
+		return nil, nil, errors.New("捕获内容已损坏")
+	}
+	var detail CaptureDetail
+	if err := json.NewDecoder(reader).Decode(&detail); err != nil {
+		return nil, nil, errors.New("捕获内容已损坏")
+	}
+	return capture, &detail, nil
+}
+
+// GetRequestCaptureList 分页获取捕获记录
+func GetRequestCaptureList(req *model.RequestCaptureListRequest) (*model.RequestCaptureListResponse, error) {
+	if req.Page < 1 {
+		req.Page = 1
+	}
+	if req.Limit < 1 {
+		req.Limit = 10
+	}
+
+	captures, total, err := model.GetRequestCaptures(req)
+	if err != nil {
+		return nil, errors.New("获取捕获记录失败")
+	}
+	return &model.RequestCaptureListResponse{
+		Captures: captures,
+		Total:    total,
+		Page:     req.Page,
+		Limit:    req.Limit,
+	}, nil
+}
+
+// DeleteRequestCapture 删除捕获记录
+func DeleteRequestCapture(id uint) error {
+	if _, err := model.GetRequestCaptureByID(id); err != nil {
+		return errors.New("捕获记录不存在")
+	}
+	return model.DeleteRequestCapture(id)
+}
+
+// CleanExpiredCaptures 删除超过保留时间的捕获记录
+func CleanExpiredCaptures() (int64, error) {
+	retention := defaultCaptureRetention
+	if value := os.Getenv("CAPTURE_RETENTION_HOURS"); value != "" {
+		if hours, err := strconv.Atoi(value); err == nil && hours > 0 {
+			retention = time.Duration(hours) * time.Hour
+		}
+	}
+	return model.DeleteRequestCapturesBefore(time.Now().Add(-retention))
+}
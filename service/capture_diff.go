@@ -0,0 +1,263 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 差异比较的最大计算量，超过时退化为逐行对齐比较
+const maxDiffCells = 4 << 20
+
+// 每次请求都会变化、比较时忽略的顶层字段
+var captureVolatileFields = []string{"id", "usage", "created", "system_fingerprint"}
+
+// DiffLine 差异结果中的一行，Op为 " "(相同)、"-"(仅原始)、"+"(仅重放)
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// CaptureDiff 两段内容的差异
+type CaptureDiff struct {
+	Changed bool       `json:"changed"`
+	Lines   []DiffLine `json:"lines"`
+}
+
+// DiffCapturedBodies 规范化后按行比较两段捕获内容
+func DiffCapturedBodies(original, replay string) *CaptureDiff {
+	return newCaptureDiff(DiffLines(NormalizeCapturedBody(original), NormalizeCapturedBody(replay)))
+}
+
+// DiffLines 基于最长公共子序列按行比较
+func DiffLines(a, b []string) []DiffLine {
+	if len(a)*len(b) > maxDiffCells {
+		return alignLines(a, b)
+	}
+
+	// lcs[i][j] 为 a[i:] 与 b[j:] 的最长公共子序列长度
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]DiffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, DiffLine{Op: " ", Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, DiffLine{Op: "-", Text: a[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{Op: "+", Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, DiffLine{Op: "-", Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, DiffLine{Op: "+", Text: b[j]})
+	}
+	return lines
+}
+
+// alignLines 内容过大时按行号对齐比较
+func alignLines(a, b []string) []DiffLine {
+	lines := make([]DiffLine, 0, len(a)+len(b))
+	for i := 0; i < len(a) || i < len(b); i++ {
+		switch {
+		case i >= len(a):
+			lines = append(lines, DiffLine{Op: "+", Text: b[i]})
+		case i >= len(b):
+			lines = append(lines, DiffLine{Op: "-", Text: a[i]})
+		case a[i] == b[i]:
+			lines = append(lines, DiffLine{Op: " ", Text: a[i]})
+		default:
+			lines = append(lines, DiffLine{Op: "-", Text: a[i]}, DiffLine{Op: "+", Text: b[i]})
+		}
+	}
+	return lines
+}
+
+// NormalizeCapturedBody 将捕获内容转换为便于比较的行
+// SSE按内容块聚合增量，JSON格式化并去掉每次都会变化的字段，其他内容按原始行比较
+func NormalizeCapturedBody(body string) []string {
+	trimmed := strings.TrimSpace(body)
+	if trimmed == "" {
+		return nil
+	}
+	if strings.HasPrefix(trimmed, "event:") || strings.HasPrefix(trimmed, "data:") {
+		return normalizeSSE(trimmed)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(trimmed), &value); err == nil {
+		return strings.Split(formatNormalizedJSON(value, "  "), "\n")
+	}
+	return strings.Split(trimmed, "\n")
+}
+
+// normalizeSSE 将SSE事件流规范化为事件摘要，Anthropic格式的内容块增量合并为完整内容
+func normalizeSSE(body string) []string {
+	var lines []string
+	blocks := make(map[int]*strings.Builder)
+	blockKinds := make(map[int]string)
+
+	for _, raw := range strings.Split(body, "\n") {
+		raw = strings.TrimSpace(raw)
+		if !strings.HasPrefix(raw, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(raw, "data:"))
+		if data == "" || data == "[DONE]" {
+			if data == "[DONE]" {
+				lines = append(lines, "[DONE]")
+			}
+			continue
+		}
+
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			lines = append(lines, data)
+			continue
+		}
+
+		eventType, _ := event["type"].(string)
+		index := jsonInt(event["index"])
+		switch eventType {
+		case "ping":
+		case "message_start":
+			message, _ := event["message"].(map[string]interface{})
+			lines = append(lines, "message_start model="+jsonString(message["model"]))
+		case "content_block_start":
+			block, _ := event["content_block"].(map[string]interface{})
+			line := "content_block_start index=" + strconv.Itoa(index) + " type=" + jsonString(block["type"])
+			if name := jsonString(block["name"]); name != "" {
+				line += " name=" + name
+			}
+			lines = append(lines, line)
+			blocks[index] = &strings.Builder{}
+		case "content_block_delta":
+			delta, _ := event["delta"].(map[string]interface{})
+			builder, ok := blocks[index]
+			if !ok {
+				builder = &strings.Builder{}
+				blocks[index] = builder
+			}
+			switch jsonString(delta["type"]) {
+			case "text_delta":
+				blockKinds[index] = "text"
+				builder.WriteString(jsonString(delta["text"]))
+			case "input_json_delta":
+				blockKinds[index] = "input"
+				builder.WriteString(jsonString(delta["partial_json"]))
+			case "thinking_delta":
+				blockKinds[index] = "thinking"
+				builder.WriteString(jsonString(delta["thinking"]))
+			}
+		case "content_block_stop":
+			if builder, ok := blocks[index]; ok && builder.Len() > 0 {
+				content := builder.String()
+				if blockKinds[index] == "input" {
+					var input interface{}
+					if err := json.Unmarshal([]byte(content), &input); err == nil {
+						content = formatNormalizedJSON(input, "")
+					}
+				}
+				lines = append(lines, "content_block["+strconv.Itoa(index)+"] "+blockKinds[index]+": "+content)
+			}
+			lines = append(lines, "content_block_stop index="+strconv.Itoa(index))
+			delete(blocks, index)
+		case "message_delta":
+			delta, _ := event["delta"].(map[string]interface{})
+			lines = append(lines, "message_delta stop_reason="+jsonString(delta["stop_reason"]))
+		case "message_stop":
+			lines = append(lines, "message_stop")
+		default:
+			// 其他格式（如OpenAI流式分片）去掉变化字段后逐条比较
+			lines = append(lines, formatNormalizedJSON(event, ""))
+		}
+	}
+	return lines
+}
+
+// formatNormalizedJSON 去掉顶层变化字段并按固定键顺序输出JSON
+func formatNormalizedJSON(value interface{}, indent string) string {
+	if object, ok := value.(map[string]interface{}); ok {
+		normalized := make(map[string]interface{}, len(object))
+		for key, item := range object {
+			normalized[key] = item
+		}
+		for _, field := range captureVolatileFields {
+			delete(normalized, field)
+		}
+		value = normalized
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	if err := encoder.Encode(value); err != nil {
+		return ""
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+// jsonString 读取JSON字符串值
+func jsonString(value interface{}) string {
+	str, _ := value.(string)
+	return str
+}
+
+// jsonInt 读取JSON数字值
+func jsonInt(value interface{}) int {
+	number, _ := value.(float64)
+	return int(number)
+}
+
+// DiffCapturedHeaders 按名称排序后比较两组请求头
+func DiffCapturedHeaders(original, replay map[string][]string) *CaptureDiff {
+	return newCaptureDiff(DiffLines(headerLines(original), headerLines(replay)))
+}
+
+// headerLines 将请求头转换为排序后的 "名称: 值" 行
+func headerLines(headers map[string][]string) []string {
+	lines := make([]string, 0, len(headers))
+	for name, values := range headers {
+		lines = append(lines, http.CanonicalHeaderKey(name)+": "+strings.Join(values, ", "))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// newCaptureDiff 根据差异行生成比较结果
+func newCaptureDiff(lines []DiffLine) *CaptureDiff {
+	diff := &CaptureDiff{Lines: lines}
+	for _, line := range lines {
+		if line.Op != " " {
+			diff.Changed = true
+			break
+		}
+	}
+	return diff
+}
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	// 熔断器状态
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+
+	// Redis键前缀
+	circuitStateKeyPrefix  = "circuit_breaker:"
+	circuitWindowKeyPrefix = "circuit_window:"
+
+	// 默认配置
+	defaultCircuitWindow              = 60 * time.Second
+	defaultCircuitMinRequests         = 10
+	defaultCircuitErrorRate           = 0.5
+	defaultCircuitConsecutiveFailures = 5
+	defaultCircuitOpenDuration        = 60 * time.Second
+	defaultCircuitHalfOpenProbes      = 3
+)
+
+// circuitConfig 熔断器配置
+type circuitConfig struct {
+	window              time.Duration
+	minRequests         int
+	errorRate           float64
+	consecutiveFailures int
+	openDuration        time.Duration
+	halfOpenProbes      int
+}
+
+// getCircuitConfig 从环境变量读取熔断器配置
+func getCircuitConfig() circuitConfig {
+	config := circuitConfig{
+		window:              getEnvDuration("CIRCUIT_WINDOW_SECONDS", defaultCircuitWindow),
+		minRequests:         getEnvInt("CIRCUIT_MIN_REQUESTS", defaultCircuitMinRequests),
+		errorRate:           defaultCircuitErrorRate,
+		consecutiveFailures: getEnvInt("CIRCUIT_CONSECUTIVE_FAILURES", defaultCircuitConsecutiveFailures),
+		openDuration:        getEnvDuration("CIRCUIT_OPEN_SECONDS", defaultCircuitOpenDuration),
+		halfOpenProbes:      getEnvInt("CIRCUIT_HALF_OPEN_PROBES", defaultCircuitHalfOpenProbes),
+	}
+
+	if rateStr := os.Getenv("CIRCUIT_ERROR_RATE"); rateStr != "" {
+		if rate, err := strconv.ParseFloat(rateStr, 64); err == nil && rate > 0 && rate <= 1 {
+			config.errorRate = rate
+		}
+	}
+	if config.halfOpenProbes < 1 {
+		config.halfOpenProbes = 1
+	}
+	return config
+}
+
+// IsCircuitFailureStatus 判断上游状态码是否计入熔断失败
+// 只有服务端错误和鉴权失败说明账号本身有问题；400等客户端错误由请求内容导致，429由限流逻辑单独处理
+func IsCircuitFailureStatus(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError ||
+		statusCode == http.StatusUnauthorized ||
+		statusCode == http.StatusForbidden
+}
+
+// circuitKeys 账号熔断器相关的Redis键
+func circuitKeys(accountID uint) (string, string) {
+	id := strconv.Itoa(int(accountID))
+	return circuitStateKeyPrefix + id, circuitWindowKeyPrefix + id
+}
+
+// GetCircuitState 获取账号熔断器状态
+func GetCircuitState(accountID uint) string {
+	stateKey, _ := circuitKeys(accountID)
+	state, err := common.RDB.HGet(context.Background(), stateKey, "state").Result()
+	if err != nil || state == "" {
+		return CircuitClosed
+	}
+	return state
+}
+
+// recordCircuitOutcome 在滑动窗口中记录一次请求结果，返回窗口内的请求数和失败数
+func recordCircuitOutcome(accountID uint, success bool, config circuitConfig) (int, int) {
+	ctx := context.Background()
+	_, windowKey := circuitKeys(accountID)
+	now := time.Now()
+
+	outcome := "1"
+	if !success {
+		outcome = "0"
+	}
+	member := fmt.Sprintf("%d-%s-%s", now.UnixMilli(), uuid.New().String()[:8], outcome)
+	minScore := strconv.FormatInt(now.Add(-config.window).UnixMilli(), 10)
+
+	pipe := common.RDB.Pipeline()
+	pipe.ZAdd(ctx, windowKey, &redis.Z{Score: float64(now.UnixMilli()), Member: member})
+	pipe.ZRemRangeByScore(ctx, windowKey, "-inf", "("+minScore)
+	pipe.Expire(ctx, windowKey, config.window*2)
+	membersCmd := pipe.ZRange(ctx, windowKey, 0, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.SysError("record circuit outcome error: " + err.Error())
+		return 0, 0
+	}
+
+	members := membersCmd.Val()
+	failures := 0
+	for _, m := range members {
+		if strings.HasSuffix(m, "-0") {
+			failures++
+		}
+	}
+	return len(members), failures
+}
+
+// RecordCircuitSuccess 记录一次成功请求，返回熔断器是否处于关闭状态（账号可以恢复正常）
+func RecordCircuitSuccess(accountID uint) bool {
+	ctx := context.Background()
+	config := getCircuitConfig()
+	stateKey, windowKey := circuitKeys(accountID)
+
+	recordCircuitOutcome(accountID, true, config)
+
+	switch GetCircuitState(accountID) {
+	case CircuitHalfOpen:
+		successes, err := common.RDB.HIncrBy(ctx, stateKey, "probe_successes", 1).Result()
+		if err != nil {
+			common.SysError("record circuit probe error: " + err.Error())
+			return false
+		}
+		if successes < int64(config.halfOpenProbes) {
+			return false
+		}
+		// 探测请求全部成功，关闭熔断器
+		common.RDB.Del(ctx, stateKey, windowKey)
+		common.SysLog(fmt.Sprintf("[CIRCUIT] Account %d closed after %d successful probes", accountID, successes))
+		return true
+	case CircuitOpen:
+		// 熔断期间仍在进行中的请求成功，不改变状态
+		return false
+	default:
+		common.RDB.HDel(ctx, stateKey, "consecutive_failures")
+		return true
+	}
+}
+
+// RecordCircuitFailure 记录一次失败请求，返回熔断器是否因此次失败打开
+func RecordCircuitFailure(accountID uint) bool {
+	ctx := context.Background()
+	config := getCircuitConfig()
+	stateKey, _ := circuitKeys(accountID)
+
+	total, failures := recordCircuitOutcome(accountID, false, config)
+
+	switch GetCircuitState(accountID) {
+	case CircuitHalfOpen:
+		// 探测失败，重新打开熔断器
+		openCircuit(accountID, "half-open probe failed")
+		return true
+	case CircuitOpen:
+		return false
+	}
+
+	consecutive, err := common.RDB.HIncrBy(ctx, stateKey, "consecutive_failures", 1).Result()
+	if err != nil {
+		common.SysError("record circuit failure error: " + err.Error())
+		return false
+	}
+	common.RDB.Expire(ctx, stateKey, config.window*2)
+
+	if consecutive >= int64(config.consecutiveFailures) {
+		openCircuit(accountID, fmt.Sprintf("%d consecutive failures", consecutive))
+		return true
+	}
+	if total >= config.minRequests && float64(failures)/float64(total) >= config.errorRate {
+		openCircuit(accountID, fmt.Sprintf("error rate %d/%d in window", failures, total))
+		return true
+	}
+	return false
+}
+
+// openCircuit 打开熔断器
+func openCircuit(accountID uint, reason string) {
+	ctx := context.Background()
+	stateKey, windowKey := circuitKeys(accountID)
+
+	pipe := common.RDB.TxPipeline()
+	pipe.Del(ctx, stateKey, windowKey)
+	pipe.HSet(ctx, stateKey, "state", CircuitOpen, "changed_at", time.Now().UnixMilli())
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.SysError("open circuit error: " + err.Error())
+		return
+	}
+	common.SysLog(fmt.Sprintf("[CIRCUIT] Account %d opened: %s", accountID, reason))
+}
+
+// CircuitProbeAvailable 判断熔断中的账号当前是否还有探测名额，只读取状态不领取名额
+func CircuitProbeAvailable(accountID uint) bool {
+	config := getCircuitConfig()
+	stateKey, _ := circuitKeys(accountID)
+
+	values, err := common.RDB.HMGet(context.Background(), stateKey, "state", "changed_at", "probes").Result()
+	if err != nil {
+		return false
+	}
+	state, _ := values[0].(string)
+	changedAtStr, _ := values[1].(string)
+	changedAt, _ := strconv.ParseInt(changedAtStr, 10, 64)
+	probesStr, _ := values[2].(string)
+	probes, _ := strconv.ParseInt(probesStr, 10, 64)
+
+	switch state {
+	case CircuitOpen:
+		return time.Since(time.UnixMilli(changedAt)) >= config.openDuration
+	case CircuitHalfOpen:
+		return time.Since(time.UnixMilli(changedAt)) >= config.openDuration || probes < int64(config.halfOpenProbes)
+	}
+	return false
+}
+
+// ClaimCircuitProbe 为熔断中的账号领取一次探测名额，在实际转发前调用
+// 熔断时间结束后进入半开状态，每轮半开最多放行配置数量的真实请求，超时未完成的探测轮次会重新开始
+func ClaimCircuitProbe(accountID uint) bool {
+	ctx := context.Background()
+	config := getCircuitConfig()
+	stateKey, _ := circuitKeys(accountID)
+
+	values, err := common.RDB.HMGet(ctx, stateKey, "state", "changed_at").Result()
+	if err != nil {
+		return false
+	}
+	state, _ := values[0].(string)
+	changedAtStr, _ := values[1].(string)
+	changedAt, _ := strconv.ParseInt(changedAtStr, 10, 64)
+	elapsed := time.Since(time.UnixMilli(changedAt))
+
+	switch state {
+	case CircuitOpen, CircuitHalfOpen:
+		if elapsed >= config.openDuration {
+			// 开始新一轮半开探测
+			pipe := common.RDB.TxPipeline()
+			pipe.HSet(ctx, stateKey, "state", CircuitHalfOpen, "changed_at", time.Now().UnixMilli(), "probes", 0, "probe_successes", 0)
+			if _, err := pipe.Exec(ctx); err != nil {
+				common.SysError("half-open circuit error: " + err.Error())
+				return false
+			}
+			if state == CircuitOpen {
+				common.SysLog(fmt.Sprintf("[CIRCUIT] Account %d half-open, allowing %d probes", accountID, config.halfOpenProbes))
+			}
+		} else if state == CircuitOpen {
+			return false
+		}
+	default:
+		// 未由熔断器打开的异常账号（如token失效）交给定时恢复任务处理
+		return false
+	}
+
+	probes, err := common.RDB.HIncrBy(ctx, stateKey, "probes", 1).Result()
+	if err != nil {
+		return false
+	}
+	return probes <= int64(config.halfOpenProbes)
+}
+
+// ResetCircuitBreaker 重置账号熔断器（账号被手动或定时任务恢复时调用）
+func ResetCircuitBreaker(accountID uint) {
+	stateKey, windowKey := circuitKeys(accountID)
+	if err := common.RDB.Del(context.Background(), stateKey, windowKey).Err(); err != nil {
+		common.SysError("reset circuit breaker error: " + err.Error())
+	}
+}
+
+// getHalfOpenProbeAccounts 获取分组中支持指定模型且还有探测名额的熔断账号，名额在获取并发槽位时领取
+func getHalfOpenProbeAccounts(groupID int, modelName string) []model.Account {
+	accounts, err := model.GetAbnormalAccountsByGroupID(groupID)
+	if err != nil {
+		common.SysError("get abnormal accounts error: " + err.Error())
+		return nil
+	}
+
+	var probes []model.Account
+	for _, account := range filterAccountsByModel(accounts, modelName) {
+		if CircuitProbeAvailable(account.ID) {
+			probes = append(probes, account)
+		}
+	}
+	return probes
+}
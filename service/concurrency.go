@@ -0,0 +1,225 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	// Redis键前缀
+	accountSemaphoreKeyPrefix = "account_semaphore:"
+
+	// 默认并发租约有效期，持有者异常退出时租约到期自动释放
+	defaultAccountLeaseTTL = 5 * time.Minute
+)
+
+// ErrNoAccountCandidate 没有可尝试的账号
+var ErrNoAccountCandidate = errors.New("没有可用的账号")
+
+// acquireSlotScript 清理过期租约后，在未达到上限时登记新的租约，最大并发数为0表示不限制
+// KEYS[1]: 信号量键 ARGV[1]: 当前时间戳(毫秒) ARGV[2]: 最大并发数 ARGV[3]: 租约到期时间戳(毫秒) ARGV[4]: 租约ID ARGV[5]: 键过期时间(毫秒)
+var acquireSlotScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local limit = tonumber(ARGV[2])
+if limit <= 0 or redis.call('ZCARD', KEYS[1]) < limit then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+	return 1
+end
+return 0
+`)
+
+// AccountLease 账号并发槽位租约，持有期间定期续期
+type AccountLease struct {
+	key     string
+	id      string
+	ttl     time.Duration
+	stop    chan struct{}
+	release sync.Once
+}
+
+// getEnvDuration 读取以秒为单位的环境变量
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(name); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultValue
+}
+
+// getEnvInt 读取整数环境变量
+func getEnvInt(name string, defaultValue int) int {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// accountSemaphoreKey 账号信号量键
+func accountSemaphoreKey(accountID uint) string {
+	return accountSemaphoreKeyPrefix + strconv.Itoa(int(accountID))
+}
+
+// TryAcquireAccountSlot 尝试获取账号并发槽位
+// 未限制并发的账号同样登记租约，信号量中未过期的租约数即为账号当前的并发请求数
+func TryAcquireAccountSlot(account *model.Account) (*AccountLease, bool) {
+	maxConcurrency := account.MaxConcurrency
+	if maxConcurrency < 0 {
+		maxConcurrency = 0
+	}
+
+	ttl := getEnvDuration("ACCOUNT_LEASE_TTL", defaultAccountLeaseTTL)
+	now := time.Now()
+	lease := &AccountLease{
+		key:  accountSemaphoreKey(account.ID),
+		id:   uuid.New().String(),
+		ttl:  ttl,
+		stop: make(chan struct{}),
+	}
+
+	acquired, err := acquireSlotScript.Run(context.Background(), common.RDB, []string{lease.key},
+		now.UnixMilli(), maxConcurrency, now.Add(ttl).UnixMilli(), lease.id, (ttl * 2).Milliseconds()).Int()
+	if err != nil {
+		// Redis异常时不阻塞请求
+		common.SysError("acquire account slot error: " + err.Error())
+		return nil, true
+	}
+	if acquired != 1 {
+		return nil, false
+	}
+
+	go lease.keepAlive()
+	return lease, true
+}
+
+// keepAlive 定期续期租约，避免长时间的流式请求被误判为过期
+func (l *AccountLease) keepAlive() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ctx := context.Background()
+			expireAt := float64(time.Now().Add(l.ttl).UnixMilli())
+			if err := common.RDB.ZAddXX(ctx, l.key, &redis.Z{Score: expireAt, Member: l.id}).Err(); err != nil {
+				common.SysError("renew account lease error: " + err.Error())
+			}
+			common.RDB.PExpire(ctx, l.key, l.ttl*2)
+		}
+	}
+}
+
+// Release 释放账号并发槽位，可重复调用
+func (l *AccountLease) Release() {
+	if l == nil {
+		return
+	}
+	l.release.Do(func() {
+		close(l.stop)
+		if err := common.RDB.ZRem(context.Background(), l.key, l.id).Err(); err != nil {
+			common.SysError("release account slot error: " + err.Error())
+		}
+		// 唤醒等待并发槽位的排队请求
+		NotifyAccountQueue()
+	})
+}
+
+// GetAccountInFlight 批量获取账号当前的并发请求数（未过期的租约数）
+func GetAccountInFlight(accounts []model.Account) map[uint]int64 {
+	ctx := context.Background()
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	inFlight := make(map[uint]int64, len(accounts))
+
+	pipe := common.RDB.Pipeline()
+	counts := make([]*redis.IntCmd, len(accounts))
+	for i := range accounts {
+		counts[i] = pipe.ZCount(ctx, accountSemaphoreKey(accounts[i].ID), "("+now, "+inf")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		common.SysError("get account in-flight error: " + err.Error())
+		return inFlight
+	}
+	for i, count := range counts {
+		inFlight[accounts[i].ID] = count.Val()
+	}
+	return inFlight
+}
+
+// HasAccountCapacity 判断候选账号中是否存在未尝试且有空闲槽位的账号
+// 熔断中的账号探测名额已领完时不计入，与tryAcquireCandidates的选择规则保持一致
+func HasAccountCapacity(accounts []model.Account, tried map[uint]bool) bool {
+	ctx := context.Background()
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	for i := range accounts {
+		if tried[accounts[i].ID] {
+			continue
+		}
+		if accounts[i].CurrentStatus == 2 && !CircuitProbeAvailable(accounts[i].ID) {
+			continue
+		}
+		if accounts[i].MaxConcurrency <= 0 {
+			return true
+		}
+		count, err := common.RDB.ZCount(ctx, accountSemaphoreKey(accounts[i].ID), "("+now, "+inf").Result()
+		if err != nil || count < int64(accounts[i].MaxConcurrency) {
+			return true
+		}
+	}
+	return false
+}
+
+// AcquireAccountSlot 按顺序为候选账号获取并发槽位，跳过已尝试和并发已满的账号
+// 没有可以立即使用的账号（全部限流、熔断或并发已满）时进入分组等待队列，直到有账号可用、等待超时或请求取消
+// 排队期间候选账号会重新加载，返回最终的候选账号列表和获取到槽位的账号下标
+func AcquireAccountSlot(ctx context.Context, waiter *AccountWaiter, accounts []model.Account, tried map[uint]bool) ([]model.Account, int, *AccountLease, error) {
+	idx, lease, remaining := tryAcquireCandidates(accounts, tried)
+	if idx >= 0 {
+		return accounts, idx, lease, nil
+	}
+	// 候选账号都已尝试过，不再排队
+	if remaining == 0 && len(tried) > 0 {
+		return accounts, -1, nil, ErrNoAccountCandidate
+	}
+	if waiter.NoWait {
+		return accounts, -1, nil, ErrNoAccountAvailable
+	}
+	return waitForAccount(ctx, waiter, accounts, tried)
+}
+
+// tryAcquireCandidates 依次尝试获取未尝试账号的槽位，返回获取到的账号下标和剩余未尝试账号数
+func tryAcquireCandidates(accounts []model.Account, tried map[uint]bool) (int, *AccountLease, int) {
+	remaining := 0
+	for i := range accounts {
+		if tried[accounts[i].ID] {
+			continue
+		}
+		remaining++
+		if lease, ok := TryAcquireAccountSlot(&accounts[i]); ok {
+			// 熔断中的账号在选中时才领取探测名额，名额已被其他请求领完时跳过
+			if accounts[i].CurrentStatus == 2 && !ClaimCircuitProbe(accounts[i].ID) {
+				lease.Release()
+				tried[accounts[i].ID] = true
+				remaining--
+				continue
+			}
+			return i, lease, remaining
+		}
+	}
+	return -1, nil, remaining
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"errors"
 	"strconv"
@@ -23,10 +24,16 @@ func CreateGroup(req *model.CreateGroupRequest, userID uint) (*model.Group, erro
 	}
 
 	group := &model.Group{
-		Name:   req.Name,
-		Remark: req.Remark,
-		Status: req.Status,
-		UserID: userID,
+		Name:              req.Name,
+		Remark:            req.Remark,
+		Status:            req.Status,
+		SchedulerStrategy: req.SchedulerStrategy,
+		UserID:            userID,
+	}
+
+	// 如果没有指定调度策略，使用默认策略
+	if group.SchedulerStrategy == "" {
+		group.SchedulerStrategy = constant.SchedulerPriorityLeastUsed
 	}
 
 	// 如果没有指定状态，默认为启用
@@ -85,6 +92,10 @@ func UpdateGroup(id string, req *model.UpdateGroupRequest, userID uint) (*model.
 		group.Status = *req.Status
 	}
 
+	if req.SchedulerStrategy != "" {
+		group.SchedulerStrategy = req.SchedulerStrategy
+	}
+
 	err = model.UpdateGroup(group)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"gorm.io/gorm"
+)
+
+const (
+	// 默认批处理价格倍率，Anthropic批处理按实时请求价格的50%计费
+	defaultBatchPriceRatio = 0.5
+	// Anthropic批处理结束状态
+	MessageBatchStatusEnded = "ended"
+	// 批处理已计费请求的custom_id集合key前缀，保证每个请求只计费一次
+	batchBilledKeyPrefix = "message_batch_billed:"
+	// 已计费集合的保留时长，覆盖批处理结束后重复收取结果的时间
+	batchBilledTTL = 7 * 24 * time.Hour
+)
+
+// GetBatchPriceRatio 获取批处理相对于实时请求的价格倍率
+func GetBatchPriceRatio() float64 {
+	if value := os.Getenv("BATCH_PRICE_RATIO"); value != "" {
+		if ratio, err := strconv.ParseFloat(value, 64); err == nil && ratio > 0 {
+			return ratio
+		}
+	}
+	return defaultBatchPriceRatio
+}
+
+// ParseMessageBatchModels 校验批处理请求格式并返回其中使用的所有模型
+func ParseMessageBatchModels(body []byte) ([]string, error) {
+	requests := gjson.GetBytes(body, "requests")
+	if !requests.IsArray() || len(requests.Array()) == 0 {
+		return nil, errors.New("requests不能为空")
+	}
+
+	var models []string
+	seen := make(map[string]bool)
+	for _, request := range requests.Array() {
+		modelName := request.Get("params.model").String()
+		if modelName == "" {
+			return nil, fmt.Errorf("请求 %s 缺少model参数", request.Get("custom_id").String())
+		}
+		if !seen[modelName] {
+			seen[modelName] = true
+			models = append(models, modelName)
+		}
+	}
+	return models, nil
+}
+
+// AccountSupportsModels 判断账号是否能服务所有指定模型
+func AccountSupportsModels(account *model.Account, models []string) bool {
+	for _, modelName := range models {
+		if !AccountSupportsModel(account, modelName) {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateMessageBatchTask 记录新创建的批处理，批处理固定由创建它的账号查询和收取结果
+func CreateMessageBatchTask(keyInfo *model.ApiKey, account *model.Account, batch []byte) (*model.Task, error) {
+	batchID := gjson.GetBytes(batch, "id").String()
+	if batchID == "" {
+		return nil, errors.New("上游返回的批处理缺少ID")
+	}
+
+	task := &model.Task{
+		Title:      "Message Batch " + batchID,
+		Status:     constant.TaskStatusRunning,
+		Priority:   constant.TaskPriorityLow,
+		UserID:     keyInfo.UserID,
+		Type:       constant.TaskTypeMessageBatch,
+		ExternalID: batchID,
+		ApiKeyID:   keyInfo.ID,
+		AccountID:  account.ID,
+		Result:     string(batch),
+	}
+	if err := model.CreateTask(task); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// GetMessageBatchTask 获取API Key创建的批处理任务
+func GetMessageBatchTask(keyInfo *model.ApiKey, batchID string) (*model.Task, error) {
+	task, err := model.GetTaskByExternalID(constant.TaskTypeMessageBatch, batchID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("批处理不存在")
+		}
+		return nil, err
+	}
+	if task.ApiKeyID != keyInfo.ID {
+		return nil, errors.New("批处理不存在")
+	}
+	return task, nil
+}
+
+// GetMessageBatchTasks 按从新到旧的顺序获取API Key创建的批处理任务
+func GetMessageBatchTasks(keyInfo *model.ApiKey, olderThan, newerThan uint, limit int) ([]model.Task, error) {
+	return model.GetApiKeyTasks(constant.TaskTypeMessageBatch, keyInfo.ID, olderThan, newerThan, limit)
+}
+
+// BillMessageBatchResult 按批处理价格记录单个成功请求的调用日志并扣费，返回本次是否计费
+func BillMessageBatchResult(task *model.Task, account *model.Account, customID string, usage *common.TokenUsage) bool {
+	totalTokens := usage.InputTokens + usage.OutputTokens + usage.CacheReadInputTokens + usage.CacheCreationInputTokens
+	if totalTokens == 0 {
+		return false
+	}
+
+	// 先登记custom_id，已登记的请求说明已由其他实例或之前的轮询计费
+	if !claimBatchResultBilling(task, customID) {
+		return false
+	}
+
+	ratio := GetBatchPriceRatio()
+	if _, err := NewLogService().CreateLogFromTokenUsage(usage, task.UserID, task.ApiKeyID, account.ID, 0, false,
+		&model.LogMeta{PriceRatio: ratio}); err != nil {
+		common.SysError(fmt.Sprintf("[BATCH] Failed to save log for %s/%s: %v", task.ExternalID, customID, err))
+	}
+
+	requestID := task.ExternalID + ":" + customID
+	cost := common.CalculateCost(usage).Costs.Total * ratio
+	response, err := NewBillingService().ProcessDeduction(&model.DeductionRequest{
+		UserID:              task.UserID,
+		CostUSD:             cost,
+		RequestID:           &requestID,
+		ApiKeyID:            &task.ApiKeyID,
+		AccountID:           &account.ID,
+		InputTokens:         usage.InputTokens,
+		OutputTokens:        usage.OutputTokens,
+		CacheReadTokens:     usage.CacheReadInputTokens,
+		CacheCreationTokens: usage.CacheCreationInputTokens,
+		Model:               &usage.Model,
+		PlatformType:        &account.PlatformType,
+	})
+	if err != nil {
+		common.SysError(fmt.Sprintf("[BATCH] Failed to process billing deduction for %s: %v", requestID, err))
+	} else if !response.Success {
+		common.SysError(fmt.Sprintf("[BATCH] Billing deduction failed for %s: %s", requestID, response.Message))
+	}
+
+	// 计入API Key今日统计，使每日限额对批处理同样生效
+	if apiKey, err := model.GetApiKeyById(task.ApiKeyID, task.UserID); err == nil {
+		updateApiKeyUsage(apiKey, usage, ratio)
+	}
+	return true
+}
+
+// claimBatchResultBilling 登记批处理中请求的计费，返回false表示该请求已经计费
+// Redis不可用时返回true，由调用方保证同一批处理只由一个实例收取结果
+func claimBatchResultBilling(task *model.Task, customID string) bool {
+	if common.RDB == nil {
+		return true
+	}
+	ctx := context.Background()
+	key := batchBilledKeyPrefix + strconv.Itoa(int(task.ID))
+	added, err := common.RDB.SAdd(ctx, key, customID).Result()
+	if err != nil {
+		common.SysError(fmt.Sprintf("[BATCH] Failed to record billing of %s/%s: %v", task.ExternalID, customID, err))
+		return true
+	}
+	common.RDB.Expire(ctx, key, batchBilledTTL)
+	return added == 1
+}
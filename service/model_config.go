@@ -3,6 +3,7 @@ package service
 import (
 	"claude-code-relay/model"
 	"errors"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -40,6 +41,8 @@ func (s *ModelConfigService) CreateModel(req *model.CreateModelRequest) (*model.
 		Description:   req.Description,
 		MaxTokens:     req.MaxTokens,
 		ContextWindow: req.ContextWindow,
+
+		FallbackModels: normalizeModelList(req.FallbackModels),
 	}
 
 	err = model.CreateModelConfig(modelConfig)
@@ -78,6 +81,7 @@ func (s *ModelConfigService) UpdateModel(id uint, req *model.UpdateModelRequest)
 	modelConfig.Description = req.Description
 	modelConfig.MaxTokens = req.MaxTokens
 	modelConfig.ContextWindow = req.ContextWindow
+	modelConfig.FallbackModels = normalizeModelList(req.FallbackModels)
 
 	err = model.UpdateModelConfig(modelConfig)
 	if err != nil {
@@ -110,6 +114,57 @@ func (s *ModelConfigService) GetActiveModels() ([]model.ModelConfig, error) {
 	return model.GetActiveModels()
 }
 
+// GetApiKeyModels 获取API Key可用的模型列表（启用的模型按Key的模型限制过滤）
+func (s *ModelConfigService) GetApiKeyModels(apiKey *model.ApiKey) ([]model.ModelConfig, error) {
+	models, err := model.GetActiveModels()
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make([]model.ModelConfig, 0, len(models))
+	for _, modelConfig := range models {
+		if IsModelAllowed(apiKey, modelConfig.Name) {
+			allowed = append(allowed, modelConfig)
+		}
+	}
+	return allowed, nil
+}
+
+// GetModelFallbackChain 获取模型的降级链，过滤掉API Key无权使用的模型
+func GetModelFallbackChain(apiKey *model.ApiKey, modelName string) []string {
+	if modelName == "" {
+		return nil
+	}
+	modelConfig, err := model.GetModelConfigByName(modelName)
+	if err != nil || modelConfig.FallbackModels == "" {
+		return nil
+	}
+
+	chain := make([]string, 0)
+	for _, fallback := range strings.Split(modelConfig.FallbackModels, ",") {
+		if fallback == modelName || !IsModelAllowed(apiKey, fallback) {
+			continue
+		}
+		chain = append(chain, fallback)
+	}
+	return chain
+}
+
+// normalizeModelList 规范化逗号分隔的模型列表，去除空白和重复项
+func normalizeModelList(models string) string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	for _, name := range strings.Split(models, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	return strings.Join(result, ",")
+}
+
 // BatchUpdateStatus 批量更新模型状态
 func (s *ModelConfigService) BatchUpdateStatus(ids []uint, status int) error {
 	if len(ids) == 0 {
@@ -0,0 +1,356 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// 默认的代理健康检查配置
+	defaultProxyHealthCheckURL     = "https://api.anthropic.com"
+	defaultProxyHealthCheckTimeout = 10 * time.Second
+	defaultProxyFailThreshold      = 2
+	// 并发检查的代理数量
+	proxyHealthCheckConcurrency = 10
+	// 代理列表在内存中的缓存时间
+	proxyCacheTTL = 30 * time.Second
+)
+
+// proxyCache 启用代理的内存缓存，避免每次转发都查询数据库
+var proxyCache = struct {
+	sync.RWMutex
+	proxies  []model.Proxy
+	loadedAt time.Time
+}{}
+
+// getCachedProxies 获取启用的代理列表，缓存过期时重新加载
+func getCachedProxies() []model.Proxy {
+	proxyCache.RLock()
+	if time.Since(proxyCache.loadedAt) < proxyCacheTTL {
+		proxies := proxyCache.proxies
+		proxyCache.RUnlock()
+		return proxies
+	}
+	proxyCache.RUnlock()
+
+	proxies, err := model.GetActiveProxies()
+	if err != nil {
+		common.SysError("load proxies error: " + err.Error())
+		return nil
+	}
+
+	proxyCache.Lock()
+	proxyCache.proxies = proxies
+	proxyCache.loadedAt = time.Now()
+	proxyCache.Unlock()
+	return proxies
+}
+
+// invalidateProxyCache 代理变更后清除缓存
+func invalidateProxyCache() {
+	proxyCache.Lock()
+	proxyCache.loadedAt = time.Time{}
+	proxyCache.Unlock()
+}
+
+// ResolveAccountProxyURI 获取账号关联的代理地址
+// 优先使用关联的代理；关联代理异常或未关联时从代理池中选择健康的代理；都没有配置时返回空字符串
+// 配置了代理但关联代理已禁用或删除、代理池中也没有可用代理时返回错误，不会退回直连
+func ResolveAccountProxyURI(account *model.Account) (string, error) {
+	if account.ProxyID == 0 && account.ProxyPool == "" {
+		return "", nil
+	}
+
+	proxies := getCachedProxies()
+	var bound *model.Proxy
+	if account.ProxyID > 0 {
+		for i := range proxies {
+			if proxies[i].ID == account.ProxyID {
+				bound = &proxies[i]
+				break
+			}
+		}
+		if bound != nil && bound.Status == model.ProxyStatusHealthy {
+			return bound.URI(), nil
+		}
+	}
+
+	// 同一账号固定映射到池中的同一个代理，保持出口IP稳定，代理被轮换出去后自动换到其他代理
+	if account.ProxyPool != "" {
+		if proxy := pickPoolProxy(proxies, account.ProxyPool, account.ID); proxy != nil {
+			return proxy.URI(), nil
+		}
+	}
+
+	// 没有可替换的代理时仍使用关联的代理
+	if bound != nil {
+		return bound.URI(), nil
+	}
+	if account.ProxyID > 0 {
+		return "", fmt.Errorf("账号关联的代理 %d 不可用", account.ProxyID)
+	}
+	return "", fmt.Errorf("代理池 %s 中没有可用的代理", account.ProxyPool)
+}
+
+// pickPoolProxy 从代理池中选择健康的代理，seed为0时随机选择
+func pickPoolProxy(proxies []model.Proxy, pool string, seed uint) *model.Proxy {
+	var healthy []*model.Proxy
+	for i := range proxies {
+		if proxies[i].Pool == pool && proxies[i].Status == model.ProxyStatusHealthy {
+			healthy = append(healthy, &proxies[i])
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	if seed == 0 {
+		return healthy[rand.Intn(len(healthy))]
+	}
+	return healthy[int(seed%uint(len(healthy)))]
+}
+
+// PickProxy 按代理ID或代理池选择代理，用于OAuth授权等尚未创建账号的场景，返回nil表示直连
+func PickProxy(proxyID uint, pool string) (*model.Proxy, error) {
+	if proxyID > 0 {
+		proxy, err := model.GetProxyByID(proxyID)
+		if err != nil {
+			return nil, errors.New("代理不存在")
+		}
+		return proxy, nil
+	}
+	if pool != "" {
+		proxy := pickPoolProxy(getCachedProxies(), pool, 0)
+		if proxy == nil {
+			return nil, errors.New("代理池中没有可用的代理")
+		}
+		return proxy, nil
+	}
+	return nil, nil
+}
+
+// validateAccountProxy 校验账号关联的代理是否存在
+func validateAccountProxy(proxyID uint) error {
+	if proxyID == 0 {
+		return nil
+	}
+	if _, err := model.GetProxyByID(proxyID); err != nil {
+		return errors.New("代理不存在")
+	}
+	return nil
+}
+
+// CreateProxy 创建代理
+func CreateProxy(req *model.ProxyRequest) (*model.Proxy, error) {
+	proxy := &model.Proxy{Status: model.ProxyStatusHealthy, ActiveStatus: 1}
+	applyProxyRequest(proxy, req)
+
+	if err := model.CreateProxy(proxy); err != nil {
+		return nil, errors.New("创建代理失败")
+	}
+	invalidateProxyCache()
+	return proxy, nil
+}
+
+// GetProxy 获取代理详情
+func GetProxy(id uint) (*model.Proxy, error) {
+	proxy, err := model.GetProxyByID(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("代理不存在")
+		}
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// UpdateProxy 更新代理，连接信息变化后重新等待健康检查结果
+func UpdateProxy(id uint, req *model.ProxyRequest) (*model.Proxy, error) {
+	proxy, err := GetProxy(id)
+	if err != nil {
+		return nil, err
+	}
+
+	oldURI := proxy.URI()
+	applyProxyRequest(proxy, req)
+	if proxy.URI() != oldURI {
+		proxy.Status = model.ProxyStatusHealthy
+		proxy.FailCount = 0
+		proxy.LastError = ""
+	}
+
+	if err := model.UpdateProxy(proxy); err != nil {
+		return nil, errors.New("更新代理失败")
+	}
+	invalidateProxyCache()
+	return proxy, nil
+}
+
+// DeleteProxy 删除代理，仍有账号关联时不允许删除
+func DeleteProxy(id uint) error {
+	proxy, err := GetProxy(id)
+	if err != nil {
+		return err
+	}
+
+	count, err := model.CountAccountsByProxyID(proxy.ID)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("该代理仍被%d个账号使用", count)
+	}
+
+	if err := model.DeleteProxy(proxy.ID); err != nil {
+		return errors.New("删除代理失败")
+	}
+	invalidateProxyCache()
+	return nil
+}
+
+// GetProxyList 分页获取代理列表
+func GetProxyList(req *model.ProxyListRequest) (*model.ProxyListResponse, error) {
+	if req.Page < 1 {
+		req.Page = 1
+	}
+	if req.Limit < 1 {
+		req.Limit = 10
+	}
+
+	proxies, total, err := model.GetProxies(req.Page, req.Limit, req.Pool, req.Region)
+	if err != nil {
+		return nil, errors.New("获取代理列表失败")
+	}
+	return &model.ProxyListResponse{
+		Proxies: proxies,
+		Total:   total,
+		Page:    req.Page,
+		Limit:   req.Limit,
+	}, nil
+}
+
+// applyProxyRequest 将请求参数写入代理
+func applyProxyRequest(proxy *model.Proxy, req *model.ProxyRequest) {
+	proxy.Name = req.Name
+	proxy.Type = req.Type
+	proxy.Host = strings.TrimSpace(req.Host)
+	proxy.Port = req.Port
+	proxy.Username = req.Username
+	// 接口不返回密码，更新时未填写密码保留原密码
+	if req.Password != "" || req.Username == "" {
+		proxy.Password = req.Password
+	}
+	proxy.Region = strings.TrimSpace(req.Region)
+	proxy.Pool = strings.TrimSpace(req.Pool)
+	if req.ActiveStatus != 0 {
+		proxy.ActiveStatus = req.ActiveStatus
+	}
+}
+
+// getProxyHealthCheckURL 获取代理健康检查的目标地址
+func getProxyHealthCheckURL() string {
+	if value := os.Getenv("PROXY_HEALTH_CHECK_URL"); value != "" {
+		return value
+	}
+	return defaultProxyHealthCheckURL
+}
+
+// CheckProxy 通过代理请求健康检查地址，收到任意HTTP响应即视为可达，返回延迟
+func CheckProxy(proxy *model.Proxy) (time.Duration, error) {
+	client, err := common.NewProxyHTTPClient(proxy.URI(), getEnvDuration("PROXY_HEALTH_CHECK_TIMEOUT", defaultProxyHealthCheckTimeout))
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodHead, getProxyHealthCheckURL(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return time.Since(start), nil
+}
+
+// CheckAndUpdateProxy 检查单个代理并保存结果，连续失败达到阈值时标记为异常，从代理池中轮换出去
+func CheckAndUpdateProxy(proxy *model.Proxy) error {
+	latency, err := CheckProxy(proxy)
+
+	now := model.Time(time.Now())
+	proxy.LastCheckTime = &now
+	if err != nil {
+		proxy.FailCount++
+		proxy.LastError = err.Error()
+		if len(proxy.LastError) > 500 {
+			proxy.LastError = proxy.LastError[:500]
+		}
+		if proxy.FailCount >= getEnvInt("PROXY_HEALTH_FAIL_THRESHOLD", defaultProxyFailThreshold) && proxy.Status != model.ProxyStatusUnhealthy {
+			proxy.Status = model.ProxyStatusUnhealthy
+			common.SysError(fmt.Sprintf("[PROXY] %s marked unhealthy: %s", proxy.DisplayName(), proxy.LastError))
+		}
+	} else {
+		if proxy.Status != model.ProxyStatusHealthy {
+			common.SysLog(fmt.Sprintf("[PROXY] %s recovered, latency %dms", proxy.DisplayName(), latency.Milliseconds()))
+		}
+		proxy.Status = model.ProxyStatusHealthy
+		proxy.FailCount = 0
+		proxy.LastError = ""
+		proxy.Latency = int(latency.Milliseconds())
+	}
+
+	if updateErr := model.UpdateProxyHealth(proxy); updateErr != nil {
+		common.SysError("update proxy health error: " + updateErr.Error())
+	}
+	invalidateProxyCache()
+	return err
+}
+
+// CheckAllProxies 并发检查所有启用的代理，返回健康和异常的数量
+func CheckAllProxies() (int, int) {
+	proxies, err := model.GetActiveProxies()
+	if err != nil {
+		common.SysError("load proxies for health check error: " + err.Error())
+		return 0, 0
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		healthy   int
+		unhealthy int
+	)
+	sem := make(chan struct{}, proxyHealthCheckConcurrency)
+	for i := range proxies {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(proxy *model.Proxy) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			CheckAndUpdateProxy(proxy)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if proxy.Status == model.ProxyStatusHealthy {
+				healthy++
+			} else {
+				unhealthy++
+			}
+		}(&proxies[i])
+	}
+	wg.Wait()
+	return healthy, unhealthy
+}
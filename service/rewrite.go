@@ -0,0 +1,355 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"gorm.io/gorm"
+)
+
+// 不允许通过改写规则修改的请求头（鉴权及传输相关）
+var protectedRewriteHeaders = map[string]bool{
+	"authorization":  true,
+	"x-api-key":      true,
+	"cookie":         true,
+	"host":           true,
+	"content-length": true,
+}
+
+// RewriteResult 改写规则的执行结果
+type RewriteResult struct {
+	Body    []byte                `json:"-"`
+	Headers []model.HeaderRewrite `json:"headers"`
+	Applied []string              `json:"applied"`
+	Errors  []string              `json:"errors"`
+}
+
+// ParseRewriteRules 解析保存的请求改写规则，空字符串表示未配置
+func ParseRewriteRules(raw string) ([]model.RewriteRule, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var rules []model.RewriteRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// ValidateRewriteRules 校验请求改写规则配置
+func ValidateRewriteRules(rules []model.RewriteRule) error {
+	for i, rule := range rules {
+		label := rewriteRuleLabel(i, rule)
+		if rule.Path == "" {
+			return fmt.Errorf("规则 %s 缺少目标路径", label)
+		}
+		if rule.Match != nil {
+			if err := validateRewriteCondition(rule.Match); err != nil {
+				return fmt.Errorf("规则 %s 的匹配条件无效: %v", label, err)
+			}
+		}
+
+		switch rule.Action {
+		case model.RewriteActionSet, model.RewriteActionAppend:
+			if len(rule.Value) == 0 || !json.Valid(rule.Value) {
+				return fmt.Errorf("规则 %s 的 %s 动作需要合法的JSON值", label, rule.Action)
+			}
+		case model.RewriteActionDelete:
+		default:
+			return fmt.Errorf("规则 %s 的动作只能是 set、delete 或 append", label)
+		}
+
+		if headerName, isHeader := rewriteHeaderName(rule.Path); isHeader {
+			if headerName == "" || protectedRewriteHeaders[strings.ToLower(headerName)] {
+				return fmt.Errorf("规则 %s 不允许改写请求头 %q", label, headerName)
+			}
+			if rule.ItemMatch != nil {
+				return fmt.Errorf("规则 %s 的请求头改写不支持 item_match", label)
+			}
+			if rule.Action != model.RewriteActionDelete && gjson.ParseBytes(rule.Value).Type != gjson.String {
+				return fmt.Errorf("规则 %s 的请求头值必须是字符串", label)
+			}
+			continue
+		}
+
+		if rule.ItemMatch != nil {
+			if rule.Action != model.RewriteActionDelete {
+				return fmt.Errorf("规则 %s 的 item_match 只能用于 delete 动作", label)
+			}
+			if err := validateRewriteCondition(rule.ItemMatch); err != nil {
+				return fmt.Errorf("规则 %s 的 item_match 无效: %v", label, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRewriteCondition 校验匹配条件
+func validateRewriteCondition(cond *model.RewriteCondition) error {
+	if cond.Path == "" {
+		return errors.New("缺少路径")
+	}
+	switch cond.Op {
+	case "exists", "not_exists":
+		return nil
+	case "eq", "ne", "contains":
+	case "gt", "gte", "lt", "lte":
+		if gjson.ParseBytes(cond.Value).Type != gjson.Number {
+			return fmt.Errorf("%s 比较需要数字值", cond.Op)
+		}
+		return nil
+	case "in":
+		if !gjson.ParseBytes(cond.Value).IsArray() {
+			return errors.New("in 比较需要数组值")
+		}
+		return nil
+	default:
+		return fmt.Errorf("不支持的比较方式 %q", cond.Op)
+	}
+	if len(cond.Value) == 0 || !json.Valid(cond.Value) {
+		return fmt.Errorf("%s 比较需要合法的JSON值", cond.Op)
+	}
+	return nil
+}
+
+// ApplyRewriteRules 按顺序执行改写规则，单条规则执行失败时跳过并记录原因
+// header为原始请求头，仅用于匹配条件，请求头改写以操作列表的形式返回
+func ApplyRewriteRules(body []byte, header http.Header, rules []model.RewriteRule) *RewriteResult {
+	result := &RewriteResult{Body: body}
+
+	for i, rule := range rules {
+		label := rewriteRuleLabel(i, rule)
+		if rule.Match != nil && !evaluateRewriteCondition(rule.Match, result.Body, header) {
+			continue
+		}
+
+		if headerName, isHeader := rewriteHeaderName(rule.Path); isHeader {
+			result.Headers = append(result.Headers, model.HeaderRewrite{
+				Name:   headerName,
+				Action: rule.Action,
+				Value:  gjson.ParseBytes(rule.Value).String(),
+			})
+			result.Applied = append(result.Applied, label)
+			continue
+		}
+
+		newBody, err := applyBodyRewrite(result.Body, rule)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", label, err))
+			continue
+		}
+		result.Body = newBody
+		result.Applied = append(result.Applied, label)
+	}
+
+	return result
+}
+
+// applyBodyRewrite 对请求体执行单条改写动作
+func applyBodyRewrite(body []byte, rule model.RewriteRule) ([]byte, error) {
+	switch rule.Action {
+	case model.RewriteActionSet:
+		return sjson.SetRawBytes(body, rule.Path, rule.Value)
+	case model.RewriteActionDelete:
+		if rule.ItemMatch == nil {
+			return sjson.DeleteBytes(body, rule.Path)
+		}
+		existing := gjson.GetBytes(body, rule.Path)
+		if !existing.Exists() {
+			return body, nil
+		}
+		if !existing.IsArray() {
+			return nil, errors.New("item_match 的目标不是数组")
+		}
+		kept := make([]string, 0, len(existing.Array()))
+		for _, item := range existing.Array() {
+			if !evaluateRewriteCondition(rule.ItemMatch, []byte(item.Raw), nil) {
+				kept = append(kept, item.Raw)
+			}
+		}
+		return sjson.SetRawBytes(body, rule.Path, []byte("["+strings.Join(kept, ",")+"]"))
+	case model.RewriteActionAppend:
+		existing := gjson.GetBytes(body, rule.Path)
+		switch {
+		case !existing.Exists():
+			return sjson.SetRawBytes(body, rule.Path, []byte("["+string(rule.Value)+"]"))
+		case existing.IsArray():
+			return sjson.SetRawBytes(body, rule.Path+".-1", rule.Value)
+		case existing.Type == gjson.String:
+			// 字符串格式的system/content先转换为文本块数组再追加
+			textBlock, _ := json.Marshal(map[string]string{"type": "text", "text": existing.String()})
+			return sjson.SetRawBytes(body, rule.Path, []byte("["+string(textBlock)+","+string(rule.Value)+"]"))
+		default:
+			return nil, errors.New("append 的目标不是数组")
+		}
+	}
+	return nil, fmt.Errorf("不支持的动作 %q", rule.Action)
+}
+
+// evaluateRewriteCondition 判断匹配条件是否成立，header.前缀的路径匹配请求头
+func evaluateRewriteCondition(cond *model.RewriteCondition, body []byte, header http.Header) bool {
+	var actual gjson.Result
+	if headerName, isHeader := rewriteHeaderName(cond.Path); isHeader {
+		if value := header.Get(headerName); value != "" {
+			actual = gjson.Result{Type: gjson.String, Str: value, Raw: fmt.Sprintf("%q", value)}
+		}
+	} else {
+		actual = gjson.GetBytes(body, cond.Path)
+	}
+	expected := gjson.ParseBytes(cond.Value)
+
+	switch cond.Op {
+	case "exists":
+		return actual.Exists()
+	case "not_exists":
+		return !actual.Exists()
+	case "eq":
+		return actual.Exists() && rewriteValuesEqual(actual, expected)
+	case "ne":
+		return !actual.Exists() || !rewriteValuesEqual(actual, expected)
+	case "gt":
+		return actual.Type == gjson.Number && actual.Float() > expected.Float()
+	case "gte":
+		return actual.Type == gjson.Number && actual.Float() >= expected.Float()
+	case "lt":
+		return actual.Type == gjson.Number && actual.Float() < expected.Float()
+	case "lte":
+		return actual.Type == gjson.Number && actual.Float() <= expected.Float()
+	case "contains":
+		if actual.IsArray() {
+			for _, item := range actual.Array() {
+				if rewriteValuesEqual(item, expected) {
+					return true
+				}
+			}
+			return false
+		}
+		return actual.Type == gjson.String && strings.Contains(actual.String(), expected.String())
+	case "in":
+		if !actual.Exists() {
+			return false
+		}
+		for _, item := range expected.Array() {
+			if rewriteValuesEqual(actual, item) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// rewriteValuesEqual 比较两个JSON值是否相等，数字按数值比较
+func rewriteValuesEqual(a, b gjson.Result) bool {
+	if a.Type == gjson.Number && b.Type == gjson.Number {
+		return a.Float() == b.Float()
+	}
+	if a.Type != b.Type {
+		return false
+	}
+	if a.IsObject() || a.IsArray() {
+		return a.Raw == b.Raw
+	}
+	return a.String() == b.String()
+}
+
+// ApplyHeaderRewrites 将改写规则产生的请求头操作应用到请求头上
+func ApplyHeaderRewrites(header http.Header, rewrites []model.HeaderRewrite) {
+	for _, rewrite := range rewrites {
+		switch rewrite.Action {
+		case model.RewriteActionSet:
+			header.Set(rewrite.Name, rewrite.Value)
+		case model.RewriteActionDelete:
+			header.Del(rewrite.Name)
+		case model.RewriteActionAppend:
+			header.Set(rewrite.Name, appendHeaderValues(header.Get(rewrite.Name), rewrite.Value))
+		}
+	}
+}
+
+// appendHeaderValues 向逗号分隔的请求头追加值，已存在的值不重复追加
+func appendHeaderValues(current, addition string) string {
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, value := range strings.Split(current+","+addition, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		values = append(values, value)
+	}
+	return strings.Join(values, ",")
+}
+
+// rewriteHeaderName 判断路径是否指向请求头，返回请求头名称
+func rewriteHeaderName(path string) (string, bool) {
+	if !strings.HasPrefix(path, model.RewriteHeaderPathPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, model.RewriteHeaderPathPrefix), true
+}
+
+// rewriteRuleLabel 规则的显示名称，未命名时使用序号
+func rewriteRuleLabel(index int, rule model.RewriteRule) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("#%d", index+1)
+}
+
+// GetRewriteRulesForGroup 获取分组生效的改写规则，格式错误时记录日志并视为未配置
+func GetRewriteRulesForGroup(groupID int) []model.RewriteRule {
+	if groupID <= 0 {
+		return nil
+	}
+	raw, err := model.GetGroupRewriteRules(uint(groupID))
+	if err != nil {
+		return nil
+	}
+	rules, err := ParseRewriteRules(raw)
+	if err != nil {
+		common.SysError(fmt.Sprintf("invalid rewrite rules on group %d: %v", groupID, err))
+		return nil
+	}
+	return rules
+}
+
+// GetGroupRewriteRules 获取分组配置的请求改写规则
+func GetGroupRewriteRules(id uint) ([]model.RewriteRule, error) {
+	raw, err := model.GetGroupRewriteRules(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("组不存在")
+		}
+		return nil, err
+	}
+	return ParseRewriteRules(raw)
+}
+
+// UpdateGroupRewriteRules 校验并更新分组的请求改写规则，规则为空时清除
+func UpdateGroupRewriteRules(id uint, rules []model.RewriteRule) error {
+	if _, err := GetGroupRewriteRules(id); err != nil {
+		return err
+	}
+	if err := ValidateRewriteRules(rules); err != nil {
+		return err
+	}
+
+	raw := ""
+	if len(rules) > 0 {
+		data, err := json.Marshal(rules)
+		if err != nil {
+			return err
+		}
+		raw = string(data)
+	}
+	return model.UpdateGroupRewriteRules(id, raw)
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"claude-code-relay/model"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestApplyRewriteRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		header      http.Header
+		rules       []model.RewriteRule
+		want        string
+		wantHeaders []model.HeaderRewrite
+		wantApplied int
+		wantErrors  int
+	}{
+		{
+			name: "set caps max_tokens when above limit",
+			body: `{"model":"claude-sonnet-4","max_tokens":64000}`,
+			rules: []model.RewriteRule{{
+				Match:  &model.RewriteCondition{Path: "max_tokens", Op: "gt", Value: json.RawMessage(`8192`)},
+				Action: model.RewriteActionSet,
+				Path:   "max_tokens",
+				Value:  json.RawMessage(`8192`),
+			}},
+			want:        `{"model":"claude-sonnet-4","max_tokens":8192}`,
+			wantApplied: 1,
+		},
+		{
+			name: "set skipped when condition does not match",
+			body: `{"max_tokens":1024}`,
+			rules: []model.RewriteRule{{
+				Match:  &model.RewriteCondition{Path: "max_tokens", Op: "gt", Value: json.RawMessage(`8192`)},
+				Action: model.RewriteActionSet,
+				Path:   "max_tokens",
+				Value:  json.RawMessage(`8192`),
+			}},
+			want: `{"max_tokens":1024}`,
+		},
+		{
+			name: "delete field",
+			body: `{"temperature":0.7,"max_tokens":1024}`,
+			rules: []model.RewriteRule{{
+				Action: model.RewriteActionDelete,
+				Path:   "temperature",
+			}},
+			want:        `{"max_tokens":1024}`,
+			wantApplied: 1,
+		},
+		{
+			name: "delete with item_match removes matching tools",
+			body: `{"tools":[{"name":"Bash"},{"name":"WebFetch"},{"name":"Read"}]}`,
+			rules: []model.RewriteRule{{
+				Action:    model.RewriteActionDelete,
+				Path:      "tools",
+				ItemMatch: &model.RewriteCondition{Path: "name", Op: "in", Value: json.RawMessage(`["WebFetch","Bash"]`)},
+			}},
+			want:        `{"tools":[{"name":"Read"}]}`,
+			wantApplied: 1,
+		},
+		{
+			name: "delete with item_match on missing array is a no-op",
+			body: `{"model":"claude-sonnet-4"}`,
+			rules: []model.RewriteRule{{
+				Action:    model.RewriteActionDelete,
+				Path:      "tools",
+				ItemMatch: &model.RewriteCondition{Path: "name", Op: "eq", Value: json.RawMessage(`"Bash"`)},
+			}},
+			want:        `{"model":"claude-sonnet-4"}`,
+			wantApplied: 1,
+		},
+		{
+			name: "delete with item_match on non-array is an error",
+			body: `{"tools":"Bash"}`,
+			rules: []model.RewriteRule{{
+				Action:    model.RewriteActionDelete,
+				Path:      "tools",
+				ItemMatch: &model.RewriteCondition{Path: "name", Op: "eq", Value: json.RawMessage(`"Bash"`)},
+			}},
+			want:       `{"tools":"Bash"}`,
+			wantErrors: 1,
+		},
+		{
+			name: "append on string system converts to text blocks",
+			body: `{"system":"You are Claude Code."}`,
+			rules: []model.RewriteRule{{
+				Action: model.RewriteActionAppend,
+				Path:   "system",
+				Value:  json.RawMessage(`{"type":"text","text":"Follow the compliance policy."}`),
+			}},
+			want:        `{"system":[{"type":"text","text":"You are Claude Code."},{"type":"text","text":"Follow the compliance policy."}]}`,
+			wantApplied: 1,
+		},
+		{
+			name: "append on array system",
+			body: `{"system":[{"type":"text","text":"a"}]}`,
+			rules: []model.RewriteRule{{
+				Action: model.RewriteActionAppend,
+				Path:   "system",
+				Value:  json.RawMessage(`{"type":"text","text":"b"}`),
+			}},
+			want:        `{"system":[{"type":"text","text":"a"},{"type":"text","text":"b"}]}`,
+			wantApplied: 1,
+		},
+		{
+			name: "append on missing system creates array",
+			body: `{}`,
+			rules: []model.RewriteRule{{
+				Action: model.RewriteActionAppend,
+				Path:   "system",
+				Value:  json.RawMessage(`{"type":"text","text":"b"}`),
+			}},
+			want:        `{"system":[{"type":"text","text":"b"}]}`,
+			wantApplied: 1,
+		},
+		{
+			name: "header rewrite matched on request header",
+			body: `{}`,
+			header: http.Header{
+				"User-Agent": []string{"claude-cli/1.0.80"},
+			},
+			rules: []model.RewriteRule{{
+				Match:  &model.RewriteCondition{Path: "header.User-Agent", Op: "contains", Value: json.RawMessage(`"claude-cli"`)},
+				Action: model.RewriteActionAppend,
+				Path:   "header.anthropic-beta",
+				Value:  json.RawMessage(`"context-1m-2025-08-07"`),
+			}},
+			want:        `{}`,
+			wantHeaders: []model.HeaderRewrite{{Name: "anthropic-beta", Action: model.RewriteActionAppend, Value: "context-1m-2025-08-07"}},
+			wantApplied: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ApplyRewriteRules([]byte(tt.body), tt.header, tt.rules)
+
+			var got, want interface{}
+			if err := json.Unmarshal(result.Body, &got); err != nil {
+				t.Fatalf("result body is not valid JSON: %v: %s", err, result.Body)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatalf("bad fixture: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("body = %s, want %s", result.Body, tt.want)
+			}
+			if !reflect.DeepEqual(result.Headers, tt.wantHeaders) {
+				t.Errorf("headers = %+v, want %+v", result.Headers, tt.wantHeaders)
+			}
+			if len(result.Applied) != tt.wantApplied {
+				t.Errorf("applied = %v, want %d rules", result.Applied, tt.wantApplied)
+			}
+			if len(result.Errors) != tt.wantErrors {
+				t.Errorf("errors = %v, want %d", result.Errors, tt.wantErrors)
+			}
+		})
+	}
+}
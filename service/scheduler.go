@@ -0,0 +1,270 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Redis键前缀
+	accountLatencyKeyPrefix  = "account_latency:"
+	groupRoundRobinKeyPrefix = "group_rr:"
+
+	// 延迟统计的过期时间，长时间无请求的账号重新参与探测
+	accountLatencyTTL = time.Hour
+	// 延迟指数移动平均的平滑系数
+	accountLatencyAlpha = 0.3
+)
+
+// Scheduler 账号调度策略，对候选账号排序，排在前面的账号优先使用
+// 候选账号已按 priority ASC, today_usage_count ASC 排序，各策略只在同一优先级内调整顺序
+type Scheduler interface {
+	Order(group *model.Group, accounts []model.Account) []model.Account
+}
+
+// SchedulerFunc 函数形式的调度策略
+type SchedulerFunc func(group *model.Group, accounts []model.Account) []model.Account
+
+// Order 实现Scheduler接口
+func (f SchedulerFunc) Order(group *model.Group, accounts []model.Account) []model.Account {
+	return f(group, accounts)
+}
+
+var schedulers = map[string]Scheduler{
+	constant.SchedulerPriorityLeastUsed: SchedulerFunc(orderByPriorityLeastUsed),
+	constant.SchedulerWeightedRandom:    SchedulerFunc(orderByWeightedRandom),
+	constant.SchedulerRoundRobin:        SchedulerFunc(orderByRoundRobin),
+	constant.SchedulerLeastInFlight:     SchedulerFunc(orderByLeastInFlight),
+	constant.SchedulerLowestLatency:     SchedulerFunc(orderByLowestLatency),
+}
+
+// GetScheduler 根据策略名称获取调度器，未知策略使用默认策略
+func GetScheduler(strategy string) Scheduler {
+	if scheduler, ok := schedulers[strategy]; ok {
+		return scheduler
+	}
+	return schedulers[constant.SchedulerPriorityLeastUsed]
+}
+
+// GetScheduledAccounts 获取分组下可用且支持指定模型的账号，并按分组配置的调度策略排序
+// modelName为空时不按模型过滤
+func GetScheduledAccounts(groupID int, userID uint, modelName string) ([]model.Account, error) {
+	accounts, err := model.GetAvailableAccountsByGroupID(groupID)
+	if err != nil {
+		return nil, err
+	}
+	accounts = filterAccountsByModel(accounts, modelName)
+	// 跳过因过载、服务端错误、网络错误等处于短暂冷却中的账号
+	accounts = filterCoolingAccounts(accounts)
+
+	if len(accounts) > 1 {
+		group, err := model.GetGroupById(groupID, userID)
+		if err != nil {
+			// 分组不存在时（如未分组的Key）使用默认策略
+			group = &model.Group{ID: uint(groupID), SchedulerStrategy: constant.SchedulerPriorityLeastUsed}
+		}
+		accounts = GetScheduler(group.SchedulerStrategy).Order(group, accounts)
+	}
+
+	// 根据上游返回的限流响应头，将接近限流的账号排到后面，避免触发限流后被锁定
+	accounts = deprioritizeLimitedAccounts(accounts)
+
+	// 熔断半开的账号排在最前面放行少量真实请求探测，失败时由故障转移切换到正常账号
+	if probes := getHalfOpenProbeAccounts(groupID, modelName); len(probes) > 0 {
+		accounts = append(probes, accounts...)
+	}
+
+	return accounts, nil
+}
+
+// AccountSupportsModel 判断账号是否能服务指定模型
+// 优先使用账号配置的支持模型列表；未配置时OpenAI/Azure OpenAI/Gemini账号只支持模型映射中的模型，其他平台不限制
+func AccountSupportsModel(account *model.Account, modelName string) bool {
+	if modelName == "" {
+		return true
+	}
+
+	if account.SupportedModels != "" {
+		for _, pattern := range strings.Split(account.SupportedModels, ",") {
+			if matchModelPattern(strings.TrimSpace(pattern), modelName) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if account.ModelMapping != "" && (account.PlatformType == constant.PlatformOpenAI || account.PlatformType == constant.PlatformAzureOpenAI || account.PlatformType == constant.PlatformGemini) {
+		// 与转发层的模型映射规则保持一致：源模型为关键字，包含即匹配
+		for _, mapping := range strings.Split(account.ModelMapping, ",") {
+			parts := strings.Split(strings.TrimSpace(mapping), ":")
+			if len(parts) != 2 && len(parts) != 3 {
+				continue
+			}
+			if sourceModel := strings.TrimSpace(parts[0]); sourceModel != "" && strings.Contains(modelName, sourceModel) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// matchModelPattern 按通配符匹配模型名称，如 claude-sonnet-*
+func matchModelPattern(pattern, modelName string) bool {
+	if pattern == "" {
+		return false
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		return pattern == modelName
+	}
+	matched, err := path.Match(pattern, modelName)
+	return err == nil && matched
+}
+
+// filterAccountsByModel 过滤出支持指定模型的账号
+func filterAccountsByModel(accounts []model.Account, modelName string) []model.Account {
+	if modelName == "" {
+		return accounts
+	}
+	filtered := accounts[:0]
+	for i := range accounts {
+		if AccountSupportsModel(&accounts[i], modelName) {
+			filtered = append(filtered, accounts[i])
+		}
+	}
+	return filtered
+}
+
+// orderByPriorityLeastUsed 优先级+今日最少使用，保持数据库排序
+func orderByPriorityLeastUsed(_ *model.Group, accounts []model.Account) []model.Account {
+	return accounts
+}
+
+// orderByWeightedRandom 同优先级内按权重加权随机排序（A-Res算法）
+func orderByWeightedRandom(_ *model.Group, accounts []model.Account) []model.Account {
+	keys := make(map[uint]float64, len(accounts))
+	for _, account := range accounts {
+		weight := account.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		keys[account.ID] = math.Pow(rand.Float64(), 1/float64(weight))
+	}
+
+	sort.SliceStable(accounts, func(i, j int) bool {
+		if accounts[i].Priority != accounts[j].Priority {
+			return accounts[i].Priority < accounts[j].Priority
+		}
+		return keys[accounts[i].ID] > keys[accounts[j].ID]
+	})
+	return accounts
+}
+
+// orderByRoundRobin 同优先级内按分组计数器轮询
+func orderByRoundRobin(group *model.Group, accounts []model.Account) []model.Account {
+	ctx := context.Background()
+	counter, err := common.RDB.Incr(ctx, groupRoundRobinKeyPrefix+strconv.Itoa(int(group.ID))).Result()
+	if err != nil {
+		common.SysError("round robin counter error: " + err.Error())
+		return accounts
+	}
+
+	// 轮询顺序需要稳定，同优先级内先按ID排序再旋转
+	sort.SliceStable(accounts, func(i, j int) bool {
+		if accounts[i].Priority != accounts[j].Priority {
+			return accounts[i].Priority < accounts[j].Priority
+		}
+		return accounts[i].ID < accounts[j].ID
+	})
+
+	for start := 0; start < len(accounts); {
+		end := start
+		for end < len(accounts) && accounts[end].Priority == accounts[start].Priority {
+			end++
+		}
+		tier := accounts[start:end]
+		offset := int((counter - 1) % int64(len(tier)))
+		rotated := append(append([]model.Account{}, tier[offset:]...), tier[:offset]...)
+		copy(tier, rotated)
+		start = end
+	}
+	return accounts
+}
+
+// orderByLeastInFlight 同优先级内按当前并发请求数升序
+func orderByLeastInFlight(_ *model.Group, accounts []model.Account) []model.Account {
+	inFlight := GetAccountInFlight(accounts)
+
+	sort.SliceStable(accounts, func(i, j int) bool {
+		if accounts[i].Priority != accounts[j].Priority {
+			return accounts[i].Priority < accounts[j].Priority
+		}
+		return inFlight[accounts[i].ID] < inFlight[accounts[j].ID]
+	})
+	return accounts
+}
+
+// orderByLowestLatency 同优先级内按首字延迟升序，没有统计数据的账号优先探测
+func orderByLowestLatency(_ *model.Group, accounts []model.Account) []model.Account {
+	latency := getAccountMetrics(accountLatencyKeyPrefix, accounts)
+
+	sort.SliceStable(accounts, func(i, j int) bool {
+		if accounts[i].Priority != accounts[j].Priority {
+			return accounts[i].Priority < accounts[j].Priority
+		}
+		return latency[accounts[i].ID] < latency[accounts[j].ID]
+	})
+	return accounts
+}
+
+// getAccountMetrics 批量读取账号在Redis中的统计值，读取失败或不存在时为0
+func getAccountMetrics(prefix string, accounts []model.Account) map[uint]float64 {
+	metrics := make(map[uint]float64, len(accounts))
+	keys := make([]string, len(accounts))
+	for i, account := range accounts {
+		keys[i] = prefix + strconv.Itoa(int(account.ID))
+	}
+
+	values, err := common.RDB.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		common.SysError("get account metrics error: " + err.Error())
+		return metrics
+	}
+
+	for i, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if parsed, err := strconv.ParseFloat(str, 64); err == nil {
+			metrics[accounts[i].ID] = parsed
+		}
+	}
+	return metrics
+}
+
+// RecordAccountLatency 记录账号首字延迟（毫秒），使用指数移动平均平滑
+func RecordAccountLatency(accountID uint, latency time.Duration) {
+	ctx := context.Background()
+	key := accountLatencyKeyPrefix + strconv.Itoa(int(accountID))
+	sample := float64(latency.Milliseconds())
+
+	if previous, err := common.RDB.Get(ctx, key).Float64(); err == nil {
+		sample = accountLatencyAlpha*sample + (1-accountLatencyAlpha)*previous
+	}
+
+	if err := common.RDB.Set(ctx, key, fmt.Sprintf("%.2f", sample), accountLatencyTTL).Err(); err != nil {
+		common.SysError("record account latency error: " + err.Error())
+	}
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// Redis键前缀
+	stickySessionKeyPrefix = "sticky_session:"
+
+	// 默认会话粘性绑定有效期
+	defaultStickySessionTTL = time.Hour
+)
+
+// getStickySessionTTL 获取会话粘性绑定有效期，配置为0时关闭会话粘性
+func getStickySessionTTL() time.Duration {
+	if ttlStr := os.Getenv("STICKY_SESSION_TTL"); ttlStr != "" {
+		if seconds, err := strconv.Atoi(ttlStr); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultStickySessionTTL
+}
+
+// GetStickySessionKey 根据请求体生成会话粘性键
+// Claude Code 的 metadata.user_id 格式为 user_<hash>_account_<uuid>_session_<uuid>，优先取其中的会话部分，
+// 取不到时回退为API Key维度的绑定，关闭会话粘性时返回空字符串
+// 键中包含模型系列，同一会话中haiku等辅助请求不会改写主模型对话的绑定
+func GetStickySessionKey(body []byte, groupID int, apiKeyID uint) string {
+	if getStickySessionTTL() <= 0 {
+		return ""
+	}
+	family := stickyModelFamily(gjson.GetBytes(body, "model").String())
+
+	sessionID := ""
+	userID := gjson.GetBytes(body, "metadata.user_id").String()
+	if idx := strings.LastIndex(userID, "_session_"); idx >= 0 {
+		sessionID = userID[idx+len("_session_"):]
+	}
+
+	if sessionID != "" {
+		return fmt.Sprintf("%s%d:session:%s:%s", stickySessionKeyPrefix, groupID, sessionID, family)
+	}
+	return fmt.Sprintf("%s%d:api_key:%d:%s", stickySessionKeyPrefix, groupID, apiKeyID, family)
+}
+
+// stickyModelFamily 获取模型系列（opus、sonnet、haiku），其他模型使用完整模型名称
+func stickyModelFamily(modelName string) string {
+	lower := strings.ToLower(modelName)
+	for _, family := range []string{"opus", "sonnet", "haiku"} {
+		if strings.Contains(lower, family) {
+			return family
+		}
+	}
+	return lower
+}
+
+// ApplyStickySession 将会话绑定的账号移到候选列表首位
+// 绑定的账号不在可用列表中（被禁用、限流或异常）时清除绑定，由调度策略重新选择
+func ApplyStickySession(key string, accounts []model.Account) ([]model.Account, uint) {
+	if key == "" || len(accounts) == 0 {
+		return accounts, 0
+	}
+
+	ctx := context.Background()
+	boundID, err := common.RDB.Get(ctx, key).Uint64()
+	if err != nil {
+		if err.Error() != "redis: nil" {
+			common.SysError("get sticky session error: " + err.Error())
+		}
+		return accounts, 0
+	}
+
+	for i := range accounts {
+		if accounts[i].ID != uint(boundID) {
+			continue
+		}
+		if i > 0 {
+			bound := accounts[i]
+			copy(accounts[1:i+1], accounts[:i])
+			accounts[0] = bound
+		}
+		return accounts, accounts[0].ID
+	}
+
+	common.RDB.Del(ctx, key)
+	common.SysLog(fmt.Sprintf("[STICKY] Bound account %d is unavailable, releasing session binding", boundID))
+	return accounts, 0
+}
+
+// BindStickySession 绑定会话与账号并刷新有效期
+func BindStickySession(key string, accountID uint) {
+	if key == "" {
+		return
+	}
+
+	err := common.RDB.Set(context.Background(), key, accountID, getStickySessionTTL()).Err()
+	if err != nil {
+		common.SysError("bind sticky session error: " + err.Error())
+	}
+}
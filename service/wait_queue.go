@@ -0,0 +1,346 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	// Redis键前缀
+	groupWaitQueueKeyPrefix = "group_wait_queue:"
+	groupWaitOrderKeyPrefix = "group_wait_order:"
+	groupWaitTagKeyPrefix   = "group_wait_tag:"
+	groupWaitAliveKeyPrefix = "group_wait_alive:"
+	// 账号可用通知的发布订阅频道
+	accountQueueNotifyChannel = "account_queue_notify"
+
+	// 默认排队等待超时时间
+	defaultAccountQueueTimeout = 60 * time.Second
+	// 默认单个分组最大排队请求数
+	defaultAccountQueueMaxSize = 100
+	// 默认建议客户端重试的等待时间，用于无法预估恢复时间的情况（并发已满、熔断等）
+	defaultAccountQueueRetryAfter = 10 * time.Second
+	// 未收到通知时重新检查的间隔，账号限流和冷却到期依靠该检查恢复
+	accountQueuePollInterval = time.Second
+	// 队首请求重新加载候选账号的最小间隔
+	accountQueueReloadInterval = time.Second
+	// 排队者心跳有效期，超过该时间未续期的排队者视为已退出
+	accountQueueAliveTTL = 10 * time.Second
+)
+
+var (
+	// ErrAccountQueueFull 排队人数已满
+	ErrAccountQueueFull = errors.New("没有可用的账号且排队人数已达上限")
+	// ErrAccountQueueTimeout 排队等待超时
+	ErrAccountQueueTimeout = errors.New("没有可用的账号，排队等待超时")
+	// ErrNoAccountAvailable 没有可以立即使用的账号且不排队
+	ErrNoAccountAvailable = errors.New("没有可以立即使用的账号")
+)
+
+// enqueueScript 按API Key公平排队：每个排队者的序号为 max(已放行的最大序号, 该Key上一个排队者的序号)+1，
+// 同一个Key的多个请求依次向后排，不同Key的请求交替放行；序号相同时按入队时间排序
+// KEYS[1]: 排队顺序 KEYS[2]: 序号记录 KEYS[3]: 排队者心跳 ARGV[1]: 排队者 ARGV[2]: API Key ID ARGV[3]: 心跳到期时间戳(毫秒) ARGV[4]: 键过期时间(毫秒)
+var enqueueScript = redis.NewScript(`
+local served = tonumber(redis.call('HGET', KEYS[2], '_served') or '0')
+local last = tonumber(redis.call('HGET', KEYS[2], ARGV[2]) or '0')
+local tag = math.max(served, last) + 1
+redis.call('HSET', KEYS[2], ARGV[2], tag)
+redis.call('ZADD', KEYS[1], tag, ARGV[1])
+redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])
+for i = 1, 3 do
+	redis.call('PEXPIRE', KEYS[i], ARGV[4])
+end
+return tag
+`)
+
+// queueHeadScript 续期排队者心跳，清理已退出的排队者后判断是否排在队首
+// KEYS[1]: 排队顺序 KEYS[2]: 排队者心跳 ARGV[1]: 排队者 ARGV[2]: 当前时间戳(毫秒) ARGV[3]: 心跳到期时间戳(毫秒)
+var queueHeadScript = redis.NewScript(`
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[2])
+while true do
+	local head = redis.call('ZRANGE', KEYS[1], 0, 0)
+	if #head == 0 or head[1] == ARGV[1] then
+		return 1
+	end
+	if redis.call('ZSCORE', KEYS[2], head[1]) then
+		return 0
+	end
+	redis.call('ZREM', KEYS[1], head[1])
+end
+`)
+
+// dequeueScript 排队者离开队列，获得账号时记录已放行的序号
+// KEYS[1]: 排队顺序 KEYS[2]: 序号记录 KEYS[3]: 排队者心跳 ARGV[1]: 排队者 ARGV[2]: 是否获得账号(1/0)
+var dequeueScript = redis.NewScript(`
+local tag = redis.call('ZSCORE', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+if tag and ARGV[2] == '1' then
+	local served = tonumber(redis.call('HGET', KEYS[2], '_served') or '0')
+	if tonumber(tag) > served then
+		redis.call('HSET', KEYS[2], '_served', tag)
+	end
+end
+return 1
+`)
+
+// AccountWaiter 等待账号的请求信息
+type AccountWaiter struct {
+	GroupID  int
+	ApiKeyID uint
+	Model    string
+	NoWait   bool                            // 不进入等待队列，如还可以降级模型时
+	Reload   func() ([]model.Account, error) // 重新加载调度后的候选账号
+}
+
+// AccountUnavailableError 排队超时或排队已满时分组仍没有可用账号
+// Class为 ErrorClassRateLimit（所有账号都在限流中）或 ErrorClassOverloaded，RetryAfter为预计恢复可用的等待时间
+type AccountUnavailableError struct {
+	Err        error
+	Class      string
+	RetryAfter time.Duration
+}
+
+// Error 实现error接口
+func (e *AccountUnavailableError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap 返回原始错误
+func (e *AccountUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// accountQueueTicket 排队凭证，Redis异常时为nil，此时不保证公平顺序
+type accountQueueTicket struct {
+	keys   []string // 排队顺序、序号记录、排队者心跳
+	member string
+}
+
+// accountQueueNotifier 账号可用通知，订阅到通知时关闭当前信号通道唤醒所有排队者
+var accountQueueNotifier = struct {
+	sync.Mutex
+	signal    chan struct{}
+	subscribe sync.Once
+}{signal: make(chan struct{})}
+
+// waitForAccount 进入分组等待队列，按API Key公平的顺序由队首请求尝试获取账号
+// 账号并发槽位释放时通过通知立即唤醒，账号限流或冷却到期依靠定期检查恢复
+func waitForAccount(ctx context.Context, waiter *AccountWaiter, accounts []model.Account, tried map[uint]bool) ([]model.Account, int, *AccountLease, error) {
+	timeout := getEnvDuration("ACCOUNT_QUEUE_TIMEOUT", defaultAccountQueueTimeout)
+	maxSize := getEnvInt("ACCOUNT_QUEUE_MAX_SIZE", defaultAccountQueueMaxSize)
+
+	// 分组中没有任何支持该模型的激活账号时排队没有意义
+	if candidates, err := getWaiterAccounts(waiter); err == nil && len(candidates) == 0 {
+		return accounts, -1, nil, ErrNoAccountCandidate
+	}
+
+	depthKey := groupWaitQueueKeyPrefix + strconv.Itoa(waiter.GroupID)
+	position, err := common.RDB.Incr(ctx, depthKey).Result()
+	if err != nil {
+		common.SysError("enter account wait queue error: " + err.Error())
+		return accounts, -1, nil, diagnoseAccountUnavailable(waiter, ErrAccountQueueFull)
+	}
+	common.RDB.Expire(ctx, depthKey, timeout*2)
+	defer common.RDB.Decr(context.Background(), depthKey)
+
+	if position > int64(maxSize) {
+		return accounts, -1, nil, diagnoseAccountUnavailable(waiter, ErrAccountQueueFull)
+	}
+
+	ticket := enqueueAccountWaiter(waiter, timeout)
+	granted := false
+	defer func() {
+		ticket.leave(granted)
+		// 队首离开后唤醒下一个排队者
+		NotifyAccountQueue()
+	}()
+
+	common.SysLog(fmt.Sprintf("[QUEUE] Group %d has no available account for model %s, request from API Key %d waiting at position %d",
+		waiter.GroupID, waiter.Model, waiter.ApiKeyID, position))
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(accountQueuePollInterval)
+	defer ticker.Stop()
+	lastReload := time.Now()
+
+	for {
+		signal := accountQueueSignal()
+		select {
+		case <-ctx.Done():
+			return accounts, -1, nil, ctx.Err()
+		case <-deadline.C:
+			return accounts, -1, nil, diagnoseAccountUnavailable(waiter, ErrAccountQueueTimeout)
+		case <-ticker.C:
+		case <-signal:
+		}
+
+		if !ticket.isHead() {
+			continue
+		}
+		if waiter.Reload != nil && (len(accounts) == 0 || time.Since(lastReload) >= accountQueueReloadInterval) {
+			if reloaded, err := waiter.Reload(); err != nil {
+				common.SysError("reload queued accounts error: " + err.Error())
+			} else {
+				accounts = reloaded
+				lastReload = time.Now()
+			}
+		}
+		if idx, lease, _ := tryAcquireCandidates(accounts, tried); idx >= 0 {
+			granted = true
+			return accounts, idx, lease, nil
+		}
+	}
+}
+
+// enqueueAccountWaiter 按API Key公平的顺序加入分组等待队列
+func enqueueAccountWaiter(waiter *AccountWaiter, timeout time.Duration) *accountQueueTicket {
+	suffix := strconv.Itoa(waiter.GroupID) + ":" + waiter.Model
+	now := time.Now()
+	ticket := &accountQueueTicket{
+		keys: []string{
+			groupWaitOrderKeyPrefix + suffix,
+			groupWaitTagKeyPrefix + suffix,
+			groupWaitAliveKeyPrefix + suffix,
+		},
+		// 成员名以入队时间开头，序号相同时按入队顺序排列
+		member: fmt.Sprintf("%013d:%s", now.UnixMilli(), uuid.New().String()),
+	}
+
+	err := enqueueScript.Run(context.Background(), common.RDB, ticket.keys, ticket.member, waiter.ApiKeyID,
+		now.Add(accountQueueAliveTTL).UnixMilli(), (timeout * 2).Milliseconds()).Err()
+	if err != nil {
+		common.SysError("enqueue account waiter error: " + err.Error())
+		return nil
+	}
+	return ticket
+}
+
+// isHead 续期心跳并判断是否排在队首，Redis异常时直接允许尝试
+func (t *accountQueueTicket) isHead() bool {
+	if t == nil {
+		return true
+	}
+	now := time.Now()
+	head, err := queueHeadScript.Run(context.Background(), common.RDB, []string{t.keys[0], t.keys[2]},
+		t.member, now.UnixMilli(), now.Add(accountQueueAliveTTL).UnixMilli()).Int()
+	if err != nil {
+		common.SysError("check account queue head error: " + err.Error())
+		return true
+	}
+	return head == 1
+}
+
+// leave 离开等待队列
+func (t *accountQueueTicket) leave(granted bool) {
+	if t == nil {
+		return
+	}
+	flag := "0"
+	if granted {
+		flag = "1"
+	}
+	if err := dequeueScript.Run(context.Background(), common.RDB, t.keys, t.member, flag).Err(); err != nil {
+		common.SysError("dequeue account waiter error: " + err.Error())
+	}
+}
+
+// NotifyAccountQueue 通知所有实例中排队的请求重新检查账号，在并发槽位释放、账号恢复时调用
+func NotifyAccountQueue() {
+	if err := common.RDB.Publish(context.Background(), accountQueueNotifyChannel, "1").Err(); err != nil {
+		// 发布失败时至少唤醒本实例的排队请求
+		broadcastAccountQueue()
+	}
+}
+
+// accountQueueSignal 获取下一次账号可用通知的信号通道，首次调用时订阅通知
+func accountQueueSignal() <-chan struct{} {
+	accountQueueNotifier.subscribe.Do(func() {
+		go subscribeAccountQueue()
+	})
+	accountQueueNotifier.Lock()
+	defer accountQueueNotifier.Unlock()
+	return accountQueueNotifier.signal
+}
+
+// subscribeAccountQueue 订阅账号可用通知，连接断开时由客户端自动重连
+func subscribeAccountQueue() {
+	pubsub := common.RDB.Subscribe(context.Background(), accountQueueNotifyChannel)
+	for range pubsub.Channel() {
+		broadcastAccountQueue()
+	}
+}
+
+// broadcastAccountQueue 唤醒本实例所有排队请求
+func broadcastAccountQueue() {
+	accountQueueNotifier.Lock()
+	defer accountQueueNotifier.Unlock()
+	close(accountQueueNotifier.signal)
+	accountQueueNotifier.signal = make(chan struct{})
+}
+
+// getWaiterAccounts 获取分组中支持请求模型的所有激活账号（不区分当前状态）
+func getWaiterAccounts(waiter *AccountWaiter) ([]model.Account, error) {
+	accounts, err := model.GetActiveAccountsByGroupID(waiter.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	return filterAccountsByModel(accounts, waiter.Model), nil
+}
+
+// diagnoseAccountUnavailable 根据分组中账号的限流和冷却状态判断不可用原因和预计恢复时间
+func diagnoseAccountUnavailable(waiter *AccountWaiter, cause error) *AccountUnavailableError {
+	accounts, err := getWaiterAccounts(waiter)
+	if err != nil {
+		common.SysError("query group accounts error: " + err.Error())
+	}
+
+	now := time.Now()
+	var earliest time.Time
+	rateLimited, unpredictable := 0, false
+	for i := range accounts {
+		account := &accounts[i]
+		var availableAt time.Time
+		if account.CurrentStatus == 3 && account.RateLimitEndTime != nil && time.Time(*account.RateLimitEndTime).After(now) {
+			rateLimited++
+			availableAt = time.Time(*account.RateLimitEndTime)
+		} else if cooldown := GetAccountCooldown(account.ID); cooldown != nil {
+			availableAt = time.Unix(cooldown.Until, 0)
+		} else {
+			// 并发已满或熔断中的账号无法预估恢复时间
+			unpredictable = true
+			continue
+		}
+		if earliest.IsZero() || availableAt.Before(earliest) {
+			earliest = availableAt
+		}
+	}
+
+	unavailable := &AccountUnavailableError{
+		Err:        cause,
+		Class:      ErrorClassOverloaded,
+		RetryAfter: getEnvDuration("ACCOUNT_QUEUE_RETRY_AFTER", defaultAccountQueueRetryAfter),
+	}
+	if len(accounts) > 0 && rateLimited == len(accounts) {
+		unavailable.Class = ErrorClassRateLimit
+	}
+	// 所有账号的恢复时间都可以预估时使用最早的恢复时间，否则不超过默认等待时间
+	if !earliest.IsZero() && (!unpredictable || earliest.Sub(now) < unavailable.RetryAfter) {
+		unavailable.RetryAfter = earliest.Sub(now)
+	}
+	if unavailable.RetryAfter < time.Second {
+		unavailable.RetryAfter = time.Second
+	}
+	return unavailable
+}